@@ -0,0 +1,525 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// States of an automatic media download
+const (
+	downloadQueued      = "queued"
+	downloadDownloading = "downloading"
+	downloadDone        = "done"
+	downloadFailed      = "failed"
+)
+
+// Media types that can be downloaded automatically
+var autoDownloadMediaTypes = []string{"image", "video", "audio", "document", "sticker"}
+
+// MediaDownloadPolicy decides which media is downloaded as soon as it arrives,
+// while the URL WhatsApp sent with it is still valid
+type MediaDownloadPolicy struct {
+	// Maximum size in bytes of each media type to download, 0 for no limit.
+	// Types that are not listed are not downloaded.
+	MediaTypes map[string]int64
+	// When set, only media from these chats is downloaded
+	Chats map[string]bool
+	// Media from these chats is never downloaded
+	ExcludeChats map[string]bool
+
+	Workers     int
+	QueueSize   int
+	MaxAttempts int
+	// Delay before the first retry; it doubles with each further attempt
+	RetryDelay time.Duration
+}
+
+// MediaDownload is the state of the automatic download of a message's media
+type MediaDownload struct {
+	MessageID     string     `json:"message_id"`
+	ChatJID       string     `json:"chat_jid"`
+	State         string     `json:"state"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// Check whether the policy downloads anything at all
+func (p MediaDownloadPolicy) Enabled() bool {
+	return len(p.MediaTypes) > 0
+}
+
+// Check whether media of a type and size from a chat should be downloaded
+func (p MediaDownloadPolicy) Allows(chatJID, mediaType string, size uint64) bool {
+	maxSize, ok := p.MediaTypes[mediaType]
+	if !ok {
+		return false
+	}
+	if maxSize > 0 && size > uint64(maxSize) {
+		return false
+	}
+	if len(p.Chats) > 0 && !p.Chats[chatJID] {
+		return false
+	}
+	return !p.ExcludeChats[chatJID]
+}
+
+// Read a comma-separated set of chat JIDs from an environment variable
+func chatSetFromEnv(name string) map[string]bool {
+	chats := make(map[string]bool)
+	for _, jid := range strings.Split(os.Getenv(name), ",") {
+		if jid = strings.TrimSpace(jid); jid != "" {
+			chats[jid] = true
+		}
+	}
+	return chats
+}
+
+// Read a positive whole number from an environment variable, or use the default
+func positiveIntFromEnv(name string, defaultValue int, logger waLog.Logger) int {
+	valueStr := os.Getenv(name)
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := strconv.Atoi(valueStr)
+	if err != nil || value <= 0 {
+		logger.Warnf("Invalid %s: %s, using default of %d", name, valueStr, defaultValue)
+		return defaultValue
+	}
+	return value
+}
+
+// Load the automatic download policy from the environment. Media types are
+// listed as "image,document=100,video=50", with an optional size limit in
+// megabytes per type, or "all".
+func loadMediaDownloadPolicy(logger waLog.Logger) MediaDownloadPolicy {
+	policy := MediaDownloadPolicy{
+		MediaTypes:   make(map[string]int64),
+		Chats:        chatSetFromEnv("AUTO_DOWNLOAD_CHATS"),
+		ExcludeChats: chatSetFromEnv("AUTO_DOWNLOAD_EXCLUDE_CHATS"),
+		Workers:      positiveIntFromEnv("AUTO_DOWNLOAD_WORKERS", 2, logger),
+		QueueSize:    positiveIntFromEnv("AUTO_DOWNLOAD_QUEUE_SIZE", 100, logger),
+		MaxAttempts:  positiveIntFromEnv("AUTO_DOWNLOAD_MAX_ATTEMPTS", 5, logger),
+		RetryDelay:   time.Duration(positiveIntFromEnv("AUTO_DOWNLOAD_RETRY_SECONDS", 60, logger)) * time.Second,
+	}
+
+	var defaultMaxSize int64
+	if sizeStr := os.Getenv("AUTO_DOWNLOAD_MAX_SIZE_MB"); sizeStr != "" {
+		if mb, err := strconv.ParseInt(sizeStr, 10, 64); err == nil && mb >= 0 {
+			defaultMaxSize = mb * 1024 * 1024
+		} else {
+			logger.Warnf("Invalid AUTO_DOWNLOAD_MAX_SIZE_MB: %s, ignoring", sizeStr)
+		}
+	}
+
+	for _, entry := range strings.Split(os.Getenv("AUTO_DOWNLOAD_MEDIA_TYPES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		mediaType, sizeStr, hasSize := strings.Cut(entry, "=")
+		mediaType = strings.TrimSpace(mediaType)
+		maxSize := defaultMaxSize
+		if hasSize {
+			mb, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 10, 64)
+			if err != nil || mb < 0 {
+				logger.Warnf("Invalid AUTO_DOWNLOAD_MEDIA_TYPES entry: %s, expected type or type=megabytes", entry)
+				continue
+			}
+			maxSize = mb * 1024 * 1024
+		}
+
+		if mediaType == "all" {
+			for _, t := range autoDownloadMediaTypes {
+				policy.MediaTypes[t] = maxSize
+			}
+			continue
+		}
+		if !slices.Contains(autoDownloadMediaTypes, mediaType) {
+			logger.Warnf("Unknown media type in AUTO_DOWNLOAD_MEDIA_TYPES: %s", mediaType)
+			continue
+		}
+		policy.MediaTypes[mediaType] = maxSize
+	}
+
+	return policy
+}
+
+// Store the download state of a message's media
+func (store *SQLMessageStore) StoreMediaDownload(download MediaDownload) error {
+	_, err := store.db.Exec(
+		`INSERT INTO media_downloads (message_id, chat_jid, state, attempts, last_error, next_attempt_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (chat_jid, message_id) DO UPDATE SET
+			state = excluded.state, attempts = excluded.attempts, last_error = excluded.last_error,
+			next_attempt_at = excluded.next_attempt_at, updated_at = excluded.updated_at`,
+		download.MessageID, download.ChatJID, download.State, download.Attempts,
+		nullIfEmpty(download.LastError), download.NextAttemptAt, download.UpdatedAt,
+	)
+	return err
+}
+
+// Queue a message's media for download unless it already has a download
+// record, so that a message delivered again (for example by a history sync)
+// does not restart a download that is running, done or has failed for good.
+// Reports whether the download was queued.
+func (store *SQLMessageStore) QueueMediaDownload(download MediaDownload) (bool, error) {
+	result, err := store.db.Exec(
+		`INSERT INTO media_downloads (message_id, chat_jid, state, attempts, last_error, next_attempt_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (chat_jid, message_id) DO NOTHING`,
+		download.MessageID, download.ChatJID, download.State, download.Attempts,
+		nullIfEmpty(download.LastError), download.NextAttemptAt, download.UpdatedAt,
+	)
+	if err != nil {
+		return false, err
+	}
+	queued, err := result.RowsAffected()
+	return queued > 0, err
+}
+
+// Get the download state of a message's media
+func (store *SQLMessageStore) GetMediaDownload(messageID, chatJID string) (*MediaDownload, error) {
+	row := store.db.QueryRow(
+		"SELECT message_id, chat_jid, state, attempts, last_error, next_attempt_at, updated_at FROM media_downloads WHERE chat_jid = ? AND message_id = ?",
+		chatJID, messageID,
+	)
+	download, err := scanMediaDownload(row)
+	if err != nil {
+		return nil, err
+	}
+	return &download, nil
+}
+
+// Get the downloads in a state, most recently updated first. An empty state matches every download.
+func (store *SQLMessageStore) GetMediaDownloads(state string, limit int) ([]MediaDownload, error) {
+	query := "SELECT message_id, chat_jid, state, attempts, last_error, next_attempt_at, updated_at FROM media_downloads"
+	var args []interface{}
+	if state != "" {
+		query += " WHERE state = ?"
+		args = append(args, state)
+	}
+	query += " ORDER BY updated_at DESC LIMIT ?"
+	args = append(args, limit)
+
+	return store.queryMediaDownloads(query, args...)
+}
+
+// Get queued downloads whose next attempt is due, oldest first
+func (store *SQLMessageStore) GetDueMediaDownloads(now time.Time, limit int) ([]MediaDownload, error) {
+	return store.queryMediaDownloads(
+		`SELECT message_id, chat_jid, state, attempts, last_error, next_attempt_at, updated_at FROM media_downloads
+		WHERE state = ? AND (next_attempt_at IS NULL OR next_attempt_at <= ?) ORDER BY updated_at LIMIT ?`,
+		downloadQueued, now, limit,
+	)
+}
+
+// Queue again the downloads that were in progress when the bridge stopped
+func (store *SQLMessageStore) RequeueMediaDownloads() error {
+	_, err := store.db.Exec(
+		"UPDATE media_downloads SET state = ?, next_attempt_at = NULL WHERE state = ?",
+		downloadQueued, downloadDownloading,
+	)
+	return err
+}
+
+func (store *SQLMessageStore) queryMediaDownloads(query string, args ...interface{}) ([]MediaDownload, error) {
+	rows, err := store.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	downloads := []MediaDownload{}
+	for rows.Next() {
+		download, err := scanMediaDownload(rows)
+		if err != nil {
+			return nil, err
+		}
+		downloads = append(downloads, download)
+	}
+	return downloads, rows.Err()
+}
+
+// Scan a media_downloads row into a MediaDownload
+func scanMediaDownload(row rowScanner) (MediaDownload, error) {
+	var download MediaDownload
+	var lastError sql.NullString
+	var nextAttemptAt sql.NullTime
+	err := row.Scan(&download.MessageID, &download.ChatJID, &download.State, &download.Attempts,
+		&lastError, &nextAttemptAt, &download.UpdatedAt)
+	if err != nil {
+		return download, err
+	}
+	download.LastError = lastError.String
+	if nextAttemptAt.Valid {
+		download.NextAttemptAt = &nextAttemptAt.Time
+	}
+	return download, nil
+}
+
+// mediaDownloadPool downloads media in the background with a fixed number of
+// workers. Downloads waiting for a worker, or for a retry, are kept in the
+// database, so the queue in memory can stay small and nothing is lost on
+// restart.
+type mediaDownloadPool struct {
+	client *whatsmeow.Client
+	store  MessageStore
+	policy MediaDownloadPolicy
+	logger waLog.Logger
+
+	jobs chan MediaDownload
+
+	mu sync.Mutex
+	// Downloads queued in memory or being downloaded, by chat and message ID
+	pending map[string]bool
+}
+
+// Start the background download workers. Returns nil when automatic
+// downloads are disabled.
+func startMediaDownloadPool(client *whatsmeow.Client, messageStore MessageStore, logger waLog.Logger) *mediaDownloadPool {
+	policy := loadMediaDownloadPolicy(logger)
+	if !policy.Enabled() {
+		return nil
+	}
+
+	pool := &mediaDownloadPool{
+		client:  client,
+		store:   messageStore,
+		policy:  policy,
+		logger:  logger,
+		jobs:    make(chan MediaDownload, policy.QueueSize),
+		pending: make(map[string]bool),
+	}
+
+	types := make([]string, 0, len(policy.MediaTypes))
+	for mediaType, maxSize := range policy.MediaTypes {
+		if maxSize > 0 {
+			types = append(types, fmt.Sprintf("%s (up to %d MB)", mediaType, maxSize/(1024*1024)))
+		} else {
+			types = append(types, mediaType)
+		}
+	}
+	logger.Infof("Automatically downloading %s with %d workers (chats: %d, excluded chats: %d, attempts: %d)",
+		strings.Join(types, ", "), policy.Workers, len(policy.Chats), len(policy.ExcludeChats), policy.MaxAttempts)
+
+	if err := messageStore.RequeueMediaDownloads(); err != nil {
+		logger.Warnf("Failed to requeue interrupted media downloads: %v", err)
+	}
+
+	for i := 0; i < policy.Workers; i++ {
+		go pool.work()
+	}
+	go pool.retry()
+
+	return pool
+}
+
+// Queue the media of a new message for download if the policy allows it
+func (p *mediaDownloadPool) Enqueue(messageID, chatJID, mediaType string, size uint64) {
+	if p == nil || !p.policy.Allows(chatJID, mediaType, size) {
+		return
+	}
+
+	download := MediaDownload{
+		MessageID: messageID,
+		ChatJID:   chatJID,
+		State:     downloadQueued,
+		UpdatedAt: time.Now(),
+	}
+	queued, err := p.store.QueueMediaDownload(download)
+	if err != nil {
+		p.logger.Warnf("Failed to queue media download of %s: %v", messageID, err)
+		return
+	}
+	if queued {
+		p.submit(download)
+	}
+}
+
+// Hand a download to the workers. When the queue is full it stays queued in
+// the database and is picked up by the retry loop.
+func (p *mediaDownloadPool) submit(download MediaDownload) {
+	key := download.ChatJID + "\x00" + download.MessageID
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending[key] {
+		return
+	}
+
+	select {
+	case p.jobs <- download:
+		p.pending[key] = true
+	default:
+	}
+}
+
+// Run downloads until the bridge stops
+func (p *mediaDownloadPool) work() {
+	for download := range p.jobs {
+		p.download(download)
+
+		p.mu.Lock()
+		delete(p.pending, download.ChatJID+"\x00"+download.MessageID)
+		p.mu.Unlock()
+	}
+}
+
+// Download one message's media and record the outcome
+func (p *mediaDownloadPool) download(download MediaDownload) {
+	// Wait for the connection rather than use up an attempt
+	if !p.client.IsConnected() {
+		next := time.Now().Add(p.policy.RetryDelay)
+		download.NextAttemptAt = &next
+		download.UpdatedAt = time.Now()
+		if err := p.store.StoreMediaDownload(download); err != nil {
+			p.logger.Warnf("Failed to store media download state of %s: %v", download.MessageID, err)
+		}
+		return
+	}
+
+	download.State = downloadDownloading
+	download.NextAttemptAt = nil
+	download.UpdatedAt = time.Now()
+	if err := p.store.StoreMediaDownload(download); err != nil {
+		p.logger.Warnf("Failed to store media download state of %s: %v", download.MessageID, err)
+	}
+
+	_, _, _, _, err := downloadMedia(p.client, p.store, download.MessageID, download.ChatJID)
+	download.Attempts++
+	download.UpdatedAt = time.Now()
+	if err == nil {
+		download.State = downloadDone
+		download.LastError = ""
+		p.logger.Infof("Automatically downloaded media of %s in %s", download.MessageID, download.ChatJID)
+	} else if download.Attempts >= p.policy.MaxAttempts {
+		download.State = downloadFailed
+		download.LastError = err.Error()
+		p.logger.Warnf("Giving up on media of %s after %d attempts: %v", download.MessageID, download.Attempts, err)
+	} else {
+		// Back off exponentially between attempts
+		next := download.UpdatedAt.Add(p.policy.RetryDelay << min(download.Attempts-1, 10))
+		download.State = downloadQueued
+		download.LastError = err.Error()
+		download.NextAttemptAt = &next
+		p.logger.Warnf("Failed to download media of %s (attempt %d of %d), retrying at %s: %v",
+			download.MessageID, download.Attempts, p.policy.MaxAttempts, next.Format(time.RFC3339), err)
+	}
+
+	if err := p.store.StoreMediaDownload(download); err != nil {
+		p.logger.Warnf("Failed to store media download state of %s: %v", download.MessageID, err)
+	}
+}
+
+// Periodically hand the queued downloads that are due to the workers
+func (p *mediaDownloadPool) retry() {
+	for {
+		due, err := p.store.GetDueMediaDownloads(time.Now(), p.policy.QueueSize)
+		if err != nil {
+			p.logger.Warnf("Failed to get queued media downloads: %v", err)
+		}
+		for _, download := range due {
+			p.submit(download)
+		}
+
+		time.Sleep(p.policy.RetryDelay / 2)
+	}
+}
+
+// Handler listing automatic media downloads: /api/media-downloads
+func handleMediaDownloads(messageStore MessageStore, logger waLog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only allow GET requests
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		query := r.URL.Query()
+		// A single message's download
+		if messageID := query.Get("message_id"); messageID != "" {
+			chatJID := query.Get("chat_jid")
+			if chatJID == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "chat_jid is required with message_id",
+				})
+				return
+			}
+
+			download, err := messageStore.GetMediaDownload(messageID, chatJID)
+			if err == sql.ErrNoRows {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "No automatic download for this message",
+				})
+				return
+			}
+			if err != nil {
+				logger.Errorf("Failed to get media download of %s: %v", messageID, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Failed to get media download: %v", err),
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":  true,
+				"download": download,
+			})
+			return
+		}
+
+		state := query.Get("state")
+		switch state {
+		case "", downloadQueued, downloadDownloading, downloadDone, downloadFailed:
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "state must be queued, downloading, done or failed",
+			})
+			return
+		}
+
+		limit := 100
+		if limitStr := query.Get("limit"); limitStr != "" {
+			if parsed, err := strconv.Atoi(limitStr); err == nil && parsed > 0 && parsed <= 1000 {
+				limit = parsed
+			}
+		}
+
+		downloads, err := messageStore.GetMediaDownloads(state, limit)
+		if err != nil {
+			logger.Errorf("Failed to get media downloads: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to get media downloads: %v", err),
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":   true,
+			"downloads": downloads,
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// A download pool without workers, so tests can inspect what it submits
+func newTestDownloadPool(t *testing.T, store *SQLMessageStore) *mediaDownloadPool {
+	t.Helper()
+	return &mediaDownloadPool{
+		client:  &whatsmeow.Client{},
+		store:   store,
+		policy:  MediaDownloadPolicy{MediaTypes: map[string]int64{"image": 1000}, MaxAttempts: 3, RetryDelay: time.Minute},
+		logger:  waLog.Noop,
+		jobs:    make(chan MediaDownload, 10),
+		pending: make(map[string]bool),
+	}
+}
+
+func TestEnqueueKeepsExistingDownloads(t *testing.T) {
+	chat := "4915112345678@s.whatsapp.net"
+	tests := []struct {
+		name       string
+		existing   string
+		wantState  string
+		wantSubmit bool
+	}{
+		{"new download", "", downloadQueued, true},
+		{"already queued", downloadQueued, downloadQueued, false},
+		{"downloading", downloadDownloading, downloadDownloading, false},
+		{"done", downloadDone, downloadDone, false},
+		{"failed", downloadFailed, downloadFailed, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			pool := newTestDownloadPool(t, store)
+			if tt.existing != "" {
+				err := store.StoreMediaDownload(MediaDownload{MessageID: "m1", ChatJID: chat, State: tt.existing, Attempts: 2, UpdatedAt: time.Now()})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			pool.Enqueue("m1", chat, "image", 100)
+
+			download, err := store.GetMediaDownload("m1", chat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if download.State != tt.wantState {
+				t.Errorf("state = %q, want %q", download.State, tt.wantState)
+			}
+			if tt.existing != "" && download.Attempts != 2 {
+				t.Errorf("attempts = %d, want 2 kept", download.Attempts)
+			}
+			if submitted := len(pool.jobs) > 0; submitted != tt.wantSubmit {
+				t.Errorf("submitted = %v, want %v", submitted, tt.wantSubmit)
+			}
+		})
+	}
+}
+
+func TestEnqueueFollowsPolicy(t *testing.T) {
+	store := newTestStore(t)
+	pool := newTestDownloadPool(t, store)
+	chat := "4915112345678@s.whatsapp.net"
+
+	pool.Enqueue("big", chat, "image", 5000)
+	pool.Enqueue("video", chat, "video", 100)
+	for _, id := range []string{"big", "video"} {
+		if _, err := store.GetMediaDownload(id, chat); err != sql.ErrNoRows {
+			t.Errorf("download of %s: %v, want none", id, err)
+		}
+	}
+}
+
+func TestMediaDownloadStates(t *testing.T) {
+	store := newTestStore(t)
+	chat := "4915112345678@s.whatsapp.net"
+	now := time.Now()
+	later := now.Add(time.Hour)
+	for _, download := range []MediaDownload{
+		{MessageID: "due", State: downloadQueued},
+		{MessageID: "backing-off", State: downloadQueued, NextAttemptAt: &later},
+		{MessageID: "interrupted", State: downloadDownloading, NextAttemptAt: &later},
+		{MessageID: "done", State: downloadDone},
+	} {
+		download.ChatJID = chat
+		download.UpdatedAt = now
+		if err := store.StoreMediaDownload(download); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids := func(downloads []MediaDownload) map[string]bool {
+		set := make(map[string]bool)
+		for _, d := range downloads {
+			set[d.MessageID] = true
+		}
+		return set
+	}
+
+	due, err := store.GetDueMediaDownloads(now, 10)
+	if got := ids(due); err != nil || len(got) != 1 || !got["due"] {
+		t.Errorf("due before requeue = %v, %v, want [due]", got, err)
+	}
+
+	// Downloads interrupted by a restart are queued again right away
+	if err := store.RequeueMediaDownloads(); err != nil {
+		t.Fatal(err)
+	}
+	due, err = store.GetDueMediaDownloads(now, 10)
+	if got := ids(due); err != nil || len(got) != 2 || !got["due"] || !got["interrupted"] {
+		t.Errorf("due after requeue = %v, %v, want [due interrupted]", got, err)
+	}
+
+	// A disconnected client postpones the download without using an attempt
+	pool := newTestDownloadPool(t, store)
+	pool.download(MediaDownload{MessageID: "due", ChatJID: chat, State: downloadQueued, UpdatedAt: now})
+	download, err := store.GetMediaDownload("due", chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if download.State != downloadQueued || download.Attempts != 0 || download.NextAttemptAt == nil || !download.NextAttemptAt.After(now) {
+		t.Errorf("download while disconnected = %+v, want queued for later with no attempts", download)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// Chat is a stored chat, optionally with its most recent message
+type Chat struct {
+	JID             string
+	Name            string
+	LastMessageTime time.Time
+	LastMessage     *Message `json:",omitempty"`
+}
+
+// ChatFilter selects chats for /api/chats
+type ChatFilter struct {
+	// Substring of the chat name or JID, ignoring case
+	Query string
+	// Only the chat with this JID and chats in which this user sent a message
+	Participant string
+	// "last_active" (newest first) or "name"
+	SortBy string
+	Limit  int
+	Offset int
+}
+
+// Sort orders accepted by ListChats
+const (
+	chatSortLastActive = "last_active"
+	chatSortName       = "name"
+)
+
+// Scan a row selected as jid, name, last_message_time into a Chat
+func scanChat(row rowScanner) (Chat, error) {
+	var chat Chat
+	var name sql.NullString
+	err := row.Scan(&chat.JID, &name, &chat.LastMessageTime)
+	chat.Name = name.String
+	return chat, err
+}
+
+// List chats matching a filter. Without encryption the filter, sort order and
+// paging run in SQL; encrypted names are matched and sorted after decrypting them.
+func (store *SQLMessageStore) ListChats(filter ChatFilter) ([]Chat, error) {
+	conditions := []string{"1 = 1"}
+	var args []interface{}
+
+	if filter.Participant != "" {
+		user, _, _ := strings.Cut(filter.Participant, "@")
+		conditions = append(conditions, "(jid = ? OR jid IN (SELECT chat_jid FROM messages WHERE sender = ?))")
+		args = append(args, filter.Participant, user)
+	}
+
+	query := strings.ToLower(strings.TrimSpace(filter.Query))
+	suffix := ""
+	if store.keys == nil {
+		if query != "" {
+			conditions = append(conditions, `(LOWER(name) LIKE ? ESCAPE '\' OR LOWER(jid) LIKE ? ESCAPE '\')`)
+			args = append(args, likePattern(query), likePattern(query))
+		}
+		suffix = " ORDER BY last_message_time DESC, jid"
+		if filter.SortBy == chatSortName {
+			suffix = " ORDER BY LOWER(COALESCE(name, '')), jid"
+		}
+		suffix += " LIMIT ? OFFSET ?"
+		args = append(args, filter.Limit, filter.Offset)
+	}
+
+	rows, err := store.db.Query("SELECT jid, name, last_message_time FROM chats WHERE "+strings.Join(conditions, " AND ")+suffix, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chats []Chat
+	for rows.Next() {
+		chat, err := scanChat(rows)
+		if err != nil {
+			return nil, err
+		}
+		if chat.Name, err = store.keys.decryptString(chat.Name); err != nil {
+			return nil, err
+		}
+		if store.keys != nil && query != "" &&
+			!strings.Contains(strings.ToLower(chat.Name), query) && !strings.Contains(strings.ToLower(chat.JID), query) {
+			continue
+		}
+		chats = append(chats, chat)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if store.keys == nil {
+		return chats, nil
+	}
+
+	slices.SortFunc(chats, func(a, b Chat) int {
+		if filter.SortBy == chatSortName {
+			if c := strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name)); c != 0 {
+				return c
+			}
+		} else if c := b.LastMessageTime.Compare(a.LastMessageTime); c != 0 {
+			return c
+		}
+		return strings.Compare(a.JID, b.JID)
+	})
+
+	if filter.Offset >= len(chats) {
+		return nil, nil
+	}
+	chats = chats[filter.Offset:]
+	if filter.Limit < len(chats) {
+		chats = chats[:filter.Limit]
+	}
+	return chats, nil
+}
+
+// Get a single stored chat
+func (store *SQLMessageStore) GetChat(jid string) (*Chat, error) {
+	chat, err := scanChat(store.db.QueryRow("SELECT jid, name, last_message_time FROM chats WHERE jid = ?", jid))
+	if err != nil {
+		return nil, err
+	}
+	if chat.Name, err = store.keys.decryptString(chat.Name); err != nil {
+		return nil, err
+	}
+	return &chat, nil
+}
+
+// Find the chat a message was stored in, for clients that only know its ID.
+// Message IDs are unique in practice; if several chats share one, the most
+// recent message wins.
+func (store *SQLMessageStore) FindMessageChat(id string) (string, error) {
+	var chatJID string
+	err := store.db.QueryRow("SELECT chat_jid FROM messages WHERE id = ? ORDER BY timestamp DESC LIMIT 1", id).Scan(&chatJID)
+	return chatJID, err
+}
+
+// Attach the most recent message of each chat
+func attachLastMessages(messageStore MessageStore, chats []Chat) error {
+	for i := range chats {
+		messages, err := messageStore.GetMessages(MessageQuery{ChatJID: chats[i].JID, Limit: 1})
+		if err != nil {
+			return err
+		}
+		if len(messages) > 0 {
+			chats[i].LastMessage = &messages[0]
+		}
+	}
+	return nil
+}
+
+// Handler for listing stored chats and looking up a single chat
+func handleChats(messageStore MessageStore, logger waLog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only allow GET requests
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		query := r.URL.Query()
+		includeLastMessage := true
+		if lastStr := query.Get("include_last_message"); lastStr != "" {
+			includeLastMessage = lastStr == "true" || lastStr == "1" || lastStr == "yes"
+		}
+
+		// Single chat lookup
+		if jid := r.PathValue("jid"); jid != "" {
+			chat, err := messageStore.GetChat(jid)
+			if err == sql.ErrNoRows {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "Chat not found",
+				})
+				return
+			}
+			if err == nil && includeLastMessage {
+				chats := []Chat{*chat}
+				err = attachLastMessages(messageStore, chats)
+				chat = &chats[0]
+			}
+			if err != nil {
+				logger.Errorf("Failed to get chat %s: %v", jid, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Failed to get chat: %v", err),
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"chat":    chat,
+			})
+			return
+		}
+
+		filter := ChatFilter{
+			Query:       query.Get("query"),
+			Participant: query.Get("participant"),
+			SortBy:      chatSortLastActive,
+			Limit:       20,
+		}
+		switch sortBy := query.Get("sort_by"); sortBy {
+		case "", chatSortLastActive:
+		case chatSortName:
+			filter.SortBy = chatSortName
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "Invalid sort_by parameter",
+				"message": "The sort_by parameter must be last_active or name",
+			})
+			return
+		}
+		if limitStr := query.Get("limit"); limitStr != "" {
+			l, err := strconv.Atoi(limitStr)
+			if err != nil || l <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "Invalid limit parameter: must be a positive number",
+					"message": "The limit parameter must be a valid positive integer",
+				})
+				return
+			}
+			filter.Limit = l
+		}
+		if offsetStr := query.Get("offset"); offsetStr != "" {
+			o, err := strconv.Atoi(offsetStr)
+			if err != nil || o < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "Invalid offset parameter: must be zero or a positive number",
+					"message": "The offset parameter must be a valid non-negative integer",
+				})
+				return
+			}
+			filter.Offset = o
+		}
+
+		chats, err := messageStore.ListChats(filter)
+		if err == nil && includeLastMessage {
+			err = attachLastMessages(messageStore, chats)
+		}
+		if err != nil {
+			logger.Errorf("Failed to list chats: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to list chats: %v", err),
+			})
+			return
+		}
+		if chats == nil {
+			chats = []Chat{}
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"count":   len(chats),
+			"chats":   chats,
+		})
+	}
+}
+
+// Handler returning a message together with the messages sent just before
+// and after it in the same chat
+func handleMessageContext(messageStore MessageStore, logger waLog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only allow GET requests
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		query := r.URL.Query()
+		counts := map[string]int{"before": 5, "after": 5}
+		for name := range counts {
+			if countStr := query.Get(name); countStr != "" {
+				n, err := strconv.Atoi(countStr)
+				if err != nil || n < 0 {
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"success": false,
+						"error":   fmt.Sprintf("Invalid %s parameter: must be zero or a positive number", name),
+					})
+					return
+				}
+				counts[name] = n
+			}
+		}
+
+		notFound := func() {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "Message not found",
+			})
+		}
+		failed := func(err error) {
+			logger.Errorf("Failed to get context of message %s: %v", r.PathValue("id"), err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to get message context: %v", err),
+			})
+		}
+
+		messageID := r.PathValue("id")
+		chatJID := query.Get("chat_jid")
+		if chatJID == "" {
+			var err error
+			chatJID, err = messageStore.FindMessageChat(messageID)
+			if err == sql.ErrNoRows {
+				notFound()
+				return
+			}
+			if err != nil {
+				failed(err)
+				return
+			}
+		}
+
+		msg, err := messageStore.GetMessage(messageID, chatJID)
+		if err == sql.ErrNoRows {
+			notFound()
+			return
+		}
+		if err != nil {
+			failed(err)
+			return
+		}
+
+		cursor := cursorForMessage(*msg)
+		before, err := messageStore.GetMessages(MessageQuery{ChatJID: chatJID, Before: &cursor, Limit: counts["before"]})
+		if err != nil {
+			failed(err)
+			return
+		}
+		// Fetched newest first; the context reads oldest first
+		slices.Reverse(before)
+		after, err := messageStore.GetMessages(MessageQuery{ChatJID: chatJID, After: &cursor, Ascending: true, Limit: counts["after"]})
+		if err != nil {
+			failed(err)
+			return
+		}
+		if before == nil {
+			before = []Message{}
+		}
+		if after == nil {
+			after = []Message{}
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"message": msg,
+			"before":  before,
+			"after":   after,
+		})
+	}
+}
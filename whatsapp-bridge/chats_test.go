@@ -0,0 +1,143 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Store three chats for the listing tests, encrypting names when encrypted is set
+func newTestChatStore(t *testing.T, encrypted bool) *SQLMessageStore {
+	t.Helper()
+	store := newTestStore(t)
+	if encrypted {
+		store.keys = newTestKeyring(t, 1)
+	}
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	chats := []struct {
+		jid, name string
+		at        time.Time
+	}{
+		{"111@s.whatsapp.net", "Bob", base.Add(2 * time.Hour)},
+		{"222@s.whatsapp.net", "alice", base},
+		{"333-444@g.us", "Climbing 100%", base.Add(time.Hour)},
+	}
+	for _, c := range chats {
+		if err := store.StoreChat(c.jid, c.name, c.at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Bob wrote in the group too
+	if err := store.StoreMessage("m1", "333-444@g.us", "111", "hi", base, false, "", "", "", nil, nil, nil, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestListChats(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter ChatFilter
+		want   []string
+	}{
+		{"last active first", ChatFilter{}, []string{"Bob", "Climbing 100%", "alice"}},
+		{"by name ignoring case", ChatFilter{SortBy: chatSortName}, []string{"alice", "Bob", "Climbing 100%"}},
+		{"name query", ChatFilter{Query: "ALI"}, []string{"alice"}},
+		{"jid query", ChatFilter{Query: "g.us"}, []string{"Climbing 100%"}},
+		{"wildcards are literal", ChatFilter{Query: "0%"}, []string{"Climbing 100%"}},
+		{"underscore is literal", ChatFilter{Query: "_"}, nil},
+		{"participant", ChatFilter{Participant: "111@s.whatsapp.net"}, []string{"Bob", "Climbing 100%"}},
+		{"paged", ChatFilter{SortBy: chatSortName, Offset: 1, Limit: 1}, []string{"Bob"}},
+		{"offset past the end", ChatFilter{Offset: 5}, nil},
+	}
+
+	for _, encrypted := range []bool{false, true} {
+		store := newTestChatStore(t, encrypted)
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if tt.filter.Limit == 0 {
+					tt.filter.Limit = 10
+				}
+				chats, err := store.ListChats(tt.filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var names []string
+				for _, chat := range chats {
+					names = append(names, chat.Name)
+				}
+				if !slices.Equal(names, tt.want) {
+					t.Errorf("ListChats(%+v) encrypted=%v = %q, want %q", tt.filter, encrypted, names, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestGetChatDecryptsName(t *testing.T) {
+	store := newTestChatStore(t, true)
+	var stored string
+	if err := store.db.QueryRow("SELECT name FROM chats WHERE jid = ?", "111@s.whatsapp.net").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, encryptedValuePrefix) {
+		t.Errorf("stored chat name %q is not encrypted", stored)
+	}
+
+	chat, err := store.GetChat("111@s.whatsapp.net")
+	if err != nil || chat.Name != "Bob" {
+		t.Errorf("GetChat = %+v, %v, want Bob", chat, err)
+	}
+}
+
+func TestGetMessagesFilters(t *testing.T) {
+	tests := []struct {
+		name  string
+		query MessageQuery
+		want  []string
+	}{
+		{"every chat", MessageQuery{}, []string{"m4", "m3", "m2", "m1"}},
+		{"one chat", MessageQuery{ChatJID: "b@s.whatsapp.net"}, []string{"m4", "m3"}},
+		{"sender", MessageQuery{Sender: "222"}, []string{"m4", "m2"}},
+		{"text ignoring case", MessageQuery{Contains: "LUNCH"}, []string{"m3", "m1"}},
+		{"wildcards are literal", MessageQuery{Contains: "50%"}, []string{"m2"}},
+		{"text, sender and chat", MessageQuery{ChatJID: "a@s.whatsapp.net", Contains: "lunch", Sender: "111"}, []string{"m1"}},
+		{"limit applies after the text filter", MessageQuery{Contains: "lunch", Limit: 1}, []string{"m3"}},
+	}
+
+	for _, encrypted := range []bool{false, true} {
+		store := newTestStore(t)
+		if encrypted {
+			store.keys = newTestKeyring(t, 1)
+		}
+		base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+		storeTestMessage(t, store, "a@s.whatsapp.net", "m1", "111", "Lunch today?", base, "", "")
+		storeTestMessage(t, store, "a@s.whatsapp.net", "m2", "222", "Only 50% sure", base.Add(time.Minute), "", "")
+		storeTestMessage(t, store, "b@s.whatsapp.net", "m3", "111", "lunch was great", base.Add(2*time.Minute), "", "")
+		storeTestMessage(t, store, "b@s.whatsapp.net", "m4", "222", "Agreed", base.Add(3*time.Minute), "", "")
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if tt.query.Limit == 0 {
+					tt.query.Limit = 10
+				}
+				messages, err := store.GetMessages(tt.query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var ids []string
+				for _, msg := range messages {
+					ids = append(ids, msg.ID)
+				}
+				if !slices.Equal(ids, tt.want) {
+					t.Errorf("GetMessages(%+v) encrypted=%v = %q, want %q", tt.query, encrypted, ids, tt.want)
+				}
+			})
+		}
+
+		if chatJID, err := store.FindMessageChat("m3"); err != nil || chatJID != "b@s.whatsapp.net" {
+			t.Errorf("FindMessageChat(m3) = %q, %v", chatJID, err)
+		}
+	}
+}
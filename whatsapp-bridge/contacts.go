@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// Contact is what we know about a WhatsApp user. Contacts are keyed by their
+// phone number JID, or by their LID while the phone number is unknown.
+type Contact struct {
+	JID          string     `json:"jid"`
+	PhoneNumber  string     `json:"phone_number,omitempty"`
+	LID          string     `json:"lid,omitempty"`
+	FullName     string     `json:"full_name,omitempty"`
+	FirstName    string     `json:"first_name,omitempty"`
+	PushName     string     `json:"push_name,omitempty"`
+	BusinessName string     `json:"business_name,omitempty"`
+	LastSeenAt   *time.Time `json:"last_seen_at,omitempty"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// Best name to show for a contact: the address book name, then the names the
+// contact chose for themselves, then the phone number
+func (c Contact) DisplayName() string {
+	for _, name := range []string{c.FullName, c.FirstName, c.BusinessName, c.PushName, c.PhoneNumber} {
+		if name != "" {
+			return name
+		}
+	}
+	return c.JID
+}
+
+const contactColumns = "jid, phone_number, lid, full_name, first_name, push_name, business_name, last_seen_at, updated_at"
+
+// Scan a contacts row selected with contactColumns
+func scanContact(row rowScanner) (Contact, error) {
+	var c Contact
+	var phoneNumber, lid, fullName, firstName, pushName, businessName sql.NullString
+	var lastSeenAt, updatedAt sql.NullTime
+	err := row.Scan(&c.JID, &phoneNumber, &lid, &fullName, &firstName, &pushName, &businessName, &lastSeenAt, &updatedAt)
+	if err != nil {
+		return c, err
+	}
+	c.PhoneNumber = phoneNumber.String
+	c.LID = lid.String
+	c.FullName = fullName.String
+	c.FirstName = firstName.String
+	c.PushName = pushName.String
+	c.BusinessName = businessName.String
+	if lastSeenAt.Valid {
+		c.LastSeenAt = &lastSeenAt.Time
+	}
+	c.UpdatedAt = updatedAt.Time
+	return c, nil
+}
+
+// Decrypt the names of a scanned contact
+func (store *SQLMessageStore) decryptContact(c *Contact) error {
+	for _, name := range []*string{&c.FullName, &c.FirstName, &c.PushName, &c.BusinessName} {
+		var err error
+		if *name, err = store.keys.decryptString(*name); err != nil {
+			return fmt.Errorf("contact %s: %v", c.JID, err)
+		}
+	}
+	return nil
+}
+
+// Empty strings are stored as NULL, so an update never blanks out a known value
+func nullIfEmpty(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+// Store what we learned about a contact. Fields left empty keep their stored
+// value, and last_seen_at only moves forward. When a contact known by its LID
+// turns out to have a phone number, the LID row is merged into it.
+func (store *SQLMessageStore) StoreContact(contact Contact) error {
+	if contact.JID == "" {
+		return fmt.Errorf("contact JID is required")
+	}
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if contact.LID != "" && contact.LID != contact.JID {
+		old, err := scanContact(tx.QueryRow("SELECT "+contactColumns+" FROM contacts WHERE jid = ?", contact.LID))
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil {
+			if err := store.decryptContact(&old); err != nil {
+				return err
+			}
+			mergeContact(&contact, old)
+			if _, err := tx.Exec("DELETE FROM contacts WHERE jid = ?", contact.LID); err != nil {
+				return err
+			}
+		}
+	}
+
+	var lastSeenAt sql.NullTime
+	if contact.LastSeenAt != nil {
+		lastSeenAt = sql.NullTime{Time: *contact.LastSeenAt, Valid: true}
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO contacts (`+contactColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (jid) DO UPDATE SET
+			phone_number = COALESCE(excluded.phone_number, contacts.phone_number),
+			lid = COALESCE(excluded.lid, contacts.lid),
+			full_name = COALESCE(excluded.full_name, contacts.full_name),
+			first_name = COALESCE(excluded.first_name, contacts.first_name),
+			push_name = COALESCE(excluded.push_name, contacts.push_name),
+			business_name = COALESCE(excluded.business_name, contacts.business_name),
+			last_seen_at = CASE
+				WHEN contacts.last_seen_at IS NULL OR excluded.last_seen_at > contacts.last_seen_at THEN excluded.last_seen_at
+				ELSE contacts.last_seen_at
+			END,
+			updated_at = excluded.updated_at`,
+		contact.JID, nullIfEmpty(contact.PhoneNumber), nullIfEmpty(contact.LID),
+		nullIfEmpty(store.keys.encryptString(contact.FullName)), nullIfEmpty(store.keys.encryptString(contact.FirstName)),
+		nullIfEmpty(store.keys.encryptString(contact.PushName)), nullIfEmpty(store.keys.encryptString(contact.BusinessName)),
+		lastSeenAt, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Fill the empty fields of a contact from an older record of the same person
+func mergeContact(contact *Contact, old Contact) {
+	fields := []struct {
+		dst *string
+		src string
+	}{
+		{&contact.PhoneNumber, old.PhoneNumber},
+		{&contact.FullName, old.FullName},
+		{&contact.FirstName, old.FirstName},
+		{&contact.PushName, old.PushName},
+		{&contact.BusinessName, old.BusinessName},
+	}
+	for _, f := range fields {
+		if *f.dst == "" {
+			*f.dst = f.src
+		}
+	}
+	if old.LastSeenAt != nil && (contact.LastSeenAt == nil || old.LastSeenAt.After(*contact.LastSeenAt)) {
+		contact.LastSeenAt = old.LastSeenAt
+	}
+}
+
+// Look up a contact by JID, LID or phone number
+func (store *SQLMessageStore) GetContact(id string) (*Contact, error) {
+	// Accept phone numbers written as +49 151 234-5678
+	if !strings.Contains(id, "@") {
+		id = normalizePhoneNumber(id)
+	}
+
+	contact, err := scanContact(store.db.QueryRow(
+		"SELECT "+contactColumns+" FROM contacts WHERE jid = ? OR lid = ? OR phone_number = ? LIMIT 1",
+		id, id, id,
+	))
+	if err != nil {
+		return nil, err
+	}
+	if err := store.decryptContact(&contact); err != nil {
+		return nil, err
+	}
+	return &contact, nil
+}
+
+// Columns matched by a contact search, as in contactMatches
+var contactSearchColumns = []string{"full_name", "first_name", "push_name", "business_name", "phone_number", "jid"}
+
+// SQL for the display name of a contact, as in Contact.DisplayName
+const contactDisplayNameSQL = "COALESCE(NULLIF(full_name, ''), NULLIF(first_name, ''), NULLIF(business_name, ''), NULLIF(push_name, ''), NULLIF(phone_number, ''), jid)"
+
+// Search contacts by any of their names or their phone number, sorted by
+// display name. An empty query lists every contact. Without encryption the
+// search runs in SQL; encrypted names are matched and sorted after decrypting them.
+func (store *SQLMessageStore) SearchContacts(query string, limit, offset int) ([]Contact, error) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if store.keys == nil {
+		var conditions []string
+		var args []interface{}
+		if query != "" {
+			for _, column := range contactSearchColumns {
+				conditions = append(conditions, "LOWER("+column+`) LIKE ? ESCAPE '\'`)
+				args = append(args, likePattern(query))
+			}
+		} else {
+			conditions = append(conditions, "1 = 1")
+		}
+		args = append(args, limit, offset)
+
+		rows, err := store.db.Query(
+			"SELECT "+contactColumns+" FROM contacts WHERE "+strings.Join(conditions, " OR ")+
+				" ORDER BY LOWER("+contactDisplayNameSQL+"), jid LIMIT ? OFFSET ?",
+			args...,
+		)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		var contacts []Contact
+		for rows.Next() {
+			contact, err := scanContact(rows)
+			if err != nil {
+				return nil, err
+			}
+			contacts = append(contacts, contact)
+		}
+		return contacts, rows.Err()
+	}
+
+	rows, err := store.db.Query("SELECT " + contactColumns + " FROM contacts")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var contacts []Contact
+	for rows.Next() {
+		contact, err := scanContact(rows)
+		if err != nil {
+			return nil, err
+		}
+		if err := store.decryptContact(&contact); err != nil {
+			return nil, err
+		}
+		if query == "" || contactMatches(contact, query) {
+			contacts = append(contacts, contact)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(contacts, func(a, b Contact) int {
+		if c := strings.Compare(strings.ToLower(a.DisplayName()), strings.ToLower(b.DisplayName())); c != 0 {
+			return c
+		}
+		return strings.Compare(a.JID, b.JID)
+	})
+
+	if offset >= len(contacts) {
+		return nil, nil
+	}
+	contacts = contacts[offset:]
+	if limit < len(contacts) {
+		contacts = contacts[:limit]
+	}
+	return contacts, nil
+}
+
+// Check whether any name, the phone number or the JID of a contact contains
+// a lowercase query
+func contactMatches(c Contact, query string) bool {
+	for _, value := range []string{c.FullName, c.FirstName, c.PushName, c.BusinessName, c.PhoneNumber, c.JID} {
+		if strings.Contains(strings.ToLower(value), query) {
+			return true
+		}
+	}
+	return false
+}
+
+// Build the contact record for a user JID, filling in whichever of the phone
+// number and LID whatsmeow can map it to
+func contactForJID(client *whatsmeow.Client, jid types.JID) Contact {
+	jid = jid.ToNonAD()
+	switch jid.Server {
+	case types.HiddenUserServer:
+		contact := Contact{JID: jid.String(), LID: jid.String()}
+		if pn, err := client.Store.LIDs.GetPNForLID(context.Background(), jid); err == nil && !pn.IsEmpty() {
+			contact.JID = pn.ToNonAD().String()
+			contact.PhoneNumber = pn.User
+		}
+		return contact
+	default:
+		contact := Contact{JID: jid.String(), PhoneNumber: jid.User}
+		if lid, err := client.Store.LIDs.GetLIDForPN(context.Background(), jid); err == nil && !lid.IsEmpty() {
+			contact.LID = lid.ToNonAD().String()
+		}
+		return contact
+	}
+}
+
+// Check whether a JID belongs to a user rather than a group, broadcast or newsletter
+func isUserJID(jid types.JID) bool {
+	return jid.Server == types.DefaultUserServer || jid.Server == types.HiddenUserServer
+}
+
+// Store a contact, logging rather than failing on errors
+func recordContact(messageStore MessageStore, contact Contact, logger waLog.Logger) {
+	if err := messageStore.StoreContact(contact); err != nil {
+		logger.Warnf("Failed to store contact %s: %v", contact.JID, err)
+	}
+}
+
+// Remember the push name and last activity of the sender of a message
+func recordMessageSender(client *whatsmeow.Client, messageStore MessageStore, info types.MessageInfo, logger waLog.Logger) {
+	if info.IsFromMe || !isUserJID(info.Sender) {
+		return
+	}
+	contact := contactForJID(client, info.Sender)
+	contact.PushName = info.PushName
+	timestamp := info.Timestamp
+	contact.LastSeenAt = &timestamp
+	recordContact(messageStore, contact, logger)
+}
+
+// Handle contact related events: push name and business name changes, and
+// address book entries synced through app state
+func handleContactEvent(client *whatsmeow.Client, messageStore MessageStore, evt interface{}, logger waLog.Logger) {
+	switch v := evt.(type) {
+	case *events.PushName:
+		if !isUserJID(v.JID) {
+			return
+		}
+		contact := contactForJID(client, v.JID)
+		contact.PushName = v.NewPushName
+		recordContact(messageStore, contact, logger)
+
+	case *events.BusinessName:
+		if !isUserJID(v.JID) {
+			return
+		}
+		contact := contactForJID(client, v.JID)
+		contact.BusinessName = v.NewBusinessName
+		recordContact(messageStore, contact, logger)
+
+	case *events.Contact:
+		if !isUserJID(v.JID) || v.Action == nil {
+			return
+		}
+		contact := contactForJID(client, v.JID)
+		contact.FullName = v.Action.GetFullName()
+		contact.FirstName = v.Action.GetFirstName()
+		if lid, err := types.ParseJID(v.Action.GetLidJID()); err == nil && contact.LID == "" && lid.Server == types.HiddenUserServer {
+			contact.LID = lid.ToNonAD().String()
+		}
+		recordContact(messageStore, contact, logger)
+	}
+}
+
+// Store the push names that come with a history sync
+func storeHistorySyncPushNames(client *whatsmeow.Client, messageStore MessageStore, historySync *events.HistorySync, logger waLog.Logger) {
+	for _, pushName := range historySync.Data.GetPushnames() {
+		jid, err := types.ParseJID(pushName.GetID())
+		if err != nil || !isUserJID(jid) || pushName.GetPushname() == "" {
+			continue
+		}
+		contact := contactForJID(client, jid)
+		contact.PushName = pushName.GetPushname()
+		recordContact(messageStore, contact, logger)
+	}
+}
+
+// Copy the contacts whatsmeow already knows into the contacts table.
+// Run on connect, so contacts synced before the table existed are not missed.
+func syncStoreContacts(client *whatsmeow.Client, messageStore MessageStore, logger waLog.Logger) {
+	contacts, err := client.Store.Contacts.GetAllContacts(context.Background())
+	if err != nil {
+		logger.Warnf("Failed to load contacts: %v", err)
+		return
+	}
+
+	for jid, info := range contacts {
+		if !isUserJID(jid) {
+			continue
+		}
+		contact := contactForJID(client, jid)
+		contact.FullName = info.FullName
+		contact.FirstName = info.FirstName
+		contact.PushName = info.PushName
+		contact.BusinessName = info.BusinessName
+		recordContact(messageStore, contact, logger)
+	}
+	logger.Infof("Synced %d contacts", len(contacts))
+}
+
+// Handler for searching contacts, or looking up one with /api/contacts/{jid}
+func handleContacts(messageStore MessageStore, logger waLog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only allow GET requests
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		// Single contact lookup
+		if id := r.PathValue("jid"); id != "" {
+			contact, err := messageStore.GetContact(id)
+			if err == sql.ErrNoRows {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "Contact not found",
+				})
+				return
+			}
+			if err != nil {
+				logger.Errorf("Failed to get contact %s: %v", id, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Failed to get contact: %v", err),
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"contact": contact,
+				"name":    contact.DisplayName(),
+			})
+			return
+		}
+
+		query := r.URL.Query()
+		limit, offset := 50, 0
+		if limitStr := query.Get("limit"); limitStr != "" {
+			l, err := strconv.Atoi(limitStr)
+			if err != nil || l <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "Invalid limit parameter: must be a positive number",
+					"message": "The limit parameter must be a valid positive integer",
+				})
+				return
+			}
+			limit = l
+		}
+		if offsetStr := query.Get("offset"); offsetStr != "" {
+			o, err := strconv.Atoi(offsetStr)
+			if err != nil || o < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "Invalid offset parameter: must be zero or a positive number",
+					"message": "The offset parameter must be a valid non-negative integer",
+				})
+				return
+			}
+			offset = o
+		}
+
+		contacts, err := messageStore.SearchContacts(query.Get("query"), limit, offset)
+		if err != nil {
+			logger.Errorf("Failed to search contacts: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to search contacts: %v", err),
+			})
+			return
+		}
+		if contacts == nil {
+			contacts = []Contact{}
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"count":    len(contacts),
+			"contacts": contacts,
+		})
+	}
+}
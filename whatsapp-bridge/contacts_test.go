@@ -0,0 +1,63 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSearchContacts(t *testing.T) {
+	contacts := []Contact{
+		{JID: "4915100000001@s.whatsapp.net", PhoneNumber: "4915100000001", FullName: "Alice Smith", PushName: "Ali"},
+		{JID: "4915100000002@s.whatsapp.net", PhoneNumber: "4915100000002", PushName: "bob"},
+		{JID: "4915100000003@s.whatsapp.net", PhoneNumber: "4915100000003", BusinessName: "Zed Corp 100%"},
+		{JID: "4915100000004@s.whatsapp.net", PhoneNumber: "4915100000004"},
+		{JID: "98765432101234@lid", LID: "98765432101234@lid", PushName: "Carol"},
+	}
+	tests := []struct {
+		name          string
+		query         string
+		limit, offset int
+		want          []string
+	}{
+		{"everyone by display name", "", 10, 0, []string{
+			"4915100000004@s.whatsapp.net", "4915100000001@s.whatsapp.net", "4915100000002@s.whatsapp.net",
+			"98765432101234@lid", "4915100000003@s.whatsapp.net",
+		}},
+		{"name ignoring case", "SMITH", 10, 0, []string{"4915100000001@s.whatsapp.net"}},
+		{"push name", "ali", 10, 0, []string{"4915100000001@s.whatsapp.net"}},
+		{"phone number", "00000002", 10, 0, []string{"4915100000002@s.whatsapp.net"}},
+		{"jid", "@lid", 10, 0, []string{"98765432101234@lid"}},
+		{"wildcards are literal", "0%", 10, 0, []string{"4915100000003@s.whatsapp.net"}},
+		{"underscore is literal", "_", 10, 0, nil},
+		{"paged", "", 2, 1, []string{"4915100000001@s.whatsapp.net", "4915100000002@s.whatsapp.net"}},
+		{"offset past the end", "", 10, 5, nil},
+	}
+
+	for _, encrypted := range []bool{false, true} {
+		store := newTestStore(t)
+		if encrypted {
+			store.keys = newTestKeyring(t, 1)
+		}
+		for _, contact := range contacts {
+			if err := store.StoreContact(contact); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				found, err := store.SearchContacts(tt.query, tt.limit, tt.offset)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var jids []string
+				for _, contact := range found {
+					jids = append(jids, contact.JID)
+				}
+				if !slices.Equal(jids, tt.want) {
+					t.Errorf("SearchContacts(%q, %d, %d) encrypted=%v = %q, want %q", tt.query, tt.limit, tt.offset, encrypted, jids, tt.want)
+				}
+			})
+		}
+	}
+}
@@ -3,7 +3,7 @@ module.exports = {
     apps: [
       {
         name: "whatsapp-bridge",
-        script: "go run main.go",
+        script: "go run -tags sqlite_fts5 .",
         interpreter: "none",
         exec_mode: "fork",
         watch: false
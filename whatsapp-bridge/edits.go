@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	waLog "go.mau.fi/whatsmeow/util/log"
+	"google.golang.org/protobuf/proto"
+)
+
+// EditMessageRequest is the request body for editing one of our messages
+type EditMessageRequest struct {
+	ChatJID string `json:"chat_jid"`
+	Message string `json:"message"`
+}
+
+// Look up a message to edit or delete, answering the request with an error
+// if it is not stored or already deleted
+func getMessageToChange(w http.ResponseWriter, messageStore MessageStore, messageID, chatJID string, logger waLog.Logger) (*Message, bool) {
+	msg, err := messageStore.GetMessage(messageID, chatJID)
+	if err == sql.ErrNoRows || (err == nil && msg.DeletedAt != nil) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Message not found",
+		})
+		return nil, false
+	}
+	if err != nil {
+		logger.Errorf("Failed to get message %s: %v", messageID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   fmt.Sprintf("Failed to get message: %v", err),
+		})
+		return nil, false
+	}
+	return msg, true
+}
+
+// Check whether we are an admin of a group. Groups that are not stored yet
+// are fetched from WhatsApp.
+func isGroupAdmin(client *whatsmeow.Client, messageStore MessageStore, group types.JID) (bool, error) {
+	info, err := messageStore.GetGroup(group.String())
+	if err == sql.ErrNoRows {
+		info, err = refreshGroup(client, messageStore, group)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range info.Participants {
+		if p.JID == client.Store.ID.ToNonAD().String() || (p.LID != "" && p.LID == client.Store.LID.ToNonAD().String()) {
+			return p.IsAdmin, nil
+		}
+	}
+	return false, nil
+}
+
+// Build the new content of an edited message: the text of a text message, or
+// the caption of an image, video or document. Other messages cannot be edited.
+func editedContent(original *Message, text string) *waProto.Message {
+	switch original.Type {
+	case messageTypeText:
+		return &waProto.Message{Conversation: proto.String(text)}
+	case "image":
+		return &waProto.Message{ImageMessage: &waProto.ImageMessage{Caption: proto.String(text)}}
+	case "video":
+		return &waProto.Message{VideoMessage: &waProto.VideoMessage{Caption: proto.String(text)}}
+	case "document":
+		return &waProto.Message{DocumentMessage: &waProto.DocumentMessage{Caption: proto.String(text)}}
+	default:
+		return nil
+	}
+}
+
+// Webhooks for our edits and deletes follow the same rules as message
+// webhooks, apart from being our own: direct chats only
+func isEligibleForChangeWebhook(chat types.JID, logger waLog.Logger) bool {
+	if chat.Server == types.GroupServer {
+		return false
+	}
+	if chat.Server == types.HiddenUserServer {
+		logger.Infof("Skipping webhook for @lid JID: %s", chat)
+		return false
+	}
+	return true
+}
+
+// Handler for editing the text or caption of one of our messages: /api/messages/{id}/edit
+func handleEditMessage(client *whatsmeow.Client, messageStore MessageStore, logger waLog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only allow POST requests
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if client is connected to WhatsApp
+		if !client.IsConnected() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "WhatsApp client is not connected",
+			})
+			return
+		}
+
+		var req EditMessageRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Invalid request format: %v", err),
+			})
+			return
+		}
+		if req.ChatJID == "" || req.Message == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "chat_jid and message are required",
+			})
+			return
+		}
+
+		chat, err := parseRecipientJID(req.ChatJID)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Invalid chat_jid: %v", err),
+			})
+			return
+		}
+
+		messageID := r.PathValue("id")
+		original, ok := getMessageToChange(w, messageStore, messageID, chat.String(), logger)
+		if !ok {
+			return
+		}
+
+		// WhatsApp only accepts edits of our own text messages and captions,
+		// for a while after they were sent
+		content := editedContent(original, req.Message)
+		if !original.IsFromMe || content == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "Only text messages and the captions of images, videos and documents we sent can be edited",
+			})
+			return
+		}
+		if time.Since(original.Time) > whatsmeow.EditWindow {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Messages can only be edited within %s of being sent", whatsmeow.EditWindow),
+			})
+			return
+		}
+
+		msg := client.BuildEdit(chat, messageID, content)
+		resp, err := client.SendMessage(context.Background(), chat, msg)
+		if err != nil {
+			logger.Warnf("Failed to send edit: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Error sending edit: %v", err),
+			})
+			return
+		}
+		logger.Infof("Edited message %s in %s", messageID, chat)
+
+		// Our own edits are not echoed back to us, so record it here
+		sender := client.Store.ID.User
+		handleEditedOrRevokedMessage(messageStore, false, messageID, chat.String(), sender, req.Message, resp.Timestamp, logger)
+		if isEligibleForChangeWebhook(chat, logger) {
+			sendWebhook(resp.ID, chat.String(), sender, req.Message, resp.Timestamp,
+				true, "", "", "", original.QuotedMessage, original.ReplyToID, original.ReplyToSender, original.Type, nil,
+				true, messageID, false, "", "", logger)
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":    true,
+			"id":         resp.ID,
+			"message_id": messageID,
+			"chat_jid":   chat.String(),
+			"edited_at":  resp.Timestamp,
+		})
+	}
+}
+
+// Handler for deleting a message for everyone: /api/messages/{id}. Group
+// admins can also delete messages sent by others.
+func handleDeleteMessage(client *whatsmeow.Client, messageStore MessageStore, logger waLog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only allow DELETE requests
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if client is connected to WhatsApp
+		if !client.IsConnected() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "WhatsApp client is not connected",
+			})
+			return
+		}
+
+		chatJID := r.URL.Query().Get("chat_jid")
+		if chatJID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "chat_jid is required",
+			})
+			return
+		}
+		chat, err := parseRecipientJID(chatJID)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Invalid chat_jid: %v", err),
+			})
+			return
+		}
+
+		messageID := r.PathValue("id")
+		original, ok := getMessageToChange(w, messageStore, messageID, chat.String(), logger)
+		if !ok {
+			return
+		}
+
+		// Others' messages can only be deleted by the admins of a group
+		sender := types.EmptyJID
+		if !original.IsFromMe {
+			isAdmin := false
+			if chat.Server == types.GroupServer {
+				isAdmin, err = isGroupAdmin(client, messageStore, chat)
+				if err != nil {
+					logger.Errorf("Failed to check admin status in %s: %v", chat, err)
+					w.WriteHeader(http.StatusInternalServerError)
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"success": false,
+						"error":   err.Error(),
+					})
+					return
+				}
+			}
+			if !isAdmin {
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "Only group admins can delete messages sent by others",
+				})
+				return
+			}
+			sender = storedSenderJID(client, messageStore, chat, original)
+		}
+
+		msg := client.BuildRevoke(chat, sender, messageID)
+		resp, err := client.SendMessage(context.Background(), chat, msg)
+		if err != nil {
+			logger.Warnf("Failed to send revoke: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Error deleting message: %v", err),
+			})
+			return
+		}
+		logger.Infof("Deleted message %s in %s", messageID, chat)
+
+		// Our own revokes are not echoed back to us, so record it here
+		deletedBy := client.Store.ID.User
+		handleEditedOrRevokedMessage(messageStore, true, messageID, chat.String(), deletedBy, "", resp.Timestamp, logger)
+		if isEligibleForChangeWebhook(chat, logger) {
+			sendDeletedWebhook(messageStore, messageID, chat.String(), deletedBy, resp.Timestamp, logger)
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":    true,
+			"id":         resp.ID,
+			"message_id": messageID,
+			"chat_jid":   chat.String(),
+			"deleted_at": resp.Timestamp,
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+func TestEditedContent(t *testing.T) {
+	tests := []struct {
+		name        string
+		messageType string
+		want        string
+	}{
+		{"text", messageTypeText, "text"},
+		{"image caption", "image", "image"},
+		{"video caption", "video", "video"},
+		{"document caption", "document", "document"},
+		{"audio", "audio", ""},
+		{"sticker", "sticker", ""},
+		{"location", messageTypeLocation, ""},
+		{"poll", messageTypePoll, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := editedContent(&Message{Type: tt.messageType}, "new text")
+			var got, text string
+			switch {
+			case msg == nil:
+			case msg.Conversation != nil:
+				got, text = "text", msg.GetConversation()
+			case msg.ImageMessage != nil:
+				got, text = "image", msg.GetImageMessage().GetCaption()
+			case msg.VideoMessage != nil:
+				got, text = "video", msg.GetVideoMessage().GetCaption()
+			case msg.DocumentMessage != nil:
+				got, text = "document", msg.GetDocumentMessage().GetCaption()
+			default:
+				got = "other"
+			}
+			if got != tt.want || (got != "" && text != "new text") {
+				t.Errorf("editedContent(%s) = %s with %q, want %q", tt.messageType, got, text, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetMessageToChange(t *testing.T) {
+	store := newTestStore(t)
+	chat := "4915112345678@s.whatsapp.net"
+	at := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	storeTestMessage(t, store, chat, "stored", "111", "hello", at, "", "")
+	storeTestMessage(t, store, chat, "deleted", "111", "gone", at, "", "")
+	if err := store.MarkMessageAsDeleted("deleted", chat, "111", at.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		id         string
+		chatJID    string
+		wantStatus int
+	}{
+		{"stored message", "stored", chat, http.StatusOK},
+		{"unknown message", "missing", chat, http.StatusNotFound},
+		{"message of another chat", "stored", "4915187654321@s.whatsapp.net", http.StatusNotFound},
+		{"deleted message", "deleted", chat, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			msg, ok := getMessageToChange(w, store, tt.id, tt.chatJID, waLog.Noop)
+			if ok != (tt.wantStatus == http.StatusOK) || w.Code != tt.wantStatus {
+				t.Errorf("getMessageToChange(%s) = %v with status %d, want %d", tt.id, ok, w.Code, tt.wantStatus)
+			}
+			if ok && (msg == nil || msg.ID != tt.id) {
+				t.Errorf("getMessageToChange(%s) = %+v", tt.id, msg)
+			}
+		})
+	}
+}
@@ -0,0 +1,1073 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// Encryption at rest uses envelope encryption: message columns and media files
+// are encrypted with random data keys kept in the encryption_keys table, and the
+// data keys are stored wrapped (encrypted) by a master key that never touches
+// the database. Rotating the master key only rewraps the data keys.
+
+// Prefix marking an encrypted column value. Values without it are plaintext,
+// written before encryption was enabled.
+const encryptedValuePrefix = "$waenc1$"
+
+// Header of an encrypted media file: magic, data key ID, nonce prefix
+const (
+	encryptedMediaMagic     = "WAENC1"
+	mediaNoncePrefixSize    = 8
+	encryptedMediaHeaderLen = len(encryptedMediaMagic) + 4 + mediaNoncePrefixSize
+	// Media files are sealed in chunks so they can be decrypted as a stream
+	mediaChunkSize = 64 * 1024
+)
+
+// mediaKeys holds the data keys used for media files on disk, or nil when
+// encryption at rest is disabled. It is set when the message store is opened.
+var mediaKeys *dataKeyring
+
+// dataKeyring holds the unwrapped data keys. New data is always encrypted with
+// the active key; older keys are only kept to decrypt existing data.
+type dataKeyring struct {
+	active uint32
+	aeads  map[uint32]cipher.AEAD
+	// Keys for naming media blobs, derived from each data key
+	blobKeys map[uint32][]byte
+}
+
+// Label for deriving the blob naming key from a data key
+const mediaBlobKeyLabel = "whatsapp-bridge media blob names"
+
+// Add an unwrapped data key to the keyring
+func (k *dataKeyring) add(id uint32, dataKey []byte) error {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, dataKey)
+	mac.Write([]byte(mediaBlobKeyLabel))
+
+	k.aeads[id] = aead
+	k.blobKeys[id] = mac.Sum(nil)
+	return nil
+}
+
+// Name the blob of content with the given SHA-256 under a data key. The name
+// is an HMAC of the hash, so it cannot be matched against known files without
+// the key.
+func (k *dataKeyring) blobName(id uint32, sum []byte) string {
+	mac := hmac.New(sha256.New, k.blobKeys[id])
+	mac.Write(sum)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Create an AES-256-GCM cipher from a 32-byte key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt with the active data key. The result is key ID | nonce | ciphertext.
+func (k *dataKeyring) seal(plaintext []byte) []byte {
+	aead := k.aeads[k.active]
+	out := make([]byte, 4+aead.NonceSize(), 4+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	binary.BigEndian.PutUint32(out, k.active)
+	if _, err := rand.Read(out[4:]); err != nil {
+		panic(fmt.Sprintf("failed to generate nonce: %v", err))
+	}
+	return aead.Seal(out, out[4:], plaintext, nil)
+}
+
+// Decrypt data produced by seal with any key in the keyring
+func (k *dataKeyring) open(data []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("encrypted value is truncated")
+	}
+	aead, ok := k.aeads[binary.BigEndian.Uint32(data)]
+	if !ok {
+		return nil, fmt.Errorf("encrypted with unknown data key %d", binary.BigEndian.Uint32(data))
+	}
+	if len(data) < 4+aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted value is truncated")
+	}
+	return aead.Open(nil, data[4:4+aead.NonceSize()], data[4+aead.NonceSize():], nil)
+}
+
+// Encrypt a text column value. Empty values are left empty.
+func (k *dataKeyring) encryptString(value string) string {
+	if k == nil || value == "" {
+		return value
+	}
+	return encryptedValuePrefix + base64.RawStdEncoding.EncodeToString(k.seal([]byte(value)))
+}
+
+// Decrypt a text column value, passing plaintext values through unchanged
+func (k *dataKeyring) decryptString(value string) (string, error) {
+	if k == nil || !strings.HasPrefix(value, encryptedValuePrefix) {
+		return value, nil
+	}
+	data, err := base64.RawStdEncoding.DecodeString(value[len(encryptedValuePrefix):])
+	if err != nil {
+		return "", fmt.Errorf("failed to decode encrypted value: %v", err)
+	}
+	plaintext, err := k.open(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// Encrypt a binary column value. Empty values are left empty.
+func (k *dataKeyring) encryptBytes(value []byte) []byte {
+	if k == nil || len(value) == 0 {
+		return value
+	}
+	return append([]byte(encryptedValuePrefix), k.seal(value)...)
+}
+
+// Decrypt a binary column value, passing plaintext values through unchanged
+func (k *dataKeyring) decryptBytes(value []byte) ([]byte, error) {
+	if k == nil || !bytes.HasPrefix(value, []byte(encryptedValuePrefix)) {
+		return value, nil
+	}
+	plaintext, err := k.open(value[len(encryptedValuePrefix):])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt value: %v", err)
+	}
+	return plaintext, nil
+}
+
+// Nonce of a media chunk: the file's random prefix followed by the chunk counter
+func mediaChunkNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, mediaNoncePrefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[mediaNoncePrefixSize:], counter)
+	return nonce
+}
+
+// Additional data of a media chunk, which marks the last chunk so that a
+// truncated file fails to decrypt instead of silently losing its tail
+func mediaChunkAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// mediaEncryptWriter encrypts a media file as it is written
+type mediaEncryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+// Start writing an encrypted media file to w with the active data key
+func newMediaEncryptWriter(w io.Writer, keys *dataKeyring) (io.WriteCloser, error) {
+	prefix := make([]byte, mediaNoncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	header := make([]byte, 0, encryptedMediaHeaderLen)
+	header = append(header, encryptedMediaMagic...)
+	header = binary.BigEndian.AppendUint32(header, keys.active)
+	header = append(header, prefix...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &mediaEncryptWriter{w: w, aead: keys.aeads[keys.active], prefix: prefix}, nil
+}
+
+func (e *mediaEncryptWriter) Write(p []byte) (int, error) {
+	e.buf = append(e.buf, p...)
+	// Hold back a full chunk until more data arrives, since the last chunk is sealed differently
+	for len(e.buf) > mediaChunkSize {
+		if err := e.writeChunk(e.buf[:mediaChunkSize], false); err != nil {
+			return 0, err
+		}
+		e.buf = e.buf[mediaChunkSize:]
+	}
+	return len(p), nil
+}
+
+// Close seals the final chunk. It does not close the underlying writer.
+func (e *mediaEncryptWriter) Close() error {
+	return e.writeChunk(e.buf, true)
+}
+
+func (e *mediaEncryptWriter) writeChunk(chunk []byte, final bool) error {
+	sealed := e.aead.Seal(nil, mediaChunkNonce(e.prefix, e.counter), chunk, mediaChunkAD(final))
+	e.counter++
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// mediaDecryptReader decrypts a media file as it is read
+type mediaDecryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	done    bool
+}
+
+func (d *mediaDecryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		sealed := make([]byte, mediaChunkSize+d.aead.Overhead())
+		n, err := io.ReadFull(d.r, sealed)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				return 0, fmt.Errorf("encrypted media file is truncated")
+			}
+			return 0, err
+		}
+
+		// The last chunk is the one followed by end of file
+		final := err == io.ErrUnexpectedEOF
+		if !final {
+			if _, peekErr := d.r.Peek(1); peekErr == io.EOF {
+				final = true
+			}
+		}
+
+		chunk, openErr := d.aead.Open(nil, mediaChunkNonce(d.prefix, d.counter), sealed[:n], mediaChunkAD(final))
+		if openErr != nil {
+			return 0, fmt.Errorf("failed to decrypt media file: %v", openErr)
+		}
+		d.counter++
+		d.buf = chunk
+		d.done = final
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// mediaFileReader pairs a decrypting reader with the file it reads from
+type mediaFileReader struct {
+	io.Reader
+	file *os.File
+}
+
+func (m *mediaFileReader) Close() error {
+	return m.file.Close()
+}
+
+// Get the cipher and nonce prefix of an encrypted media file from its header
+func mediaFileCipher(path string, header []byte) (cipher.AEAD, []byte, error) {
+	if mediaKeys == nil {
+		return nil, nil, fmt.Errorf("media file %s is encrypted but no encryption key is configured", path)
+	}
+
+	keyID := binary.BigEndian.Uint32(header[len(encryptedMediaMagic):])
+	aead, ok := mediaKeys.aeads[keyID]
+	if !ok {
+		return nil, nil, fmt.Errorf("media file %s is encrypted with unknown data key %d", path, keyID)
+	}
+	return aead, append([]byte(nil), header[len(encryptedMediaMagic)+4:encryptedMediaHeaderLen]...), nil
+}
+
+// Open a media file for reading, decrypting it if it was stored encrypted.
+// Plaintext files, such as ones saved before encryption was enabled, are read as is.
+// Blobs of the media store are checked against their content hash.
+func openMediaFile(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(file)
+	header, err := r.Peek(encryptedMediaHeaderLen)
+	if err != nil || string(header[:len(encryptedMediaMagic)]) != encryptedMediaMagic {
+		return verifyMediaBlob(path, &mediaFileReader{Reader: r, file: file}), nil
+	}
+
+	aead, prefix, err := mediaFileCipher(path, header)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	r.Discard(encryptedMediaHeaderLen)
+
+	return verifyMediaBlob(path, &mediaFileReader{
+		Reader: &mediaDecryptReader{r: r, aead: aead, prefix: prefix},
+		file:   file,
+	}), nil
+}
+
+// mediaFileSeeker gives random access to a media file. Encrypted files are
+// decrypted one chunk at a time, so any range can be read without going
+// through the chunks before it.
+type mediaFileSeeker struct {
+	file   *os.File
+	size   int64
+	offset int64
+
+	// Set for encrypted files
+	aead       cipher.AEAD
+	prefix     []byte
+	chunks     int64
+	chunkIndex int64
+	chunk      []byte
+}
+
+// Open a media file for random access, decrypting it if it was stored encrypted
+func openMediaFileSeeker(path string) (*mediaFileSeeker, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	header := make([]byte, encryptedMediaHeaderLen)
+	if n, _ := file.ReadAt(header, 0); n < encryptedMediaHeaderLen || string(header[:len(encryptedMediaMagic)]) != encryptedMediaMagic {
+		return &mediaFileSeeker{file: file, size: info.Size()}, nil
+	}
+
+	aead, prefix, err := mediaFileCipher(path, header)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// Every chunk is full except the last, which is always present
+	sealedSize := int64(mediaChunkSize + aead.Overhead())
+	body := info.Size() - int64(encryptedMediaHeaderLen)
+	chunks := (body + sealedSize - 1) / sealedSize
+	if chunks == 0 {
+		file.Close()
+		return nil, fmt.Errorf("encrypted media file %s is truncated", path)
+	}
+
+	return &mediaFileSeeker{
+		file:       file,
+		size:       body - chunks*int64(aead.Overhead()),
+		aead:       aead,
+		prefix:     prefix,
+		chunks:     chunks,
+		chunkIndex: -1,
+	}, nil
+}
+
+// Size of the media file's content
+func (m *mediaFileSeeker) Size() int64 {
+	return m.size
+}
+
+func (m *mediaFileSeeker) Read(p []byte) (int, error) {
+	if m.offset >= m.size {
+		return 0, io.EOF
+	}
+	if remaining := m.size - m.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	var n int
+	var err error
+	if m.aead == nil {
+		n, err = m.file.ReadAt(p, m.offset)
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+	} else {
+		n, err = m.readEncrypted(p)
+	}
+	m.offset += int64(n)
+	return n, err
+}
+
+// Read from the chunk holding the current offset, decrypting it if needed
+func (m *mediaFileSeeker) readEncrypted(p []byte) (int, error) {
+	index := m.offset / mediaChunkSize
+	if index != m.chunkIndex {
+		sealedSize := int64(mediaChunkSize + m.aead.Overhead())
+		sealed := make([]byte, sealedSize)
+		n, err := m.file.ReadAt(sealed, int64(encryptedMediaHeaderLen)+index*sealedSize)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+
+		chunk, err := m.aead.Open(nil, mediaChunkNonce(m.prefix, uint32(index)), sealed[:n], mediaChunkAD(index == m.chunks-1))
+		if err != nil {
+			return 0, fmt.Errorf("failed to decrypt media file: %v", err)
+		}
+		m.chunkIndex = index
+		m.chunk = chunk
+	}
+
+	start := m.offset - index*mediaChunkSize
+	if start >= int64(len(m.chunk)) {
+		return 0, fmt.Errorf("encrypted media file is truncated")
+	}
+	return copy(p, m.chunk[start:]), nil
+}
+
+func (m *mediaFileSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += m.offset
+	case io.SeekEnd:
+		offset += m.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	m.offset = offset
+	return offset, nil
+}
+
+func (m *mediaFileSeeker) Close() error {
+	return m.file.Close()
+}
+
+// Read a whole media file, decrypting it if needed
+func readMediaFile(path string) ([]byte, error) {
+	file, err := openMediaFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// Write a media file, encrypting it when encryption at rest is enabled
+func writeMediaFile(path string, data []byte) error {
+	if mediaKeys == nil {
+		return os.WriteFile(path, data, 0644)
+	}
+	return writeEncryptedMediaFile(path, data, mediaKeys)
+}
+
+// Write data to path encrypted with the active key of keys. The file is
+// written under a temporary name first so a failed write never leaves a
+// half-encrypted file behind.
+func writeEncryptedMediaFile(path string, data []byte, keys *dataKeyring) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".encrypting-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w, err := newMediaEncryptWriter(tmp, keys)
+	if err == nil {
+		_, err = w.Write(data)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Read a 32-byte base64 master key from an environment variable, or from the
+// file named by a second environment variable. Returns nil if neither is set.
+func loadMasterKey(keyEnv, fileEnv string) ([]byte, error) {
+	encoded := os.Getenv(keyEnv)
+	source := keyEnv
+	if encoded == "" {
+		path := os.Getenv(fileEnv)
+		if path == "" {
+			return nil, nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", fileEnv, err)
+		}
+		encoded = string(data)
+		source = fileEnv
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s must be a base64-encoded 32-byte key (generate one with: openssl rand -base64 32)", source)
+	}
+	return key, nil
+}
+
+// Short identifier of a master key, stored next to the data keys it wraps so
+// that a wrong key is reported clearly instead of as a decryption failure
+func masterKeyID(masterKey []byte) string {
+	sum := sha256.Sum256(masterKey)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Additional data binding a wrapped data key to its ID
+func dataKeyAD(id uint32) []byte {
+	return []byte(fmt.Sprintf("whatsapp-bridge data key %d", id))
+}
+
+// Encrypt a data key with the master key
+func wrapDataKey(masterKey, dataKey []byte, id uint32) (string, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, dataKey, dataKeyAD(id))), nil
+}
+
+// Decrypt a data key with the master key
+func unwrapDataKey(masterKey []byte, wrapped string, id uint32) ([]byte, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil || len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("data key %d is corrupt", id)
+	}
+	dataKey, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], dataKeyAD(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key %d: %v", id, err)
+	}
+	return dataKey, nil
+}
+
+// Generate a new data key, store it wrapped by the master key and make it the
+// active key. Older keys are marked retired but kept for decryption.
+func addDataKey(db *dialectDB, masterKey []byte) error {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return fmt.Errorf("failed to generate data key: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var maxID sql.NullInt64
+	if err := tx.QueryRow("SELECT MAX(id) FROM encryption_keys").Scan(&maxID); err != nil {
+		return err
+	}
+	id := uint32(maxID.Int64) + 1
+
+	wrapped, err := wrapDataKey(masterKey, dataKey, id)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if _, err := tx.Exec("UPDATE encryption_keys SET retired_at = ? WHERE retired_at IS NULL", now); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO encryption_keys (id, wrapped_key, master_key_id, created_at) VALUES (?, ?, ?, ?)",
+		id, wrapped, masterKeyID(masterKey), now,
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Load and unwrap the data keys. Returns nil when encryption at rest is not
+// enabled. The first start with a master key creates the initial data key.
+func loadDataKeyring(db *dialectDB, masterKey []byte) (*dataKeyring, error) {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM encryption_keys").Scan(&count); err != nil {
+		return nil, fmt.Errorf("failed to read encryption keys: %v", err)
+	}
+
+	if masterKey == nil {
+		if count > 0 {
+			return nil, fmt.Errorf("message database is encrypted: set ENCRYPTION_KEY or ENCRYPTION_KEY_FILE")
+		}
+		return nil, nil
+	}
+
+	if count == 0 {
+		if err := addDataKey(db, masterKey); err != nil {
+			// Another replica may have created the key at the same time
+			if db.QueryRow("SELECT COUNT(*) FROM encryption_keys").Scan(&count); count == 0 {
+				return nil, fmt.Errorf("failed to create data key: %v", err)
+			}
+		}
+	}
+
+	rows, err := db.Query("SELECT id, wrapped_key, master_key_id, retired_at FROM encryption_keys ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption keys: %v", err)
+	}
+	defer rows.Close()
+
+	keys := &dataKeyring{aeads: make(map[uint32]cipher.AEAD), blobKeys: make(map[uint32][]byte)}
+	for rows.Next() {
+		var id int64
+		var wrapped, keyID string
+		var retiredAt sql.NullTime
+		if err := rows.Scan(&id, &wrapped, &keyID, &retiredAt); err != nil {
+			return nil, err
+		}
+
+		if keyID != masterKeyID(masterKey) {
+			return nil, fmt.Errorf("data key %d is wrapped by master key %s, but the configured key is %s", id, keyID, masterKeyID(masterKey))
+		}
+
+		dataKey, err := unwrapDataKey(masterKey, wrapped, uint32(id))
+		if err != nil {
+			return nil, err
+		}
+		if err := keys.add(uint32(id), dataKey); err != nil {
+			return nil, err
+		}
+		if !retiredAt.Valid {
+			keys.active = uint32(id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, ok := keys.aeads[keys.active]; !ok {
+		return nil, fmt.Errorf("no active data key found")
+	}
+	return keys, nil
+}
+
+// Open the message database and unwrap its data keys for the maintenance commands
+func openEncryptedMessageDB() (*dialectDB, []byte, *dataKeyring, error) {
+	masterKey, err := loadMasterKey("ENCRYPTION_KEY", "ENCRYPTION_KEY_FILE")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if masterKey == nil {
+		return nil, nil, nil, fmt.Errorf("set ENCRYPTION_KEY or ENCRYPTION_KEY_FILE to the current master key")
+	}
+
+	db, err := openMessageDB()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if _, err := runMigrations(db, false); err != nil {
+		db.Close()
+		return nil, nil, nil, err
+	}
+
+	keys, err := loadDataKeyring(db, masterKey)
+	if err != nil {
+		db.Close()
+		return nil, nil, nil, err
+	}
+	return db, masterKey, keys, nil
+}
+
+// Rewrap every data key with a new master key. The encrypted data itself is
+// untouched, so this is quick and safe to run while the bridge is running.
+func RotateMasterKey() (int, error) {
+	newMasterKey, err := loadMasterKey("ENCRYPTION_NEW_KEY", "ENCRYPTION_NEW_KEY_FILE")
+	if err != nil {
+		return 0, err
+	}
+	if newMasterKey == nil {
+		return 0, fmt.Errorf("set ENCRYPTION_NEW_KEY or ENCRYPTION_NEW_KEY_FILE to the new master key")
+	}
+
+	db, masterKey, _, err := openEncryptedMessageDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, wrapped_key FROM encryption_keys")
+	if err != nil {
+		return 0, err
+	}
+	rewrapped := make(map[uint32]string)
+	for rows.Next() {
+		var id int64
+		var wrapped string
+		if err := rows.Scan(&id, &wrapped); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		dataKey, err := unwrapDataKey(masterKey, wrapped, uint32(id))
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if rewrapped[uint32(id)], err = wrapDataKey(newMasterKey, dataKey, uint32(id)); err != nil {
+			rows.Close()
+			return 0, err
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for id, wrapped := range rewrapped {
+		if _, err := tx.Exec(
+			"UPDATE encryption_keys SET wrapped_key = ?, master_key_id = ? WHERE id = ?",
+			wrapped, masterKeyID(newMasterKey), id,
+		); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(rewrapped), tx.Commit()
+}
+
+// Re-encrypt one column value with the active key, whatever key (if any) it was encrypted with
+func reencryptString(keys *dataKeyring, value sql.NullString) (interface{}, error) {
+	if !value.Valid {
+		return nil, nil
+	}
+	plaintext, err := keys.decryptString(value.String)
+	if err != nil {
+		return nil, err
+	}
+	return keys.encryptString(plaintext), nil
+}
+
+func reencryptBytes(keys *dataKeyring, value []byte) ([]byte, error) {
+	plaintext, err := keys.decryptBytes(value)
+	if err != nil {
+		return nil, err
+	}
+	return keys.encryptBytes(plaintext), nil
+}
+
+// Number of rows re-encrypted per transaction
+const reencryptBatchSize = 500
+
+// Re-encrypt all message columns with the active data key, in batches
+func reencryptMessages(db *dialectDB, keys *dataKeyring) (int, error) {
+	total := 0
+	lastChat, lastID := "", ""
+	for {
+		rows, err := db.Query(
+			`SELECT id, chat_jid, content, quoted_message, url, structured_data, direct_path, media_key, file_sha256, file_enc_sha256 FROM messages
+			WHERE chat_jid > ? OR (chat_jid = ? AND id > ?)
+			ORDER BY chat_jid, id LIMIT ?`,
+			lastChat, lastChat, lastID, reencryptBatchSize,
+		)
+		if err != nil {
+			return total, err
+		}
+
+		type messageRow struct {
+			id, chatJID                                             string
+			content, quotedMessage, url, structuredData, directPath sql.NullString
+			mediaKey, fileSHA256, fileEncSHA256                     []byte
+		}
+		var batch []messageRow
+		for rows.Next() {
+			var m messageRow
+			if err := rows.Scan(&m.id, &m.chatJID, &m.content, &m.quotedMessage, &m.url, &m.structuredData, &m.directPath, &m.mediaKey, &m.fileSHA256, &m.fileEncSHA256); err != nil {
+				rows.Close()
+				return total, err
+			}
+			batch = append(batch, m)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return total, err
+		}
+		if len(batch) == 0 {
+			return total, nil
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return total, err
+		}
+		for _, m := range batch {
+			var values [8]interface{}
+			for i, s := range []sql.NullString{m.content, m.quotedMessage, m.url, m.structuredData, m.directPath} {
+				if values[i], err = reencryptString(keys, s); err != nil {
+					tx.Rollback()
+					return total, fmt.Errorf("message %s in %s: %v", m.id, m.chatJID, err)
+				}
+			}
+			for i, b := range [][]byte{m.mediaKey, m.fileSHA256, m.fileEncSHA256} {
+				if values[5+i], err = reencryptBytes(keys, b); err != nil {
+					tx.Rollback()
+					return total, fmt.Errorf("message %s in %s: %v", m.id, m.chatJID, err)
+				}
+			}
+
+			if _, err := tx.Exec(
+				`UPDATE messages SET content = ?, quoted_message = ?, url = ?, structured_data = ?, direct_path = ?, media_key = ?, file_sha256 = ?, file_enc_sha256 = ?
+				WHERE id = ? AND chat_jid = ?`,
+				values[0], values[1], values[2], values[3], values[4], values[5], values[6], values[7], m.id, m.chatJID,
+			); err != nil {
+				tx.Rollback()
+				return total, err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return total, err
+		}
+
+		total += len(batch)
+		lastChat, lastID = batch[len(batch)-1].chatJID, batch[len(batch)-1].id
+	}
+}
+
+// encryptedTable is a table outside of messages with encrypted text columns,
+// which the re-encrypt pass seals again with the active data key
+type encryptedTable struct {
+	name string
+	// Columns identifying a row
+	keys []string
+	// Encrypted text columns
+	columns []string
+}
+
+// encryptedTables lists every table besides messages that holds encrypted
+// customer data. Tables adding encrypted columns must be registered here, or
+// --reencrypt leaves them under old keys or in plaintext.
+var encryptedTables = []encryptedTable{
+	{name: "chats", keys: []string{"jid"}, columns: []string{"name"}},
+	{name: "message_revisions", keys: []string{"message_id", "chat_jid", "revision"}, columns: []string{"content"}},
+	{name: "contacts", keys: []string{"jid"}, columns: []string{"full_name", "first_name", "push_name", "business_name"}},
+	{name: "groups", keys: []string{"jid"}, columns: []string{"subject", "description"}},
+	{name: "reactions", keys: []string{"chat_jid", "message_id", "sender"}, columns: []string{"emoji"}},
+	{name: "polls", keys: []string{"chat_jid", "message_id"}, columns: []string{"question"}},
+	{name: "poll_options", keys: []string{"chat_jid", "poll_id", "option_index"}, columns: []string{"name"}},
+	{name: "poll_votes", keys: []string{"chat_jid", "poll_id", "voter"}, columns: []string{"selected"}},
+}
+
+// Re-encrypt the encrypted columns of a table with the active data key
+func reencryptTable(db *dialectDB, keys *dataKeyring, table encryptedTable) (int, error) {
+	rows, err := db.Query("SELECT " + strings.Join(append(append([]string{}, table.keys...), table.columns...), ", ") + " FROM " + table.name)
+	if err != nil {
+		return 0, err
+	}
+
+	// Keys are read as text, which also matches integer key columns
+	var batch [][]sql.NullString
+	for rows.Next() {
+		row := make([]sql.NullString, len(table.keys)+len(table.columns))
+		dest := make([]interface{}, len(row))
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	set := make([]string, len(table.columns))
+	for i, column := range table.columns {
+		set[i] = column + " = ?"
+	}
+	where := make([]string, len(table.keys))
+	for i, key := range table.keys {
+		where[i] = key + " = ?"
+	}
+	update := "UPDATE " + table.name + " SET " + strings.Join(set, ", ") + " WHERE " + strings.Join(where, " AND ")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, row := range batch {
+		args := make([]interface{}, 0, len(row))
+		for _, value := range row[len(table.keys):] {
+			sealed, err := reencryptString(keys, value)
+			if err != nil {
+				return 0, fmt.Errorf("%s row %v: %v", table.name, row[:len(table.keys)], err)
+			}
+			args = append(args, sealed)
+		}
+		for _, key := range row[:len(table.keys)] {
+			args = append(args, key.String)
+		}
+		if _, err := tx.Exec(update, args...); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(batch), tx.Commit()
+}
+
+// Re-encrypt every downloaded media file with the active data key. Blobs of
+// the media store are renamed to their name under the active key.
+func reencryptMediaFiles(db *dialectDB, keys *dataKeyring) (int, error) {
+	// openMediaFile decrypts with the global keyring
+	mediaKeys = keys
+
+	count := 0
+	renamed := make(map[string]bool)
+	err := filepath.WalkDir(mediaRootDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == "temp_media" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Files directly in the store directory are databases, not media
+		if filepath.Dir(path) == mediaRootDir || renamed[path] {
+			return nil
+		}
+
+		data, err := readMediaFile(path)
+		if err != nil {
+			return err
+		}
+
+		name, ok := isMediaBlobPath(path)
+		if ok {
+			sum := sha256.Sum256(data)
+			if target := mediaBlobName(sum[:]); target != name {
+				if err := moveMediaBlob(db, keys, name, target, data); err != nil {
+					return fmt.Errorf("failed to rename %s: %v", path, err)
+				}
+				renamed[mediaBlobPath(target)] = true
+				count++
+				return nil
+			}
+		}
+
+		if err := writeEncryptedMediaFile(path, data, keys); err != nil {
+			return fmt.Errorf("failed to encrypt %s: %v", path, err)
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// Move a blob to a new name, writing it encrypted under the new name before
+// its references are moved and the old file is removed
+func moveMediaBlob(db *dialectDB, keys *dataKeyring, from, to string, data []byte) error {
+	path := mediaBlobPath(to)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := writeEncryptedMediaFile(path, data, keys); err != nil {
+		return err
+	}
+	if err := renameMediaBlob(db, from, to); err != nil {
+		return err
+	}
+	if err := os.Remove(mediaBlobPath(from)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Re-encrypt all stored data under a fresh data key, then drop the old keys.
+// This also encrypts data stored before encryption was enabled. All bridges
+// using the database must be stopped while it runs.
+func ReencryptMessageStore(logger waLog.Logger) error {
+	db, masterKey, _, err := openEncryptedMessageDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := addDataKey(db, masterKey); err != nil {
+		return fmt.Errorf("failed to create data key: %v", err)
+	}
+	keys, err := loadDataKeyring(db, masterKey)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Re-encrypting with data key %d", keys.active)
+
+	messages, err := reencryptMessages(db, keys)
+	if err != nil {
+		return fmt.Errorf("failed to re-encrypt messages: %v", err)
+	}
+	logger.Infof("Re-encrypted %d messages", messages)
+
+	for _, table := range encryptedTables {
+		count, err := reencryptTable(db, keys, table)
+		if err != nil {
+			return fmt.Errorf("failed to re-encrypt %s: %v", table.name, err)
+		}
+		logger.Infof("Re-encrypted %d rows of %s", count, table.name)
+	}
+
+	files, err := reencryptMediaFiles(db, keys)
+	if err != nil {
+		return fmt.Errorf("failed to re-encrypt media files: %v", err)
+	}
+	logger.Infof("Re-encrypted %d media files", files)
+
+	// The full-text index would otherwise keep a plaintext copy of messages
+	if db.dialect == sqliteDialect {
+		if err := clearSearchIndex(db); err != nil {
+			return err
+		}
+	}
+
+	if _, err := db.Exec("DELETE FROM encryption_keys WHERE id <> ?", keys.active); err != nil {
+		return fmt.Errorf("failed to drop old data keys: %v", err)
+	}
+
+	// Reclaim the pages that held the old plaintext and ciphertext
+	if _, err := db.Exec("VACUUM"); err != nil {
+		logger.Warnf("Failed to vacuum message database: %v", err)
+	}
+
+	return nil
+}
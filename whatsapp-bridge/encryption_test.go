@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Build a keyring of random data keys with the given IDs. The last one is active.
+func newTestKeyring(t *testing.T, ids ...uint32) *dataKeyring {
+	t.Helper()
+	keys := &dataKeyring{aeads: make(map[uint32]cipher.AEAD), blobKeys: make(map[uint32][]byte)}
+	for _, id := range ids {
+		key := make([]byte, 32)
+		rand.Read(key)
+		if err := keys.add(id, key); err != nil {
+			t.Fatal(err)
+		}
+		keys.active = id
+	}
+	return keys
+}
+
+// Use keys for media files for the rest of the test
+func setMediaKeys(t *testing.T, keys *dataKeyring) {
+	t.Helper()
+	old := mediaKeys
+	mediaKeys = keys
+	t.Cleanup(func() { mediaKeys = old })
+}
+
+func TestEncryptString(t *testing.T) {
+	keys := newTestKeyring(t, 1)
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"empty", ""},
+		{"text", "hello world"},
+		{"unicode", "grüße 👋 你好"},
+		{"looks encrypted", encryptedValuePrefix + "not really"},
+		{"long", strings.Repeat("x", 100000)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed := keys.encryptString(tt.value)
+			if tt.value == "" {
+				if sealed != "" {
+					t.Errorf("empty value was encrypted to %q", sealed)
+				}
+				return
+			}
+			if !strings.HasPrefix(sealed, encryptedValuePrefix) || strings.Contains(sealed, tt.value) {
+				t.Errorf("encryptString(%q) = %q is not sealed", tt.value, sealed)
+			}
+			if again := keys.encryptString(tt.value); again == sealed {
+				t.Error("encrypting twice gave the same ciphertext")
+			}
+			got, err := keys.decryptString(sealed)
+			if err != nil || got != tt.value {
+				t.Errorf("decryptString = %q, %v, want %q", got, err, tt.value)
+			}
+		})
+	}
+}
+
+func TestDecryptStringPassthrough(t *testing.T) {
+	keys := newTestKeyring(t, 1)
+	tests := []struct {
+		name  string
+		keys  *dataKeyring
+		value string
+	}{
+		{"plaintext with keys", keys, "written before encryption"},
+		{"empty with keys", keys, ""},
+		{"plaintext without keys", nil, "hello"},
+		{"ciphertext without keys", nil, keys.encryptString("secret")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.keys.decryptString(tt.value)
+			if err != nil || got != tt.value {
+				t.Errorf("decryptString(%q) = %q, %v, want it unchanged", tt.value, got, err)
+			}
+		})
+	}
+
+	var none *dataKeyring
+	if got := none.encryptString("hello"); got != "hello" {
+		t.Errorf("encryptString without keys = %q, want plaintext", got)
+	}
+}
+
+func TestDecryptStringErrors(t *testing.T) {
+	keys := newTestKeyring(t, 1)
+	sealed := keys.encryptString("secret")
+	tests := []struct {
+		name  string
+		keys  *dataKeyring
+		value string
+	}{
+		{"wrong key with the same id", newTestKeyring(t, 1), sealed},
+		{"unknown key id", newTestKeyring(t, 2), sealed},
+		{"not base64", keys, encryptedValuePrefix + "!!!"},
+		{"truncated", keys, sealed[:len(encryptedValuePrefix)+8]},
+		{"tampered", keys, sealed[:len(sealed)-2] + strings.Map(func(r rune) rune {
+			if r == 'A' {
+				return 'B'
+			}
+			return 'A'
+		}, sealed[len(sealed)-2:])},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := tt.keys.decryptString(tt.value); err == nil {
+				t.Errorf("decryptString = %q, want an error", got)
+			}
+		})
+	}
+}
+
+func TestKeyringKeepsOldKeys(t *testing.T) {
+	keys := newTestKeyring(t, 1)
+	old := keys.encryptString("old")
+	oldBytes := keys.encryptBytes([]byte{1, 2, 3})
+
+	// A new active key, as added by --reencrypt
+	newer := newTestKeyring(t, 2)
+	keys.aeads[2] = newer.aeads[2]
+	keys.active = 2
+
+	if got, err := keys.decryptString(old); err != nil || got != "old" {
+		t.Errorf("decrypt with retired key = %q, %v", got, err)
+	}
+	if got, err := keys.decryptBytes(oldBytes); err != nil || !bytes.Equal(got, []byte{1, 2, 3}) {
+		t.Errorf("decryptBytes with retired key = %v, %v", got, err)
+	}
+
+	// New values use the active key only
+	delete(keys.aeads, 1)
+	if _, err := keys.decryptString(keys.encryptString("new")); err != nil {
+		t.Errorf("new value needs the retired key: %v", err)
+	}
+}
+
+func TestEncryptBytes(t *testing.T) {
+	keys := newTestKeyring(t, 1)
+	tests := []struct {
+		name  string
+		value []byte
+	}{
+		{"nil", nil},
+		{"one byte", []byte{0}},
+		{"media key", bytes.Repeat([]byte{0xab}, 32)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed := keys.encryptBytes(tt.value)
+			if len(tt.value) > 0 && !bytes.HasPrefix(sealed, []byte(encryptedValuePrefix)) {
+				t.Errorf("encryptBytes(%v) = %v is not sealed", tt.value, sealed)
+			}
+			got, err := keys.decryptBytes(sealed)
+			if err != nil || !bytes.Equal(got, tt.value) {
+				t.Errorf("decryptBytes = %v, %v, want %v", got, err, tt.value)
+			}
+		})
+	}
+
+	if _, err := newTestKeyring(t, 1).decryptBytes(keys.encryptBytes([]byte("secret"))); err == nil {
+		t.Error("decryptBytes with the wrong key succeeded")
+	}
+}
+
+func TestMediaFileRoundTrip(t *testing.T) {
+	setMediaKeys(t, newTestKeyring(t, 1))
+	dir := t.TempDir()
+
+	sizes := []int{0, 1, mediaChunkSize - 1, mediaChunkSize, mediaChunkSize + 1, 3*mediaChunkSize + 17}
+	for _, size := range sizes {
+		data := make([]byte, size)
+		rand.Read(data)
+		path := filepath.Join(dir, "media.bin")
+		if err := writeMediaFile(path, data); err != nil {
+			t.Fatalf("size %d: writeMediaFile: %v", size, err)
+		}
+
+		raw, _ := os.ReadFile(path)
+		if !bytes.HasPrefix(raw, []byte(encryptedMediaMagic)) {
+			t.Errorf("size %d: file has no %s header", size, encryptedMediaMagic)
+		}
+		if size > 16 && bytes.Contains(raw, data[:16]) {
+			t.Errorf("size %d: file contains plaintext", size)
+		}
+
+		got, err := readMediaFile(path)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("size %d: readMediaFile returned %d bytes, %v", size, len(got), err)
+		}
+
+		// Random access, across chunk boundaries
+		seeker, err := openMediaFileSeeker(path)
+		if err != nil {
+			t.Fatalf("size %d: openMediaFileSeeker: %v", size, err)
+		}
+		if seeker.Size() != int64(size) {
+			t.Errorf("size %d: seeker size = %d", size, seeker.Size())
+		}
+		for _, offset := range []int{0, size / 2, size - 1, mediaChunkSize - 3} {
+			if offset < 0 || offset >= size {
+				continue
+			}
+			seeker.Seek(int64(offset), io.SeekStart)
+			part, err := io.ReadAll(io.LimitReader(seeker, 10))
+			want := data[offset:min(offset+10, size)]
+			if err != nil || !bytes.Equal(part, want) {
+				t.Errorf("size %d: read at %d = %v, %v, want %v", size, offset, part, err, want)
+			}
+		}
+		seeker.Close()
+	}
+}
+
+func TestMediaFilePlaintext(t *testing.T) {
+	setMediaKeys(t, newTestKeyring(t, 1))
+	path := filepath.Join(t.TempDir(), "old.jpg")
+	os.WriteFile(path, []byte("stored before encryption"), 0644)
+
+	got, err := readMediaFile(path)
+	if err != nil || string(got) != "stored before encryption" {
+		t.Errorf("readMediaFile of a plaintext file = %q, %v", got, err)
+	}
+}
+
+func TestMediaFileErrors(t *testing.T) {
+	keys := newTestKeyring(t, 1)
+	data := make([]byte, 2*mediaChunkSize+100)
+	rand.Read(data)
+
+	tests := []struct {
+		name     string
+		readKeys *dataKeyring
+		damage   func(raw []byte) []byte
+	}{
+		{"wrong key", newTestKeyring(t, 1), nil},
+		{"unknown key id", newTestKeyring(t, 2), nil},
+		{"no key configured", nil, nil},
+		{"last chunk dropped", keys, func(raw []byte) []byte {
+			return raw[:encryptedMediaHeaderLen+2*(mediaChunkSize+16)]
+		}},
+		{"cut inside a chunk", keys, func(raw []byte) []byte { return raw[:len(raw)-50] }},
+		{"flipped byte", keys, func(raw []byte) []byte {
+			raw[encryptedMediaHeaderLen+10] ^= 1
+			return raw
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "media.bin")
+			if err := writeEncryptedMediaFile(path, data, keys); err != nil {
+				t.Fatal(err)
+			}
+			if tt.damage != nil {
+				raw, _ := os.ReadFile(path)
+				os.WriteFile(path, tt.damage(raw), 0644)
+			}
+
+			setMediaKeys(t, tt.readKeys)
+			if got, err := readMediaFile(path); err == nil {
+				t.Errorf("readMediaFile returned %d bytes, want an error", len(got))
+			}
+		})
+	}
+}
+
+func TestLoadMasterKey(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	encoded := base64.StdEncoding.EncodeToString(key)
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	os.WriteFile(keyFile, []byte(encoded+"\n"), 0600)
+
+	tests := []struct {
+		name    string
+		env     string
+		file    string
+		want    []byte
+		wantErr bool
+	}{
+		{"unset", "", "", nil, false},
+		{"from env", encoded, "", key, false},
+		{"from file", "", keyFile, key, false},
+		{"env wins over file", encoded, "/does/not/exist", key, false},
+		{"missing file", "", "/does/not/exist", nil, true},
+		{"not base64", "not a key", "", nil, true},
+		{"too short", base64.StdEncoding.EncodeToString(key[:16]), "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_MASTER_KEY", tt.env)
+			t.Setenv("TEST_MASTER_KEY_FILE", tt.file)
+			got, err := loadMasterKey("TEST_MASTER_KEY", "TEST_MASTER_KEY_FILE")
+			if (err != nil) != tt.wantErr || !bytes.Equal(got, tt.want) {
+				t.Errorf("loadMasterKey = %v, %v, want %v (error %v)", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDataKeyWrapping(t *testing.T) {
+	master := make([]byte, 32)
+	other := make([]byte, 32)
+	dataKey := make([]byte, 32)
+	rand.Read(master)
+	rand.Read(other)
+	rand.Read(dataKey)
+
+	wrapped, err := wrapDataKey(master, dataKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := unwrapDataKey(master, wrapped, 1); err != nil || !bytes.Equal(got, dataKey) {
+		t.Errorf("unwrapDataKey = %v, %v", got, err)
+	}
+	if _, err := unwrapDataKey(other, wrapped, 1); err == nil {
+		t.Error("unwrapping with the wrong master key succeeded")
+	}
+	if _, err := unwrapDataKey(master, wrapped, 2); err == nil {
+		t.Error("unwrapping under another key ID succeeded")
+	}
+}
+
+func TestLoadDataKeyring(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := runMigrations(db, false); err != nil {
+		t.Fatal(err)
+	}
+	master := make([]byte, 32)
+	other := make([]byte, 32)
+	rand.Read(master)
+	rand.Read(other)
+
+	if keys, err := loadDataKeyring(db, nil); err != nil || keys != nil {
+		t.Fatalf("without a master key = %v, %v, want encryption disabled", keys, err)
+	}
+
+	keys, err := loadDataKeyring(db, master)
+	if err != nil || keys == nil {
+		t.Fatalf("first start with a master key = %v, %v", keys, err)
+	}
+	sealed := keys.encryptString("secret")
+
+	again, err := loadDataKeyring(db, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := again.decryptString(sealed); err != nil || got != "secret" {
+		t.Errorf("decrypt after restart = %q, %v", got, err)
+	}
+
+	if _, err := loadDataKeyring(db, other); err == nil || !strings.Contains(err.Error(), "master key") {
+		t.Errorf("wrong master key = %v, want a master key error", err)
+	}
+	if _, err := loadDataKeyring(db, nil); err == nil {
+		t.Error("encrypted database opened without a master key")
+	}
+}
+
+func TestReencryptTables(t *testing.T) {
+	store := newTestStore(t)
+	now := time.Now()
+
+	// Plaintext rows in every table with encrypted columns
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(store.StoreChat("c@s.whatsapp.net", "Chat", now))
+	must(store.StoreMessage("m1", "c@s.whatsapp.net", "c", "first", now, false, "", "", "", nil, nil, nil, 0, ""))
+	must(store.UpdateEditedMessage("m1", "c@s.whatsapp.net", "second", now))
+	must(store.StoreContact(Contact{JID: "c@s.whatsapp.net", PhoneNumber: "c", FullName: "Alice", PushName: "ali"}))
+	must(store.StoreGroup(Group{JID: "g@g.us", Subject: "Team", Description: "Plans"}))
+	must(store.StoreReaction("m1", "c@s.whatsapp.net", Reaction{Sender: "c", Emoji: "👍", Time: now}))
+	must(store.StorePoll(Poll{ID: "p1", ChatJID: "g@g.us", Creator: "c", Question: "Lunch?", Options: []PollOption{{Name: "Pizza"}, {Name: "Sushi"}}}))
+	must(store.StorePollVote("p1", "g@g.us", PollVote{Voter: "c", Selected: []string{pollOptionHash("Sushi")}, Time: now}))
+
+	keys := newTestKeyring(t, 1)
+	for _, table := range encryptedTables {
+		count, err := reencryptTable(store.db, keys, table)
+		if err != nil || count == 0 {
+			t.Errorf("reencryptTable(%s) = %d, %v, want rows re-encrypted", table.name, count, err)
+		}
+
+		// No registered column keeps a plaintext value
+		for _, column := range table.columns {
+			rows, err := store.db.Query("SELECT " + column + " FROM " + table.name)
+			must(err)
+			for rows.Next() {
+				var value *string
+				must(rows.Scan(&value))
+				if value != nil && *value != "" && !strings.HasPrefix(*value, encryptedValuePrefix) {
+					t.Errorf("%s.%s is still plaintext: %q", table.name, column, *value)
+				}
+			}
+			rows.Close()
+		}
+	}
+
+	// Everything reads back as before
+	store.keys = keys
+	if name, err := store.GetStoredChatName("c@s.whatsapp.net"); err != nil || name != "Chat" {
+		t.Errorf("GetStoredChatName = %q, %v", name, err)
+	}
+	if revisions, err := store.GetMessageRevisions("m1", "c@s.whatsapp.net"); err != nil || len(revisions) == 0 || revisions[0].Content != "first" {
+		t.Errorf("GetMessageRevisions = %+v, %v", revisions, err)
+	}
+	if contact, err := store.GetContact("c@s.whatsapp.net"); err != nil || contact.FullName != "Alice" || contact.PushName != "ali" {
+		t.Errorf("GetContact = %+v, %v", contact, err)
+	}
+	if group, err := store.GetGroup("g@g.us"); err != nil || group.Subject != "Team" || group.Description != "Plans" {
+		t.Errorf("GetGroup = %+v, %v", group, err)
+	}
+	if reactions, err := store.GetReactions("c@s.whatsapp.net", []string{"m1"}); err != nil || len(reactions["m1"]) != 1 || reactions["m1"][0].Emoji != "👍" {
+		t.Errorf("GetReactions = %+v, %v", reactions, err)
+	}
+	poll, err := store.GetPoll("p1", "g@g.us")
+	if err != nil || poll.Question != "Lunch?" || len(poll.Options) != 2 || poll.Options[1].Name != "Sushi" || poll.Options[1].Votes != 1 {
+		t.Errorf("GetPoll = %+v, %v", poll, err)
+	}
+}
+
+func TestMediaBlobNames(t *testing.T) {
+	t.Chdir(t.TempDir())
+	data := []byte("photo")
+	sum := sha256.Sum256(data)
+	plain := hex.EncodeToString(sum[:])
+
+	readBlob := func(name string) error {
+		content, err := openStoredMedia(mediaBlobPath(name))
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+		got, err := io.ReadAll(content)
+		if err == nil && !bytes.Equal(got, data) {
+			err = fmt.Errorf("read %q", got)
+		}
+		return err
+	}
+
+	name, _, err := writeMediaBlob(data)
+	if err != nil || name != plain {
+		t.Fatalf("writeMediaBlob without encryption = %q, %v, want %q", name, err, plain)
+	}
+
+	// Encrypted blobs are named by an HMAC, not the plaintext hash
+	keys := newTestKeyring(t, 1)
+	setMediaKeys(t, keys)
+	hidden, _, err := writeMediaBlob(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hidden == plain || mediaBlobName(sum[:]) != hidden {
+		t.Errorf("encrypted blob name = %q, want an HMAC of %q", hidden, plain)
+	}
+	if _, ok := isMediaBlobPath(mediaBlobPath(hidden)); !ok {
+		t.Errorf("isMediaBlobPath(%q) = false", hidden)
+	}
+
+	// Blobs named under a retired key or before encryption still verify
+	newer := newTestKeyring(t, 2)
+	keys.aeads[2], keys.blobKeys[2], keys.active = newer.aeads[2], newer.blobKeys[2], 2
+	if mediaBlobName(sum[:]) == hidden {
+		t.Error("blob name did not change with the active key")
+	}
+	for _, name := range []string{plain, hidden} {
+		if err := readBlob(name); err != nil {
+			t.Errorf("read blob %s: %v", name, err)
+		}
+	}
+
+	// A blob whose content does not match its name is rejected
+	other := strings.Repeat("ab", sha256.Size)
+	os.MkdirAll(filepath.Dir(mediaBlobPath(other)), 0755)
+	if err := writeMediaFile(mediaBlobPath(other), data); err != nil {
+		t.Fatal(err)
+	}
+	if err := readBlob(other); err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Errorf("read mismatched blob = %v, want corrupt", err)
+	}
+}
+
+func TestReencryptMediaBlobs(t *testing.T) {
+	t.Chdir(t.TempDir())
+	store := newTestStore(t)
+	chat := "4915112345678@s.whatsapp.net"
+	data := []byte("photo")
+
+	// A blob from before encryption was enabled, shared by two messages
+	plain, _, err := writeMediaBlob(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"m1", "m2"} {
+		if err := store.StoreMediaRef(id, chat, plain, int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys := newTestKeyring(t, 1)
+	setMediaKeys(t, keys)
+	count, err := reencryptMediaFiles(store.db, keys)
+	if err != nil || count != 1 {
+		t.Fatalf("reencryptMediaFiles = %d, %v, want 1", count, err)
+	}
+
+	sum := sha256.Sum256(data)
+	hidden := keys.blobName(keys.active, sum[:])
+	for _, id := range []string{"m1", "m2"} {
+		if ref, err := store.GetMediaRef(id, chat); err != nil || ref != hidden {
+			t.Errorf("media ref of %s = %q, %v, want %q", id, ref, err, hidden)
+		}
+	}
+	if _, err := os.Stat(mediaBlobPath(plain)); !os.IsNotExist(err) {
+		t.Errorf("blob under the plaintext hash is still there: %v", err)
+	}
+	raw, err := os.ReadFile(mediaBlobPath(hidden))
+	if err != nil || !bytes.HasPrefix(raw, []byte(encryptedMediaMagic)) {
+		t.Errorf("renamed blob is not encrypted: %v", err)
+	}
+	if got, err := readMediaFile(mediaBlobPath(hidden)); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("renamed blob = %q, %v, want %q", got, err, data)
+	}
+
+	var blobs int
+	if err := store.db.QueryRow("SELECT COUNT(*) FROM media_blobs WHERE sha256 = ?", hidden).Scan(&blobs); err != nil || blobs != 1 {
+		t.Errorf("media_blobs rows under the new name = %d, %v, want 1", blobs, err)
+	}
+	if err := store.db.QueryRow("SELECT COUNT(*) FROM media_blobs WHERE sha256 = ?", plain).Scan(&blobs); err != nil || blobs != 0 {
+		t.Errorf("media_blobs rows under the old name = %d, %v, want 0", blobs, err)
+	}
+}
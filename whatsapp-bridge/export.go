@@ -0,0 +1,567 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// Chat export formats
+const (
+	exportFormatJSONL = "jsonl"
+	exportFormatTXT   = "txt"
+	exportFormatHTML  = "html"
+	exportFormatZip   = "zip"
+)
+
+// Content type and file extension of each export format
+var exportFormats = map[string]struct {
+	contentType string
+	extension   string
+}{
+	exportFormatJSONL: {"application/x-ndjson", ".jsonl"},
+	exportFormatTXT:   {"text/plain; charset=utf-8", ".txt"},
+	exportFormatHTML:  {"text/html; charset=utf-8", ".html"},
+	exportFormatZip:   {"application/zip", ".zip"},
+}
+
+// Number of messages read from the store at a time while exporting
+const exportPageSize = 500
+
+// Timestamp layout of WhatsApp's own "Export chat" text files
+const whatsAppExportTimeLayout = "02/01/2006, 15:04"
+
+// ChatExportOptions selects the chat, format and date range of an export
+type ChatExportOptions struct {
+	ChatJID string
+	Format  string
+	// Only messages at or after From and at or before To, when set
+	From time.Time
+	To   time.Time
+}
+
+// ExportedMessage is one line of a JSON Lines chat export.
+// The content of deleted messages is never exported.
+type ExportedMessage struct {
+	ID        string    `json:"id"`
+	ChatJID   string    `json:"chat_jid"`
+	Sender    string    `json:"sender"`
+	Timestamp time.Time `json:"timestamp"`
+	IsFromMe  bool      `json:"is_from_me"`
+	Content   string    `json:"content"`
+	Type      string    `json:"type"`
+	// Structured fields of locations, contact cards, polls, ...
+	Data          *MessageData `json:"data,omitempty"`
+	MediaType     string       `json:"media_type,omitempty"`
+	Filename      string       `json:"filename,omitempty"`
+	QuotedMessage string       `json:"quoted_message,omitempty"`
+	ReplyToID     string       `json:"reply_to_id,omitempty"`
+	EditedAt      *time.Time   `json:"edited_at,omitempty"`
+	DeletedAt     *time.Time   `json:"deleted_at,omitempty"`
+	DeletedBy     string       `json:"deleted_by,omitempty"`
+}
+
+// Build export options from the format and RFC3339 / YYYY-MM-DD date range
+// given to the REST API or the command line
+func parseExportOptions(chatJID, format, from, to string) (ChatExportOptions, error) {
+	opts := ChatExportOptions{ChatJID: chatJID, Format: strings.ToLower(format)}
+	if opts.ChatJID == "" {
+		return opts, fmt.Errorf("chat JID is required")
+	}
+	if opts.Format == "" {
+		opts.Format = exportFormatJSONL
+	}
+	if _, ok := exportFormats[opts.Format]; !ok {
+		return opts, fmt.Errorf("unsupported export format %q: use jsonl, txt, html or zip", format)
+	}
+
+	var err error
+	if from != "" {
+		if opts.From, err = parseSearchTime(from, false); err != nil {
+			return opts, err
+		}
+	}
+	if to != "" {
+		if opts.To, err = parseSearchTime(to, true); err != nil {
+			return opts, err
+		}
+	}
+	if !opts.From.IsZero() && !opts.To.IsZero() && opts.To.Before(opts.From) {
+		return opts, fmt.Errorf("'to' must not be before 'from'")
+	}
+	return opts, nil
+}
+
+// Default file name of an export, e.g. chat-123456789@s.whatsapp.net.zip
+func exportFileName(opts ChatExportOptions) string {
+	name := strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(opts.ChatJID)
+	return "chat-" + name + exportFormats[opts.Format].extension
+}
+
+// Call fn for every message in the export range, oldest first, including deleted ones
+func forEachExportMessage(messageStore MessageStore, opts ChatExportOptions, fn func(Message) error) error {
+	query := MessageQuery{
+		ChatJID:        opts.ChatJID,
+		Limit:          exportPageSize,
+		Since:          opts.From,
+		Until:          opts.To,
+		Ascending:      true,
+		IncludeDeleted: true,
+	}
+
+	for {
+		messages, err := messageStore.GetMessages(query)
+		if err != nil {
+			return fmt.Errorf("failed to read messages: %v", err)
+		}
+		for _, msg := range messages {
+			if err := fn(msg); err != nil {
+				return err
+			}
+		}
+		if len(messages) < exportPageSize {
+			return nil
+		}
+		cursor := cursorForMessage(messages[len(messages)-1])
+		query.After = &cursor
+	}
+}
+
+// Write a chat export in the requested format
+func ExportChat(messageStore MessageStore, opts ChatExportOptions, w io.Writer) error {
+	chatName, err := messageStore.GetStoredChatName(opts.ChatJID)
+	if err != nil {
+		return fmt.Errorf("failed to get chat name: %v", err)
+	}
+	if chatName == "" {
+		chatName = opts.ChatJID
+	}
+
+	switch opts.Format {
+	case exportFormatJSONL:
+		return writeJSONLExport(w, messageStore, opts)
+	case exportFormatTXT:
+		return writeTXTExport(w, messageStore, opts)
+	case exportFormatHTML:
+		return writeHTMLExport(w, messageStore, opts, chatName)
+	case exportFormatZip:
+		return writeZipExport(w, messageStore, opts, chatName)
+	default:
+		return fmt.Errorf("unsupported export format %q", opts.Format)
+	}
+}
+
+// Name shown for the sender of a message in text and HTML exports
+func exportSenderName(msg Message) string {
+	if msg.IsFromMe {
+		return "You"
+	}
+	return msg.Sender
+}
+
+// Write one JSON object per message
+func writeJSONLExport(w io.Writer, messageStore MessageStore, opts ChatExportOptions) error {
+	encoder := json.NewEncoder(w)
+	return forEachExportMessage(messageStore, opts, func(msg Message) error {
+		exported := ExportedMessage{
+			ID:            msg.ID,
+			ChatJID:       opts.ChatJID,
+			Sender:        msg.Sender,
+			Timestamp:     msg.Time,
+			IsFromMe:      msg.IsFromMe,
+			Content:       msg.Content,
+			Type:          msg.Type,
+			Data:          msg.Data,
+			MediaType:     msg.MediaType,
+			Filename:      msg.Filename,
+			QuotedMessage: msg.QuotedMessage,
+			ReplyToID:     msg.ReplyToID,
+			EditedAt:      msg.EditedAt,
+			DeletedAt:     msg.DeletedAt,
+			DeletedBy:     msg.DeletedBy,
+		}
+		if msg.DeletedAt != nil {
+			exported.Content = ""
+			exported.Data = nil
+			exported.Filename = ""
+			exported.QuotedMessage = ""
+		}
+		return encoder.Encode(exported)
+	})
+}
+
+// Write one message in WhatsApp's "Export chat" text format:
+//
+//	15/07/2023, 10:30 - Sender: text
+//
+// Quoted replies are written as "> " lines ahead of the text. Media is
+// "<filename> (file attached)" when the file is part of the export and
+// "<Media omitted>" otherwise, as in WhatsApp's own exports.
+func writeTXTMessage(w io.Writer, msg Message, attachment string) error {
+	var lines []string
+	if msg.DeletedAt != nil {
+		lines = append(lines, "This message was deleted")
+	} else {
+		if msg.QuotedMessage != "" {
+			for _, line := range strings.Split(msg.QuotedMessage, "\n") {
+				lines = append(lines, "> "+line)
+			}
+		}
+		if msg.MediaType != "" {
+			if attachment != "" {
+				lines = append(lines, attachment+" (file attached)")
+			} else {
+				lines = append(lines, "<Media omitted>")
+			}
+		}
+		if msg.Content != "" {
+			lines = append(lines, msg.Content)
+		}
+		if msg.EditedAt != nil && len(lines) > 0 {
+			lines[len(lines)-1] += " <This message was edited>"
+		}
+	}
+
+	timestamp := msg.Time.Local().Format(whatsAppExportTimeLayout)
+	// System lines, such as imported "Alice added Bob", have no sender
+	if msg.Sender == "" && !msg.IsFromMe {
+		_, err := fmt.Fprintf(w, "%s - %s\n", timestamp, strings.Join(lines, "\n"))
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s - %s: %s\n", timestamp, exportSenderName(msg), strings.Join(lines, "\n"))
+	return err
+}
+
+// Write a plain text transcript without media
+func writeTXTExport(w io.Writer, messageStore MessageStore, opts ChatExportOptions) error {
+	return forEachExportMessage(messageStore, opts, func(msg Message) error {
+		return writeTXTMessage(w, msg, "")
+	})
+}
+
+// Check whether a message's media file has been downloaded and can be
+// exported. Returns where the file is stored.
+func exportableMedia(messageStore MessageStore, chatJID string, msg Message) (string, bool) {
+	if msg.DeletedAt != nil || msg.MediaType == "" || msg.Filename == "" {
+		return "", false
+	}
+	path := storedMediaPath(messageStore, msg.ID, chatJID, msg.Filename)
+	info, err := os.Stat(path)
+	return path, err == nil && info.Mode().IsRegular()
+}
+
+// Write the transcript in WhatsApp's text format followed by every
+// downloaded media file it references, like WhatsApp's "Attach media" export
+func writeZipExport(w io.Writer, messageStore MessageStore, opts ChatExportOptions, chatName string) error {
+	zw := zip.NewWriter(w)
+
+	transcriptName := "WhatsApp Chat with " + strings.NewReplacer("/", "_", "\\", "_").Replace(chatName) + ".txt"
+	transcript, err := zw.Create(transcriptName)
+	if err != nil {
+		return err
+	}
+
+	// Media can only be added once the transcript entry is complete
+	type exportMedia struct {
+		filename, path string
+	}
+	var mediaFiles []exportMedia
+	// Entry names by stored path, so a file shared by several messages is
+	// added once, and every name in the archive so far
+	included := make(map[string]string)
+	taken := map[string]bool{transcriptName: true}
+	err = forEachExportMessage(messageStore, opts, func(msg Message) error {
+		path, attached := exportableMedia(messageStore, opts.ChatJID, msg)
+		attachment := ""
+		if attached {
+			var ok bool
+			if attachment, ok = included[path]; !ok {
+				attachment = zipMediaName(filepath.Base(msg.Filename), msg.ID, taken)
+				included[path] = attachment
+				taken[attachment] = true
+				mediaFiles = append(mediaFiles, exportMedia{filename: attachment, path: path})
+			}
+		}
+		return writeTXTMessage(transcript, msg, attachment)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, media := range mediaFiles {
+		if err := addMediaToZip(zw, media.filename, media.path); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+// Pick the archive name of a media file. Different files with the same name
+// get the message ID added before the extension, so none overwrites another.
+func zipMediaName(filename, messageID string, taken map[string]bool) string {
+	if !taken[filename] {
+		return filename
+	}
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext) + "-" + messageID
+	name := base + ext
+	for i := 2; taken[name]; i++ {
+		name = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	return name
+}
+
+// Copy one decrypted media file into the zip archive
+func addMediaToZip(zw *zip.Writer, filename, path string) error {
+	file, err := openMediaFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to open media file %s: %v", filename, err)
+	}
+	defer file.Close()
+
+	entry, err := zw.Create(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(entry, file); err != nil {
+		return fmt.Errorf("failed to export media file %s: %v", filename, err)
+	}
+	return nil
+}
+
+// Styles of the HTML transcript. Kept inline so the file is self-contained.
+const htmlExportStyle = `body{font-family:-apple-system,"Segoe UI",Roboto,Helvetica,Arial,sans-serif;background:#efeae2;margin:0;padding:24px}
+h1{font-size:20px;margin:0 0 4px}
+.range{color:#667781;font-size:13px;margin-bottom:16px}
+.msg{max-width:65%;margin:6px 0;padding:6px 9px;border-radius:8px;background:#fff;box-shadow:0 1px .5px rgba(0,0,0,.13);clear:both;float:left;white-space:pre-wrap;word-wrap:break-word}
+.msg.me{background:#d9fdd3;float:right}
+.sender{font-weight:600;font-size:13px;color:#1f7aec}
+.quote{border-left:4px solid #06cf9c;background:rgba(0,0,0,.05);padding:4px 8px;margin:4px 0;font-size:13px;color:#54656f;border-radius:4px}
+.meta{font-size:11px;color:#667781;text-align:right;margin-top:2px}
+.deleted{font-style:italic;color:#8696a0}
+.media img,.media video{max-width:100%;border-radius:6px}
+.media.missing{font-style:italic;color:#8696a0}
+.clear{clear:both}`
+
+// Write a self-contained HTML transcript with downloaded media inlined as data URIs
+func writeHTMLExport(w io.Writer, messageStore MessageStore, opts ChatExportOptions, chatName string) error {
+	title := html.EscapeString(chatName)
+	if _, err := fmt.Fprintf(w, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>WhatsApp Chat with %s</title>\n<style>\n%s\n</style>\n</head>\n<body>\n<h1>%s</h1>\n",
+		title, htmlExportStyle, title); err != nil {
+		return err
+	}
+
+	if !opts.From.IsZero() || !opts.To.IsZero() {
+		from, to := "start", "now"
+		if !opts.From.IsZero() {
+			from = opts.From.Local().Format("2006-01-02 15:04")
+		}
+		if !opts.To.IsZero() {
+			to = opts.To.Local().Format("2006-01-02 15:04")
+		}
+		if _, err := fmt.Fprintf(w, "<div class=\"range\">Messages from %s to %s</div>\n", from, to); err != nil {
+			return err
+		}
+	}
+
+	err := forEachExportMessage(messageStore, opts, func(msg Message) error {
+		return writeHTMLMessage(w, messageStore, opts.ChatJID, msg)
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "<div class=\"clear\"></div>\n</body>\n</html>\n")
+	return err
+}
+
+// Write one message bubble of the HTML transcript
+func writeHTMLMessage(w io.Writer, messageStore MessageStore, chatJID string, msg Message) error {
+	class := "msg"
+	if msg.IsFromMe {
+		class += " me"
+	}
+	if _, err := fmt.Fprintf(w, "<div class=\"%s\" id=\"msg-%s\"><div class=\"sender\">%s</div>",
+		class, html.EscapeString(msg.ID), html.EscapeString(exportSenderName(msg))); err != nil {
+		return err
+	}
+
+	if msg.DeletedAt != nil {
+		if _, err := io.WriteString(w, "<div class=\"deleted\">This message was deleted</div>"); err != nil {
+			return err
+		}
+	} else {
+		if msg.QuotedMessage != "" {
+			if _, err := fmt.Fprintf(w, "<div class=\"quote\">%s</div>", html.EscapeString(msg.QuotedMessage)); err != nil {
+				return err
+			}
+		}
+		if msg.MediaType != "" {
+			if err := writeHTMLMedia(w, messageStore, chatJID, msg); err != nil {
+				return err
+			}
+		}
+		if msg.Content != "" {
+			if _, err := fmt.Fprintf(w, "<div class=\"text\">%s</div>", html.EscapeString(msg.Content)); err != nil {
+				return err
+			}
+		}
+	}
+
+	meta := html.EscapeString(msg.Time.Local().Format("2006-01-02 15:04"))
+	if msg.EditedAt != nil {
+		meta = fmt.Sprintf("<span title=\"Edited %s\">Edited</span> · %s",
+			html.EscapeString(msg.EditedAt.Local().Format("2006-01-02 15:04")), meta)
+	}
+	_, err := fmt.Fprintf(w, "<div class=\"meta\">%s</div></div>\n", meta)
+	return err
+}
+
+// Inline a message's media as a base64 data URI, streaming it from disk.
+// Media that has not been downloaded is shown as a placeholder.
+func writeHTMLMedia(w io.Writer, messageStore MessageStore, chatJID string, msg Message) error {
+	filename := filepath.Base(msg.Filename)
+	path, ok := exportableMedia(messageStore, chatJID, msg)
+	if !ok {
+		_, err := fmt.Fprintf(w, "<div class=\"media missing\">%s (not downloaded)</div>",
+			html.EscapeString(msg.MediaType+" "+filename))
+		return err
+	}
+
+	file, err := openMediaFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to open media file %s: %v", filename, err)
+	}
+	defer file.Close()
+
+	mimeType := mime.TypeByExtension(filepath.Ext(filename))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	// Drop parameters such as charset so the data URI stays simple
+	mimeType = strings.SplitN(mimeType, ";", 2)[0]
+
+	var openTag, closeTag string
+	switch msg.MediaType {
+	case "image":
+		openTag, closeTag = "<img src=\"", "\" alt=\""+html.EscapeString(filename)+"\">"
+	case "video":
+		openTag, closeTag = "<video controls src=\"", "\"></video>"
+	case "audio":
+		openTag, closeTag = "<audio controls src=\"", "\"></audio>"
+	default:
+		openTag, closeTag = "<a download=\""+html.EscapeString(filename)+"\" href=\"", "\">"+html.EscapeString(filename)+"</a>"
+	}
+
+	if _, err := fmt.Fprintf(w, "<div class=\"media\">%sdata:%s;base64,", openTag, mimeType); err != nil {
+		return err
+	}
+	encoder := base64.NewEncoder(base64.StdEncoding, w)
+	if _, err := io.Copy(encoder, file); err != nil {
+		return fmt.Errorf("failed to export media file %s: %v", filename, err)
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, closeTag+"</div>")
+	return err
+}
+
+// Handler for exporting a chat as a downloadable file
+func handleChatExport(messageStore MessageStore, logger waLog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only allow GET requests
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		opts, err := parseExportOptions(r.PathValue("jid"), query.Get("format"), query.Get("from"), query.Get("to"))
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		exists, err := messageStore.ChatExists(opts.ChatJID)
+		if err != nil || !exists {
+			status, message := http.StatusNotFound, "Chat not found"
+			if err != nil {
+				status, message = http.StatusInternalServerError, fmt.Sprintf("Failed to look up chat: %v", err)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   message,
+			})
+			return
+		}
+
+		w.Header().Set("Content-Type", exportFormats[opts.Format].contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFileName(opts)))
+
+		// The response is streamed, so errors past this point can only be logged
+		if err := ExportChat(messageStore, opts, w); err != nil {
+			logger.Errorf("Failed to export chat %s: %v", opts.ChatJID, err)
+		}
+	}
+}
+
+// Export a chat to a file from the command line, then exit
+func runExportChat(opts ChatExportOptions, output string, logger waLog.Logger) {
+	messageStore, err := NewMessageStore()
+	if err != nil {
+		logger.Errorf("Failed to initialize message store: %v", err)
+		os.Exit(1)
+	}
+	defer messageStore.Close()
+
+	exists, err := messageStore.ChatExists(opts.ChatJID)
+	if err != nil {
+		logger.Errorf("Failed to look up chat: %v", err)
+		os.Exit(1)
+	}
+	if !exists {
+		logger.Errorf("Chat %s not found", opts.ChatJID)
+		os.Exit(1)
+	}
+
+	if output == "" {
+		output = exportFileName(opts)
+	}
+	file, err := os.Create(output)
+	if err != nil {
+		logger.Errorf("Failed to create %s: %v", output, err)
+		os.Exit(1)
+	}
+
+	err = ExportChat(messageStore, opts, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(output)
+		logger.Errorf("Export failed: %v", err)
+		os.Exit(1)
+	}
+
+	logger.Infof("Exported %s to %s", opts.ChatJID, output)
+}
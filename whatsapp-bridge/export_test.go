@@ -0,0 +1,101 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestZipMediaName(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		taken    []string
+		want     string
+	}{
+		{"free name", "photo.jpg", nil, "photo.jpg"},
+		{"taken name gets the message ID", "photo.jpg", []string{"photo.jpg"}, "photo-M1.jpg"},
+		{"no extension", "notes", []string{"notes"}, "notes-M1"},
+		{"taken twice", "photo.jpg", []string{"photo.jpg", "photo-M1.jpg"}, "photo-M1-2.jpg"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taken := make(map[string]bool)
+			for _, name := range tt.taken {
+				taken[name] = true
+			}
+			if got := zipMediaName(tt.filename, "M1", taken); got != tt.want {
+				t.Errorf("zipMediaName(%q) = %q, want %q", tt.filename, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteZipExport(t *testing.T) {
+	t.Chdir(t.TempDir())
+	store := newTestStore(t)
+	chat := "4915112345678@s.whatsapp.net"
+	at := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// Two different photos with the same name, and a third message sharing the first photo
+	media := map[string]string{"m1": "first photo", "m2": "second photo", "m3": "first photo"}
+	for i, id := range []string{"m1", "m2", "m3"} {
+		storeTestMessage(t, store, chat, id, "111", "", at.Add(time.Duration(i)*time.Minute), "image", "photo.jpg")
+		hash, _, err := writeMediaBlob([]byte(media[id]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.StoreMediaRef(id, chat, hash, int64(len(media[id]))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeZipExport(&buf, store, ChatExportOptions{ChatJID: chat, Format: "zip"}, "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := make(map[string]string)
+	var names []string
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[f.Name] = string(data)
+		names = append(names, f.Name)
+	}
+
+	wantEntries := map[string]string{"photo.jpg": "first photo", "photo-m2.jpg": "second photo"}
+	if len(names) != len(wantEntries)+1 {
+		t.Errorf("zip entries = %q, want the transcript and %d media files", names, len(wantEntries))
+	}
+	for name, want := range wantEntries {
+		if got, ok := entries[name]; !ok || got != want {
+			t.Errorf("zip entry %s = %q (present %v), want %q", name, got, ok, want)
+		}
+	}
+
+	transcript := entries["WhatsApp Chat with Alice.txt"]
+	var attached []string
+	for _, line := range strings.Split(strings.TrimSpace(transcript), "\n") {
+		_, text, _ := strings.Cut(line, ": ")
+		attached = append(attached, strings.TrimSuffix(text, " (file attached)"))
+	}
+	if want := []string{"photo.jpg", "photo-m2.jpg", "photo.jpg"}; strings.Join(attached, ",") != strings.Join(want, ",") {
+		t.Errorf("transcript attachments = %q, want %q\n%s", attached, want, transcript)
+	}
+}
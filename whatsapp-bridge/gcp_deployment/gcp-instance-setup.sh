@@ -93,7 +93,7 @@ export CGO_ENABLED=1
 
 # Build the binary
 echo "Building $BINARY_NAME..."
-GOOS=linux GOARCH=amd64 go build -o "$BINARY_NAME" main.go
+GOOS=linux GOARCH=amd64 go build -tags sqlite_fts5 -o "$BINARY_NAME" .
 
 # Make sure store directory exists
 mkdir -p store
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// Group holds the metadata of a WhatsApp group
+type Group struct {
+	JID         string     `json:"jid"`
+	Subject     string     `json:"subject"`
+	Description string     `json:"description"`
+	OwnerJID    string     `json:"owner_jid,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	// Only admins can send messages
+	IsAnnounce bool `json:"is_announce"`
+	// Only admins can edit the group info
+	IsLocked          bool               `json:"is_locked"`
+	IsEphemeral       bool               `json:"is_ephemeral"`
+	DisappearingTimer uint32             `json:"disappearing_timer"`
+	UpdatedAt         time.Time          `json:"updated_at"`
+	ParticipantCount  int                `json:"participant_count"`
+	Participants      []GroupParticipant `json:"participants,omitempty"`
+}
+
+// GroupParticipant is one member of a group
+type GroupParticipant struct {
+	JID          string `json:"jid"`
+	LID          string `json:"lid,omitempty"`
+	IsAdmin      bool   `json:"is_admin"`
+	IsSuperAdmin bool   `json:"is_super_admin"`
+	// Name from the contacts table, if the participant is a known contact
+	Name string `json:"name,omitempty"`
+}
+
+// Convert group metadata from whatsmeow into a Group
+func groupFromInfo(info *types.GroupInfo) Group {
+	group := Group{
+		JID:               info.JID.String(),
+		Subject:           info.Name,
+		Description:       info.Topic,
+		IsAnnounce:        info.IsAnnounce,
+		IsLocked:          info.IsLocked,
+		IsEphemeral:       info.IsEphemeral,
+		DisappearingTimer: info.DisappearingTimer,
+	}
+	if !info.OwnerJID.IsEmpty() {
+		group.OwnerJID = info.OwnerJID.String()
+	}
+	if !info.GroupCreated.IsZero() {
+		created := info.GroupCreated
+		group.CreatedAt = &created
+	}
+	for _, p := range info.Participants {
+		participant := GroupParticipant{
+			JID:          p.JID.ToNonAD().String(),
+			IsAdmin:      p.IsAdmin || p.IsSuperAdmin,
+			IsSuperAdmin: p.IsSuperAdmin,
+		}
+		if !p.LID.IsEmpty() && p.LID != p.JID {
+			participant.LID = p.LID.ToNonAD().String()
+		}
+		group.Participants = append(group.Participants, participant)
+	}
+	group.ParticipantCount = len(group.Participants)
+	return group
+}
+
+// Store a group and replace its participant list
+func (store *SQLMessageStore) StoreGroup(group Group) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var createdAt sql.NullTime
+	if group.CreatedAt != nil {
+		createdAt = sql.NullTime{Time: *group.CreatedAt, Valid: true}
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO groups (jid, subject, description, owner_jid, created_at, is_announce, is_locked, is_ephemeral, disappearing_timer, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (jid) DO UPDATE SET
+			subject = excluded.subject,
+			description = excluded.description,
+			owner_jid = excluded.owner_jid,
+			created_at = excluded.created_at,
+			is_announce = excluded.is_announce,
+			is_locked = excluded.is_locked,
+			is_ephemeral = excluded.is_ephemeral,
+			disappearing_timer = excluded.disappearing_timer,
+			updated_at = excluded.updated_at`,
+		group.JID, store.keys.encryptString(group.Subject), store.keys.encryptString(group.Description), nullIfEmpty(group.OwnerJID), createdAt,
+		group.IsAnnounce, group.IsLocked, group.IsEphemeral, group.DisappearingTimer, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM group_participants WHERE group_jid = ?", group.JID); err != nil {
+		return err
+	}
+	for _, p := range group.Participants {
+		_, err := tx.Exec(
+			`INSERT INTO group_participants (group_jid, jid, lid, is_admin, is_super_admin) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (group_jid, jid) DO UPDATE SET lid = excluded.lid, is_admin = excluded.is_admin, is_super_admin = excluded.is_super_admin`,
+			group.JID, p.JID, nullIfEmpty(p.LID), p.IsAdmin, p.IsSuperAdmin,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Remove a group and its participants
+func (store *SQLMessageStore) DeleteGroup(jid string) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM group_participants WHERE group_jid = ?", jid); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM groups WHERE jid = ?", jid); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const groupColumns = `g.jid, g.subject, g.description, g.owner_jid, g.created_at, g.is_announce, g.is_locked,
+	g.is_ephemeral, g.disappearing_timer, g.updated_at,
+	(SELECT COUNT(*) FROM group_participants gp WHERE gp.group_jid = g.jid)`
+
+// Scan a groups row selected with groupColumns
+func scanGroup(row rowScanner) (Group, error) {
+	var group Group
+	var subject, description, ownerJID sql.NullString
+	var createdAt, updatedAt sql.NullTime
+	err := row.Scan(&group.JID, &subject, &description, &ownerJID, &createdAt, &group.IsAnnounce, &group.IsLocked,
+		&group.IsEphemeral, &group.DisappearingTimer, &updatedAt, &group.ParticipantCount)
+	if err != nil {
+		return group, err
+	}
+	group.Subject = subject.String
+	group.Description = description.String
+	group.OwnerJID = ownerJID.String
+	if createdAt.Valid {
+		group.CreatedAt = &createdAt.Time
+	}
+	group.UpdatedAt = updatedAt.Time
+	return group, nil
+}
+
+// Decrypt the subject and description of a scanned group
+func (store *SQLMessageStore) decryptGroup(group *Group) error {
+	var err error
+	if group.Subject, err = store.keys.decryptString(group.Subject); err != nil {
+		return fmt.Errorf("group %s: %v", group.JID, err)
+	}
+	if group.Description, err = store.keys.decryptString(group.Description); err != nil {
+		return fmt.Errorf("group %s: %v", group.JID, err)
+	}
+	return nil
+}
+
+// Get a group with its participants, admins first
+func (store *SQLMessageStore) GetGroup(jid string) (*Group, error) {
+	group, err := scanGroup(store.db.QueryRow("SELECT "+groupColumns+" FROM groups g WHERE g.jid = ?", jid))
+	if err != nil {
+		return nil, err
+	}
+	if err := store.decryptGroup(&group); err != nil {
+		return nil, err
+	}
+
+	rows, err := store.db.Query(
+		`SELECT gp.jid, gp.lid, gp.is_admin, gp.is_super_admin, c.full_name, c.first_name, c.business_name, c.push_name
+		FROM group_participants gp
+		LEFT JOIN contacts c ON c.jid = (SELECT c2.jid FROM contacts c2
+			WHERE c2.jid = gp.jid OR c2.lid = gp.jid OR c2.lid = gp.lid LIMIT 1)
+		WHERE gp.group_jid = ?
+		ORDER BY gp.is_super_admin DESC, gp.is_admin DESC, gp.jid`,
+		jid,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p GroupParticipant
+		var lid, fullName, firstName, businessName, pushName sql.NullString
+		if err := rows.Scan(&p.JID, &lid, &p.IsAdmin, &p.IsSuperAdmin, &fullName, &firstName, &businessName, &pushName); err != nil {
+			return nil, err
+		}
+		p.LID = lid.String
+		// Contact names may be encrypted, so the best one is picked here
+		for _, name := range []sql.NullString{fullName, firstName, businessName, pushName} {
+			if !name.Valid || name.String == "" {
+				continue
+			}
+			if p.Name, err = store.keys.decryptString(name.String); err != nil {
+				return nil, fmt.Errorf("participant %s: %v", p.JID, err)
+			}
+			break
+		}
+		group.Participants = append(group.Participants, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+// Get all stored groups, without their participants
+func (store *SQLMessageStore) GetGroups() ([]Group, error) {
+	rows, err := store.db.Query("SELECT " + groupColumns + " FROM groups g")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []Group
+	for rows.Next() {
+		group, err := scanGroup(rows)
+		if err != nil {
+			return nil, err
+		}
+		if err := store.decryptGroup(&group); err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Subjects may be encrypted, so groups are sorted after decrypting them
+	slices.SortFunc(groups, func(a, b Group) int {
+		if c := strings.Compare(strings.ToLower(a.Subject), strings.ToLower(b.Subject)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.JID, b.JID)
+	})
+	return groups, nil
+}
+
+// Store group metadata fetched from WhatsApp, logging rather than failing on errors
+func recordGroupInfo(messageStore MessageStore, info *types.GroupInfo, logger waLog.Logger) {
+	if err := messageStore.StoreGroup(groupFromInfo(info)); err != nil {
+		logger.Warnf("Failed to store group %s: %v", info.JID, err)
+	}
+}
+
+// Fetch a group's full metadata from WhatsApp and store it
+func refreshGroup(client *whatsmeow.Client, messageStore MessageStore, jid types.JID) (*Group, error) {
+	info, err := client.GetGroupInfo(jid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get group info: %v", err)
+	}
+	group := groupFromInfo(info)
+	if err := messageStore.StoreGroup(group); err != nil {
+		return nil, fmt.Errorf("failed to store group: %v", err)
+	}
+	return messageStore.GetGroup(group.JID)
+}
+
+// Apply a change notification to the stored copy of a group
+func applyGroupChange(client *whatsmeow.Client, messageStore MessageStore, evt *events.GroupInfo, logger waLog.Logger) {
+	jid := evt.JID.String()
+
+	if evt.Delete != nil {
+		if err := messageStore.DeleteGroup(jid); err != nil {
+			logger.Warnf("Failed to delete group %s: %v", jid, err)
+		}
+		return
+	}
+
+	group, err := messageStore.GetGroup(jid)
+	if err == sql.ErrNoRows {
+		// We never stored this group, so fetch all of it rather than a single change
+		if _, err := refreshGroup(client, messageStore, evt.JID); err != nil {
+			logger.Warnf("Failed to refresh group %s: %v", jid, err)
+		}
+		return
+	}
+	if err != nil {
+		logger.Warnf("Failed to get group %s: %v", jid, err)
+		return
+	}
+
+	if evt.Name != nil {
+		group.Subject = evt.Name.Name
+	}
+	if evt.Topic != nil {
+		group.Description = evt.Topic.Topic
+		if evt.Topic.TopicDeleted {
+			group.Description = ""
+		}
+	}
+	if evt.Locked != nil {
+		group.IsLocked = evt.Locked.IsLocked
+	}
+	if evt.Announce != nil {
+		group.IsAnnounce = evt.Announce.IsAnnounce
+	}
+	if evt.Ephemeral != nil {
+		group.IsEphemeral = evt.Ephemeral.IsEphemeral
+		group.DisappearingTimer = evt.Ephemeral.DisappearingTimer
+	}
+
+	// Participants are keyed by JID; a change only touches the listed members
+	participants := make(map[string]*GroupParticipant, len(group.Participants))
+	var order []string
+	for i := range group.Participants {
+		p := &group.Participants[i]
+		participants[p.JID] = p
+		order = append(order, p.JID)
+	}
+	for _, j := range evt.Join {
+		id := j.ToNonAD().String()
+		if _, ok := participants[id]; !ok {
+			participants[id] = &GroupParticipant{JID: id}
+			order = append(order, id)
+		}
+	}
+	for _, j := range evt.Leave {
+		delete(participants, j.ToNonAD().String())
+	}
+	for _, j := range evt.Promote {
+		if p, ok := participants[j.ToNonAD().String()]; ok {
+			p.IsAdmin = true
+		}
+	}
+	for _, j := range evt.Demote {
+		if p, ok := participants[j.ToNonAD().String()]; ok {
+			p.IsAdmin = false
+			p.IsSuperAdmin = false
+		}
+	}
+
+	updated := make([]GroupParticipant, 0, len(participants))
+	for _, id := range order {
+		if p, ok := participants[id]; ok {
+			updated = append(updated, *p)
+			delete(participants, id)
+		}
+	}
+	group.Participants = updated
+
+	if err := messageStore.StoreGroup(*group); err != nil {
+		logger.Warnf("Failed to store group %s: %v", jid, err)
+	}
+}
+
+// Handle group events: groups we join and changes to groups we are in
+func handleGroupEvent(client *whatsmeow.Client, messageStore MessageStore, evt interface{}, logger waLog.Logger) {
+	switch v := evt.(type) {
+	case *events.JoinedGroup:
+		recordGroupInfo(messageStore, &v.GroupInfo, logger)
+	case *events.GroupInfo:
+		applyGroupChange(client, messageStore, v, logger)
+	}
+}
+
+// Store the metadata of every group we are in. Run on connect, so changes
+// made while the bridge was offline are picked up.
+func syncJoinedGroups(client *whatsmeow.Client, messageStore MessageStore, logger waLog.Logger) {
+	groups, err := client.GetJoinedGroups()
+	if err != nil {
+		logger.Warnf("Failed to get joined groups: %v", err)
+		return
+	}
+	for _, info := range groups {
+		recordGroupInfo(messageStore, info, logger)
+	}
+	logger.Infof("Synced %d groups", len(groups))
+}
+
+// Handler for listing groups, or getting one group with its participants
+// with /api/groups/{jid}
+func handleGroups(client *whatsmeow.Client, messageStore MessageStore, logger waLog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only allow GET requests
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		writeError := func(status int, message string) {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   message,
+			})
+		}
+
+		id := r.PathValue("jid")
+		if id == "" {
+			groups, err := messageStore.GetGroups()
+			if err != nil {
+				logger.Errorf("Failed to get groups: %v", err)
+				writeError(http.StatusInternalServerError, fmt.Sprintf("Failed to get groups: %v", err))
+				return
+			}
+			if groups == nil {
+				groups = []Group{}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"count":   len(groups),
+				"groups":  groups,
+			})
+			return
+		}
+
+		jid, err := types.ParseJID(id)
+		if err != nil || jid.Server != types.GroupServer {
+			writeError(http.StatusBadRequest, "Invalid group JID")
+			return
+		}
+
+		// Fetch from WhatsApp when asked to, or when we have not stored the group yet
+		refresh := r.URL.Query().Get("refresh")
+		var group *Group
+		if refresh != "true" && refresh != "1" && refresh != "yes" {
+			group, err = messageStore.GetGroup(jid.String())
+			if err != nil && err != sql.ErrNoRows {
+				logger.Errorf("Failed to get group %s: %v", jid, err)
+				writeError(http.StatusInternalServerError, fmt.Sprintf("Failed to get group: %v", err))
+				return
+			}
+		}
+		if group == nil {
+			if !client.IsConnected() {
+				writeError(http.StatusServiceUnavailable, "Not connected to WhatsApp")
+				return
+			}
+			if group, err = refreshGroup(client, messageStore, jid); err != nil {
+				writeError(http.StatusNotFound, err.Error())
+				return
+			}
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"group":   group,
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"slices"
+	"testing"
+)
+
+func TestStoreGroup(t *testing.T) {
+	group := "123456789@g.us"
+	owner := "4915100000001@s.whatsapp.net"
+	admin := "4915100000002@s.whatsapp.net"
+	member := "4915100000003@s.whatsapp.net"
+	lidMember := "98765432101234@lid"
+
+	for _, encrypted := range []bool{false, true} {
+		store := newTestStore(t)
+		if encrypted {
+			store.keys = newTestKeyring(t, 1)
+		}
+		must := func(err error) {
+			t.Helper()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Participants are named from contacts, also when only their LID matches
+		must(store.StoreContact(Contact{JID: member, PhoneNumber: "4915100000003", PushName: "Carol"}))
+		must(store.StoreContact(Contact{JID: "4915100000004@s.whatsapp.net", LID: lidMember, FullName: "Dave Jones", PushName: "dave"}))
+		must(store.StoreGroup(Group{JID: group, Subject: "Team", Description: "Plans", OwnerJID: owner, Participants: []GroupParticipant{
+			{JID: member}, {JID: lidMember}, {JID: admin, IsAdmin: true}, {JID: owner, IsAdmin: true, IsSuperAdmin: true},
+		}}))
+		must(store.StoreGroup(Group{JID: "111@g.us", Subject: "alpha"}))
+
+		got, err := store.GetGroup(group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Subject != "Team" || got.Description != "Plans" || got.OwnerJID != owner || got.ParticipantCount != 4 {
+			t.Errorf("encrypted=%v: GetGroup = %+v", encrypted, got)
+		}
+		type participant struct{ jid, name string }
+		var participants []participant
+		for _, p := range got.Participants {
+			participants = append(participants, participant{p.JID, p.Name})
+		}
+		want := []participant{{owner, ""}, {admin, ""}, {member, "Carol"}, {lidMember, "Dave Jones"}}
+		if !slices.Equal(participants, want) {
+			t.Errorf("encrypted=%v: participants = %v, want admins first %v", encrypted, participants, want)
+		}
+
+		// Storing the group again replaces its participants
+		must(store.StoreGroup(Group{JID: group, Subject: "Team 2", Participants: []GroupParticipant{{JID: owner}}}))
+		if got, err := store.GetGroup(group); err != nil || got.Subject != "Team 2" || got.ParticipantCount != 1 || len(got.Participants) != 1 {
+			t.Errorf("encrypted=%v: GetGroup after update = %+v, %v", encrypted, got, err)
+		}
+
+		// Groups are listed by subject, ignoring case
+		groups, err := store.GetGroups()
+		if err != nil || len(groups) != 2 || groups[0].Subject != "alpha" || groups[1].Subject != "Team 2" {
+			t.Errorf("encrypted=%v: GetGroups = %+v, %v", encrypted, groups, err)
+		}
+
+		must(store.DeleteGroup(group))
+		if _, err := store.GetGroup(group); err != sql.ErrNoRows {
+			t.Errorf("encrypted=%v: GetGroup after delete: %v, want %v", encrypted, err, sql.ErrNoRows)
+		}
+	}
+}
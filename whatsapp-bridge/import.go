@@ -0,0 +1,597 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// ChatImportOptions describes an "Export chat" archive and the chat it is imported into
+type ChatImportOptions struct {
+	// The .txt transcript or .zip archive written by the phone
+	Path    string
+	ChatJID string
+	// Chat name, taken from the file name ("WhatsApp Chat with <name>") when empty
+	Name string
+	// Sender name of the account owner in the export, so their messages are
+	// stored as sent by us. "You" is always treated as the account owner.
+	Me string
+	// Order of day, month and year in the export's dates: "dmy", "mdy" or "ymd".
+	// Detected from the dates themselves when empty.
+	DateOrder string
+	// Time zone of the phone that made the export
+	Location *time.Location
+}
+
+// ChatImportReport summarizes what an import added to the store
+type ChatImportReport struct {
+	ChatJID          string `json:"chat_jid"`
+	MessagesImported int    `json:"messages_imported"`
+	SystemMessages   int    `json:"system_messages"`
+	Duplicates       int    `json:"duplicates"`
+	MediaFiles       int    `json:"media_files"`
+	SkippedLines     int    `json:"skipped_lines"`
+}
+
+// importedMessage is one message parsed from an export transcript
+type importedMessage struct {
+	Time time.Time
+	// Whether the transcript gave seconds; without them, Time is only accurate to the minute
+	HasSeconds bool
+	Sender     string
+	IsFromMe   bool
+	IsSystem   bool
+	Content    string
+	MediaType  string
+	Filename   string
+	Deleted    bool
+}
+
+// First line of a message in an Android export: "15/07/2023, 10:30 - Sender: text"
+var androidExportLine = regexp.MustCompile(`(?i)^(\d{1,4})[./-](\d{1,2})[./-](\d{1,4}),? (\d{1,2})[:.](\d{2})(?:[:.](\d{2}))?(?: ?([ap]\.? ?m\.?))? - (.*)$`)
+
+// First line of a message in an iOS export: "[15/07/2023, 10:30:45] Sender: text"
+var iosExportLine = regexp.MustCompile(`(?i)^\[(\d{1,4})[./-](\d{1,2})[./-](\d{1,4}),? (\d{1,2})[:.](\d{2})(?:[:.](\d{2}))?(?: ?([ap]\.? ?m\.?))?\] (.*)$`)
+
+// Attachment references and markers within a message's text
+var (
+	androidAttachment = regexp.MustCompile(`^(.+\.[A-Za-z0-9]+) \(file attached\)$`)
+	iosAttachment     = regexp.MustCompile(`^<attached: (.+)>$`)
+	iosMediaOmitted   = regexp.MustCompile(`(?i)^(image|video|audio|sticker|GIF|document) omitted$`)
+	deletedMarker     = regexp.MustCompile(`^(This message was deleted|You deleted this message)\.?$`)
+	editedMarker      = regexp.MustCompile(`\s*\x{200E}?<This message was edited>$`)
+	phoneNumberSender = regexp.MustCompile(`^\+?[0-9][0-9 ()\-]{5,}$`)
+)
+
+// Media type of a file by its extension, using the same names as downloaded media
+func mediaTypeForFilename(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp", ".heic":
+		return "image"
+	case ".mp4", ".3gp", ".mov", ".mkv", ".webm":
+		return "video"
+	case ".opus", ".ogg", ".m4a", ".mp3", ".aac", ".amr", ".wav":
+		return "audio"
+	default:
+		return "document"
+	}
+}
+
+// Remove the invisible direction marks and odd spaces phones put into exports
+func normalizeExportLine(line string) string {
+	line = strings.TrimRight(line, "\r")
+	line = strings.NewReplacer("\u202f", " ", "\u00a0", " ").Replace(line)
+	return strings.TrimLeft(line, "\u200e\u200f\ufeff")
+}
+
+// exportHeader holds the date and time fields of a message's first line
+type exportHeader struct {
+	fields [3]int
+	// Whether the first field has four digits, as in 2023-07-15
+	yearFirst   bool
+	hour, min   int
+	sec         int
+	hasSeconds  bool
+	meridiem    string
+	rest        string
+	lrmPrefixed bool
+}
+
+// Parse the first line of a message, or return false for a continuation line
+func parseExportHeader(line string) (exportHeader, bool) {
+	var h exportHeader
+	m := iosExportLine.FindStringSubmatch(line)
+	if m == nil {
+		m = androidExportLine.FindStringSubmatch(line)
+	}
+	if m == nil {
+		return h, false
+	}
+
+	for i := 0; i < 3; i++ {
+		h.fields[i], _ = strconv.Atoi(m[i+1])
+	}
+	h.yearFirst = len(m[1]) == 4
+	h.hour, _ = strconv.Atoi(m[4])
+	h.min, _ = strconv.Atoi(m[5])
+	if m[6] != "" {
+		h.sec, _ = strconv.Atoi(m[6])
+		h.hasSeconds = true
+	}
+	h.meridiem = strings.ToLower(strings.NewReplacer(".", "", " ", "").Replace(m[7]))
+
+	// iOS marks system lines and attachments with a left-to-right mark after the sender
+	h.rest = m[8]
+	if i := strings.Index(h.rest, ": "); i >= 0 && strings.HasPrefix(h.rest[i+2:], "\u200e") {
+		h.lrmPrefixed = true
+	}
+	h.rest = strings.ReplaceAll(h.rest, "\u200e", "")
+	return h, true
+}
+
+// Work out whether dates are written day or month first. Days above 12 give it away;
+// if no date does, 12-hour clocks suggest a US-style export.
+func detectDateOrder(headers []exportHeader) string {
+	dayFirst, monthFirst, meridiem := false, false, false
+	for _, h := range headers {
+		if h.yearFirst {
+			return "ymd"
+		}
+		if h.fields[0] > 12 {
+			dayFirst = true
+		}
+		if h.fields[1] > 12 {
+			monthFirst = true
+		}
+		if h.meridiem != "" {
+			meridiem = true
+		}
+	}
+	switch {
+	case dayFirst:
+		return "dmy"
+	case monthFirst || meridiem:
+		return "mdy"
+	default:
+		return "dmy"
+	}
+}
+
+// Turn a header's fields into a time in the export's time zone
+func (h exportHeader) time(dateOrder string, loc *time.Location) (time.Time, error) {
+	var year, month, day int
+	switch dateOrder {
+	case "dmy":
+		day, month, year = h.fields[0], h.fields[1], h.fields[2]
+	case "mdy":
+		month, day, year = h.fields[0], h.fields[1], h.fields[2]
+	case "ymd":
+		year, month, day = h.fields[0], h.fields[1], h.fields[2]
+	default:
+		return time.Time{}, fmt.Errorf("unknown date order %q: use dmy, mdy or ymd", dateOrder)
+	}
+	if year < 100 {
+		year += 2000
+	}
+
+	hour := h.hour
+	switch h.meridiem {
+	case "am":
+		if hour == 12 {
+			hour = 0
+		}
+	case "pm":
+		if hour < 12 {
+			hour += 12
+		}
+	}
+
+	if month < 1 || month > 12 || day < 1 || day > 31 || hour > 23 || h.min > 59 || h.sec > 59 {
+		return time.Time{}, fmt.Errorf("invalid date %02d-%02d-%02d %02d:%02d", year, month, day, hour, h.min)
+	}
+	return time.Date(year, time.Month(month), day, hour, h.min, h.sec, 0, loc), nil
+}
+
+// Check whether a sender in the export is the account owner
+func (opts ChatImportOptions) isMe(sender string) bool {
+	return sender == "You" || (opts.Me != "" && strings.EqualFold(sender, opts.Me))
+}
+
+// Reduce a phone number such as +49 151 234-5678 to bare digits, the way live
+// messages store senders. Anything else, such as a display name, is returned as is.
+func normalizePhoneNumber(sender string) string {
+	if !phoneNumberSender.MatchString(sender) {
+		return sender
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, sender)
+}
+
+// Fill in a parsed message from the text following its header
+func (msg *importedMessage) parseText(text string, lrmPrefixed bool) {
+	firstLine, rest, _ := strings.Cut(text, "\n")
+
+	switch {
+	case deletedMarker.MatchString(firstLine) && rest == "":
+		msg.Deleted = true
+		msg.Content = firstLine
+		return
+	case androidAttachment.MatchString(firstLine):
+		msg.Filename = androidAttachment.FindStringSubmatch(firstLine)[1]
+	case iosAttachment.MatchString(firstLine):
+		msg.Filename = iosAttachment.FindStringSubmatch(firstLine)[1]
+	case iosMediaOmitted.MatchString(firstLine):
+		switch kind := strings.ToLower(iosMediaOmitted.FindStringSubmatch(firstLine)[1]); kind {
+		case "sticker":
+			msg.MediaType = "image"
+		case "gif":
+			msg.MediaType = "video"
+		default:
+			msg.MediaType = kind
+		}
+	default:
+		// iOS attributes system lines like "Messages and calls are end-to-end
+		// encrypted" to the chat itself, marked with a left-to-right mark
+		msg.IsSystem = lrmPrefixed
+		msg.Content = text
+		return
+	}
+
+	if msg.Filename != "" {
+		msg.Filename = filepath.Base(strings.TrimSpace(msg.Filename))
+		msg.MediaType = mediaTypeForFilename(msg.Filename)
+	}
+	// Whatever follows an attachment is its caption
+	msg.Content = rest
+}
+
+// Parse an export transcript into messages, oldest first
+func parseExportTranscript(r io.Reader, opts ChatImportOptions) ([]importedMessage, int, error) {
+	type rawMessage struct {
+		header exportHeader
+		lines  []string
+	}
+
+	var raw []rawMessage
+	skipped := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := normalizeExportLine(scanner.Text())
+		if h, ok := parseExportHeader(line); ok {
+			raw = append(raw, rawMessage{header: h})
+			continue
+		}
+		// Continuation of a multi-line message
+		if len(raw) == 0 {
+			if strings.TrimSpace(line) != "" {
+				skipped++
+			}
+			continue
+		}
+		last := &raw[len(raw)-1]
+		last.lines = append(last.lines, strings.ReplaceAll(line, "\u200e", ""))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to read transcript: %v", err)
+	}
+
+	dateOrder := opts.DateOrder
+	if dateOrder == "" {
+		headers := make([]exportHeader, len(raw))
+		for i, m := range raw {
+			headers[i] = m.header
+		}
+		dateOrder = detectDateOrder(headers)
+	}
+
+	messages := make([]importedMessage, 0, len(raw))
+	for _, m := range raw {
+		t, err := m.header.time(dateOrder, opts.Location)
+		if err != nil {
+			skipped++
+			continue
+		}
+		msg := importedMessage{Time: t, HasSeconds: m.header.hasSeconds}
+
+		// Lines without a "Sender: " part are system lines, e.g. "Alice added Bob"
+		sender, text, ok := strings.Cut(m.header.rest, ": ")
+		if !ok {
+			msg.IsSystem = true
+			msg.Content = strings.Join(append([]string{m.header.rest}, m.lines...), "\n")
+		} else {
+			text = strings.Join(append([]string{text}, m.lines...), "\n")
+			text = editedMarker.ReplaceAllString(text, "")
+			msg.parseText(text, m.header.lrmPrefixed)
+			if !msg.IsSystem {
+				msg.Sender = sender
+				msg.IsFromMe = opts.isMe(sender)
+			}
+		}
+
+		msg.Content = strings.TrimRight(msg.Content, "\n")
+		if msg.Content == "" && msg.MediaType == "" {
+			skipped++
+			continue
+		}
+		messages = append(messages, msg)
+	}
+
+	return messages, skipped, nil
+}
+
+// Get the chat name from an export's file name, e.g. "WhatsApp Chat with Alice.zip"
+func chatNameFromExportPath(path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	for _, prefix := range []string{"WhatsApp Chat with ", "WhatsApp Chat - "} {
+		if strings.HasPrefix(name, prefix) {
+			return strings.TrimPrefix(name, prefix)
+		}
+	}
+	return ""
+}
+
+// Stable ID of an imported message, so importing the same export twice adds nothing.
+// The occurrence count tells apart identical messages sent within the same minute.
+func importedMessageID(chatJID string, msg importedMessage, occurrence int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%s\x00%s\x00%s\x00%d",
+		chatJID, msg.Time.Unix(), msg.Sender, msg.Content, msg.Filename, occurrence)))
+	return "import-" + hex.EncodeToString(sum[:10])
+}
+
+// Find a message already in the store, e.g. from history sync, that an imported
+// message duplicates. Exports only give times to the minute or second, so
+// candidates come from that window and are matched on content.
+func findImportDuplicate(messageStore MessageStore, chatJID string, msg importedMessage, claimed map[string]bool) (bool, error) {
+	window := time.Minute
+	if msg.HasSeconds {
+		window = time.Second
+	}
+	candidates, err := messageStore.GetMessages(MessageQuery{
+		ChatJID:        chatJID,
+		Since:          msg.Time,
+		Until:          msg.Time.Add(window - time.Nanosecond),
+		Ascending:      true,
+		IncludeDeleted: true,
+		Limit:          100,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	content := strings.TrimSpace(msg.Content)
+	for _, existing := range candidates {
+		if claimed[existing.ID] {
+			continue
+		}
+		var match bool
+		switch {
+		case msg.Deleted:
+			match = existing.DeletedAt != nil
+		case content == "<Media omitted>":
+			match = existing.MediaType != ""
+		case msg.MediaType != "":
+			match = existing.MediaType == msg.MediaType && strings.TrimSpace(existing.Content) == content
+		default:
+			match = existing.MediaType == "" && strings.TrimSpace(existing.Content) == content
+		}
+		if match {
+			claimed[existing.ID] = true
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Copy an attachment out of the archive into the media store as the file of
+// a message. Returns whether it was not stored already.
+func importMediaFile(messageStore MessageStore, file *zip.File, messageID, chatJID string) (bool, error) {
+	r, err := file.Open()
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return false, err
+	}
+	hash, added, err := writeMediaBlob(data)
+	if err != nil {
+		return false, err
+	}
+	if err := messageStore.StoreMediaRef(messageID, chatJID, hash, int64(len(data))); err != nil {
+		return false, err
+	}
+	return added, nil
+}
+
+// Open the transcript of an export, along with the attachments of a .zip archive
+func openExportArchive(path string) (io.ReadCloser, map[string]*zip.File, func() error, error) {
+	if !strings.EqualFold(filepath.Ext(path), ".zip") {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return file, nil, func() error { return nil }, nil
+	}
+
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var transcript *zip.File
+	media := make(map[string]*zip.File)
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		name := filepath.Base(file.Name)
+		// Android names the transcript after the chat, iOS calls it _chat.txt
+		if strings.EqualFold(filepath.Ext(name), ".txt") &&
+			(transcript == nil || name == "_chat.txt" || strings.HasPrefix(name, "WhatsApp Chat")) {
+			if transcript != nil {
+				media[filepath.Base(transcript.Name)] = transcript
+			}
+			transcript = file
+			continue
+		}
+		media[name] = file
+	}
+	if transcript == nil {
+		archive.Close()
+		return nil, nil, nil, fmt.Errorf("no chat transcript found in %s", path)
+	}
+
+	r, err := transcript.Open()
+	if err != nil {
+		archive.Close()
+		return nil, nil, nil, err
+	}
+	return r, media, archive.Close, nil
+}
+
+// Import a WhatsApp "Export chat" transcript or archive into the message store.
+// Messages already in the store are skipped, so an import can be repeated safely.
+func ImportChat(messageStore MessageStore, opts ChatImportOptions, logger waLog.Logger) (ChatImportReport, error) {
+	report := ChatImportReport{ChatJID: opts.ChatJID}
+	if opts.ChatJID == "" {
+		return report, fmt.Errorf("chat JID is required")
+	}
+	if opts.Location == nil {
+		opts.Location = time.Local
+	}
+
+	transcript, media, closeArchive, err := openExportArchive(opts.Path)
+	if err != nil {
+		return report, fmt.Errorf("failed to open export: %v", err)
+	}
+	defer closeArchive()
+
+	messages, skipped, err := parseExportTranscript(transcript, opts)
+	transcript.Close()
+	if err != nil {
+		return report, err
+	}
+	report.SkippedLines = skipped
+	if len(messages) == 0 {
+		return report, fmt.Errorf("no messages found in %s", opts.Path)
+	}
+
+	// Keep the chat's existing name and newer activity, if any
+	name, err := messageStore.GetStoredChatName(opts.ChatJID)
+	if err != nil {
+		return report, fmt.Errorf("failed to get chat name: %v", err)
+	}
+	if name == "" {
+		name = opts.Name
+	}
+	if name == "" {
+		name = chatNameFromExportPath(opts.Path)
+	}
+	if name == "" {
+		name = opts.ChatJID
+	}
+	chats, err := messageStore.GetChats()
+	if err != nil {
+		return report, fmt.Errorf("failed to get chats: %v", err)
+	}
+	lastMessageTime := messages[len(messages)-1].Time
+	if existing, ok := chats[opts.ChatJID]; ok && existing.After(lastMessageTime) {
+		lastMessageTime = existing
+	}
+	if err := messageStore.StoreChat(opts.ChatJID, name, lastMessageTime); err != nil {
+		return report, fmt.Errorf("failed to store chat: %v", err)
+	}
+
+	occurrences := make(map[string]int)
+	claimed := make(map[string]bool)
+	for _, msg := range messages {
+		key := fmt.Sprintf("%d\x00%s\x00%s\x00%s", msg.Time.Unix(), msg.Sender, msg.Content, msg.Filename)
+		id := importedMessageID(opts.ChatJID, msg, occurrences[key])
+		occurrences[key]++
+
+		exists, err := messageStore.MessageExists(id, opts.ChatJID)
+		if err != nil {
+			return report, fmt.Errorf("failed to check message: %v", err)
+		}
+		if !exists {
+			exists, err = findImportDuplicate(messageStore, opts.ChatJID, msg, claimed)
+			if err != nil {
+				return report, fmt.Errorf("failed to check for duplicates: %v", err)
+			}
+		}
+		if exists {
+			report.Duplicates++
+			continue
+		}
+
+		if msg.Filename != "" {
+			if file, ok := media[msg.Filename]; ok {
+				added, err := importMediaFile(messageStore, file, id, opts.ChatJID)
+				if err != nil {
+					logger.Warnf("Failed to import media file %s: %v", msg.Filename, err)
+				} else if added {
+					report.MediaFiles++
+				}
+			}
+		}
+
+		sender := normalizePhoneNumber(msg.Sender)
+		err = messageStore.StoreMessage(id, opts.ChatJID, sender, msg.Content, msg.Time, msg.IsFromMe,
+			msg.MediaType, msg.Filename, "", nil, nil, nil, 0, "")
+		if err != nil {
+			return report, fmt.Errorf("failed to store message: %v", err)
+		}
+		// Later lines of the export must not be matched against this one
+		claimed[id] = true
+		if msg.Deleted {
+			if err := messageStore.MarkMessageAsDeleted(id, opts.ChatJID, sender, msg.Time); err != nil {
+				return report, fmt.Errorf("failed to mark message as deleted: %v", err)
+			}
+		}
+
+		if msg.IsSystem {
+			report.SystemMessages++
+		} else {
+			report.MessagesImported++
+		}
+	}
+
+	return report, nil
+}
+
+// Import an export archive from the command line, then exit
+func runImportChat(opts ChatImportOptions, logger waLog.Logger) {
+	messageStore, err := NewMessageStore()
+	if err != nil {
+		logger.Errorf("Failed to initialize message store: %v", err)
+		os.Exit(1)
+	}
+	defer messageStore.Close()
+
+	report, err := ImportChat(messageStore, opts, logger)
+	if err != nil {
+		logger.Errorf("Import failed: %v", err)
+		os.Exit(1)
+	}
+
+	logger.Infof("Imported %d message(s), %d system message(s) and %d media file(s) into %s; skipped %d duplicate(s) and %d unreadable line(s)",
+		report.MessagesImported, report.SystemMessages, report.MediaFiles, report.ChatJID, report.Duplicates, report.SkippedLines)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExportHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		ok     bool
+		want   exportHeader
+		wantAt time.Time
+	}{
+		{
+			name: "android",
+			line: "15/07/2023, 10:30 - Alice: hello",
+			ok:   true,
+			want: exportHeader{fields: [3]int{15, 7, 2023}, hour: 10, min: 30, rest: "Alice: hello"},
+		},
+		{
+			name: "android with 12-hour clock",
+			line: "7/15/23, 9:05 PM - Bob: hi",
+			ok:   true,
+			want: exportHeader{fields: [3]int{7, 15, 23}, hour: 9, min: 5, meridiem: "pm", rest: "Bob: hi"},
+		},
+		{
+			name: "android with spanish meridiem",
+			line: "15/7/23, 9:05 p. m. - Bob: hola",
+			ok:   true,
+			want: exportHeader{fields: [3]int{15, 7, 23}, hour: 9, min: 5, meridiem: "pm", rest: "Bob: hola"},
+		},
+		{
+			name: "ios with seconds",
+			line: "[15.07.23, 10:30:45] Alice: hello",
+			ok:   true,
+			want: exportHeader{fields: [3]int{15, 7, 23}, hour: 10, min: 30, sec: 45, hasSeconds: true, rest: "Alice: hello"},
+		},
+		{
+			name: "ios attachment marked with a direction mark",
+			line: "[2023-07-15, 10:30:45] Alice: \u200e<attached: 00000012-PHOTO.jpg>",
+			ok:   true,
+			want: exportHeader{fields: [3]int{2023, 7, 15}, yearFirst: true, hour: 10, min: 30, sec: 45, hasSeconds: true,
+				rest: "Alice: <attached: 00000012-PHOTO.jpg>", lrmPrefixed: true},
+		},
+		{
+			name: "system line",
+			line: "15/07/2023, 10:30 - Alice added Bob",
+			ok:   true,
+			want: exportHeader{fields: [3]int{15, 7, 2023}, hour: 10, min: 30, rest: "Alice added Bob"},
+		},
+		{name: "continuation line", line: "second line of a message", ok: false},
+		{name: "date without time", line: "15/07/2023 - Alice: hi", ok: false},
+		{name: "empty", line: "", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseExportHeader(normalizeExportLine(tt.line))
+			if ok != tt.ok {
+				t.Fatalf("parseExportHeader(%q) ok = %v, want %v", tt.line, ok, tt.ok)
+			}
+			if ok && got != tt.want {
+				t.Errorf("parseExportHeader(%q) = %+v, want %+v", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeExportLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"15/07/2023, 10:30 - Alice: hi\r", "15/07/2023, 10:30 - Alice: hi"},
+		{"\u200e[15/07/2023, 10:30:00] Alice: hi", "[15/07/2023, 10:30:00] Alice: hi"},
+		{"\ufeff15/07/2023, 10:30 - Alice: hi", "15/07/2023, 10:30 - Alice: hi"},
+		{"7/15/23, 9:05\u202fPM - Bob: hi", "7/15/23, 9:05 PM - Bob: hi"},
+		{"a\u00a0b", "a b"},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeExportLine(tt.line); got != tt.want {
+			t.Errorf("normalizeExportLine(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestDetectDateOrder(t *testing.T) {
+	header := func(a, b, c int, meridiem string) exportHeader {
+		return exportHeader{fields: [3]int{a, b, c}, yearFirst: a > 999, meridiem: meridiem}
+	}
+	tests := []struct {
+		name    string
+		headers []exportHeader
+		want    string
+	}{
+		{"no messages", nil, "dmy"},
+		{"day above 12 first", []exportHeader{header(3, 4, 23, ""), header(15, 4, 23, "")}, "dmy"},
+		{"day above 12 second", []exportHeader{header(3, 4, 23, ""), header(4, 15, 23, "")}, "mdy"},
+		{"ambiguous 24-hour", []exportHeader{header(3, 4, 23, "")}, "dmy"},
+		{"ambiguous 12-hour", []exportHeader{header(3, 4, 23, "pm")}, "mdy"},
+		{"day wins over 12-hour clock", []exportHeader{header(15, 4, 23, "pm")}, "dmy"},
+		{"year first", []exportHeader{header(2023, 4, 15, "")}, "ymd"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectDateOrder(tt.headers); got != tt.want {
+				t.Errorf("detectDateOrder = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportHeaderTime(t *testing.T) {
+	berlin := time.FixedZone("CEST", 2*3600)
+	tests := []struct {
+		name      string
+		header    exportHeader
+		dateOrder string
+		want      time.Time
+		wantErr   bool
+	}{
+		{"dmy", exportHeader{fields: [3]int{15, 7, 2023}, hour: 10, min: 30}, "dmy", time.Date(2023, 7, 15, 10, 30, 0, 0, berlin), false},
+		{"mdy with two-digit year", exportHeader{fields: [3]int{7, 15, 23}, hour: 10, min: 30}, "mdy", time.Date(2023, 7, 15, 10, 30, 0, 0, berlin), false},
+		{"ymd with seconds", exportHeader{fields: [3]int{2023, 7, 15}, hour: 10, min: 30, sec: 45}, "ymd", time.Date(2023, 7, 15, 10, 30, 45, 0, berlin), false},
+		{"pm", exportHeader{fields: [3]int{15, 7, 23}, hour: 9, min: 5, meridiem: "pm"}, "dmy", time.Date(2023, 7, 15, 21, 5, 0, 0, berlin), false},
+		{"midnight", exportHeader{fields: [3]int{15, 7, 23}, hour: 12, min: 5, meridiem: "am"}, "dmy", time.Date(2023, 7, 15, 0, 5, 0, 0, berlin), false},
+		{"noon", exportHeader{fields: [3]int{15, 7, 23}, hour: 12, min: 5, meridiem: "pm"}, "dmy", time.Date(2023, 7, 15, 12, 5, 0, 0, berlin), false},
+		{"month out of range", exportHeader{fields: [3]int{15, 7, 23}, hour: 10}, "mdy", time.Time{}, true},
+		{"hour out of range", exportHeader{fields: [3]int{15, 7, 23}, hour: 25}, "dmy", time.Time{}, true},
+		{"unknown order", exportHeader{fields: [3]int{15, 7, 23}}, "ydm", time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.header.time(tt.dateOrder, berlin)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("time() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !got.Equal(tt.want) {
+				t.Errorf("time() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseExportTranscript(t *testing.T) {
+	tests := []struct {
+		name       string
+		transcript string
+		opts       ChatImportOptions
+		want       []importedMessage
+		skipped    int
+	}{
+		{
+			name: "android",
+			transcript: "Export header without a date\n" +
+				"15/07/2023, 10:30 - Messages and calls are end-to-end encrypted.\n" +
+				"15/07/2023, 10:31 - Alice: Hello\n" +
+				"second line\n" +
+				"15/07/2023, 10:32 - Bob: IMG-20230715-WA0001.jpg (file attached)\n" +
+				"Look at this\n" +
+				"15/07/2023, 10:33 - Alice: This message was deleted\n" +
+				"15/07/2023, 10:34 - Bob: Fixed it <This message was edited>\n" +
+				"15/07/2023, 10:35 - Alice: \n",
+			opts: ChatImportOptions{Me: "bob", Location: time.UTC},
+			want: []importedMessage{
+				{Time: time.Date(2023, 7, 15, 10, 30, 0, 0, time.UTC), IsSystem: true, Content: "Messages and calls are end-to-end encrypted."},
+				{Time: time.Date(2023, 7, 15, 10, 31, 0, 0, time.UTC), Sender: "Alice", Content: "Hello\nsecond line"},
+				{Time: time.Date(2023, 7, 15, 10, 32, 0, 0, time.UTC), Sender: "Bob", IsFromMe: true, Content: "Look at this",
+					MediaType: "image", Filename: "IMG-20230715-WA0001.jpg"},
+				{Time: time.Date(2023, 7, 15, 10, 33, 0, 0, time.UTC), Sender: "Alice", Content: "This message was deleted", Deleted: true},
+				{Time: time.Date(2023, 7, 15, 10, 34, 0, 0, time.UTC), Sender: "Bob", IsFromMe: true, Content: "Fixed it"},
+			},
+			skipped: 2,
+		},
+		{
+			name: "ios",
+			transcript: "[7/15/23, 9:05:01 PM] Chat: \u200eMessages and calls are end-to-end encrypted.\n" +
+				"[7/15/23, 9:06:02 PM] You: \u200e<attached: 00000012-PHOTO-2023-07-15.jpg>\n" +
+				"[7/15/23, 9:07:03 PM] +49 151 2345678: \u200eaudio omitted\n",
+			opts: ChatImportOptions{Location: time.UTC},
+			want: []importedMessage{
+				{Time: time.Date(2023, 7, 15, 21, 5, 1, 0, time.UTC), HasSeconds: true, IsSystem: true, Content: "Messages and calls are end-to-end encrypted."},
+				{Time: time.Date(2023, 7, 15, 21, 6, 2, 0, time.UTC), HasSeconds: true, Sender: "You", IsFromMe: true,
+					MediaType: "image", Filename: "00000012-PHOTO-2023-07-15.jpg"},
+				{Time: time.Date(2023, 7, 15, 21, 7, 3, 0, time.UTC), HasSeconds: true, Sender: "+49 151 2345678", MediaType: "audio"},
+			},
+		},
+		{
+			name:       "invalid date with a given order",
+			transcript: "15/07/2023, 10:30 - Alice: Hello\n",
+			opts:       ChatImportOptions{DateOrder: "mdy", Location: time.UTC},
+			skipped:    1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, skipped, err := parseExportTranscript(strings.NewReader(tt.transcript), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if skipped != tt.skipped {
+				t.Errorf("skipped %d lines, want %d", skipped, tt.skipped)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parsed %d messages, want %d: %+v", len(got), len(tt.want), got)
+			}
+			for i := range got {
+				if !got[i].Time.Equal(tt.want[i].Time) {
+					t.Errorf("message %d time = %v, want %v", i, got[i].Time, tt.want[i].Time)
+				}
+				got[i].Time = tt.want[i].Time
+				if got[i] != tt.want[i] {
+					t.Errorf("message %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizePhoneNumber(t *testing.T) {
+	tests := []struct {
+		sender string
+		want   string
+	}{
+		{"+49 151 234-5678", "491512345678"},
+		{"+1 (555) 010-0000", "15550100000"},
+		{"4915112345678", "4915112345678"},
+		{"Alice", "Alice"},
+		{"12345", "12345"},
+		{"Alice 2", "Alice 2"},
+	}
+
+	for _, tt := range tests {
+		if got := normalizePhoneNumber(tt.sender); got != tt.want {
+			t.Errorf("normalizePhoneNumber(%q) = %q, want %q", tt.sender, got, tt.want)
+		}
+	}
+}
+
+func TestChatNameFromExportPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/tmp/WhatsApp Chat with Alice.zip", "Alice"},
+		{"WhatsApp Chat - Family.txt", "Family"},
+		{"_chat.txt", ""},
+	}
+
+	for _, tt := range tests {
+		if got := chatNameFromExportPath(tt.path); got != tt.want {
+			t.Errorf("chatNameFromExportPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
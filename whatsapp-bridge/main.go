@@ -6,6 +6,7 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"math"
@@ -39,6 +40,7 @@ import (
 // Message represents a chat message for our client
 type Message struct {
 	ID            string
+	ChatJID       string
 	Time          time.Time
 	Sender        string
 	Content       string
@@ -46,100 +48,236 @@ type Message struct {
 	MediaType     string
 	Filename      string
 	QuotedMessage string
+	EditedAt      *time.Time        `json:",omitempty"`
+	Revisions     []MessageRevision `json:",omitempty"`
+	Reactions     []Reaction        `json:",omitempty"`
+	DeletedAt     *time.Time        `json:",omitempty"`
+	DeletedBy     string            `json:",omitempty"`
+	// "text", a media type, or one of the structured types in messagetypes.go
+	Type string
+	Data *MessageData `json:",omitempty"`
+	// The message this one replies to, and who sent it
+	ReplyToID     string `json:",omitempty"`
+	ReplyToSender string `json:",omitempty"`
+
+	// Structured data as stored, decoded by decryptMessage
+	structuredData string
 }
 
-// SenderWhitelist holds the list of approved senders
-var SenderWhitelist map[string]bool
-
-// Database handler for storing message history
-type MessageStore struct {
-	db *sql.DB
+// MessageRevision is one version of an edited message. Revision 0 is the
+// original text as first sent.
+type MessageRevision struct {
+	Revision int
+	Content  string
+	EditedAt time.Time
 }
 
-// Initialize message store
-func NewMessageStore() (*MessageStore, error) {
-	// Create directory for database if it doesn't exist
-	if err := os.MkdirAll("store", 0755); err != nil {
-		return nil, fmt.Errorf("failed to create store directory: %v", err)
-	}
-
-	// Open SQLite database for messages
-	db, err := sql.Open("sqlite3", "file:store/messages.db?_foreign_keys=on")
-	if err != nil {
-		return nil, fmt.Errorf("failed to open message database: %v", err)
-	}
-
-	// Create tables if they don't exist
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS chats (
-			jid TEXT PRIMARY KEY,
-			name TEXT,
-			last_message_time TIMESTAMP
-		);
-		
-		CREATE TABLE IF NOT EXISTS messages (
-			id TEXT,
-			chat_jid TEXT,
-			sender TEXT,
-			content TEXT,
-			timestamp TIMESTAMP,
-			is_from_me BOOLEAN,
-			media_type TEXT,
-			filename TEXT,
-			url TEXT,
-			media_key BLOB,
-			file_sha256 BLOB,
-			file_enc_sha256 BLOB,
-			file_length INTEGER,
-			quoted_message TEXT,
-			PRIMARY KEY (id, chat_jid),
-			FOREIGN KEY (chat_jid) REFERENCES chats(jid)
-		);
-	`)
-	if err != nil {
-		db.Close()
-		return nil, fmt.Errorf("failed to create tables: %v", err)
-	}
+// SenderWhitelist holds the list of approved senders
+var SenderWhitelist map[string]bool
 
-	return &MessageStore{db: db}, nil
+// SQL implementation of MessageStore, backed by SQLite or PostgreSQL
+type SQLMessageStore struct {
+	db *dialectDB
+	// Data keys for encrypting sensitive columns, nil when encryption at rest is disabled
+	keys *dataKeyring
+	// Whether SQLite was built with FTS5 (the sqlite_fts5 build tag), so the
+	// full-text index can be used
+	fts bool
 }
 
 // Close the database connection
-func (store *MessageStore) Close() error {
+func (store *SQLMessageStore) Close() error {
 	return store.db.Close()
 }
 
-// Store a chat in the database
-func (store *MessageStore) StoreChat(jid, name string, lastMessageTime time.Time) error {
+// Store a chat in the database, encrypting its name when encryption at rest is enabled
+func (store *SQLMessageStore) StoreChat(jid, name string, lastMessageTime time.Time) error {
 	_, err := store.db.Exec(
-		"INSERT OR REPLACE INTO chats (jid, name, last_message_time) VALUES (?, ?, ?)",
-		jid, name, lastMessageTime,
+		`INSERT INTO chats (jid, name, last_message_time) VALUES (?, ?, ?)
+		ON CONFLICT (jid) DO UPDATE SET name = excluded.name, last_message_time = excluded.last_message_time`,
+		jid, store.keys.encryptString(name), lastMessageTime,
 	)
 	return err
 }
 
+// Check whether a chat has been stored
+func (store *SQLMessageStore) ChatExists(jid string) (bool, error) {
+	var exists bool
+	err := store.db.QueryRow("SELECT EXISTS(SELECT 1 FROM chats WHERE jid = ?)", jid).Scan(&exists)
+	return exists, err
+}
+
+// Get the stored name of a chat, or an empty string if the chat has no name yet
+func (store *SQLMessageStore) GetStoredChatName(jid string) (string, error) {
+	var name sql.NullString
+	err := store.db.QueryRow("SELECT name FROM chats WHERE jid = ?", jid).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return store.keys.decryptString(name.String)
+}
+
 // Store a message in the database
-func (store *MessageStore) StoreMessage(id, chatJID, sender, content string, timestamp time.Time, isFromMe bool,
+func (store *SQLMessageStore) StoreMessage(id, chatJID, sender, content string, timestamp time.Time, isFromMe bool,
 	mediaType, filename, url string, mediaKey, fileSHA256, fileEncSHA256 []byte, fileLength uint64, quotedMessage string) error {
 	// Only store if there's actual content or media
 	if content == "" && mediaType == "" {
 		return nil
 	}
 
-	_, err := store.db.Exec(
-		`INSERT OR REPLACE INTO messages 
+	// Encrypt sensitive columns when encryption at rest is enabled
+	storedContent := store.keys.encryptString(content)
+	url = store.keys.encryptString(url)
+	mediaKey = store.keys.encryptBytes(mediaKey)
+	fileSHA256 = store.keys.encryptBytes(fileSHA256)
+	fileEncSHA256 = store.keys.encryptBytes(fileEncSHA256)
+	quotedMessage = store.keys.encryptString(quotedMessage)
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Upsert rather than replace, so a message stored again (e.g. by history sync)
+	// keeps its edit state and its edited content, and deleted messages are left alone
+	_, err = tx.Exec(
+		`INSERT INTO messages 
 		(id, chat_jid, sender, content, timestamp, is_from_me, media_type, filename, url, media_key, file_sha256, file_enc_sha256, file_length, quoted_message) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		id, chatJID, sender, content, timestamp, isFromMe, mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength, quotedMessage,
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id, chat_jid) DO UPDATE SET
+			sender = excluded.sender,
+			content = CASE WHEN messages.edited_at IS NULL THEN excluded.content ELSE messages.content END,
+			timestamp = excluded.timestamp,
+			is_from_me = excluded.is_from_me,
+			media_type = excluded.media_type,
+			filename = excluded.filename,
+			url = excluded.url,
+			media_key = excluded.media_key,
+			file_sha256 = excluded.file_sha256,
+			file_enc_sha256 = excluded.file_enc_sha256,
+			file_length = excluded.file_length,
+			quoted_message = excluded.quoted_message
+		WHERE messages.deleted_at IS NULL`,
+		id, chatJID, sender, storedContent, timestamp, isFromMe, mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength, quotedMessage,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+
+	// Keep the full-text search index in sync
+	if err := store.syncSearchIndex(tx, id, chatJID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Columns selected for a Message, in the order scanMessage expects
+const messageColumns = "id, sender, content, timestamp, is_from_me, media_type, filename, quoted_message, edited_at, deleted_at, deleted_by, message_type, structured_data, reply_to_id, reply_to_sender, chat_jid"
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Scan a row selected with messageColumns into a Message
+func scanMessage(row rowScanner) (Message, error) {
+	var msg Message
+	var timestamp time.Time
+	var quotedMessage, deletedBy, messageType, structuredData, replyToID, replyToSender sql.NullString
+	var editedAt, deletedAt sql.NullTime
+	err := row.Scan(&msg.ID, &msg.Sender, &msg.Content, &timestamp, &msg.IsFromMe, &msg.MediaType, &msg.Filename, &quotedMessage, &editedAt, &deletedAt, &deletedBy,
+		&messageType, &structuredData, &replyToID, &replyToSender, &msg.ChatJID)
+	if err != nil {
+		return msg, err
+	}
+	msg.Time = timestamp
+	if quotedMessage.Valid {
+		msg.QuotedMessage = quotedMessage.String
+	} else {
+		msg.QuotedMessage = ""
+	}
+	if editedAt.Valid {
+		msg.EditedAt = &editedAt.Time
+	}
+	if deletedAt.Valid {
+		msg.DeletedAt = &deletedAt.Time
+		msg.DeletedBy = deletedBy.String
+	}
+	// Messages stored before types were recorded are text or media
+	msg.Type = messageType.String
+	if msg.Type == "" {
+		msg.Type = messageTypeText
+		if msg.MediaType != "" {
+			msg.Type = msg.MediaType
+		}
+	}
+	msg.structuredData = structuredData.String
+	msg.ReplyToID = replyToID.String
+	msg.ReplyToSender = replyToSender.String
+	return msg, nil
 }
 
-// Get messages from a chat
-func (store *MessageStore) GetMessages(chatJID string, limit int) ([]Message, error) {
+// Get a page of messages, ordered by (timestamp, id).
+// Deleted messages are left out unless query.IncludeDeleted is set.
+func (store *SQLMessageStore) GetMessages(query MessageQuery) ([]Message, error) {
+	conditions := []string{"1 = 1"}
+	var args []interface{}
+
+	if query.ChatJID != "" {
+		conditions = append(conditions, "chat_jid = ?")
+		args = append(args, query.ChatJID)
+	}
+	if query.Sender != "" {
+		conditions = append(conditions, "sender = ?")
+		args = append(args, query.Sender)
+	}
+	// Encrypted content can only be matched after decrypting it, so the
+	// rows are filtered below and the limit is applied there
+	contains := strings.ToLower(query.Contains)
+	filterContent := contains != "" && store.keys != nil
+	if contains != "" && !filterContent {
+		conditions = append(conditions, `LOWER(content) LIKE ? ESCAPE '\'`)
+		args = append(args, likePattern(contains))
+	}
+	if !query.IncludeDeleted {
+		conditions = append(conditions, "deleted_at IS NULL")
+	}
+	if query.Before != nil {
+		conditions = append(conditions, "(timestamp < ? OR (timestamp = ? AND id < ?))")
+		args = append(args, query.Before.Time, query.Before.Time, query.Before.ID)
+	}
+	if query.After != nil {
+		conditions = append(conditions, "(timestamp > ? OR (timestamp = ? AND id > ?))")
+		args = append(args, query.After.Time, query.After.Time, query.After.ID)
+	}
+	if !query.Since.IsZero() {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, query.Since)
+	}
+	if !query.Until.IsZero() {
+		conditions = append(conditions, "timestamp <= ?")
+		args = append(args, query.Until)
+	}
+
+	order := "DESC"
+	if query.Ascending {
+		order = "ASC"
+	}
+	limit := ""
+	if !filterContent {
+		limit = " LIMIT ?"
+		args = append(args, query.Limit)
+	}
+
 	rows, err := store.db.Query(
-		"SELECT id, sender, content, timestamp, is_from_me, media_type, filename, quoted_message FROM messages WHERE chat_jid = ? ORDER BY timestamp DESC LIMIT ?",
-		chatJID, limit,
+		"SELECT "+messageColumns+" FROM messages WHERE "+strings.Join(conditions, " AND ")+
+			" ORDER BY timestamp "+order+", id "+order+limit,
+		args...,
 	)
 	if err != nil {
 		return nil, err
@@ -147,28 +285,90 @@ func (store *MessageStore) GetMessages(chatJID string, limit int) ([]Message, er
 	defer rows.Close()
 
 	var messages []Message
-	for rows.Next() {
-		var msg Message
-		var timestamp time.Time
-		var quotedMessage sql.NullString
-		err := rows.Scan(&msg.ID, &msg.Sender, &msg.Content, &timestamp, &msg.IsFromMe, &msg.MediaType, &msg.Filename, &quotedMessage)
+	for len(messages) < query.Limit && rows.Next() {
+		msg, err := scanMessage(rows)
 		if err != nil {
 			return nil, err
 		}
-		msg.Time = timestamp
-		if quotedMessage.Valid {
-			msg.QuotedMessage = quotedMessage.String
-		} else {
-			msg.QuotedMessage = ""
+		if err := store.decryptMessage(&msg); err != nil {
+			return nil, err
+		}
+		if filterContent && !strings.Contains(strings.ToLower(msg.Content), contains) {
+			continue
 		}
 		messages = append(messages, msg)
 	}
 
-	return messages, nil
+	return messages, rows.Err()
+}
+
+// Get a single message by ID, including deleted ones
+func (store *SQLMessageStore) GetMessage(id, chatJID string) (*Message, error) {
+	msg, err := scanMessage(store.db.QueryRow(
+		"SELECT "+messageColumns+" FROM messages WHERE id = ? AND chat_jid = ?",
+		id, chatJID,
+	))
+	if err != nil {
+		return nil, err
+	}
+	if err := store.decryptMessage(&msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Decrypt the encrypted columns of a scanned message
+func (store *SQLMessageStore) decryptMessage(msg *Message) error {
+	var err error
+	if msg.Content, err = store.keys.decryptString(msg.Content); err != nil {
+		return fmt.Errorf("message %s: %v", msg.ID, err)
+	}
+	if msg.QuotedMessage, err = store.keys.decryptString(msg.QuotedMessage); err != nil {
+		return fmt.Errorf("message %s: %v", msg.ID, err)
+	}
+	structuredData, err := store.keys.decryptString(msg.structuredData)
+	if err != nil {
+		return fmt.Errorf("message %s: %v", msg.ID, err)
+	}
+	return decodeMessageData(msg, structuredData)
+}
+
+// Check whether a message has been stored, including deleted ones
+func (store *SQLMessageStore) MessageExists(id, chatJID string) (bool, error) {
+	var exists bool
+	err := store.db.QueryRow("SELECT EXISTS(SELECT 1 FROM messages WHERE id = ? AND chat_jid = ?)", id, chatJID).Scan(&exists)
+	return exists, err
+}
+
+// Get every recorded version of a message, oldest first
+func (store *SQLMessageStore) GetMessageRevisions(id, chatJID string) ([]MessageRevision, error) {
+	rows, err := store.db.Query(
+		"SELECT revision, content, edited_at FROM message_revisions WHERE message_id = ? AND chat_jid = ? ORDER BY revision",
+		id, chatJID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []MessageRevision
+	for rows.Next() {
+		var revision MessageRevision
+		var content sql.NullString
+		if err := rows.Scan(&revision.Revision, &content, &revision.EditedAt); err != nil {
+			return nil, err
+		}
+		if revision.Content, err = store.keys.decryptString(content.String); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, rows.Err()
 }
 
 // Get all chats
-func (store *MessageStore) GetChats() (map[string]time.Time, error) {
+func (store *SQLMessageStore) GetChats() (map[string]time.Time, error) {
 	rows, err := store.db.Query("SELECT jid, last_message_time FROM chats ORDER BY last_message_time DESC")
 	if err != nil {
 		return nil, err
@@ -194,6 +394,7 @@ func extractTextContent(msg *waProto.Message) string {
 	if msg == nil {
 		return ""
 	}
+	msg, _ = unwrapViewOnce(msg)
 
 	// Try to get text content
 	if text := msg.GetConversation(); text != "" {
@@ -206,15 +407,17 @@ func extractTextContent(msg *waProto.Message) string {
 		return vid.GetCaption()
 	} else if doc := msg.GetDocumentMessage(); doc != nil && doc.GetCaption() != "" {
 		return doc.GetCaption()
+	} else if poll := getPollCreation(msg); poll != nil {
+		return formatPollContent(poll)
+	} else if description := describeMessageData(extractMessageData(msg)); description != "" {
+		// Locations, contact cards, events and interactive replies
+		return description
 	} else if proto := msg.GetProtocolMessage(); proto != nil {
 		if proto.GetType() == waProto.ProtocolMessage_MESSAGE_EDIT {
-			// Handle edited message content
+			// Handle edited message content (text or a media caption).
+			// Edits are flagged separately, so no marker is added to the text.
 			if edited := proto.GetEditedMessage(); edited != nil {
-				if editedText := edited.GetConversation(); editedText != "" {
-					return "[EDITED] " + editedText
-				} else if editedExtText := edited.GetExtendedTextMessage(); editedExtText != nil {
-					return "[EDITED] " + editedExtText.GetText()
-				}
+				return extractTextContent(edited)
 			}
 		} else if proto.GetType() == waProto.ProtocolMessage_REVOKE {
 			// Handle revoked (deleted) message
@@ -228,52 +431,37 @@ func extractTextContent(msg *waProto.Message) string {
 
 // Extract quoted message content from a message
 func extractQuotedMessage(msg *waProto.Message) string {
-	if msg == nil {
+	// Replies of every message type carry the quoted message in their context info
+	quotedMsg := getContextInfo(msg).GetQuotedMessage()
+	if quotedMsg == nil {
 		return ""
 	}
 
-	// Check for extended text message with context info
-	if extendedText := msg.GetExtendedTextMessage(); extendedText != nil {
-		if ctx := extendedText.GetContextInfo(); ctx != nil && ctx.QuotedMessage != nil {
-			// Try to extract text from quoted message
-			quotedMsg := ctx.QuotedMessage
-
-			// Extract text based on message type
-			if text := quotedMsg.GetConversation(); text != "" {
-				return text
-			} else if extText := quotedMsg.GetExtendedTextMessage(); extText != nil {
-				return extText.GetText()
-			} else if img := quotedMsg.GetImageMessage(); img != nil && img.GetCaption() != "" {
-				return img.GetCaption()
-			} else if vid := quotedMsg.GetVideoMessage(); vid != nil && vid.GetCaption() != "" {
-				return vid.GetCaption()
-			} else if doc := quotedMsg.GetDocumentMessage(); doc != nil && doc.GetCaption() != "" {
-				return doc.GetCaption()
-			}
-
-			// If we couldn't extract text, return a placeholder based on the message type
-			if quotedMsg.GetImageMessage() != nil {
-				return "[Image]"
-			} else if quotedMsg.GetVideoMessage() != nil {
-				return "[Video]"
-			} else if quotedMsg.GetAudioMessage() != nil {
-				return "[Audio]"
-			} else if quotedMsg.GetDocumentMessage() != nil {
-				return "[Document]"
-			} else if quotedMsg.GetStickerMessage() != nil {
-				return "[Sticker]"
-			} else if quotedMsg.GetContactMessage() != nil {
-				return "[Contact]"
-			} else if quotedMsg.GetLocationMessage() != nil {
-				return "[Location]"
-			}
-
-			// Unknown message type
-			return "[Message]"
-		}
+	// Extract the text, caption or description of the quoted message
+	if text := extractTextContent(quotedMsg); text != "" {
+		return text
 	}
 
-	return ""
+	// If we couldn't extract text, return a placeholder based on the message type
+	quotedMsg, _ = unwrapViewOnce(quotedMsg)
+	if quotedMsg.GetImageMessage() != nil {
+		return "[Image]"
+	} else if quotedMsg.GetVideoMessage() != nil {
+		return "[Video]"
+	} else if quotedMsg.GetAudioMessage() != nil {
+		return "[Audio]"
+	} else if quotedMsg.GetDocumentMessage() != nil {
+		return "[Document]"
+	} else if quotedMsg.GetStickerMessage() != nil {
+		return "[Sticker]"
+	} else if quotedMsg.GetContactMessage() != nil {
+		return "[Contact]"
+	} else if quotedMsg.GetLocationMessage() != nil {
+		return "[Location]"
+	}
+
+	// Unknown message type
+	return "[Message]"
 }
 
 // SendMessageResponse represents the response for the send message API
@@ -284,16 +472,25 @@ type SendMessageResponse struct {
 
 // SendMessageRequest represents the request body for the send message API
 type SendMessageRequest struct {
-	Recipient string `json:"recipient"`
-	Message   string `json:"message"`
-	MediaPath string `json:"media_path,omitempty"`
+	Recipient string       `json:"recipient"`
+	Message   string       `json:"message"`
+	MediaPath string       `json:"media_path,omitempty"`
+	ReplyTo   *ReplyTarget `json:"reply_to,omitempty"`
+	// Phone numbers or JIDs to mention, besides the "@<phone>" tokens in the text
+	Mentions []string `json:"mentions,omitempty"`
+	// Mention all participants of the group
+	MentionEveryone bool `json:"mention_everyone,omitempty"`
 }
 
 // SendURLImageRequest represents the request body for sending images via URL
 type SendURLImageRequest struct {
-	Recipient string `json:"recipient"`
-	Message   string `json:"message"`
-	ImageURL  string `json:"image_url"`
+	Recipient string       `json:"recipient"`
+	Message   string       `json:"message"`
+	ImageURL  string       `json:"image_url"`
+	ReplyTo   *ReplyTarget `json:"reply_to,omitempty"`
+	// Mentions as in SendMessageRequest
+	Mentions        []string `json:"mentions,omitempty"`
+	MentionEveryone bool     `json:"mention_everyone,omitempty"`
 }
 
 // ImageBase64Response represents the response for the image base64 API
@@ -305,8 +502,9 @@ type ImageBase64Response struct {
 	MimeType string `json:"mime_type,omitempty"`
 }
 
-// Function to send a WhatsApp message
-func sendWhatsAppMessage(client *whatsmeow.Client, recipient string, message string, mediaPath string) (bool, string) {
+// Function to send a WhatsApp message. A non-nil contextInfo (a quoted
+// reply, mentions) is attached to the message whatever its type.
+func sendWhatsAppMessage(client *whatsmeow.Client, recipient string, message string, mediaPath string, contextInfo *waProto.ContextInfo) (bool, string) {
 	fmt.Println("sendWhatsAppMessage called with:", recipient, message, mediaPath)
 
 	if !client.IsConnected() {
@@ -315,25 +513,10 @@ func sendWhatsAppMessage(client *whatsmeow.Client, recipient string, message str
 	}
 
 	// Create JID for recipient
-	var recipientJID types.JID
-	var err error
-
-	// Check if recipient is a JID
-	isJID := strings.Contains(recipient, "@")
-
-	if isJID {
-		// Parse the JID string
-		recipientJID, err = types.ParseJID(recipient)
-		if err != nil {
-			fmt.Println("Error parsing JID:", err)
-			return false, fmt.Sprintf("Error parsing JID: %v", err)
-		}
-	} else {
-		// Create JID from phone number
-		recipientJID = types.JID{
-			User:   recipient,
-			Server: "s.whatsapp.net", // For personal chats
-		}
+	recipientJID, err := parseRecipientJID(recipient)
+	if err != nil {
+		fmt.Println("Error parsing JID:", err)
+		return false, fmt.Sprintf("Error parsing JID: %v", err)
 	}
 
 	fmt.Println("Recipient JID:", recipientJID.String())
@@ -343,7 +526,7 @@ func sendWhatsAppMessage(client *whatsmeow.Client, recipient string, message str
 	// Check if we have media to send
 	if mediaPath != "" {
 		// Read media file
-		mediaData, err := os.ReadFile(mediaPath)
+		mediaData, err := readMediaFile(mediaPath)
 		if err != nil {
 			fmt.Println("Error reading media file:", err)
 			return false, fmt.Sprintf("Error reading media file: %v", err)
@@ -473,6 +656,10 @@ func sendWhatsAppMessage(client *whatsmeow.Client, recipient string, message str
 		msg.Conversation = proto.String(message)
 	}
 
+	if contextInfo != nil {
+		setContextInfo(msg, contextInfo)
+	}
+
 	// Send message
 	fmt.Println("Sending message to:", recipientJID.String())
 	resp, err := client.SendMessage(context.Background(), recipientJID, msg)
@@ -484,6 +671,28 @@ func sendWhatsAppMessage(client *whatsmeow.Client, recipient string, message str
 
 	fmt.Println("Message sent successfully with ID:", resp.ID)
 
+	dispatchOutgoingMessage(client, recipientJID, resp.ID, msg)
+
+	return true, fmt.Sprintf("Message sent to %s", recipient)
+}
+
+// Parse a send recipient: a full JID, or a phone number for a personal chat
+func parseRecipientJID(recipient string) (types.JID, error) {
+	// Check if recipient is a JID
+	if strings.Contains(recipient, "@") {
+		return types.ParseJID(recipient)
+	}
+
+	// Create JID from phone number
+	return types.JID{
+		User:   recipient,
+		Server: "s.whatsapp.net", // For personal chats
+	}, nil
+}
+
+// Dispatch a message we sent as an events.Message, so it is stored and
+// processed by the same handlers as incoming messages
+func dispatchOutgoingMessage(client *whatsmeow.Client, recipientJID types.JID, id types.MessageID, msg *waProto.Message) {
 	// Create an events.Message struct for the outgoing message
 	outgoingMsg := &events.Message{
 		Info: types.MessageInfo{
@@ -493,7 +702,7 @@ func sendWhatsAppMessage(client *whatsmeow.Client, recipient string, message str
 				IsFromMe: true,                          // Mark as sent by us
 				IsGroup:  recipientJID.Server == "g.us", // Check if it's a group
 			},
-			ID:        resp.ID,    // Message ID from the send response
+			ID:        id,         // Message ID from the send response
 			Timestamp: time.Now(), // Current time
 		},
 		Message: msg, // The original message object we sent
@@ -501,8 +710,6 @@ func sendWhatsAppMessage(client *whatsmeow.Client, recipient string, message str
 
 	// Manually dispatch the event to trigger the same handlers as incoming messages
 	client.DangerousInternals().DispatchEvent(outgoingMsg)
-
-	return true, fmt.Sprintf("Message sent to %s", recipient)
 }
 
 // Extract media info from a message
@@ -510,6 +717,7 @@ func extractMediaInfo(msg *waProto.Message) (mediaType string, filename string,
 	if msg == nil {
 		return "", "", "", nil, nil, nil, 0
 	}
+	msg, _ = unwrapViewOnce(msg)
 
 	// Check for image message
 	if img := msg.GetImageMessage(); img != nil {
@@ -539,9 +747,37 @@ func extractMediaInfo(msg *waProto.Message) (mediaType string, filename string,
 			doc.GetURL(), doc.GetMediaKey(), doc.GetFileSHA256(), doc.GetFileEncSHA256(), doc.GetFileLength()
 	}
 
+	// Check for sticker message
+	if sticker := msg.GetStickerMessage(); sticker != nil {
+		return "sticker", "sticker_" + time.Now().Format("20060102_150405") + ".webp",
+			sticker.GetURL(), sticker.GetMediaKey(), sticker.GetFileSHA256(), sticker.GetFileEncSHA256(), sticker.GetFileLength()
+	}
+
 	return "", "", "", nil, nil, nil, 0
 }
 
+// Extract the mimetype and direct path of a media message
+func extractMediaSource(msg *waProto.Message) (mimetype string, directPath string) {
+	if msg == nil {
+		return "", ""
+	}
+	msg, _ = unwrapViewOnce(msg)
+
+	switch {
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage().GetMimetype(), msg.GetImageMessage().GetDirectPath()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage().GetMimetype(), msg.GetVideoMessage().GetDirectPath()
+	case msg.GetAudioMessage() != nil:
+		return msg.GetAudioMessage().GetMimetype(), msg.GetAudioMessage().GetDirectPath()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage().GetMimetype(), msg.GetDocumentMessage().GetDirectPath()
+	case msg.GetStickerMessage() != nil:
+		return msg.GetStickerMessage().GetMimetype(), msg.GetStickerMessage().GetDirectPath()
+	}
+	return "", ""
+}
+
 // formatOrderAsNaturalLanguage converts order details to a natural language string
 func formatOrderAsNaturalLanguage(node *waBinary.Node) string {
 	if node == nil {
@@ -602,7 +838,7 @@ func formatOrderAsNaturalLanguage(node *waBinary.Node) string {
 }
 
 // Handle regular incoming messages with media support
-func handleMessage(client *whatsmeow.Client, messageStore *MessageStore, msg *events.Message, logger waLog.Logger) {
+func handleMessage(client *whatsmeow.Client, messageStore MessageStore, downloads *mediaDownloadPool, msg *events.Message, logger waLog.Logger) {
 	// Save message to database
 	chatJID := msg.Info.Chat.String()
 	sender := msg.Info.Sender.User
@@ -612,6 +848,21 @@ func handleMessage(client *whatsmeow.Client, messageStore *MessageStore, msg *ev
 		return
 	}
 
+	// Keep the sender's push name and last activity up to date
+	recordMessageSender(client, messageStore, msg.Info, logger)
+
+	// Reactions are kept apart from messages, keyed to the message they react to
+	if msg.Message.GetReactionMessage() != nil {
+		handleReactionMessage(messageStore, msg, logger)
+		return
+	}
+
+	// Poll votes only update the tally of the poll they belong to
+	if msg.Message.GetPollUpdateMessage() != nil {
+		handlePollVote(client, messageStore, msg, logger)
+		return
+	}
+
 	// Get chat name and update chat record
 	name := GetChatName(client, messageStore, msg.Info.Chat, chatJID, nil, sender, logger)
 	logger.Infof("Chat name: %s", name)
@@ -625,8 +876,22 @@ func handleMessage(client *whatsmeow.Client, messageStore *MessageStore, msg *ev
 	// Extract message content and media info
 	content := extractTextContent(msg.Message)
 	quotedMessage := extractQuotedMessage(msg.Message)
+	replyToID, replyToSender := extractReplyTarget(msg.Message)
 	mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength := extractMediaInfo(msg.Message)
 
+	// Extract the message type and structured data (locations, contact cards, ...)
+	messageType, messageData := extractMessageData(msg.Message)
+	if isEditedMessage {
+		messageType, messageData = extractMessageData(msg.Message.GetProtocolMessage().GetEditedMessage())
+	}
+	if messageData == nil && (msg.IsViewOnce || msg.IsViewOnceV2 || msg.IsViewOnceV2Extension) {
+		messageData = &MessageData{ViewOnce: true}
+	}
+	if messageType == "" && !isRevokedMessage {
+		// Other messages with content, such as orders, are stored as text
+		messageType = messageTypeText
+	}
+
 	// Process order message if present
 	isOrder, orderID, orderFormatted := processOrderMessage(client, msg.Message, &content, logger)
 
@@ -639,19 +904,51 @@ func handleMessage(client *whatsmeow.Client, messageStore *MessageStore, msg *ev
 
 	// Handle edited or revoked messages
 	if (isEditedMessage || isRevokedMessage) && originalMessageID != "" {
-		handleEditedOrRevokedMessage(messageStore, isRevokedMessage, originalMessageID, chatJID, content, msg.Info.Timestamp, logger)
+		handleEditedOrRevokedMessage(messageStore, isRevokedMessage, originalMessageID, chatJID, sender, content, msg.Info.Timestamp, logger)
 	} else {
 		// Store new message
 		storeNewMessage(messageStore, msg.Info.ID, chatJID, sender, content, msg.Info.Timestamp,
 			msg.Info.IsFromMe, mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256,
 			fileLength, quotedMessage, logger)
+		if messageType != "" {
+			if err := messageStore.StoreMessageData(msg.Info.ID, chatJID, messageType, messageData); err != nil {
+				logger.Warnf("Failed to store message data: %v", err)
+			}
+		}
+		if replyToID != "" {
+			if err := messageStore.StoreReplyTarget(msg.Info.ID, chatJID, replyToID, replyToSender); err != nil {
+				logger.Warnf("Failed to store reply link: %v", err)
+			}
+		}
+		if mimetype, directPath := extractMediaSource(msg.Message); mimetype != "" || directPath != "" {
+			if err := messageStore.StoreMediaSource(msg.Info.ID, chatJID, mimetype, directPath); err != nil {
+				logger.Warnf("Failed to store media source: %v", err)
+			}
+		}
+
+		// Keep polls with their options, so votes can be tallied
+		recordPoll(messageStore, msg, logger)
+
+		// Fetch the media while its URL is still valid, if the download policy asks for it
+		if mediaType != "" {
+			downloads.Enqueue(msg.Info.ID, chatJID, mediaType, fileLength)
+		}
+
+		// Start the delivery status history of our own messages
+		if msg.Info.IsFromMe {
+			recordSentStatus(messageStore, msg, logger)
+		}
 	}
 
 	// Send webhook for eligible messages
-	if isEligibleForWebhook(msg, chatJID, isRevokedMessage, logger) {
-		sendWebhook(msg.Info.ID, chatJID, sender, content, msg.Info.Timestamp,
-			msg.Info.IsFromMe, mediaType, filename, url, quotedMessage,
-			isEditedMessage, originalMessageID, isOrder, orderID, orderFormatted, logger)
+	if isEligibleForWebhook(msg, chatJID, logger) {
+		if isRevokedMessage {
+			sendDeletedWebhook(messageStore, originalMessageID, chatJID, sender, msg.Info.Timestamp, logger)
+		} else {
+			sendWebhook(msg.Info.ID, chatJID, sender, content, msg.Info.Timestamp,
+				msg.Info.IsFromMe, mediaType, filename, url, quotedMessage, replyToID, replyToSender, messageType, messageData,
+				isEditedMessage, originalMessageID, isOrder, orderID, orderFormatted, logger)
+		}
 	}
 }
 
@@ -742,11 +1039,11 @@ func shouldSkipMessage(content string, mediaType string, isRevokedMessage bool,
 }
 
 // Handle edited or revoked messages
-func handleEditedOrRevokedMessage(messageStore *MessageStore, isRevokedMessage bool, originalID string, chatJID string, content string, timestamp time.Time, logger waLog.Logger) {
+func handleEditedOrRevokedMessage(messageStore MessageStore, isRevokedMessage bool, originalID string, chatJID string, sender string, content string, timestamp time.Time, logger waLog.Logger) {
 	var err error
 
 	if isRevokedMessage {
-		err = messageStore.MarkMessageAsDeleted(originalID, chatJID, timestamp)
+		err = messageStore.MarkMessageAsDeleted(originalID, chatJID, sender, timestamp)
 		if err != nil {
 			logger.Warnf("Failed to mark message as deleted: %v", err)
 		} else {
@@ -764,7 +1061,7 @@ func handleEditedOrRevokedMessage(messageStore *MessageStore, isRevokedMessage b
 }
 
 // Store a new message in the database and log it
-func storeNewMessage(messageStore *MessageStore, msgID string, chatJID string, sender string, content string,
+func storeNewMessage(messageStore MessageStore, msgID string, chatJID string, sender string, content string,
 	timestamp time.Time, isFromMe bool, mediaType string, filename string, url string, mediaKey []byte,
 	fileSHA256 []byte, fileEncSHA256 []byte, fileLength uint64, quotedMessage string, logger waLog.Logger) {
 
@@ -800,11 +1097,17 @@ func storeNewMessage(messageStore *MessageStore, msgID string, chatJID string, s
 
 // Send webhook notification
 func sendWebhook(msgID string, chatJID string, sender string, content string, timestamp time.Time,
-	isFromMe bool, mediaType string, filename string, url string, quotedMessage string,
+	isFromMe bool, mediaType string, filename string, url string, quotedMessage string, replyToID string, replyToSender string,
+	messageType string, messageData *MessageData,
 	isEditedMessage bool, originalMessageID string, isOrder bool, orderID string, orderFormatted string, logger waLog.Logger) {
 
 	// Prepare webhook payload
+	event := "message"
+	if isEditedMessage {
+		event = "message.edited"
+	}
 	webhookPayload := map[string]interface{}{
+		"event":          event,
 		"id":             msgID,
 		"chat_jid":       chatJID,
 		"sender":         sender,
@@ -816,6 +1119,18 @@ func sendWebhook(msgID string, chatJID string, sender string, content string, ti
 		"url":            url,
 		"quoted_message": quotedMessage,
 		"is_edited":      isEditedMessage,
+		"type":           messageType,
+	}
+
+	// Link replies to the message they answer
+	if replyToID != "" {
+		webhookPayload["reply_to_id"] = replyToID
+		webhookPayload["reply_to_sender"] = replyToSender
+	}
+
+	// Add the structured fields of locations, contact cards, polls, ...
+	if messageData != nil {
+		webhookPayload["data"] = messageData
 	}
 
 	// Add order details to webhook payload if available
@@ -831,6 +1146,41 @@ func sendWebhook(msgID string, chatJID string, sender string, content string, ti
 		webhookPayload["original_message_id"] = originalMessageID
 	}
 
+	postWebhook(webhookPayload, logger)
+}
+
+// Send a message.deleted webhook notification. The original message is
+// included when it is still retained in the store.
+func sendDeletedWebhook(messageStore MessageStore, originalMessageID string, chatJID string, deletedBy string,
+	deletedAt time.Time, logger waLog.Logger) {
+
+	webhookPayload := map[string]interface{}{
+		"event":      "message.deleted",
+		"id":         originalMessageID,
+		"chat_jid":   chatJID,
+		"deleted_by": deletedBy,
+		"deleted_at": deletedAt,
+	}
+
+	if original, err := messageStore.GetMessage(originalMessageID, chatJID); err == nil {
+		webhookPayload["original_message"] = map[string]interface{}{
+			"sender":         original.Sender,
+			"content":        original.Content,
+			"timestamp":      original.Time,
+			"is_from_me":     original.IsFromMe,
+			"media_type":     original.MediaType,
+			"filename":       original.Filename,
+			"quoted_message": original.QuotedMessage,
+		}
+	} else {
+		logger.Infof("Deleted message %s not found in store, sending webhook without original content", originalMessageID)
+	}
+
+	postWebhook(webhookPayload, logger)
+}
+
+// POST a webhook payload to WEBHOOK_URL
+func postWebhook(webhookPayload map[string]interface{}, logger waLog.Logger) {
 	// Marshal payload to JSON
 	jsonPayload, err := json.Marshal(webhookPayload)
 	if err != nil {
@@ -871,16 +1221,17 @@ type DownloadMediaResponse struct {
 }
 
 // Store additional media info in the database
-func (store *MessageStore) StoreMediaInfo(id, chatJID, url string, mediaKey, fileSHA256, fileEncSHA256 []byte, fileLength uint64) error {
+func (store *SQLMessageStore) StoreMediaInfo(id, chatJID, url string, mediaKey, fileSHA256, fileEncSHA256 []byte, fileLength uint64) error {
 	_, err := store.db.Exec(
 		"UPDATE messages SET url = ?, media_key = ?, file_sha256 = ?, file_enc_sha256 = ?, file_length = ? WHERE id = ? AND chat_jid = ?",
-		url, mediaKey, fileSHA256, fileEncSHA256, fileLength, id, chatJID,
+		store.keys.encryptString(url), store.keys.encryptBytes(mediaKey), store.keys.encryptBytes(fileSHA256),
+		store.keys.encryptBytes(fileEncSHA256), fileLength, id, chatJID,
 	)
 	return err
 }
 
 // Get media info from the database
-func (store *MessageStore) GetMediaInfo(id, chatJID string) (string, string, string, []byte, []byte, []byte, uint64, error) {
+func (store *SQLMessageStore) GetMediaInfo(id, chatJID string) (string, string, string, []byte, []byte, []byte, uint64, error) {
 	var mediaType, filename sql.NullString
 	var url sql.NullString
 	var mediaKey, fileSHA256, fileEncSHA256 []byte
@@ -890,6 +1241,9 @@ func (store *MessageStore) GetMediaInfo(id, chatJID string) (string, string, str
 		"SELECT media_type, filename, url, media_key, file_sha256, file_enc_sha256, file_length FROM messages WHERE id = ? AND chat_jid = ?",
 		id, chatJID,
 	).Scan(&mediaType, &filename, &url, &mediaKey, &fileSHA256, &fileEncSHA256, &fileLength)
+	if err == nil {
+		err = store.decryptMediaInfo(&url, &mediaKey, &fileSHA256, &fileEncSHA256)
+	}
 
 	// Convert nullable types to their non-nullable equivalents
 	mediaTypeStr := ""
@@ -915,6 +1269,46 @@ func (store *MessageStore) GetMediaInfo(id, chatJID string) (string, string, str
 	return mediaTypeStr, filenameStr, urlStr, mediaKey, fileSHA256, fileEncSHA256, fileLengthVal, err
 }
 
+// Store the mimetype and direct path of a media message, which are needed to
+// quote it
+func (store *SQLMessageStore) StoreMediaSource(id, chatJID, mimetype, directPath string) error {
+	_, err := store.db.Exec(
+		"UPDATE messages SET mimetype = ?, direct_path = ? WHERE id = ? AND chat_jid = ?",
+		nullIfEmpty(mimetype), nullIfEmpty(store.keys.encryptString(directPath)), id, chatJID,
+	)
+	return err
+}
+
+// Get the mimetype and direct path of a media message
+func (store *SQLMessageStore) GetMediaSource(id, chatJID string) (string, string, error) {
+	var mimetype, directPath sql.NullString
+	err := store.db.QueryRow(
+		"SELECT mimetype, direct_path FROM messages WHERE id = ? AND chat_jid = ?", id, chatJID,
+	).Scan(&mimetype, &directPath)
+	if err != nil {
+		return "", "", err
+	}
+	path, err := store.keys.decryptString(directPath.String)
+	if err != nil {
+		return "", "", fmt.Errorf("message %s: %v", id, err)
+	}
+	return mimetype.String, path, nil
+}
+
+// Decrypt the encrypted media columns of a message
+func (store *SQLMessageStore) decryptMediaInfo(url *sql.NullString, mediaKey, fileSHA256, fileEncSHA256 *[]byte) error {
+	var err error
+	if url.String, err = store.keys.decryptString(url.String); err != nil {
+		return err
+	}
+	for _, value := range []*[]byte{mediaKey, fileSHA256, fileEncSHA256} {
+		if *value, err = store.keys.decryptBytes(*value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // MediaDownloader implements the whatsmeow.DownloadableMessage interface
 type MediaDownloader struct {
 	URL           string
@@ -961,40 +1355,38 @@ func (d *MediaDownloader) GetMediaType() whatsmeow.MediaType {
 	return d.MediaType
 }
 
-// Function to download media from a message
-func downloadMedia(client *whatsmeow.Client, messageStore *MessageStore, messageID, chatJID string) (bool, string, string, string, error) {
+// Get the directory where media for a chat was downloaded before the media store
+func chatMediaDir(chatJID string) string {
+	return filepath.Join("store", strings.ReplaceAll(chatJID, ":", "_"))
+}
+
+// Get the legacy local path of a downloaded media file for a chat
+func mediaFilePath(chatJID, filename string) string {
+	return filepath.Join(chatMediaDir(chatJID), filename)
+}
+
+// Function to download media from a message. Media is kept in the
+// content-addressed media store, so a file shared by several messages is
+// only downloaded and stored once.
+func downloadMedia(client *whatsmeow.Client, messageStore MessageStore, messageID, chatJID string) (bool, string, string, string, error) {
 	// Query the database for the message
 	var mediaType, filename, url string
 	var mediaKey, fileSHA256, fileEncSHA256 []byte
 	var fileLength uint64
 	var err error
 
-	// First, check if we already have this file
-	chatDir := fmt.Sprintf("store/%s", strings.ReplaceAll(chatJID, ":", "_"))
-	localPath := ""
-
 	// Get media info from the database
 	mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength, err = messageStore.GetMediaInfo(messageID, chatJID)
 
 	if err != nil {
 		// Try to get basic info if extended info isn't available
-		var mediaTypeNull, filenameNull sql.NullString
-		err = messageStore.db.QueryRow(
-			"SELECT media_type, filename FROM messages WHERE id = ? AND chat_jid = ?",
-			messageID, chatJID,
-		).Scan(&mediaTypeNull, &filenameNull)
-
+		msg, err := messageStore.GetMessage(messageID, chatJID)
 		if err != nil {
 			return false, "", "", "", fmt.Errorf("failed to find message: %v", err)
 		}
 
-		if mediaTypeNull.Valid {
-			mediaType = mediaTypeNull.String
-		}
-
-		if filenameNull.Valid {
-			filename = filenameNull.String
-		}
+		mediaType = msg.MediaType
+		filename = msg.Filename
 	}
 
 	// Check if this is a media message
@@ -1002,24 +1394,22 @@ func downloadMedia(client *whatsmeow.Client, messageStore *MessageStore, message
 		return false, "", "", "", fmt.Errorf("not a media message")
 	}
 
-	// Create directory for the chat if it doesn't exist
-	if err := os.MkdirAll(chatDir, 0755); err != nil {
-		return false, "", "", "", fmt.Errorf("failed to create chat directory: %v", err)
-	}
-
-	// Generate a local path for the file
-	localPath = fmt.Sprintf("%s/%s", chatDir, filename)
-
-	// Get absolute path
-	absPath, err := filepath.Abs(localPath)
-	if err != nil {
-		return false, "", "", "", fmt.Errorf("failed to get absolute path: %v", err)
+	// Check if we already have this file
+	if hash, err := messageStore.GetMediaRef(messageID, chatJID); err == nil {
+		if localPath, ok := existingMediaBlob(hash); ok {
+			return true, mediaType, filename, localPath, nil
+		}
 	}
 
-	// Check if file already exists
-	if _, err := os.Stat(localPath); err == nil {
-		// File exists, return it
-		return true, mediaType, filename, absPath, nil
+	// Another message may already have brought in the same file
+	if len(fileSHA256) > 0 {
+		hash := mediaBlobName(fileSHA256)
+		if localPath, ok := existingMediaBlob(hash); ok {
+			if err := messageStore.StoreMediaRef(messageID, chatJID, hash, int64(fileLength)); err != nil {
+				return false, "", "", "", fmt.Errorf("failed to reference media file: %v", err)
+			}
+			return true, mediaType, filename, localPath, nil
+		}
 	}
 
 	// If we don't have all the media info we need, we can't download
@@ -1035,7 +1425,7 @@ func downloadMedia(client *whatsmeow.Client, messageStore *MessageStore, message
 	// Create a downloader that implements DownloadableMessage
 	var waMediaType whatsmeow.MediaType
 	switch mediaType {
-	case "image":
+	case "image", "sticker":
 		waMediaType = whatsmeow.MediaImage
 	case "video":
 		waMediaType = whatsmeow.MediaVideo
@@ -1063,10 +1453,19 @@ func downloadMedia(client *whatsmeow.Client, messageStore *MessageStore, message
 		return false, "", "", "", fmt.Errorf("failed to download media: %v", err)
 	}
 
-	// Save the downloaded media to file
-	if err := os.WriteFile(localPath, mediaData, 0644); err != nil {
+	// Save the downloaded media to the media store, encrypted if encryption at rest is enabled
+	hash, _, err := writeMediaBlob(mediaData)
+	if err != nil {
 		return false, "", "", "", fmt.Errorf("failed to save media file: %v", err)
 	}
+	if err := messageStore.StoreMediaRef(messageID, chatJID, hash, int64(len(mediaData))); err != nil {
+		return false, "", "", "", fmt.Errorf("failed to reference media file: %v", err)
+	}
+
+	absPath, err := filepath.Abs(mediaBlobPath(hash))
+	if err != nil {
+		return false, "", "", "", fmt.Errorf("failed to get absolute path: %v", err)
+	}
 
 	fmt.Printf("Successfully downloaded %s media to %s (%d bytes)\n", mediaType, absPath, len(mediaData))
 	return true, mediaType, filename, absPath, nil
@@ -1093,7 +1492,7 @@ func extractDirectPathFromURL(url string) string {
 }
 
 // Start a REST API server to expose the WhatsApp client functionality
-func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port int) {
+func startRESTServer(client *whatsmeow.Client, messageStore MessageStore, janitor *retentionJanitor, port int) {
 	// Get logger reference for the REST server
 	logger := waLog.Stdout("REST", "INFO", true)
 
@@ -1167,10 +1566,24 @@ func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port
 			}
 		}
 
+		// Resolve the message replied to and the users mentioned, if any
+		contextInfo, status, err := sendContextForRequest(client, messageStore, req.Recipient, req.Message,
+			req.ReplyTo, req.Mentions, req.MentionEveryone)
+		if err != nil {
+			logger.Warnf("API call failed: %v", err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(SendMessageResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+
 		logger.Infof("Received request to send message to %s", req.Recipient)
 
 		// Send the message
-		success, message := sendWhatsAppMessage(client, req.Recipient, req.Message, req.MediaPath)
+		success, message := sendWhatsAppMessage(client, req.Recipient, req.Message, req.MediaPath, contextInfo)
 
 		// Set response headers
 		w.Header().Set("Content-Type", "application/json")
@@ -1242,6 +1655,18 @@ func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port
 			return
 		}
 
+		contextInfo, status, err := sendContextForRequest(client, messageStore, req.Recipient, req.Message,
+			req.ReplyTo, req.Mentions, req.MentionEveryone)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(SendMessageResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
+
 		logger.Infof("Received request to send image from URL to %s", req.Recipient)
 
 		// Download the image from URL
@@ -1266,7 +1691,7 @@ func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port
 		}()
 
 		// Send the message using the existing function
-		success, message := sendWhatsAppMessage(client, req.Recipient, req.Message, tempFilePath)
+		success, message := sendWhatsAppMessage(client, req.Recipient, req.Message, tempFilePath, contextInfo)
 
 		// Set response headers
 		w.Header().Set("Content-Type", "application/json")
@@ -1303,18 +1728,8 @@ func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port
 			return
 		}
 
-		// Parse query parameters
+		// Parse query parameters. Without chat_jid, messages from every chat are listed.
 		chatJID := r.URL.Query().Get("chat_jid")
-		if chatJID == "" {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"success": false,
-				"error":   "Missing required parameter: chat_jid",
-				"message": "The chat_jid parameter is required to identify which chat to retrieve messages from",
-			})
-			return
-		}
 
 		// Parse limit parameter with default value
 		limit := 20
@@ -1333,9 +1748,87 @@ func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port
 			}
 		}
 
+		// Optionally include the edit history of each message
+		includeRevisions := false
+		if revisionsStr := r.URL.Query().Get("include_revisions"); revisionsStr != "" {
+			includeRevisions = revisionsStr == "true" || revisionsStr == "1" || revisionsStr == "yes"
+		}
+
+		// Deleted messages are hidden unless explicitly requested
+		includeDeleted := false
+		if deletedStr := r.URL.Query().Get("include_deleted"); deletedStr != "" {
+			includeDeleted = deletedStr == "true" || deletedStr == "1" || deletedStr == "yes"
+		}
+
+		// Senders are stored by the user part of their JID
+		sender, _, _ := strings.Cut(r.URL.Query().Get("sender"), "@")
+
+		messageQuery := MessageQuery{
+			ChatJID:        chatJID,
+			Sender:         sender,
+			Contains:       r.URL.Query().Get("q"),
+			IncludeDeleted: includeDeleted,
+		}
+
+		// Small helper for the pagination validation failures below
+		badRequest := func(errMsg, message string) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   errMsg,
+				"message": message,
+			})
+		}
+
+		// Parse pagination parameters
+		switch order := r.URL.Query().Get("order"); order {
+		case "", "desc":
+		case "asc":
+			messageQuery.Ascending = true
+		default:
+			badRequest("Invalid order parameter", "The order parameter must be asc or desc")
+			return
+		}
+		if beforeStr := r.URL.Query().Get("before"); beforeStr != "" {
+			cursor, err := parseMessageCursor(beforeStr)
+			if err != nil {
+				badRequest("Invalid before parameter", "The before parameter must be a cursor returned as next_cursor")
+				return
+			}
+			messageQuery.Before = cursor
+		}
+		if afterStr := r.URL.Query().Get("after"); afterStr != "" {
+			cursor, err := parseMessageCursor(afterStr)
+			if err != nil {
+				badRequest("Invalid after parameter", "The after parameter must be a cursor returned as next_cursor")
+				return
+			}
+			messageQuery.After = cursor
+		}
+		if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+			since, err := parseSearchTime(sinceStr, false)
+			if err != nil {
+				badRequest("Invalid since parameter", err.Error())
+				return
+			}
+			messageQuery.Since = since
+		}
+		if untilStr := r.URL.Query().Get("until"); untilStr != "" {
+			until, err := parseSearchTime(untilStr, true)
+			if err != nil {
+				badRequest("Invalid until parameter", err.Error())
+				return
+			}
+			messageQuery.Until = until
+		}
+
 		// Check if chat exists
-		var chatExists bool
-		err := messageStore.db.QueryRow("SELECT EXISTS(SELECT 1 FROM chats WHERE jid = ?)", chatJID).Scan(&chatExists)
+		chatExists := true
+		var err error
+		if chatJID != "" {
+			chatExists, err = messageStore.ChatExists(chatJID)
+		}
 		if err != nil {
 			logger.Warnf("Database error checking chat existence: %v", err)
 			w.Header().Set("Content-Type", "application/json")
@@ -1360,7 +1853,8 @@ func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port
 		}
 
 		// Get messages
-		messages, err := messageStore.GetMessages(chatJID, limit)
+		messageQuery.Limit = limit
+		messages, hasMore, err := getMessagePage(messageStore, messageQuery)
 
 		// Set response headers
 		w.Header().Set("Content-Type", "application/json")
@@ -1377,23 +1871,112 @@ func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port
 			return
 		}
 
+		// Attach revisions to edited messages
+		if includeRevisions {
+			for i := range messages {
+				if messages[i].EditedAt == nil {
+					continue
+				}
+				revisions, err := messageStore.GetMessageRevisions(messages[i].ID, messages[i].ChatJID)
+				if err != nil {
+					logger.Warnf("Error retrieving revisions for message %s: %v", messages[i].ID, err)
+					w.WriteHeader(http.StatusInternalServerError)
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"success": false,
+						"error":   "Database error",
+						"message": fmt.Sprintf("Failed to retrieve message revisions: %v", err),
+					})
+					return
+				}
+				messages[i].Revisions = revisions
+			}
+		}
+
+		// Attach reactions to the messages they react to
+		if err := attachReactions(messageStore, messages); err != nil {
+			logger.Warnf("Error retrieving reactions: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "Database error",
+				"message": fmt.Sprintf("Failed to retrieve reactions: %v", err),
+			})
+			return
+		}
+
 		// Handle case where no messages were found
 		if len(messages) == 0 {
 			json.NewEncoder(w).Encode(map[string]interface{}{
 				"success":  true,
 				"messages": []struct{}{},
 				"message":  "No messages found for this chat",
+				"has_more": false,
 			})
 			return
 		}
 
-		// Send successful response
+		// Send successful response. The cursor of the last message continues
+		// the listing in the same order, and is kept even on the last page so
+		// that sync jobs can resume from it later.
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success":  true,
-			"messages": messages,
+			"success":     true,
+			"messages":    messages,
+			"next_cursor": cursorForMessage(messages[len(messages)-1]).String(),
+			"has_more":    hasMore,
 		})
 	})
 
+	// Handler for full-text search over stored messages
+	http.HandleFunc("/api/search", handleSearch(messageStore, logger))
+
+	// Handler reporting what the retention janitor last removed
+	http.HandleFunc("/api/retention", handleRetentionReport(janitor))
+
+	// Handlers for searching contacts and looking up a single contact
+	http.HandleFunc("/api/contacts", handleContacts(messageStore, logger))
+	http.HandleFunc("/api/contacts/{jid}", handleContacts(messageStore, logger))
+
+	// Handlers for listing groups and getting one group with its participants
+	http.HandleFunc("/api/groups", handleGroups(client, messageStore, logger))
+	http.HandleFunc("/api/groups/{jid}", handleGroups(client, messageStore, logger))
+
+	// Handlers for listing chats and looking up a single chat
+	http.HandleFunc("/api/chats", handleChats(messageStore, logger))
+	http.HandleFunc("/api/chats/{jid}", handleChats(messageStore, logger))
+
+	// Handler for exporting a chat as JSON Lines, text, HTML or a zip bundle
+	http.HandleFunc("/api/chats/{jid}/export", handleChatExport(messageStore, logger))
+
+	// Handlers for editing and deleting our messages
+	http.HandleFunc("/api/messages/{id}", handleDeleteMessage(client, messageStore, logger))
+	http.HandleFunc("/api/messages/{id}/edit", handleEditMessage(client, messageStore, logger))
+
+	// Handler for the delivery status of a message
+	http.HandleFunc("/api/messages/{id}/status", handleMessageStatus(messageStore, logger))
+
+	// Handler for walking the reply chain of a message
+	http.HandleFunc("/api/messages/{id}/thread", handleMessageThread(messageStore, logger))
+
+	// Handler for the messages around a message
+	http.HandleFunc("/api/messages/{id}/context", handleMessageContext(messageStore, logger))
+
+	// Handlers for sending a poll and getting its live tally
+	http.HandleFunc("/api/send-poll", handleSendPoll(client, logger))
+	http.HandleFunc("/api/polls/{id}", handlePoll(messageStore, logger))
+
+	// Handlers for sending a location and contact cards
+	http.HandleFunc("/api/send-location", handleSendLocation(client, messageStore, logger))
+	http.HandleFunc("/api/send-contact", handleSendContact(client, messageStore, logger))
+
+	// Handler for reacting to a message
+	http.HandleFunc("/api/react", handleReact(client, messageStore, logger))
+
+	// Handler for streaming the media of a message
+	http.HandleFunc("/api/media/{chat_jid}/{message_id}", handleMedia(client, messageStore, logger))
+
+	// Handler for the state of automatic media downloads
+	http.HandleFunc("/api/media-downloads", handleMediaDownloads(messageStore, logger))
+
 	// Handler for downloading media
 	http.HandleFunc("/api/download", func(w http.ResponseWriter, r *http.Request) {
 		// Only allow POST requests
@@ -1437,9 +2020,7 @@ func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port
 		}
 
 		// Check if message exists
-		var messageExists bool
-		err := messageStore.db.QueryRow("SELECT EXISTS(SELECT 1 FROM messages WHERE id = ? AND chat_jid = ?)",
-			req.MessageID, req.ChatJID).Scan(&messageExists)
+		messageExists, err := messageStore.MessageExists(req.MessageID, req.ChatJID)
 		if err != nil {
 			logger.Warnf("Database error checking message existence: %v", err)
 			w.Header().Set("Content-Type", "application/json")
@@ -1543,12 +2124,18 @@ func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port
 			return
 		}
 
-		// Sanitize the chat JID for use in a path
-		sanitizedChatJID := strings.ReplaceAll(chatJID, ":", "_")
-
-		// Construct the path where the file should be
-		chatDir := fmt.Sprintf("store/%s", sanitizedChatJID)
-		filePath := filepath.Join(chatDir, filename)
+		// Only files of stored messages are served, never arbitrary paths
+		messageID, filePath, status, err := findRequestedMedia(messageStore, chatJID, filename)
+		if err != nil {
+			logger.Warnf("Refusing media request for %s in chat %s: %v", filename, chatJID, err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(ImageBase64Response{
+				Success: false,
+				Message: err.Error(),
+			})
+			return
+		}
 		logger.Debugf("Looking for file at path: %s", filePath)
 
 		// Track if the file was downloaded just for this request
@@ -1560,19 +2147,6 @@ func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port
 			logger.Warnf("File not found at path: %s, will attempt to download", filePath)
 			fileExists = false
 
-			// Try to find the message ID in the database
-			messageID, err := messageStore.FindMessageIDByFilename(chatJID, filename)
-			if err != nil {
-				logger.Errorf("Failed to find message ID for file %s in chat %s: %v", filename, chatJID, err)
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusNotFound)
-				json.NewEncoder(w).Encode(ImageBase64Response{
-					Success: false,
-					Message: fmt.Sprintf("File not found and unable to locate message in database: %v", err),
-				})
-				return
-			}
-
 			logger.Infof("Found message ID %s for file %s, attempting to download", messageID, filename)
 
 			// Try to download the file
@@ -1611,7 +2185,7 @@ func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port
 		}
 
 		// Read the file
-		fileData, err := os.ReadFile(filePath)
+		fileData, err := readMediaFile(filePath)
 		if err != nil {
 			logger.Errorf("Failed to read file %s: %v", filePath, err)
 			w.Header().Set("Content-Type", "application/json")
@@ -1655,10 +2229,11 @@ func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port
 		})
 		logger.Infof("Successfully responded to request for file %s", filename)
 
-		// Delete the file if requested or if it was downloaded just for this request
+		// Delete the file if requested or if it was downloaded just for this request.
+		// A stored file shared with other messages is kept for them.
 		if deleteAfterSend || wasDownloadedForThisRequest {
 			logger.Infof("Deleting file after sending response: %s", filePath)
-			if err := os.Remove(filePath); err != nil {
+			if err := releaseStoredMedia(messageStore, MediaFile{MessageID: messageID, ChatJID: chatJID, Filename: filename}); err != nil {
 				logger.Errorf("Failed to delete file %s: %v", filePath, err)
 			} else {
 				logger.Infof("Successfully deleted file: %s", filePath)
@@ -1708,12 +2283,13 @@ func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port
 			return
 		}
 
-		// Sanitize the chat JID for use in a path
-		sanitizedChatJID := strings.ReplaceAll(chatJID, ":", "_")
-
-		// Construct the path where the file should be
-		chatDir := fmt.Sprintf("store/%s", sanitizedChatJID)
-		filePath := filepath.Join(chatDir, filename)
+		// Only files of stored messages are served, never arbitrary paths
+		messageID, filePath, status, err := findRequestedMedia(messageStore, chatJID, filename)
+		if err != nil {
+			logger.Warnf("Refusing media request for %s in chat %s: %v", filename, chatJID, err)
+			http.Error(w, err.Error(), status)
+			return
+		}
 		logger.Debugf("Looking for file at path: %s", filePath)
 
 		// Track if the file was downloaded just for this request
@@ -1725,14 +2301,6 @@ func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port
 			logger.Warnf("File not found at path: %s, will attempt to download", filePath)
 			fileExists = false
 
-			// Try to find the message ID in the database
-			messageID, err := messageStore.FindMessageIDByFilename(chatJID, filename)
-			if err != nil {
-				logger.Errorf("Failed to find message ID for file %s in chat %s: %v", filename, chatJID, err)
-				http.Error(w, fmt.Sprintf("File not found and unable to locate message in database: %v", err), http.StatusNotFound)
-				return
-			}
-
 			logger.Infof("Found message ID %s for file %s, attempting to download", messageID, filename)
 
 			// Try to download the file
@@ -1761,7 +2329,7 @@ func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port
 		}
 
 		// Read the file
-		fileData, err := os.ReadFile(filePath)
+		fileData, err := readMediaFile(filePath)
 		if err != nil {
 			logger.Errorf("Failed to read file %s: %v", filePath, err)
 			http.Error(w, fmt.Sprintf("Failed to read file: %v", err), http.StatusInternalServerError)
@@ -1779,10 +2347,11 @@ func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port
 			logger.Infof("Successfully sent PDF file %s", filename)
 		}
 
-		// Delete the file if requested or if it was downloaded just for this request
+		// Delete the file if requested or if it was downloaded just for this request.
+		// A stored file shared with other messages is kept for them.
 		if deleteAfterSend || wasDownloadedForThisRequest {
 			logger.Infof("Deleting file after sending response: %s", filePath)
-			if err := os.Remove(filePath); err != nil {
+			if err := releaseStoredMedia(messageStore, MediaFile{MessageID: messageID, ChatJID: chatJID, Filename: filename}); err != nil {
 				logger.Errorf("Failed to delete file %s: %v", filePath, err)
 			} else {
 				logger.Infof("Successfully deleted file: %s", filePath)
@@ -1809,8 +2378,80 @@ func main() {
 		fmt.Println("Warning: .env file not found or failed to load")
 	}
 
+	// Parse command line flags
+	migrateOnly := flag.Bool("migrate-only", false, "Apply pending message database migrations and exit")
+	dryRun := flag.Bool("dry-run", false, "List pending message database migrations without applying them, then exit")
+	rotateMasterKey := flag.Bool("rotate-master-key", false, "Rewrap the data keys with ENCRYPTION_NEW_KEY, then exit")
+	reencrypt := flag.Bool("reencrypt", false, "Re-encrypt all messages and media with a new data key, then exit")
+	exportChat := flag.String("export-chat", "", "Export the chat with this JID, then exit")
+	exportFormat := flag.String("export-format", exportFormatJSONL, "Chat export format: jsonl, txt, html or zip")
+	exportFrom := flag.String("export-from", "", "Only export messages at or after this date (RFC3339 or YYYY-MM-DD)")
+	exportTo := flag.String("export-to", "", "Only export messages at or before this date (RFC3339 or YYYY-MM-DD)")
+	exportOutput := flag.String("export-output", "", "File to write the chat export to (default chat-<jid>.<format>)")
+	importChat := flag.String("import-chat", "", "Import a WhatsApp \"Export chat\" .txt or .zip file, then exit")
+	importJID := flag.String("import-jid", "", "JID of the chat to import into")
+	importName := flag.String("import-name", "", "Name of the imported chat (default taken from the file name)")
+	importMe := flag.String("import-me", "", "Your own name as it appears in the export")
+	importDateOrder := flag.String("import-date-order", "", "Date order of the export: dmy, mdy or ymd (default detected)")
+	importTZ := flag.String("import-tz", "", "Time zone of the phone that made the export, e.g. Europe/Berlin (default local)")
+	flag.Parse()
+
 	// Set up logger
 	logger := waLog.Stdout("Client", "INFO", true)
+
+	if *migrateOnly || *dryRun {
+		runMigrateOnly(*dryRun, logger)
+		return
+	}
+
+	if *rotateMasterKey {
+		rewrapped, err := RotateMasterKey()
+		if err != nil {
+			logger.Errorf("Master key rotation failed: %v", err)
+			os.Exit(1)
+		}
+		logger.Infof("Rewrapped %d data key(s); set ENCRYPTION_KEY to the new master key before restarting", rewrapped)
+		return
+	}
+
+	if *reencrypt {
+		if err := ReencryptMessageStore(logger); err != nil {
+			logger.Errorf("Re-encryption failed: %v", err)
+			os.Exit(1)
+		}
+		logger.Infof("Message database and media re-encrypted")
+		return
+	}
+
+	if *exportChat != "" {
+		opts, err := parseExportOptions(*exportChat, *exportFormat, *exportFrom, *exportTo)
+		if err != nil {
+			logger.Errorf("Invalid export options: %v", err)
+			os.Exit(1)
+		}
+		runExportChat(opts, *exportOutput, logger)
+		return
+	}
+
+	if *importChat != "" {
+		location := time.Local
+		if *importTZ != "" {
+			if location, err = time.LoadLocation(*importTZ); err != nil {
+				logger.Errorf("Invalid time zone: %v", err)
+				os.Exit(1)
+			}
+		}
+		runImportChat(ChatImportOptions{
+			Path:      *importChat,
+			ChatJID:   *importJID,
+			Name:      *importName,
+			Me:        *importMe,
+			DateOrder: *importDateOrder,
+			Location:  location,
+		}, logger)
+		return
+	}
+
 	logger.Infof("Starting WhatsApp client...")
 
 	// Initialize whitelist from environment variable
@@ -1859,12 +2500,25 @@ func main() {
 	}
 	defer messageStore.Close()
 
+	// Move media downloaded before the media store existed into it
+	if moved, err := migrateLegacyMedia(messageStore, logger); err != nil {
+		logger.Warnf("Failed to migrate media files: %v", err)
+	} else if moved > 0 {
+		logger.Infof("Moved %d media file(s) into the media store", moved)
+	}
+
+	// Prune old messages and media according to the retention policy
+	janitor := startRetentionJanitor(messageStore, logger)
+
+	// Download media in the background as it arrives, according to the download policy
+	downloads := startMediaDownloadPool(client, messageStore, logger)
+
 	// Setup event handling for messages and history sync
 	client.AddEventHandler(func(evt interface{}) {
 		switch v := evt.(type) {
 		case *events.Message:
 			// Process regular messages
-			handleMessage(client, messageStore, v, logger)
+			handleMessage(client, messageStore, downloads, v, logger)
 
 		case *events.HistorySync:
 			// Process history sync events
@@ -1872,6 +2526,17 @@ func main() {
 
 		case *events.Connected:
 			logger.Infof("Connected to WhatsApp")
+			go syncStoreContacts(client, messageStore, logger)
+			go syncJoinedGroups(client, messageStore, logger)
+
+		case *events.PushName, *events.BusinessName, *events.Contact:
+			handleContactEvent(client, messageStore, v, logger)
+
+		case *events.JoinedGroup, *events.GroupInfo:
+			handleGroupEvent(client, messageStore, v, logger)
+
+		case *events.Receipt:
+			handleReceipt(client, messageStore, v, logger)
 
 		case *events.LoggedOut:
 			logger.Warnf("Device logged out, please scan QR code to log in again")
@@ -1940,7 +2605,7 @@ func main() {
 			logger.Warnf("Invalid PORT environment variable: %s, using default port %d", portStr, port)
 		}
 	}
-	startRESTServer(client, messageStore, port)
+	startRESTServer(client, messageStore, janitor, port)
 
 	// Create a channel to keep the main goroutine alive
 	exitChan := make(chan os.Signal, 1)
@@ -1956,11 +2621,38 @@ func main() {
 	client.Disconnect()
 }
 
+// Apply (or list, for a dry run) pending message database migrations
+func runMigrateOnly(dryRun bool, logger waLog.Logger) {
+	migrations, err := MigrateMessageStore(dryRun)
+	if err != nil {
+		logger.Errorf("Migration failed: %v", err)
+		os.Exit(1)
+	}
+
+	if len(migrations) == 0 {
+		logger.Infof("Message database is up to date (schema version %d)", latestSchemaVersion())
+		return
+	}
+
+	for _, m := range migrations {
+		if dryRun {
+			logger.Infof("Pending migration %d: %s", m.Version, m.Description)
+		} else {
+			logger.Infof("Applied migration %d: %s", m.Version, m.Description)
+		}
+	}
+
+	if dryRun {
+		logger.Infof("Dry run: %d migration(s) would be applied", len(migrations))
+	} else {
+		logger.Infof("Message database migrated to schema version %d", latestSchemaVersion())
+	}
+}
+
 // GetChatName determines the appropriate name for a chat based on JID and other info
-func GetChatName(client *whatsmeow.Client, messageStore *MessageStore, jid types.JID, chatJID string, conversation interface{}, sender string, logger waLog.Logger) string {
+func GetChatName(client *whatsmeow.Client, messageStore MessageStore, jid types.JID, chatJID string, conversation interface{}, sender string, logger waLog.Logger) string {
 	// First, check if chat already exists in database with a name
-	var existingName string
-	err := messageStore.db.QueryRow("SELECT name FROM chats WHERE jid = ?", chatJID).Scan(&existingName)
+	existingName, err := messageStore.GetStoredChatName(chatJID)
 	if err == nil && existingName != "" {
 		// Chat exists with a name, use that
 		logger.Infof("Using existing chat name for %s: %s", chatJID, existingName)
@@ -2008,6 +2700,10 @@ func GetChatName(client *whatsmeow.Client, messageStore *MessageStore, jid types
 		// If we didn't get a name, try group info
 		if name == "" {
 			groupInfo, err := client.GetGroupInfo(jid)
+			if err == nil {
+				// Keep the rest of the group metadata while we have it
+				recordGroupInfo(messageStore, groupInfo, logger)
+			}
 			if err == nil && groupInfo.Name != "" {
 				name = groupInfo.Name
 			} else {
@@ -2021,10 +2717,12 @@ func GetChatName(client *whatsmeow.Client, messageStore *MessageStore, jid types
 		// This is an individual contact
 		logger.Infof("Getting name for contact: %s", chatJID)
 
-		// Just use contact info (full name)
+		// Just use contact info (full name), then whatever else we know about the contact
 		contact, err := client.Store.Contacts.GetContact(context.Background(), jid)
 		if err == nil && contact.FullName != "" {
 			name = contact.FullName
+		} else if stored, err := messageStore.GetContact(chatJID); err == nil {
+			name = stored.DisplayName()
 		} else if sender != "" {
 			// Fallback to sender
 			name = sender
@@ -2040,9 +2738,11 @@ func GetChatName(client *whatsmeow.Client, messageStore *MessageStore, jid types
 }
 
 // Handle history sync events
-func handleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, historySync *events.HistorySync, logger waLog.Logger) {
+func handleHistorySync(client *whatsmeow.Client, messageStore MessageStore, historySync *events.HistorySync, logger waLog.Logger) {
 	fmt.Printf("Received history sync event with %d conversations\n", len(historySync.Data.Conversations))
 
+	storeHistorySyncPushNames(client, messageStore, historySync, logger)
+
 	syncedCount := 0
 	for _, conversation := range historySync.Data.Conversations {
 		// Parse JID from the conversation
@@ -2087,16 +2787,15 @@ func handleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, his
 					continue
 				}
 
-				// Extract text content
-				var content string
-				if msg.Message.Message != nil {
-					if conv := msg.Message.Message.GetConversation(); conv != "" {
-						content = conv
-					} else if ext := msg.Message.Message.GetExtendedTextMessage(); ext != nil {
-						content = ext.GetText()
-					}
+				// Edits, deletes and other protocol messages only change earlier
+				// messages, and are already applied to the history we get
+				if msg.Message.Message.GetProtocolMessage() != nil {
+					continue
 				}
 
+				// Extract text content, the same way as for live messages
+				content := extractTextContent(msg.Message.Message)
+
 				// Extract quoted message content
 				var quotedMessage string
 				if msg.Message.Message != nil {
@@ -2112,8 +2811,13 @@ func handleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, his
 					mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength = extractMediaInfo(msg.Message.Message)
 				}
 
+				// Extract the message type and structured data (locations, contact
+				// cards, polls, stickers, view-once media, ...). Their content is a
+				// description of the structured data, so they are not skipped below.
+				messageType, messageData := extractMessageData(msg.Message.Message)
+
 				// Log the message content for debugging
-				logger.Infof("Message content: %v, Media Type: %v", content, mediaType)
+				logger.Infof("Message content: %v, Media Type: %v, Type: %v", content, mediaType, messageType)
 
 				// Skip messages with no content and no media
 				if content == "" && mediaType == "" {
@@ -2182,6 +2886,23 @@ func handleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, his
 					logger.Warnf("Failed to store history message: %v", err)
 				} else {
 					syncedCount++
+					if messageType != "" {
+						if err := messageStore.StoreMessageData(msgID, chatJID, messageType, messageData); err != nil {
+							logger.Warnf("Failed to store history message data: %v", err)
+						}
+					}
+					if replyToID, replyToSender := extractReplyTarget(msg.Message.Message); replyToID != "" {
+						if err := messageStore.StoreReplyTarget(msgID, chatJID, replyToID, replyToSender); err != nil {
+							logger.Warnf("Failed to store history reply link: %v", err)
+						}
+					}
+					if mimetype, directPath := extractMediaSource(msg.Message.Message); mimetype != "" || directPath != "" {
+						if err := messageStore.StoreMediaSource(msgID, chatJID, mimetype, directPath); err != nil {
+							logger.Warnf("Failed to store history media source: %v", err)
+						}
+					}
+					storeHistorySyncReactions(client, messageStore, chatJID, jid, msgID, msg.Message.GetReactions(), logger)
+					storeHistorySyncPoll(client, messageStore, chatJID, jid, msgID, sender, timestamp, msg.Message, logger)
 					// Log successful message storage
 					if mediaType != "" {
 						logger.Infof("Stored message: [%s] %s -> %s: [%s: %s] %s",
@@ -2479,7 +3200,7 @@ func downloadImageFromURL(imageURL string) (string, error) {
 }
 
 // Find message ID by chat_jid and filename
-func (store *MessageStore) FindMessageIDByFilename(chatJID string, filename string) (string, error) {
+func (store *SQLMessageStore) FindMessageIDByFilename(chatJID string, filename string) (string, error) {
 	var messageID sql.NullString
 	err := store.db.QueryRow(
 		"SELECT id FROM messages WHERE chat_jid = ? AND filename = ? LIMIT 1",
@@ -2497,20 +3218,87 @@ func (store *MessageStore) FindMessageIDByFilename(chatJID string, filename stri
 	return "", fmt.Errorf("message ID is NULL")
 }
 
-// Update an edited message in the database
-func (store *MessageStore) UpdateEditedMessage(originalID, chatJID, content string, timestamp time.Time) error {
-	_, err := store.db.Exec(
-		"UPDATE messages SET content = ?, timestamp = ? WHERE id = ? AND chat_jid = ?",
+// Update an edited message in the database, keeping every earlier version in
+// message_revisions. The original send time stays on the message row and the
+// edit time is recorded as edited_at.
+func (store *SQLMessageStore) UpdateEditedMessage(originalID, chatJID, content string, timestamp time.Time) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Nothing to revise if we never stored the original message
+	var exists bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM messages WHERE id = ? AND chat_jid = ?)", originalID, chatJID).Scan(&exists)
+	if err != nil || !exists {
+		return err
+	}
+
+	// On the first edit, save the original text as revision 0
+	_, err = tx.Exec(
+		`INSERT INTO message_revisions (message_id, chat_jid, revision, content, edited_at)
+		SELECT id, chat_jid, 0, content, timestamp FROM messages
+		WHERE id = ? AND chat_jid = ?
+		AND NOT EXISTS (SELECT 1 FROM message_revisions WHERE message_id = ? AND chat_jid = ?)`,
+		originalID, chatJID, originalID, chatJID,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Ignore repeated deliveries of an edit we already recorded
+	var latestContent sql.NullString
+	err = tx.QueryRow(
+		"SELECT content FROM message_revisions WHERE message_id = ? AND chat_jid = ? ORDER BY revision DESC LIMIT 1",
+		originalID, chatJID,
+	).Scan(&latestContent)
+	if err != nil {
+		return err
+	}
+	if latestContent.Valid {
+		latest, err := store.keys.decryptString(latestContent.String)
+		if err != nil {
+			return err
+		}
+		if latest == content {
+			return nil
+		}
+	}
+
+	content = store.keys.encryptString(content)
+
+	_, err = tx.Exec(
+		`INSERT INTO message_revisions (message_id, chat_jid, revision, content, edited_at)
+		VALUES (?, ?, (SELECT MAX(revision) + 1 FROM message_revisions WHERE message_id = ? AND chat_jid = ?), ?, ?)`,
+		originalID, chatJID, originalID, chatJID, content, timestamp,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE messages SET content = ?, edited_at = ? WHERE id = ? AND chat_jid = ?",
 		content, timestamp, originalID, chatJID,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+
+	if err := store.syncSearchIndex(tx, originalID, chatJID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-// Mark a message as deleted in the database
-func (store *MessageStore) MarkMessageAsDeleted(originalID, chatJID string, timestamp time.Time) error {
+// Mark a message as deleted in the database. The row is kept as a tombstone with
+// its original content, which is only cleared later by the deleted message
+// retention policy.
+func (store *SQLMessageStore) MarkMessageAsDeleted(originalID, chatJID, deletedBy string, timestamp time.Time) error {
 	_, err := store.db.Exec(
-		"UPDATE messages SET content = '[MESSAGE DELETED]', timestamp = ? WHERE id = ? AND chat_jid = ?",
-		timestamp, originalID, chatJID,
+		"UPDATE messages SET deleted_at = ?, deleted_by = ? WHERE id = ? AND chat_jid = ? AND deleted_at IS NULL",
+		timestamp, deletedBy, originalID, chatJID,
 	)
 	return err
 }
@@ -2738,7 +3526,8 @@ func decodeOrderDetails(node *waBinary.Node) {
 		}
 	}
 
-	fmt.Println("========================\n")
+	fmt.Println("========================")
+	fmt.Println()
 }
 
 // ExtractOrderFromMessage attempts to extract order details from a message
@@ -2769,27 +3558,22 @@ func ExtractOrderFromMessage(msg *waProto.Message) (orderID string, token string
 }
 
 // Check if a message is eligible for webhook notification
-func isEligibleForWebhook(msg *events.Message, chatJID string, isRevokedMessage bool, logger waLog.Logger) bool {
+func isEligibleForWebhook(msg *events.Message, chatJID string, logger waLog.Logger) bool {
 	// Don't send webhook for messages from self
 	if msg.Info.IsFromMe {
 		return false
 	}
-	
-	// Don't send webhook for revoked messages
-	if isRevokedMessage {
-		return false
-	}
-	
+
 	// Don't send webhook for group messages
 	if msg.Info.IsGroup {
 		return false
 	}
-	
+
 	// Don't send webhook for @lid JIDs
 	if strings.HasSuffix(chatJID, "@lid") {
 		logger.Infof("Skipping webhook for message from @lid JID: %s", chatJID)
 		return false
 	}
-	
+
 	return true
 }
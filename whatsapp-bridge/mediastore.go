@@ -0,0 +1,694 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// Downloaded media is stored once per distinct content, named by the SHA-256
+// of its plaintext: store/blobs/<first two hex digits>/<hash>. The media_refs
+// table maps each message to the blob holding its file, so the same file
+// forwarded to many chats takes up space once, and a blob is only removed
+// when the last message referencing it lets go. With encryption at rest the
+// name is an HMAC of the SHA-256 under the active data key instead, so the
+// store does not reveal whether it holds a known file.
+var mediaBlobDir = filepath.Join(mediaRootDir, "blobs")
+
+// Get the name of the blob for content with the given SHA-256
+func mediaBlobName(sum []byte) string {
+	if mediaKeys == nil {
+		return hex.EncodeToString(sum)
+	}
+	return mediaKeys.blobName(mediaKeys.active, sum)
+}
+
+// Check whether a blob name belongs to content with the given SHA-256. Names
+// under retired data keys and plain hashes from before encryption was enabled
+// stay valid until the store is re-encrypted.
+func matchesMediaBlobName(name string, sum []byte) bool {
+	if name == hex.EncodeToString(sum) {
+		return true
+	}
+	if mediaKeys == nil {
+		return false
+	}
+	for id := range mediaKeys.blobKeys {
+		if name == mediaKeys.blobName(id, sum) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the path of the blob holding the content with the given hash
+func mediaBlobPath(hash string) string {
+	return filepath.Join(mediaBlobDir, hash[:2], hash)
+}
+
+// Get the absolute path of a blob, if it is in the media store
+func existingMediaBlob(hash string) (string, bool) {
+	path, err := filepath.Abs(mediaBlobPath(hash))
+	if err != nil {
+		return "", false
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+	return path, true
+}
+
+// Check whether a path names a blob in the media store, so that reads of it
+// can be verified against its name
+func isMediaBlobPath(path string) (string, bool) {
+	name := filepath.Base(path)
+	if len(name) != sha256.Size*2 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(name); err != nil {
+		return "", false
+	}
+	dir := filepath.Dir(path)
+	if filepath.Base(dir) != name[:2] || filepath.Base(filepath.Dir(dir)) != filepath.Base(mediaBlobDir) {
+		return "", false
+	}
+	return name, true
+}
+
+// Write content into the media store unless a blob with the same content is
+// already there. Returns its name and whether a new blob was written.
+func writeMediaBlob(data []byte) (string, bool, error) {
+	sum := sha256.Sum256(data)
+	hash := mediaBlobName(sum[:])
+	path := mediaBlobPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", false, err
+	}
+	// Write under a temporary name so a blob is never seen half written
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".blob-*")
+	if err != nil {
+		return "", false, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := writeMediaFile(tmp.Name(), data); err != nil {
+		return "", false, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", false, err
+	}
+	return hash, true, nil
+}
+
+// blobVerifyReader hashes a blob as it is read and fails the read that
+// reaches the end if the content does not match the blob's name. A corrupt
+// blob is moved aside so the next download replaces it.
+type blobVerifyReader struct {
+	io.ReadCloser
+	path    string
+	want    string
+	hash    hash.Hash
+	err     error
+	release func()
+}
+
+func (b *blobVerifyReader) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	if err != io.EOF {
+		return n, err
+	}
+
+	if b.err = checkMediaBlob(b.path, b.want, b.hash); b.err != nil {
+		return n, b.err
+	}
+	return n, io.EOF
+}
+
+func (b *blobVerifyReader) Close() error {
+	b.release()
+	return b.ReadCloser.Close()
+}
+
+// Compare the hash of a blob's content with its name, moving the blob
+// aside if they differ
+func checkMediaBlob(path, want string, h hash.Hash) error {
+	if matchesMediaBlobName(want, h.Sum(nil)) {
+		return nil
+	}
+	err := fmt.Errorf("media blob %s is corrupt: content does not match its name", path)
+	if renameErr := os.Rename(path, path+".corrupt"); renameErr != nil && !os.IsNotExist(renameErr) {
+		err = fmt.Errorf("%v (failed to quarantine it: %v)", err, renameErr)
+	}
+	return err
+}
+
+// blobVerifySeeker checks a blob against its hash when its whole content is
+// read in one pass from the start. Range reads cannot be checked this way.
+type blobVerifySeeker struct {
+	*mediaFileSeeker
+	path    string
+	want    string
+	hash    hash.Hash
+	hashed  int64
+	err     error
+	release func()
+}
+
+func (b *blobVerifySeeker) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	before := b.offset
+	n, err := b.mediaFileSeeker.Read(p)
+	// Stop verifying once reads skip part of the content
+	if b.hashed < 0 || before != b.hashed {
+		b.hashed = -1
+		return n, err
+	}
+
+	b.hash.Write(p[:n])
+	b.hashed += int64(n)
+	if b.hashed == b.size {
+		if b.err = checkMediaBlob(b.path, b.want, b.hash); b.err != nil {
+			return n, b.err
+		}
+	}
+	return n, err
+}
+
+func (b *blobVerifySeeker) Close() error {
+	b.release()
+	return b.mediaFileSeeker.Close()
+}
+
+// Blobs open for reading, with the number of readers of each. The disk
+// budget leaves them for a later run rather than deleting them under a
+// stream.
+var openMediaBlobs = struct {
+	sync.Mutex
+	readers map[string]int
+}{readers: make(map[string]int)}
+
+// Count a reader of a blob until the returned function is called
+func useMediaBlob(hash string) func() {
+	openMediaBlobs.Lock()
+	openMediaBlobs.readers[hash]++
+	openMediaBlobs.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			openMediaBlobs.Lock()
+			defer openMediaBlobs.Unlock()
+			if openMediaBlobs.readers[hash]--; openMediaBlobs.readers[hash] <= 0 {
+				delete(openMediaBlobs.readers, hash)
+			}
+		})
+	}
+}
+
+// Check whether a blob is being read
+func mediaBlobInUse(hash string) bool {
+	openMediaBlobs.Lock()
+	defer openMediaBlobs.Unlock()
+	return openMediaBlobs.readers[hash] > 0
+}
+
+// Open a stored media file for random access. Blobs of the media store are
+// checked against their content hash when read whole.
+func openStoredMedia(path string) (io.ReadSeekCloser, error) {
+	file, err := openMediaFileSeeker(path)
+	if err != nil {
+		return nil, err
+	}
+	want, ok := isMediaBlobPath(path)
+	if !ok {
+		return file, nil
+	}
+	return &blobVerifySeeker{mediaFileSeeker: file, path: path, want: want, hash: sha256.New(), release: useMediaBlob(want)}, nil
+}
+
+// Wrap the reader of a media file in integrity verification when the file
+// is a blob of the media store
+func verifyMediaBlob(path string, r io.ReadCloser) io.ReadCloser {
+	want, ok := isMediaBlobPath(path)
+	if !ok {
+		return r
+	}
+	return &blobVerifyReader{ReadCloser: r, path: path, want: want, hash: sha256.New(), release: useMediaBlob(want)}
+}
+
+// Point the rows of a blob to a new name. A blob already stored under the
+// new name keeps its row, so two copies of the same content merge.
+func renameMediaBlob(db *dialectDB, from, to string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		`INSERT INTO media_blobs (sha256, size, created_at)
+		SELECT ?, size, created_at FROM media_blobs WHERE sha256 = ?
+		ON CONFLICT (sha256) DO NOTHING`,
+		to, from,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE media_refs SET sha256 = ? WHERE sha256 = ?", to, from); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM media_blobs WHERE sha256 = ?", from); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get the hash of the blob holding a message's media file
+func (store *SQLMessageStore) GetMediaRef(messageID, chatJID string) (string, error) {
+	var hash string
+	err := store.db.QueryRow(
+		"SELECT sha256 FROM media_refs WHERE chat_jid = ? AND message_id = ?",
+		chatJID, messageID,
+	).Scan(&hash)
+	return hash, err
+}
+
+// Record that a message's media file is the blob with the given hash
+func (store *SQLMessageStore) StoreMediaRef(messageID, chatJID, hash string, size int64) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"INSERT INTO media_blobs (sha256, size, created_at) VALUES (?, ?, ?) ON CONFLICT (sha256) DO NOTHING",
+		hash, size, time.Now(),
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO media_refs (message_id, chat_jid, sha256) VALUES (?, ?, ?)
+		ON CONFLICT (chat_jid, message_id) DO UPDATE SET sha256 = excluded.sha256`,
+		messageID, chatJID, hash,
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Release a message's media file. Returns the path of the file to delete:
+// the blob once no other message references it, the legacy per-chat file
+// for media downloaded before the media store, or "" when the file is
+// still in use.
+func (store *SQLMessageStore) ReleaseMediaFile(file MediaFile) (string, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var hash string
+	err = tx.QueryRow(
+		"SELECT sha256 FROM media_refs WHERE chat_jid = ? AND message_id = ?",
+		file.ChatJID, file.MessageID,
+	).Scan(&hash)
+	if err == sql.ErrNoRows {
+		if file.Filename == "" {
+			return "", nil
+		}
+		return mediaFilePath(file.ChatJID, filepath.Base(file.Filename)), nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := tx.Exec("DELETE FROM media_refs WHERE chat_jid = ? AND message_id = ?", file.ChatJID, file.MessageID); err != nil {
+		return "", err
+	}
+
+	var remaining int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM media_refs WHERE sha256 = ?", hash).Scan(&remaining); err != nil {
+		return "", err
+	}
+	path := ""
+	if remaining == 0 {
+		if _, err := tx.Exec("DELETE FROM media_blobs WHERE sha256 = ?", hash); err != nil {
+			return "", err
+		}
+		path = mediaBlobPath(hash)
+	}
+
+	return path, tx.Commit()
+}
+
+// MediaBlob is a file of the media store, shared by every message that
+// references it
+type MediaBlob struct {
+	Hash      string
+	Size      int64
+	CreatedAt time.Time
+}
+
+// Get the blobs of the media store, oldest first
+func (store *SQLMessageStore) GetMediaBlobs() ([]MediaBlob, error) {
+	rows, err := store.db.Query("SELECT sha256, size, created_at FROM media_blobs ORDER BY created_at, sha256")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blobs []MediaBlob
+	for rows.Next() {
+		var blob MediaBlob
+		var createdAt sql.NullTime
+		if err := rows.Scan(&blob.Hash, &blob.Size, &createdAt); err != nil {
+			return nil, err
+		}
+		blob.CreatedAt = createdAt.Time
+		blobs = append(blobs, blob)
+	}
+	return blobs, rows.Err()
+}
+
+// Drop a blob from the media store along with every message's reference to
+// it, so those messages download their file again when it is next needed.
+// Returns the path of the blob to delete, or "" if it was already released.
+func (store *SQLMessageStore) ReleaseMediaBlob(hash string) (string, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM media_refs WHERE sha256 = ?", hash); err != nil {
+		return "", err
+	}
+	result, err := tx.Exec("DELETE FROM media_blobs WHERE sha256 = ?", hash)
+	if err != nil {
+		return "", err
+	}
+	released, err := result.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil || released == 0 {
+		return "", err
+	}
+	return mediaBlobPath(hash), nil
+}
+
+// Get the media files of messages that have a filename but no blob yet,
+// such as files downloaded before the media store existed
+func (store *SQLMessageStore) GetUnreferencedMediaFiles() ([]MediaFile, error) {
+	rows, err := store.db.Query(
+		`SELECT id, chat_jid, filename FROM messages
+		WHERE COALESCE(media_type, '') <> '' AND COALESCE(filename, '') <> ''
+			AND NOT EXISTS (SELECT 1 FROM media_refs WHERE media_refs.chat_jid = messages.chat_jid AND media_refs.message_id = messages.id)`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []MediaFile
+	for rows.Next() {
+		var file MediaFile
+		if err := rows.Scan(&file.MessageID, &file.ChatJID, &file.Filename); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+// Get the local path of a message's media file: its blob, or the legacy
+// per-chat path when it has none
+func storedMediaPath(messageStore MessageStore, messageID, chatJID, filename string) string {
+	if hash, err := messageStore.GetMediaRef(messageID, chatJID); err == nil {
+		return mediaBlobPath(hash)
+	}
+	return mediaFilePath(chatJID, filepath.Base(filename))
+}
+
+// Find the message whose media file a request names by chat and filename,
+// and where that file is stored. Only files of stored messages are found, so
+// a request can never name another path. Returns the HTTP status to answer
+// with when the file cannot be found.
+func findRequestedMedia(messageStore MessageStore, chatJID, filename string) (string, string, int, error) {
+	jid, err := types.ParseJID(chatJID)
+	if err != nil || jid.User == "" || jid.Server == "" || jid.String() != chatJID || strings.ContainsAny(chatJID, `/\`) {
+		return "", "", http.StatusBadRequest, fmt.Errorf("invalid chat_jid %q", chatJID)
+	}
+	if filename != filepath.Base(filename) {
+		return "", "", http.StatusBadRequest, fmt.Errorf("filename must not contain a path")
+	}
+
+	messageID, err := messageStore.FindMessageIDByFilename(chatJID, filename)
+	if err == sql.ErrNoRows {
+		return "", "", http.StatusNotFound, fmt.Errorf("no message in chat %s has the file %s", chatJID, filename)
+	}
+	if err != nil {
+		return "", "", http.StatusInternalServerError, fmt.Errorf("failed to find the message of %s: %v", filename, err)
+	}
+	return messageID, storedMediaPath(messageStore, messageID, chatJID, filename), 0, nil
+}
+
+// Release a message's media file and delete it if nothing else uses it
+func releaseStoredMedia(messageStore MessageStore, file MediaFile) error {
+	path, err := messageStore.ReleaseMediaFile(file)
+	if err != nil || path == "" {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Move media files downloaded into per-chat directories before the media
+// store existed into it. A file is only adopted by a message whose recorded
+// file hash matches it, since two messages could have been saved under the
+// same name. Returns the number of files moved.
+func migrateLegacyMedia(messageStore MessageStore, logger waLog.Logger) (int, error) {
+	// Find the files left in per-chat directories first, so there is no
+	// database work once everything has been migrated
+	legacy := make(map[string]bool)
+	err := filepath.WalkDir(mediaRootDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path == mediaBlobDir || d.Name() == "temp_media" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Files directly in the store directory are databases, not media
+		if filepath.Dir(path) != mediaRootDir {
+			legacy[path] = true
+		}
+		return nil
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if len(legacy) == 0 {
+		return 0, nil
+	}
+
+	files, err := messageStore.GetUnreferencedMediaFiles()
+	if err != nil {
+		return 0, err
+	}
+
+	adopted := make(map[string]bool)
+	for _, file := range files {
+		path := mediaFilePath(file.ChatJID, filepath.Base(file.Filename))
+		if !legacy[path] {
+			continue
+		}
+
+		data, err := readMediaFile(path)
+		if err != nil {
+			logger.Warnf("Failed to read media file %s: %v", path, err)
+			continue
+		}
+		sum := sha256.Sum256(data)
+		_, _, _, _, fileSHA256, _, _, err := messageStore.GetMediaInfo(file.MessageID, file.ChatJID)
+		if err == nil && len(fileSHA256) > 0 && !bytes.Equal(fileSHA256, sum[:]) {
+			logger.Warnf("Media file %s does not belong to message %s, skipping", path, file.MessageID)
+			continue
+		}
+
+		hash, _, err := writeMediaBlob(data)
+		if err != nil {
+			return len(adopted), fmt.Errorf("failed to store %s: %v", path, err)
+		}
+		if err := messageStore.StoreMediaRef(file.MessageID, file.ChatJID, hash, int64(len(data))); err != nil {
+			return len(adopted), fmt.Errorf("failed to reference %s: %v", path, err)
+		}
+		adopted[path] = true
+	}
+
+	// Files are only removed once every message that may share them is done
+	for path := range adopted {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logger.Warnf("Failed to remove migrated media file %s: %v", path, err)
+		}
+		// Drop the chat directory once it is empty
+		os.Remove(filepath.Dir(path))
+	}
+
+	if unmatched := len(legacy) - len(adopted); unmatched > 0 && len(adopted) > 0 {
+		logger.Infof("%d media file(s) in per-chat directories belong to no stored message and were left in place", unmatched)
+	}
+	return len(adopted), nil
+}
+
+// Whether a media request asks for base64 JSON rather than the file itself
+func wantsBase64Media(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "base64"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// Stream a media file as base64 inside a JSON response, without holding the
+// whole file in memory
+func writeBase64Media(w http.ResponseWriter, content io.Reader, filename string, size int64) error {
+	mimeType := mime.TypeByExtension(filepath.Ext(filename))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	name, _ := json.Marshal(filename)
+	mimeJSON, _ := json.Marshal(mimeType)
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := fmt.Fprintf(w, `{"success":true,"filename":%s,"mime_type":%s,"size":%d,"base64":"`, name, mimeJSON, size); err != nil {
+		return err
+	}
+	encoder := base64.NewEncoder(base64.StdEncoding, w)
+	if _, err := io.Copy(encoder, content); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\"}\n")
+	return err
+}
+
+// Handler for the media of a message: /api/media/{chat_jid}/{message_id}.
+// The file is downloaded on first request and streamed with Range and
+// ETag support, or returned as base64 JSON when asked for.
+func handleMedia(client *whatsmeow.Client, messageStore MessageStore, logger waLog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only allow GET and HEAD requests
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		chatJID := r.PathValue("chat_jid")
+		messageID := r.PathValue("message_id")
+		writeError := func(status int, message string) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   message,
+			})
+		}
+
+		msg, err := messageStore.GetMessage(messageID, chatJID)
+		if err == sql.ErrNoRows {
+			writeError(http.StatusNotFound, "Message not found")
+			return
+		}
+		if err != nil {
+			logger.Errorf("Failed to get message %s: %v", messageID, err)
+			writeError(http.StatusInternalServerError, fmt.Sprintf("Failed to get message: %v", err))
+			return
+		}
+		if msg.MediaType == "" || msg.DeletedAt != nil {
+			writeError(http.StatusNotFound, "Message has no media")
+			return
+		}
+
+		_, _, filename, path, err := downloadMedia(client, messageStore, messageID, chatJID)
+		if err != nil {
+			logger.Errorf("Failed to download media of message %s: %v", messageID, err)
+			if !client.IsConnected() {
+				writeError(http.StatusServiceUnavailable, "Media is not downloaded and WhatsApp client is not connected")
+				return
+			}
+			writeError(http.StatusInternalServerError, fmt.Sprintf("Failed to download media: %v", err))
+			return
+		}
+
+		content, err := openStoredMedia(path)
+		if err != nil {
+			logger.Errorf("Failed to open media file %s: %v", path, err)
+			writeError(http.StatusInternalServerError, fmt.Sprintf("Failed to open media file: %v", err))
+			return
+		}
+		defer content.Close()
+
+		// The representation depends on the Accept header
+		w.Header().Set("Vary", "Accept")
+		if wantsBase64Media(r) {
+			size, err := content.Seek(0, io.SeekEnd)
+			if err == nil {
+				_, err = content.Seek(0, io.SeekStart)
+			}
+			if err == nil {
+				err = writeBase64Media(w, content, filename, size)
+			}
+			if err != nil {
+				logger.Errorf("Failed to send media of message %s: %v", messageID, err)
+			}
+			return
+		}
+
+		// Stored files never change, so their hash makes a strong ETag
+		if hash, err := messageStore.GetMediaRef(messageID, chatJID); err == nil {
+			w.Header().Set("ETag", `"`+hash+`"`)
+		}
+		w.Header().Set("Cache-Control", "private")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": filename}))
+		http.ServeContent(w, r, filename, msg.Time, content)
+	}
+}
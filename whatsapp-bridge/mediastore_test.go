@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindRequestedMedia(t *testing.T) {
+	store := newTestStore(t)
+	chat := "4915112345678@s.whatsapp.net"
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	storeTestMessage(t, store, chat, "legacy", chat, "", at, "document", "scan.pdf")
+	storeTestMessage(t, store, chat, "stored", chat, "", at, "image", "image_20240301_120000.jpg")
+	hash := strings.Repeat("ab", 32)
+	if err := store.StoreMediaRef("stored", chat, hash, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		chatJID    string
+		filename   string
+		wantID     string
+		wantPath   string
+		wantStatus int
+	}{
+		{"legacy file", chat, "scan.pdf", "legacy", mediaFilePath(chat, "scan.pdf"), 0},
+		{"blob", chat, "image_20240301_120000.jpg", "stored", mediaBlobPath(hash), 0},
+		{"unknown file", chat, "other.pdf", "", "", http.StatusNotFound},
+		{"session database", chat, "whatsapp.db", "", "", http.StatusNotFound},
+		{"file of another chat", "4915187654321@s.whatsapp.net", "scan.pdf", "", "", http.StatusNotFound},
+		{"dot chat", ".", "whatsapp.db", "", "", http.StatusBadRequest},
+		{"parent chat", "..", "whatsapp.db", "", "", http.StatusBadRequest},
+		{"no user", "@s.whatsapp.net", "scan.pdf", "", "", http.StatusBadRequest},
+		{"path in server", "4915112345678@s.whatsapp.net/../..", "scan.pdf", "", "", http.StatusBadRequest},
+		{"path in filename", chat, "../whatsapp.db", "", "", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, path, status, err := findRequestedMedia(store, tt.chatJID, tt.filename)
+			if tt.wantStatus != 0 {
+				if err == nil || status != tt.wantStatus {
+					t.Errorf("findRequestedMedia(%q, %q) = %q, %v (status %d), want status %d", tt.chatJID, tt.filename, path, err, status, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil || id != tt.wantID || path != tt.wantPath {
+				t.Errorf("findRequestedMedia(%q, %q) = %q, %q, %v, want %q, %q", tt.chatJID, tt.filename, id, path, err, tt.wantID, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestReleaseMediaFile(t *testing.T) {
+	chat := "4915112345678@s.whatsapp.net"
+	shared := strings.Repeat("ab", 32)
+	single := strings.Repeat("cd", 32)
+	store := newTestStore(t)
+	// m1 and m2 share a blob, m3 has its own, and legacy predates the media store
+	refs := map[string]string{"m1": shared, "m2": shared, "m3": single}
+	for id, hash := range refs {
+		if err := store.StoreMediaRef(id, chat, hash, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		file     MediaFile
+		wantPath string
+	}{
+		{"shared blob still in use", MediaFile{MessageID: "m1", ChatJID: chat, Filename: "a.jpg"}, ""},
+		{"last reference to a shared blob", MediaFile{MessageID: "m2", ChatJID: chat, Filename: "a.jpg"}, mediaBlobPath(shared)},
+		{"blob of one message", MediaFile{MessageID: "m3", ChatJID: chat, Filename: "b.jpg"}, mediaBlobPath(single)},
+		{"already released", MediaFile{MessageID: "m3", ChatJID: chat}, ""},
+		{"legacy file", MediaFile{MessageID: "legacy", ChatJID: chat, Filename: "old.jpg"}, mediaFilePath(chat, "old.jpg")},
+	}
+
+	// The cases run in order, releasing references one by one
+	for _, tt := range tests {
+		path, err := store.ReleaseMediaFile(tt.file)
+		if err != nil || path != tt.wantPath {
+			t.Errorf("%s: ReleaseMediaFile(%s) = %q, %v, want %q", tt.name, tt.file.MessageID, path, err, tt.wantPath)
+		}
+	}
+
+	blobs, err := store.GetMediaBlobs()
+	if err != nil || len(blobs) != 0 {
+		t.Errorf("media blobs after releasing every reference = %+v, %v, want none", blobs, err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// An "@<phone>" token in message text, which is sent as a mention of that
+// number. The token must start the text or follow whitespace, so e-mail
+// addresses are left alone.
+var phoneMentionToken = regexp.MustCompile(`(?:^|\s)@(\d{5,15})\b`)
+
+// Get the users a message mentions: the explicit mentions, and the
+// "@<phone>" tokens in its text
+func resolveMentions(text string, mentions []string) ([]string, error) {
+	var mentioned []string
+	for _, mention := range mentions {
+		jid, err := parseRecipientJID(mention)
+		if err != nil || jid.User == "" {
+			return nil, fmt.Errorf("invalid mention %q", mention)
+		}
+		mentioned = append(mentioned, jid.ToNonAD().String())
+	}
+	for _, match := range phoneMentionToken.FindAllStringSubmatch(text, -1) {
+		mentioned = append(mentioned, types.NewJID(match[1], types.DefaultUserServer).String())
+	}
+	return mentioned, nil
+}
+
+// Get all current participants of a group, apart from ourselves, to mention
+// everyone
+func groupMentions(client *whatsmeow.Client, group types.JID) ([]string, error) {
+	info, err := client.GetGroupInfo(group)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get group participants: %v", err)
+	}
+	var mentioned []string
+	for _, p := range info.Participants {
+		// Mentioning ourselves would only notify our other devices
+		if p.JID.User == client.Store.ID.User || p.JID.User == client.Store.LID.User {
+			continue
+		}
+		mentioned = append(mentioned, p.JID.ToNonAD().String())
+	}
+	return mentioned, nil
+}
+
+// Build the context info of a send request: the message it replies to and
+// the users it mentions, with the HTTP status to answer with when the
+// request is invalid
+func sendContextForRequest(client *whatsmeow.Client, messageStore MessageStore, recipient, text string,
+	replyTo *ReplyTarget, mentions []string, everyone bool) (*waProto.ContextInfo, int, error) {
+	contextInfo, status, err := replyContextForRequest(client, messageStore, recipient, replyTo)
+	if err != nil {
+		return nil, status, err
+	}
+
+	mentioned, err := resolveMentions(text, mentions)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if everyone {
+		chat, err := parseRecipientJID(recipient)
+		if err != nil || chat.Server != types.GroupServer {
+			return nil, http.StatusBadRequest, fmt.Errorf("mention_everyone is only possible in groups")
+		}
+		participants, err := groupMentions(client, chat)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		mentioned = append(mentioned, participants...)
+	}
+
+	if len(mentioned) > 0 {
+		if contextInfo == nil {
+			contextInfo = &waProto.ContextInfo{}
+		}
+		slices.Sort(mentioned)
+		contextInfo.MentionedJID = slices.Compact(mentioned)
+	}
+	return contextInfo, http.StatusOK, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestResolveMentions(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		mentions []string
+		want     []string
+	}{
+		{"nothing", "hello", nil, nil},
+		{"phone number", "hi", []string{"4915112345678"}, []string{"4915112345678@s.whatsapp.net"}},
+		{"device jid", "hi", []string{"4915112345678:12@s.whatsapp.net"}, []string{"4915112345678@s.whatsapp.net"}},
+		{"lid", "hi", []string{"123456789012345@lid"}, []string{"123456789012345@lid"}},
+		{"token at start", "@4915112345678 look", nil, []string{"4915112345678@s.whatsapp.net"}},
+		{"token after whitespace", "look\n@4915112345678", nil, []string{"4915112345678@s.whatsapp.net"}},
+		{"token before punctuation", "thanks @4915112345678!", nil, []string{"4915112345678@s.whatsapp.net"}},
+		{"five digits", "hi @12345", nil, []string{"12345@s.whatsapp.net"}},
+		{"four digits", "hi @1234", nil, nil},
+		{"fifteen digits", "hi @123456789012345", nil, []string{"123456789012345@s.whatsapp.net"}},
+		{"sixteen digits", "hi @1234567890123456", nil, nil},
+		{"e-mail address", "mail me at alice@12345.example", nil, nil},
+		{"e-mail with digits only", "x@4915112345678", nil, nil},
+		{"letters after digits", "hi @12345abc", nil, nil},
+		{"explicit before tokens", "@12345 and @67890", []string{"4915112345678"},
+			[]string{"4915112345678@s.whatsapp.net", "12345@s.whatsapp.net", "67890@s.whatsapp.net"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveMentions(tt.text, tt.mentions)
+			if err != nil {
+				t.Fatalf("resolveMentions(%q, %q): %v", tt.text, tt.mentions, err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("resolveMentions(%q, %q) = %q, want %q", tt.text, tt.mentions, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveMentionsInvalid(t *testing.T) {
+	for _, mention := range []string{"", "@s.whatsapp.net", "123:x@s.whatsapp.net"} {
+		if got, err := resolveMentions("hi", []string{mention}); err == nil {
+			t.Errorf("resolveMentions with mention %q = %q, want an error", mention, got)
+		}
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+)
+
+// Message types beyond the media types from extractMediaInfo
+// ("image", "video", "audio", "document" and "sticker")
+const (
+	messageTypeText             = "text"
+	messageTypeLocation         = "location"
+	messageTypeLiveLocation     = "live_location"
+	messageTypeContact          = "contact"
+	messageTypePoll             = "poll"
+	messageTypeEvent            = "event"
+	messageTypeInteractiveReply = "interactive_reply"
+)
+
+// MessageData holds the structured fields of the message types that are more
+// than text and media. Only the part matching the message type is set.
+type MessageData struct {
+	Location *LocationData `json:"location,omitempty"`
+	// One card for a single contact, several for a shared contact list
+	Contacts         []ContactCard     `json:"contacts,omitempty"`
+	Sticker          *StickerData      `json:"sticker,omitempty"`
+	Poll             *PollData         `json:"poll,omitempty"`
+	Event            *EventData        `json:"event,omitempty"`
+	InteractiveReply *InteractiveReply `json:"interactive_reply,omitempty"`
+	// The media can only be opened once on the recipient's phone
+	ViewOnce bool `json:"view_once,omitempty"`
+}
+
+// LocationData is a shared location, or one update of a live location
+type LocationData struct {
+	Latitude       float64 `json:"latitude"`
+	Longitude      float64 `json:"longitude"`
+	Name           string  `json:"name,omitempty"`
+	Address        string  `json:"address,omitempty"`
+	URL            string  `json:"url,omitempty"`
+	Comment        string  `json:"comment,omitempty"`
+	AccuracyMeters uint32  `json:"accuracy_meters,omitempty"`
+	// Live locations only
+	SpeedMPS       float32 `json:"speed_mps,omitempty"`
+	Heading        uint32  `json:"heading,omitempty"`
+	SequenceNumber int64   `json:"sequence_number,omitempty"`
+}
+
+// ContactCard is the parsed content of a shared vCard
+type ContactCard struct {
+	DisplayName  string         `json:"display_name"`
+	FullName     string         `json:"full_name,omitempty"`
+	FirstName    string         `json:"first_name,omitempty"`
+	LastName     string         `json:"last_name,omitempty"`
+	Organization string         `json:"organization,omitempty"`
+	Title        string         `json:"title,omitempty"`
+	Phones       []ContactPhone `json:"phones,omitempty"`
+	Emails       []string       `json:"emails,omitempty"`
+	URLs         []string       `json:"urls,omitempty"`
+}
+
+// ContactPhone is one phone number of a contact card
+type ContactPhone struct {
+	Number string `json:"number"`
+	Type   string `json:"type,omitempty"`
+	// WhatsApp user of the number, when the card links one
+	WAID string `json:"waid,omitempty"`
+}
+
+// StickerData describes a sticker; the image itself is downloaded like other media
+type StickerData struct {
+	Mimetype   string `json:"mimetype,omitempty"`
+	Width      uint32 `json:"width,omitempty"`
+	Height     uint32 `json:"height,omitempty"`
+	IsAnimated bool   `json:"is_animated,omitempty"`
+}
+
+// PollData is the question and options of a poll; the tally is at /api/polls/{id}
+type PollData struct {
+	Question        string   `json:"question"`
+	Options         []string `json:"options"`
+	SelectableCount int      `json:"selectable_count"`
+}
+
+// EventData is an event created in a chat
+type EventData struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description,omitempty"`
+	StartTime   *time.Time    `json:"start_time,omitempty"`
+	EndTime     *time.Time    `json:"end_time,omitempty"`
+	Location    *LocationData `json:"location,omitempty"`
+	JoinLink    string        `json:"join_link,omitempty"`
+	IsCanceled  bool          `json:"is_canceled,omitempty"`
+}
+
+// InteractiveReply is the answer picked from a business message's buttons or list
+type InteractiveReply struct {
+	// "button", "list", "template_button" or "native_flow"
+	Kind         string `json:"kind"`
+	SelectedID   string `json:"selected_id,omitempty"`
+	SelectedText string `json:"selected_text,omitempty"`
+	Description  string `json:"description,omitempty"`
+	// JSON parameters of a native flow (e.g. WhatsApp Flows) response
+	Params string `json:"params,omitempty"`
+}
+
+// Store the type and structured data of a stored message
+func (store *SQLMessageStore) StoreMessageData(id, chatJID, messageType string, data *MessageData) error {
+	var structuredData sql.NullString
+	if data != nil {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		structuredData = sql.NullString{String: store.keys.encryptString(string(encoded)), Valid: true}
+	}
+
+	_, err := store.db.Exec(
+		"UPDATE messages SET message_type = ?, structured_data = ? WHERE id = ? AND chat_jid = ? AND deleted_at IS NULL",
+		messageType, structuredData, id, chatJID,
+	)
+	return err
+}
+
+// Decode the structured data column of a message, once decrypted
+func decodeMessageData(msg *Message, structuredData string) error {
+	if structuredData == "" {
+		return nil
+	}
+	var data MessageData
+	if err := json.Unmarshal([]byte(structuredData), &data); err != nil {
+		return fmt.Errorf("message %s: invalid structured data: %v", msg.ID, err)
+	}
+	msg.Data = &data
+	return nil
+}
+
+// Strip the view-once wrappers from a message. Live events arrive unwrapped,
+// but history sync messages keep them.
+func unwrapViewOnce(msg *waProto.Message) (*waProto.Message, bool) {
+	if inner := msg.GetViewOnceMessage().GetMessage(); inner != nil {
+		return inner, true
+	} else if inner := msg.GetViewOnceMessageV2().GetMessage(); inner != nil {
+		return inner, true
+	} else if inner := msg.GetViewOnceMessageV2Extension().GetMessage(); inner != nil {
+		return inner, true
+	}
+	return msg, msg.GetImageMessage().GetViewOnce() || msg.GetVideoMessage().GetViewOnce() || msg.GetAudioMessage().GetViewOnce()
+}
+
+// Work out the type of a message and its structured data. The type is "" for
+// messages that are not stored as such (protocol messages, reactions, ...),
+// and the data is nil for types without structured fields.
+func extractMessageData(msg *waProto.Message) (string, *MessageData) {
+	if msg == nil {
+		return "", nil
+	}
+	msg, viewOnce := unwrapViewOnce(msg)
+
+	var data MessageData
+	messageType := ""
+	if loc := msg.GetLocationMessage(); loc != nil {
+		messageType = messageTypeLocation
+		data.Location = locationFromMessage(loc)
+		if loc.GetIsLive() {
+			messageType = messageTypeLiveLocation
+		}
+	} else if live := msg.GetLiveLocationMessage(); live != nil {
+		messageType = messageTypeLiveLocation
+		data.Location = &LocationData{
+			Latitude:       live.GetDegreesLatitude(),
+			Longitude:      live.GetDegreesLongitude(),
+			Comment:        live.GetCaption(),
+			AccuracyMeters: live.GetAccuracyInMeters(),
+			SpeedMPS:       live.GetSpeedInMps(),
+			Heading:        live.GetDegreesClockwiseFromMagneticNorth(),
+			SequenceNumber: live.GetSequenceNumber(),
+		}
+	} else if contact := msg.GetContactMessage(); contact != nil {
+		messageType = messageTypeContact
+		data.Contacts = []ContactCard{contactCardFromMessage(contact)}
+	} else if contacts := msg.GetContactsArrayMessage(); contacts != nil {
+		messageType = messageTypeContact
+		for _, contact := range contacts.GetContacts() {
+			data.Contacts = append(data.Contacts, contactCardFromMessage(contact))
+		}
+	} else if sticker := msg.GetStickerMessage(); sticker != nil {
+		messageType = "sticker"
+		data.Sticker = &StickerData{
+			Mimetype:   sticker.GetMimetype(),
+			Width:      sticker.GetWidth(),
+			Height:     sticker.GetHeight(),
+			IsAnimated: sticker.GetIsAnimated(),
+		}
+	} else if poll := getPollCreation(msg); poll != nil {
+		messageType = messageTypePoll
+		data.Poll = &PollData{
+			Question:        poll.GetName(),
+			Options:         []string{},
+			SelectableCount: int(poll.GetSelectableOptionsCount()),
+		}
+		for _, option := range poll.GetOptions() {
+			data.Poll.Options = append(data.Poll.Options, option.GetOptionName())
+		}
+	} else if event := msg.GetEventMessage(); event != nil {
+		messageType = messageTypeEvent
+		data.Event = &EventData{
+			Name:        event.GetName(),
+			Description: event.GetDescription(),
+			StartTime:   unixTimeOrNil(event.GetStartTime()),
+			EndTime:     unixTimeOrNil(event.GetEndTime()),
+			JoinLink:    event.GetJoinLink(),
+			IsCanceled:  event.GetIsCanceled(),
+		}
+		if loc := event.GetLocation(); loc != nil {
+			data.Event.Location = locationFromMessage(loc)
+		}
+	} else if reply := extractInteractiveReply(msg); reply != nil {
+		messageType = messageTypeInteractiveReply
+		data.InteractiveReply = reply
+	} else if mediaType, _, _, _, _, _, _ := extractMediaInfo(msg); mediaType != "" {
+		if viewOnce {
+			return mediaType, &MessageData{ViewOnce: true}
+		}
+		return mediaType, nil
+	} else if msg.GetConversation() != "" || msg.GetExtendedTextMessage() != nil {
+		return messageTypeText, nil
+	}
+
+	if messageType == "" {
+		return "", nil
+	}
+	return messageType, &data
+}
+
+// Convert a location message into LocationData
+func locationFromMessage(loc *waProto.LocationMessage) *LocationData {
+	return &LocationData{
+		Latitude:       loc.GetDegreesLatitude(),
+		Longitude:      loc.GetDegreesLongitude(),
+		Name:           loc.GetName(),
+		Address:        loc.GetAddress(),
+		URL:            loc.GetURL(),
+		Comment:        loc.GetComment(),
+		AccuracyMeters: loc.GetAccuracyInMeters(),
+	}
+}
+
+// Convert a contact message into a ContactCard, falling back to the
+// message's display name when the vCard has none
+func contactCardFromMessage(contact *waProto.ContactMessage) ContactCard {
+	card := parseVCard(contact.GetVcard())
+	if card.DisplayName == "" {
+		card.DisplayName = contact.GetDisplayName()
+	}
+	return card
+}
+
+// Convert Unix seconds into a time, with 0 meaning unset
+func unixTimeOrNil(seconds int64) *time.Time {
+	if seconds == 0 {
+		return nil
+	}
+	t := time.Unix(seconds, 0)
+	return &t
+}
+
+// Extract the answer from the reply to a buttons, list or flow message
+func extractInteractiveReply(msg *waProto.Message) *InteractiveReply {
+	if buttons := msg.GetButtonsResponseMessage(); buttons != nil {
+		return &InteractiveReply{
+			Kind:         "button",
+			SelectedID:   buttons.GetSelectedButtonID(),
+			SelectedText: buttons.GetSelectedDisplayText(),
+		}
+	} else if list := msg.GetListResponseMessage(); list != nil {
+		return &InteractiveReply{
+			Kind:         "list",
+			SelectedID:   list.GetSingleSelectReply().GetSelectedRowID(),
+			SelectedText: list.GetTitle(),
+			Description:  list.GetDescription(),
+		}
+	} else if template := msg.GetTemplateButtonReplyMessage(); template != nil {
+		return &InteractiveReply{
+			Kind:         "template_button",
+			SelectedID:   template.GetSelectedID(),
+			SelectedText: template.GetSelectedDisplayText(),
+		}
+	} else if interactive := msg.GetInteractiveResponseMessage(); interactive != nil {
+		flow := interactive.GetNativeFlowResponseMessage()
+		return &InteractiveReply{
+			Kind:         "native_flow",
+			SelectedID:   flow.GetName(),
+			SelectedText: interactive.GetBody().GetText(),
+			Params:       flow.GetParamsJSON(),
+		}
+	}
+	return nil
+}
+
+// Describe a structured message as text, for the content column, search and exports
+func describeMessageData(messageType string, data *MessageData) string {
+	if data == nil {
+		return ""
+	}
+
+	switch messageType {
+	case messageTypeLocation, messageTypeLiveLocation:
+		label := "[Location]"
+		if messageType == messageTypeLiveLocation {
+			label = "[Live location]"
+		}
+		loc := data.Location
+		parts := []string{}
+		for _, part := range []string{loc.Name, loc.Address, loc.Comment} {
+			if part != "" {
+				parts = append(parts, part)
+			}
+		}
+		if len(parts) == 0 {
+			parts = append(parts, fmt.Sprintf("%.6f, %.6f", loc.Latitude, loc.Longitude))
+		}
+		return label + " " + strings.Join(parts, ", ")
+	case messageTypeContact:
+		names := make([]string, len(data.Contacts))
+		for i, card := range data.Contacts {
+			names[i] = card.DisplayName
+		}
+		return "[Contact] " + strings.Join(names, ", ")
+	case messageTypeEvent:
+		content := "[Event] " + data.Event.Name
+		if data.Event.IsCanceled {
+			content += " (canceled)"
+		}
+		if data.Event.Description != "" {
+			content += "\n" + data.Event.Description
+		}
+		return content
+	case messageTypeInteractiveReply:
+		// Some replies carry only the ID of the picked option
+		if data.InteractiveReply.SelectedText == "" {
+			return data.InteractiveReply.SelectedID
+		}
+		return data.InteractiveReply.SelectedText
+	}
+	return ""
+}
+
+// Parse the fields of a vCard (versions 2.1, 3.0 and 4.0) into a ContactCard
+func parseVCard(vcard string) ContactCard {
+	var card ContactCard
+
+	// Unfold continuation lines, which start with a space or tab
+	vcard = strings.ReplaceAll(vcard, "\r\n", "\n")
+	vcard = strings.ReplaceAll(vcard, "\n ", "")
+	vcard = strings.ReplaceAll(vcard, "\n\t", "")
+
+	for _, line := range strings.Split(vcard, "\n") {
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+		params := strings.Split(line[:colon], ";")
+		value := line[colon+1:]
+
+		// Drop the group prefix of grouped properties like "item1.TEL"
+		name := strings.ToUpper(params[0])
+		if dot := strings.LastIndex(name, "."); dot >= 0 {
+			name = name[dot+1:]
+		}
+
+		switch name {
+		case "FN":
+			card.FullName = unescapeVCard(value)
+		case "N":
+			fields := splitVCardValue(value)
+			card.LastName = fields[0]
+			if len(fields) > 1 {
+				card.FirstName = fields[1]
+			}
+		case "ORG":
+			card.Organization = strings.Join(nonEmpty(splitVCardValue(value)), ", ")
+		case "TITLE":
+			card.Title = unescapeVCard(value)
+		case "TEL":
+			phone := ContactPhone{Number: unescapeVCard(value)}
+			for _, param := range params[1:] {
+				key, val, found := strings.Cut(param, "=")
+				switch {
+				case !found:
+					// vCard 2.1 style bare type, e.g. TEL;CELL:...
+					phone.Type = strings.ToLower(key)
+				case strings.EqualFold(key, "type"):
+					phone.Type = strings.ToLower(val)
+				case strings.EqualFold(key, "waid"):
+					phone.WAID = val
+				}
+			}
+			card.Phones = append(card.Phones, phone)
+		case "EMAIL":
+			card.Emails = append(card.Emails, unescapeVCard(value))
+		case "URL":
+			card.URLs = append(card.URLs, unescapeVCard(value))
+		}
+	}
+
+	card.DisplayName = card.FullName
+	if card.DisplayName == "" {
+		card.DisplayName = strings.TrimSpace(card.FirstName + " " + card.LastName)
+	}
+	return card
+}
+
+// Write a ContactCard as a vCard 3.0. Phones in international format are
+// linked to their WhatsApp user, unless the card names one.
+func formatVCard(card ContactCard) string {
+	fullName := card.FullName
+	if fullName == "" {
+		fullName = card.DisplayName
+	}
+	if fullName == "" {
+		fullName = strings.TrimSpace(card.FirstName + " " + card.LastName)
+	}
+
+	lines := []string{"BEGIN:VCARD", "VERSION:3.0"}
+	// N is required, so a card with only a full name uses it as the first name
+	if card.FirstName == "" && card.LastName == "" {
+		lines = append(lines, "N:;"+escapeVCard(fullName)+";;;")
+	} else {
+		lines = append(lines, "N:"+escapeVCard(card.LastName)+";"+escapeVCard(card.FirstName)+";;;")
+	}
+	lines = append(lines, "FN:"+escapeVCard(fullName))
+	if card.Organization != "" {
+		lines = append(lines, "ORG:"+escapeVCard(card.Organization))
+	}
+	if card.Title != "" {
+		lines = append(lines, "TITLE:"+escapeVCard(card.Title))
+	}
+	for _, phone := range card.Phones {
+		property := "TEL"
+		if phone.Type != "" {
+			property += ";type=" + strings.ToUpper(phone.Type)
+		}
+		waid := phone.WAID
+		if waid == "" && strings.HasPrefix(strings.TrimSpace(phone.Number), "+") {
+			waid = strings.Map(func(r rune) rune {
+				if r >= '0' && r <= '9' {
+					return r
+				}
+				return -1
+			}, phone.Number)
+		}
+		if waid != "" {
+			property += ";waid=" + waid
+		}
+		lines = append(lines, property+":"+escapeVCard(phone.Number))
+	}
+	for _, email := range card.Emails {
+		lines = append(lines, "EMAIL;type=INTERNET:"+escapeVCard(email))
+	}
+	for _, url := range card.URLs {
+		lines = append(lines, "URL:"+escapeVCard(url))
+	}
+	lines = append(lines, "END:VCARD")
+	return strings.Join(lines, "\r\n")
+}
+
+// Apply vCard text escaping
+func escapeVCard(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`).Replace(value)
+}
+
+// Split a structured vCard value (like N or ORG) into its unescaped fields
+func splitVCardValue(value string) []string {
+	var fields []string
+	var field strings.Builder
+	escaped := false
+	for _, r := range value {
+		switch {
+		case escaped:
+			field.WriteString(unescapeVCard("\\" + string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ';':
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteRune(r)
+		}
+	}
+	return append(fields, field.String())
+}
+
+// Undo vCard text escaping
+func unescapeVCard(value string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
+
+// Keep the non-empty strings of a list
+func nonEmpty(values []string) []string {
+	var kept []string
+	for _, v := range values {
+		if v != "" {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseVCard(t *testing.T) {
+	tests := []struct {
+		name  string
+		vcard string
+		want  ContactCard
+	}{
+		{
+			name: "whatsapp card",
+			vcard: "BEGIN:VCARD\nVERSION:3.0\nN:Doe;John;;;\nFN:John Doe\n" +
+				"item1.TEL;waid=4915112345678:+49 151 12345678\nitem1.X-ABLabel:Mobile\nEND:VCARD",
+			want: ContactCard{DisplayName: "John Doe", FullName: "John Doe", FirstName: "John", LastName: "Doe",
+				Phones: []ContactPhone{{Number: "+49 151 12345678", WAID: "4915112345678"}}},
+		},
+		{
+			name: "vcard 2.1 with bare types and no full name",
+			vcard: "BEGIN:VCARD\r\nVERSION:2.1\r\nN:Smith;Anna\r\nTEL;CELL:0151 1234\r\nTEL;TYPE=work:030 1234\r\n" +
+				"EMAIL:anna@example.com\r\nEND:VCARD\r\n",
+			want: ContactCard{DisplayName: "Anna Smith", FirstName: "Anna", LastName: "Smith",
+				Phones: []ContactPhone{{Number: "0151 1234", Type: "cell"}, {Number: "030 1234", Type: "work"}},
+				Emails: []string{"anna@example.com"}},
+		},
+		{
+			name: "escaped and folded values",
+			vcard: "BEGIN:VCARD\nVERSION:3.0\nFN:Doe\\, John\nORG:Acme\\; Inc;;Sales\nTITLE:Head of\n  R&D\n" +
+				"URL:https://example.com\nEND:VCARD",
+			want: ContactCard{DisplayName: "Doe, John", FullName: "Doe, John", Organization: "Acme; Inc, Sales",
+				Title: "Head of R&D", URLs: []string{"https://example.com"}},
+		},
+		{
+			name:  "lowercase properties",
+			vcard: "begin:vcard\nfn:Jane\ntel;type=HOME:123456\nend:vcard",
+			want:  ContactCard{DisplayName: "Jane", FullName: "Jane", Phones: []ContactPhone{{Number: "123456", Type: "home"}}},
+		},
+		{name: "empty", vcard: "", want: ContactCard{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseVCard(tt.vcard); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseVCard = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDescribeMessageData(t *testing.T) {
+	tests := []struct {
+		name        string
+		messageType string
+		data        *MessageData
+		want        string
+	}{
+		{"no data", messageTypeLocation, nil, ""},
+		{"named location", messageTypeLocation,
+			&MessageData{Location: &LocationData{Latitude: 52.52, Longitude: 13.405, Name: "Brandenburg Gate", Address: "Pariser Platz"}},
+			"[Location] Brandenburg Gate, Pariser Platz"},
+		{"bare coordinates", messageTypeLiveLocation,
+			&MessageData{Location: &LocationData{Latitude: 52.52, Longitude: 13.405}},
+			"[Live location] 52.520000, 13.405000"},
+		{"contacts", messageTypeContact,
+			&MessageData{Contacts: []ContactCard{{DisplayName: "Alice"}, {DisplayName: "Bob"}}},
+			"[Contact] Alice, Bob"},
+		{"event", messageTypeEvent,
+			&MessageData{Event: &EventData{Name: "Party", Description: "Bring snacks"}},
+			"[Event] Party\nBring snacks"},
+		{"canceled event", messageTypeEvent,
+			&MessageData{Event: &EventData{Name: "Party", IsCanceled: true}},
+			"[Event] Party (canceled)"},
+		{"interactive reply", messageTypeInteractiveReply,
+			&MessageData{InteractiveReply: &InteractiveReply{Kind: "button", SelectedID: "yes", SelectedText: "Yes please"}},
+			"Yes please"},
+		{"interactive reply without text", messageTypeInteractiveReply,
+			&MessageData{InteractiveReply: &InteractiveReply{Kind: "list", SelectedID: "row-2"}},
+			"row-2"},
+		{"sticker", "sticker", &MessageData{Sticker: &StickerData{Mimetype: "image/webp"}}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := describeMessageData(tt.messageType, tt.data); got != tt.want {
+				t.Errorf("describeMessageData(%q) = %q, want %q", tt.messageType, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatVCardRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		card ContactCard
+		want ContactCard
+	}{
+		{
+			name: "full card",
+			card: ContactCard{FirstName: "John", LastName: "Doe", Organization: "Acme, Inc", Title: "Head of\nSales",
+				Phones: []ContactPhone{{Number: "+49 151 12345678", Type: "cell"}, {Number: "030 1234", Type: "work"}},
+				Emails: []string{"john@example.com"}, URLs: []string{"https://example.com"}},
+			want: ContactCard{DisplayName: "John Doe", FullName: "John Doe", FirstName: "John", LastName: "Doe",
+				Organization: "Acme, Inc", Title: "Head of\nSales",
+				Phones: []ContactPhone{{Number: "+49 151 12345678", Type: "cell", WAID: "4915112345678"}, {Number: "030 1234", Type: "work"}},
+				Emails: []string{"john@example.com"}, URLs: []string{"https://example.com"}},
+		},
+		{
+			name: "display name only",
+			card: ContactCard{DisplayName: "Pizza; Place", Phones: []ContactPhone{{Number: "030 1234"}}},
+			want: ContactCard{DisplayName: "Pizza; Place", FullName: "Pizza; Place", FirstName: "Pizza; Place",
+				Phones: []ContactPhone{{Number: "030 1234"}}},
+		},
+		{
+			name: "given whatsapp user",
+			card: ContactCard{FullName: "Bob", Phones: []ContactPhone{{Number: "+1 555 0100", WAID: "15550100999"}}},
+			want: ContactCard{DisplayName: "Bob", FullName: "Bob", FirstName: "Bob",
+				Phones: []ContactPhone{{Number: "+1 555 0100", WAID: "15550100999"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vcard := formatVCard(tt.card)
+			if !strings.HasPrefix(vcard, "BEGIN:VCARD\r\nVERSION:3.0\r\n") || !strings.HasSuffix(vcard, "\r\nEND:VCARD") {
+				t.Errorf("formatVCard = %q, want a vCard 3.0", vcard)
+			}
+			if got := parseVCard(vcard); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseVCard(formatVCard) = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Migration is a single, ordered change to the message database schema.
+// Migrations are append-only: once released, a migration must never be edited,
+// only followed by a new one with a higher version.
+type Migration struct {
+	Version     int
+	Description string
+	SQL         string
+	// PostgreSQL version of SQL, only set where the two dialects differ
+	Postgres string
+}
+
+// Get the SQL of a migration for the given dialect
+func (m Migration) sqlFor(dialect sqlDialect) string {
+	if dialect == postgresDialect && m.Postgres != "" {
+		return m.Postgres
+	}
+	return m.SQL
+}
+
+// Arbitrary key for the PostgreSQL advisory lock held while migrating, so
+// replicas starting at the same time don't apply the same migration twice
+const migrationLockKey = 7254019
+
+// messageStoreMigrations lists every schema change for the message database in order.
+// Every change to the MessageStore schema must ship as a new entry here, for
+// both SQLite and PostgreSQL.
+var messageStoreMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "create chats and messages tables",
+		// Uses IF NOT EXISTS so databases created before migrations existed
+		// are adopted as version 1 without changes
+		SQL: `
+			CREATE TABLE IF NOT EXISTS chats (
+				jid TEXT PRIMARY KEY,
+				name TEXT,
+				last_message_time TIMESTAMP
+			);
+
+			CREATE TABLE IF NOT EXISTS messages (
+				id TEXT,
+				chat_jid TEXT,
+				sender TEXT,
+				content TEXT,
+				timestamp TIMESTAMP,
+				is_from_me BOOLEAN,
+				media_type TEXT,
+				filename TEXT,
+				url TEXT,
+				media_key BLOB,
+				file_sha256 BLOB,
+				file_enc_sha256 BLOB,
+				file_length INTEGER,
+				quoted_message TEXT,
+				PRIMARY KEY (id, chat_jid),
+				FOREIGN KEY (chat_jid) REFERENCES chats(jid)
+			);
+		`,
+		Postgres: `
+			CREATE TABLE chats (
+				jid TEXT PRIMARY KEY,
+				name TEXT,
+				last_message_time TIMESTAMPTZ
+			);
+
+			CREATE TABLE messages (
+				id TEXT,
+				chat_jid TEXT,
+				sender TEXT,
+				content TEXT,
+				timestamp TIMESTAMPTZ,
+				is_from_me BOOLEAN,
+				media_type TEXT,
+				filename TEXT,
+				url TEXT,
+				media_key BYTEA,
+				file_sha256 BYTEA,
+				file_enc_sha256 BYTEA,
+				file_length BIGINT,
+				quoted_message TEXT,
+				PRIMARY KEY (id, chat_jid),
+				FOREIGN KEY (chat_jid) REFERENCES chats(jid)
+			);
+		`,
+	},
+	{
+		Version:     2,
+		Description: "add full-text search index over messages",
+		// message_search_docs gives every message a stable integer docid, since
+		// VACUUM may renumber the implicit rowid of the messages table. The FTS5
+		// table itself is created and filled by ensureSearchIndex, so that
+		// databases still migrate when SQLite was built without FTS5.
+		SQL: `
+			CREATE TABLE message_search_docs (
+				docid INTEGER PRIMARY KEY AUTOINCREMENT,
+				message_id TEXT NOT NULL,
+				chat_jid TEXT NOT NULL,
+				UNIQUE (message_id, chat_jid)
+			);
+		`,
+		// PostgreSQL indexes the document expression directly, so there is
+		// nothing to keep in sync. The expression must match postgresSearchDocument.
+		Postgres: `
+			CREATE INDEX idx_messages_search ON messages USING GIN (
+				to_tsvector('simple', COALESCE(content, '') || ' ' || COALESCE(filename, '') || ' ' || COALESCE(quoted_message, ''))
+			);
+		`,
+	},
+	{
+		Version:     3,
+		Description: "keep message edit history",
+		SQL: `
+			ALTER TABLE messages ADD COLUMN edited_at TIMESTAMP;
+
+			CREATE TABLE message_revisions (
+				message_id TEXT NOT NULL,
+				chat_jid TEXT NOT NULL,
+				revision INTEGER NOT NULL,
+				content TEXT,
+				edited_at TIMESTAMP,
+				PRIMARY KEY (message_id, chat_jid, revision)
+			);
+
+			-- Older versions prefixed edited content with a marker and replaced
+			-- the timestamp with the edit time, so keep that as edited_at
+			UPDATE messages SET content = substr(content, 10), edited_at = timestamp
+			WHERE content LIKE '[EDITED] %';
+
+			-- Have ensureSearchIndex index the changed messages again
+			DELETE FROM message_search_docs
+			WHERE (message_id, chat_jid) IN (SELECT id, chat_jid FROM messages WHERE edited_at IS NOT NULL);
+		`,
+		Postgres: `
+			ALTER TABLE messages ADD COLUMN edited_at TIMESTAMPTZ;
+
+			CREATE TABLE message_revisions (
+				message_id TEXT NOT NULL,
+				chat_jid TEXT NOT NULL,
+				revision INTEGER NOT NULL,
+				content TEXT,
+				edited_at TIMESTAMPTZ,
+				PRIMARY KEY (message_id, chat_jid, revision)
+			);
+		`,
+	},
+	{
+		Version:     4,
+		Description: "keep deleted messages as tombstones",
+		SQL: `
+			ALTER TABLE messages ADD COLUMN deleted_at TIMESTAMP;
+			ALTER TABLE messages ADD COLUMN deleted_by TEXT;
+			ALTER TABLE messages ADD COLUMN content_purged_at TIMESTAMP;
+
+			-- Older versions replaced deleted content with a marker and the
+			-- timestamp with the delete time; the original content is gone
+			UPDATE messages SET deleted_at = timestamp, content_purged_at = timestamp
+			WHERE content = '[MESSAGE DELETED]';
+		`,
+		Postgres: `
+			ALTER TABLE messages ADD COLUMN deleted_at TIMESTAMPTZ;
+			ALTER TABLE messages ADD COLUMN deleted_by TEXT;
+			ALTER TABLE messages ADD COLUMN content_purged_at TIMESTAMPTZ;
+		`,
+	},
+	{
+		Version:     5,
+		Description: "index messages for cursor pagination",
+		SQL: `
+			CREATE INDEX idx_messages_chat_timestamp ON messages (chat_jid, timestamp, id);
+		`,
+	},
+	{
+		Version:     6,
+		Description: "add data keys for encryption at rest",
+		SQL: `
+			CREATE TABLE encryption_keys (
+				id INTEGER PRIMARY KEY,
+				wrapped_key TEXT NOT NULL,
+				master_key_id TEXT NOT NULL,
+				created_at TIMESTAMP,
+				retired_at TIMESTAMP
+			);
+		`,
+		Postgres: `
+			CREATE TABLE encryption_keys (
+				id INTEGER PRIMARY KEY,
+				wrapped_key TEXT NOT NULL,
+				master_key_id TEXT NOT NULL,
+				created_at TIMESTAMPTZ,
+				retired_at TIMESTAMPTZ
+			);
+		`,
+	},
+	{
+		Version:     7,
+		Description: "add contacts table",
+		SQL: `
+			CREATE TABLE contacts (
+				jid TEXT PRIMARY KEY,
+				phone_number TEXT,
+				lid TEXT,
+				full_name TEXT,
+				first_name TEXT,
+				push_name TEXT,
+				business_name TEXT,
+				last_seen_at TIMESTAMP,
+				updated_at TIMESTAMP
+			);
+			CREATE INDEX idx_contacts_phone_number ON contacts (phone_number);
+			CREATE INDEX idx_contacts_lid ON contacts (lid);
+		`,
+		Postgres: `
+			CREATE TABLE contacts (
+				jid TEXT PRIMARY KEY,
+				phone_number TEXT,
+				lid TEXT,
+				full_name TEXT,
+				first_name TEXT,
+				push_name TEXT,
+				business_name TEXT,
+				last_seen_at TIMESTAMPTZ,
+				updated_at TIMESTAMPTZ
+			);
+			CREATE INDEX idx_contacts_phone_number ON contacts (phone_number);
+			CREATE INDEX idx_contacts_lid ON contacts (lid);
+		`,
+	},
+	{
+		Version:     8,
+		Description: "add groups and group participants",
+		SQL: `
+			CREATE TABLE groups (
+				jid TEXT PRIMARY KEY,
+				subject TEXT,
+				description TEXT,
+				owner_jid TEXT,
+				created_at TIMESTAMP,
+				is_announce BOOLEAN NOT NULL DEFAULT FALSE,
+				is_locked BOOLEAN NOT NULL DEFAULT FALSE,
+				is_ephemeral BOOLEAN NOT NULL DEFAULT FALSE,
+				disappearing_timer INTEGER NOT NULL DEFAULT 0,
+				updated_at TIMESTAMP
+			);
+			CREATE TABLE group_participants (
+				group_jid TEXT NOT NULL,
+				jid TEXT NOT NULL,
+				lid TEXT,
+				is_admin BOOLEAN NOT NULL DEFAULT FALSE,
+				is_super_admin BOOLEAN NOT NULL DEFAULT FALSE,
+				PRIMARY KEY (group_jid, jid),
+				FOREIGN KEY (group_jid) REFERENCES groups(jid) ON DELETE CASCADE
+			);
+		`,
+		Postgres: `
+			CREATE TABLE groups (
+				jid TEXT PRIMARY KEY,
+				subject TEXT,
+				description TEXT,
+				owner_jid TEXT,
+				created_at TIMESTAMPTZ,
+				is_announce BOOLEAN NOT NULL DEFAULT FALSE,
+				is_locked BOOLEAN NOT NULL DEFAULT FALSE,
+				is_ephemeral BOOLEAN NOT NULL DEFAULT FALSE,
+				disappearing_timer INTEGER NOT NULL DEFAULT 0,
+				updated_at TIMESTAMPTZ
+			);
+			CREATE TABLE group_participants (
+				group_jid TEXT NOT NULL,
+				jid TEXT NOT NULL,
+				lid TEXT,
+				is_admin BOOLEAN NOT NULL DEFAULT FALSE,
+				is_super_admin BOOLEAN NOT NULL DEFAULT FALSE,
+				PRIMARY KEY (group_jid, jid),
+				FOREIGN KEY (group_jid) REFERENCES groups(jid) ON DELETE CASCADE
+			);
+		`,
+	},
+	{
+		Version:     9,
+		Description: "add message reactions",
+		SQL: `
+			CREATE TABLE reactions (
+				message_id TEXT NOT NULL,
+				chat_jid TEXT NOT NULL,
+				sender TEXT NOT NULL,
+				emoji TEXT NOT NULL,
+				timestamp TIMESTAMP,
+				is_from_me BOOLEAN NOT NULL DEFAULT FALSE,
+				PRIMARY KEY (chat_jid, message_id, sender)
+			);
+		`,
+		Postgres: `
+			CREATE TABLE reactions (
+				message_id TEXT NOT NULL,
+				chat_jid TEXT NOT NULL,
+				sender TEXT NOT NULL,
+				emoji TEXT NOT NULL,
+				timestamp TIMESTAMPTZ,
+				is_from_me BOOLEAN NOT NULL DEFAULT FALSE,
+				PRIMARY KEY (chat_jid, message_id, sender)
+			);
+		`,
+	},
+	{
+		Version:     10,
+		Description: "add message delivery status history",
+		SQL: `
+			CREATE TABLE message_status (
+				message_id TEXT NOT NULL,
+				chat_jid TEXT NOT NULL,
+				participant TEXT NOT NULL,
+				status TEXT NOT NULL,
+				timestamp TIMESTAMP,
+				PRIMARY KEY (chat_jid, message_id, participant, status)
+			);
+		`,
+		Postgres: `
+			CREATE TABLE message_status (
+				message_id TEXT NOT NULL,
+				chat_jid TEXT NOT NULL,
+				participant TEXT NOT NULL,
+				status TEXT NOT NULL,
+				timestamp TIMESTAMPTZ,
+				PRIMARY KEY (chat_jid, message_id, participant, status)
+			);
+		`,
+	},
+	{
+		Version:     11,
+		Description: "add polls, poll options and votes",
+		SQL: `
+			CREATE TABLE polls (
+				message_id TEXT NOT NULL,
+				chat_jid TEXT NOT NULL,
+				creator TEXT NOT NULL,
+				question TEXT NOT NULL,
+				selectable_count INTEGER NOT NULL DEFAULT 0,
+				created_at TIMESTAMP,
+				is_from_me BOOLEAN NOT NULL DEFAULT FALSE,
+				PRIMARY KEY (chat_jid, message_id)
+			);
+
+			CREATE TABLE poll_options (
+				poll_id TEXT NOT NULL,
+				chat_jid TEXT NOT NULL,
+				option_index INTEGER NOT NULL,
+				name TEXT NOT NULL,
+				hash TEXT NOT NULL,
+				PRIMARY KEY (chat_jid, poll_id, option_index)
+			);
+
+			CREATE TABLE poll_votes (
+				poll_id TEXT NOT NULL,
+				chat_jid TEXT NOT NULL,
+				voter TEXT NOT NULL,
+				selected TEXT NOT NULL,
+				timestamp TIMESTAMP,
+				PRIMARY KEY (chat_jid, poll_id, voter)
+			);
+		`,
+		Postgres: `
+			CREATE TABLE polls (
+				message_id TEXT NOT NULL,
+				chat_jid TEXT NOT NULL,
+				creator TEXT NOT NULL,
+				question TEXT NOT NULL,
+				selectable_count INTEGER NOT NULL DEFAULT 0,
+				created_at TIMESTAMPTZ,
+				is_from_me BOOLEAN NOT NULL DEFAULT FALSE,
+				PRIMARY KEY (chat_jid, message_id)
+			);
+
+			CREATE TABLE poll_options (
+				poll_id TEXT NOT NULL,
+				chat_jid TEXT NOT NULL,
+				option_index INTEGER NOT NULL,
+				name TEXT NOT NULL,
+				hash TEXT NOT NULL,
+				PRIMARY KEY (chat_jid, poll_id, option_index)
+			);
+
+			CREATE TABLE poll_votes (
+				poll_id TEXT NOT NULL,
+				chat_jid TEXT NOT NULL,
+				voter TEXT NOT NULL,
+				selected TEXT NOT NULL,
+				timestamp TIMESTAMPTZ,
+				PRIMARY KEY (chat_jid, poll_id, voter)
+			);
+		`,
+	},
+	{
+		Version:     12,
+		Description: "add message type and structured data",
+		SQL: `
+			ALTER TABLE messages ADD COLUMN message_type TEXT;
+			ALTER TABLE messages ADD COLUMN structured_data TEXT;
+		`,
+	},
+	{
+		Version:     13,
+		Description: "link replies to the message they reply to",
+		SQL: `
+			ALTER TABLE messages ADD COLUMN reply_to_id TEXT;
+			ALTER TABLE messages ADD COLUMN reply_to_sender TEXT;
+			CREATE INDEX idx_messages_reply_to ON messages (chat_jid, reply_to_id);
+		`,
+	},
+	{
+		Version:     14,
+		Description: "store media by content hash",
+		SQL: `
+			CREATE TABLE media_blobs (
+				sha256 TEXT PRIMARY KEY,
+				size INTEGER NOT NULL DEFAULT 0,
+				created_at TIMESTAMP
+			);
+
+			CREATE TABLE media_refs (
+				message_id TEXT NOT NULL,
+				chat_jid TEXT NOT NULL,
+				sha256 TEXT NOT NULL,
+				PRIMARY KEY (chat_jid, message_id)
+			);
+			CREATE INDEX idx_media_refs_sha256 ON media_refs (sha256);
+		`,
+		Postgres: `
+			CREATE TABLE media_blobs (
+				sha256 TEXT PRIMARY KEY,
+				size BIGINT NOT NULL DEFAULT 0,
+				created_at TIMESTAMPTZ
+			);
+
+			CREATE TABLE media_refs (
+				message_id TEXT NOT NULL,
+				chat_jid TEXT NOT NULL,
+				sha256 TEXT NOT NULL,
+				PRIMARY KEY (chat_jid, message_id)
+			);
+			CREATE INDEX idx_media_refs_sha256 ON media_refs (sha256);
+		`,
+	},
+	{
+		Version:     15,
+		Description: "track automatic media downloads",
+		SQL: `
+			CREATE TABLE media_downloads (
+				message_id TEXT NOT NULL,
+				chat_jid TEXT NOT NULL,
+				state TEXT NOT NULL,
+				attempts INTEGER NOT NULL DEFAULT 0,
+				last_error TEXT,
+				next_attempt_at TIMESTAMP,
+				updated_at TIMESTAMP,
+				PRIMARY KEY (chat_jid, message_id)
+			);
+			CREATE INDEX idx_media_downloads_state ON media_downloads (state, next_attempt_at);
+		`,
+		Postgres: `
+			CREATE TABLE media_downloads (
+				message_id TEXT NOT NULL,
+				chat_jid TEXT NOT NULL,
+				state TEXT NOT NULL,
+				attempts INTEGER NOT NULL DEFAULT 0,
+				last_error TEXT,
+				next_attempt_at TIMESTAMPTZ,
+				updated_at TIMESTAMPTZ,
+				PRIMARY KEY (chat_jid, message_id)
+			);
+			CREATE INDEX idx_media_downloads_state ON media_downloads (state, next_attempt_at);
+		`,
+	},
+	{
+		Version:     16,
+		Description: "stop storing poll option hashes",
+		SQL: `
+			ALTER TABLE poll_options DROP COLUMN hash;
+		`,
+	},
+	{
+		Version:     17,
+		Description: "keep the mimetype and direct path of media",
+		SQL: `
+			ALTER TABLE messages ADD COLUMN mimetype TEXT;
+			ALTER TABLE messages ADD COLUMN direct_path TEXT;
+		`,
+	},
+}
+
+// latestSchemaVersion returns the schema version this binary was built for
+func latestSchemaVersion() int {
+	if len(messageStoreMigrations) == 0 {
+		return 0
+	}
+	return messageStoreMigrations[len(messageStoreMigrations)-1].Version
+}
+
+// Create the schema version table if it doesn't exist
+func ensureSchemaVersionTable(db *dialectDB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			description TEXT,
+			applied_at TIMESTAMP
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %v", err)
+	}
+	return nil
+}
+
+// Get the highest applied schema version (0 for a fresh database)
+func currentSchemaVersion(db *dialectDB) (int, error) {
+	var version sql.NullInt64
+	if err := db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %v", err)
+	}
+	if !version.Valid {
+		return 0, nil
+	}
+	return int(version.Int64), nil
+}
+
+// Get the migrations that have not been applied yet.
+// Returns an error if the database was written by a newer binary.
+func pendingMigrations(db *dialectDB) ([]Migration, error) {
+	if err := ensureSchemaVersionTable(db); err != nil {
+		return nil, err
+	}
+
+	current, err := currentSchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if latest := latestSchemaVersion(); current > latest {
+		return nil, fmt.Errorf("database schema version %d is newer than this binary supports (%d), refusing to start", current, latest)
+	}
+
+	var pending []Migration
+	for _, m := range messageStoreMigrations {
+		if m.Version > current {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Apply a single migration and record it, all inside one transaction
+func applyMigration(db *dialectDB, m Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin migration %d: %v", m.Version, err)
+	}
+
+	if db.dialect == postgresDialect {
+		// Serialize migrations across replicas sharing the database, and skip
+		// this one if another replica applied it while we waited for the lock
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLockKey); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to lock for migration %d: %v", m.Version, err)
+		}
+
+		var applied bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE version = ?)", m.Version).Scan(&applied); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to check migration %d: %v", m.Version, err)
+		}
+		if applied {
+			return tx.Commit()
+		}
+	}
+
+	if _, err := tx.Exec(m.sqlFor(db.dialect)); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Description, err)
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)",
+		m.Version, m.Description, time.Now(),
+	); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to record migration %d: %v", m.Version, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration %d: %v", m.Version, err)
+	}
+	return nil
+}
+
+// Run all pending migrations in order. With dryRun set, nothing is applied and
+// the pending migrations are only returned.
+func runMigrations(db *dialectDB, dryRun bool) ([]Migration, error) {
+	pending, err := pendingMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return pending, nil
+	}
+
+	for _, m := range pending {
+		fmt.Printf("Applying migration %d: %s\n", m.Version, m.Description)
+		if err := applyMigration(db, m); err != nil {
+			return nil, err
+		}
+	}
+
+	return pending, nil
+}
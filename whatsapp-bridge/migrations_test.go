@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+// Open an empty SQLite database without running any migrations
+func openTestDB(t *testing.T) *dialectDB {
+	t.Helper()
+	db, err := sql.Open(string(sqliteDialect), testDBDSN(t))
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &dialectDB{DB: db, dialect: sqliteDialect}
+}
+
+func TestMigrationsAreOrdered(t *testing.T) {
+	for i, m := range messageStoreMigrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %d has version %d, want %d", i, m.Version, i+1)
+		}
+		if m.Description == "" || strings.TrimSpace(m.SQL) == "" {
+			t.Errorf("migration %d has no description or SQL", m.Version)
+		}
+	}
+}
+
+func TestRunMigrations(t *testing.T) {
+	db := openTestDB(t)
+
+	pending, err := runMigrations(db, true)
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if len(pending) != len(messageStoreMigrations) {
+		t.Errorf("dry run found %d pending migrations, want %d", len(pending), len(messageStoreMigrations))
+	}
+	if version, _ := currentSchemaVersion(db); version != 0 {
+		t.Errorf("dry run applied migrations up to version %d", version)
+	}
+
+	if _, err := runMigrations(db, false); err != nil {
+		t.Fatalf("runMigrations: %v", err)
+	}
+	if version, err := currentSchemaVersion(db); err != nil || version != latestSchemaVersion() {
+		t.Errorf("schema version = %d (%v), want %d", version, err, latestSchemaVersion())
+	}
+
+	// Running again finds nothing to do
+	pending, err = runMigrations(db, false)
+	if err != nil || len(pending) != 0 {
+		t.Errorf("second run applied %d migrations (%v), want none", len(pending), err)
+	}
+
+	// Every table the store relies on exists
+	for _, table := range []string{"chats", "messages", "message_revisions", "encryption_keys", "contacts", "groups",
+		"group_participants", "reactions", "message_status", "polls", "poll_options", "poll_votes", "media_blobs", "media_downloads"} {
+		var name string
+		if err := db.QueryRow("SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&name); err != nil {
+			t.Errorf("table %s is missing: %v", table, err)
+		}
+	}
+}
+
+func TestRunMigrationsFromOlderSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+	}{
+		{"before polls", 10},
+		{"before option hashes were dropped", 15},
+		{"one behind", latestSchemaVersion() - 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t)
+			if err := ensureSchemaVersionTable(db); err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range messageStoreMigrations[:tt.version] {
+				if err := applyMigration(db, m); err != nil {
+					t.Fatalf("apply migration %d: %v", m.Version, err)
+				}
+			}
+
+			pending, err := runMigrations(db, false)
+			if err != nil {
+				t.Fatalf("runMigrations: %v", err)
+			}
+			if len(pending) != latestSchemaVersion()-tt.version || pending[0].Version != tt.version+1 {
+				t.Errorf("applied %d migrations starting at %d, want %d starting at %d",
+					len(pending), pending[0].Version, latestSchemaVersion()-tt.version, tt.version+1)
+			}
+		})
+	}
+}
+
+func TestRunMigrationsRefusesNewerSchema(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := runMigrations(db, false); err != nil {
+		t.Fatalf("runMigrations: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO schema_migrations (version, description) VALUES (?, ?)", latestSchemaVersion()+1, "from the future"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := runMigrations(db, false); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("runMigrations on a newer schema = %v, want an error", err)
+	}
+}
+
+func TestMigrationSQLFor(t *testing.T) {
+	shared := Migration{SQL: "ALTER TABLE t ADD COLUMN c TEXT"}
+	split := Migration{SQL: "CREATE TABLE t (at TIMESTAMP)", Postgres: "CREATE TABLE t (at TIMESTAMPTZ)"}
+
+	tests := []struct {
+		name      string
+		migration Migration
+		dialect   sqlDialect
+		want      string
+	}{
+		{"shared on sqlite", shared, sqliteDialect, shared.SQL},
+		{"shared on postgres", shared, postgresDialect, shared.SQL},
+		{"split on sqlite", split, sqliteDialect, split.SQL},
+		{"split on postgres", split, postgresDialect, split.Postgres},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.migration.sqlFor(tt.dialect); got != tt.want {
+				t.Errorf("sqlFor(%s) = %q, want %q", tt.dialect, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// MessageCursor marks a position in a chat's message history.
+// Messages are ordered by (timestamp, id), so a cursor is always unambiguous
+// even when several messages share the same timestamp.
+type MessageCursor struct {
+	Time time.Time `json:"t"`
+	ID   string    `json:"id"`
+}
+
+// MessageQuery selects a page of messages from a chat, or from every chat
+// when ChatJID is empty
+type MessageQuery struct {
+	ChatJID string
+	Limit   int
+	// Only messages from this sender (the user part of their JID)
+	Sender string
+	// Only messages whose text contains this, ignoring case
+	Contains string
+	// Only messages strictly before / after these positions
+	Before *MessageCursor
+	After  *MessageCursor
+	// Only messages at or after Since and at or before Until
+	Since time.Time
+	Until time.Time
+	// Oldest first when set, newest first otherwise
+	Ascending      bool
+	IncludeDeleted bool
+}
+
+// Encode the cursor as an opaque, URL-safe string
+func (c MessageCursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Get the cursor pointing at a message
+func cursorForMessage(msg Message) MessageCursor {
+	return MessageCursor{Time: msg.Time, ID: msg.ID}
+}
+
+// Get a page of messages and whether more pages follow, by fetching one
+// message past the limit
+func getMessagePage(messageStore MessageStore, query MessageQuery) ([]Message, bool, error) {
+	limit := query.Limit
+	query.Limit++
+	messages, err := messageStore.GetMessages(query)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(messages) > limit {
+		return messages[:limit], true, nil
+	}
+	return messages, false, nil
+}
+
+// Decode a cursor previously returned as next_cursor
+func parseMessageCursor(value string) (*MessageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	var cursor MessageCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.ID == "" || cursor.Time.IsZero() {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &cursor, nil
+}
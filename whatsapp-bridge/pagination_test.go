@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageCursorRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor MessageCursor
+	}{
+		{"utc", MessageCursor{Time: time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC), ID: "3EB0C767D71D8A6B9F7C"}},
+		{"nanoseconds", MessageCursor{Time: time.Date(2024, 3, 1, 12, 30, 0, 123456789, time.UTC), ID: "ABC"}},
+		{"time zone", MessageCursor{Time: time.Date(2023, 12, 31, 23, 59, 59, 0, time.FixedZone("CET", 3600)), ID: "x"}},
+		{"id with symbols", MessageCursor{Time: time.Unix(1700000000, 0).UTC(), ID: `a/b+c=d"e`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := tt.cursor.String()
+			if strings.ContainsAny(encoded, "+/=") {
+				t.Errorf("cursor %q is not URL-safe", encoded)
+			}
+			got, err := parseMessageCursor(encoded)
+			if err != nil {
+				t.Fatalf("parseMessageCursor(%q): %v", encoded, err)
+			}
+			if !got.Time.Equal(tt.cursor.Time) || got.ID != tt.cursor.ID {
+				t.Errorf("round trip = %+v, want %+v", *got, tt.cursor)
+			}
+		})
+	}
+}
+
+func TestParseMessageCursorInvalid(t *testing.T) {
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"empty", ""},
+		{"not base64", "not a cursor!"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte(`{"t":"2024-03-01T12:30:00Z","id":"x"}`))},
+		{"not json", encode("hello")},
+		{"missing id", encode(`{"t":"2024-03-01T12:30:00Z"}`)},
+		{"missing time", encode(`{"id":"x"}`)},
+		{"bad time", encode(`{"t":"yesterday","id":"x"}`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if cursor, err := parseMessageCursor(tt.value); err == nil {
+				t.Errorf("parseMessageCursor(%q) = %+v, want an error", tt.value, *cursor)
+			}
+		})
+	}
+}
+
+func TestCursorForMessage(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	cursor := cursorForMessage(Message{ID: "m1", Time: at, Content: "hi"})
+	if cursor.ID != "m1" || !cursor.Time.Equal(at) {
+		t.Errorf("cursorForMessage = %+v", cursor)
+	}
+}
+
+func TestGetMessagePage(t *testing.T) {
+	store := newTestStore(t)
+	chat := "4915112345678@s.whatsapp.net"
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	// m2 and m3 share a timestamp and are ordered by ID
+	times := map[string]time.Time{"m1": at, "m2": at.Add(time.Minute), "m3": at.Add(time.Minute), "m4": at.Add(2 * time.Minute)}
+	for _, id := range []string{"m1", "m2", "m3", "m4"} {
+		storeTestMessage(t, store, chat, id, "111", "text "+id, times[id], "", "")
+	}
+	storeTestMessage(t, store, "other@s.whatsapp.net", "x1", "222", "elsewhere", at, "", "")
+
+	tests := []struct {
+		name      string
+		query     MessageQuery
+		wantPages [][]string
+	}{
+		{"newest first", MessageQuery{ChatJID: chat, Limit: 3}, [][]string{{"m4", "m3", "m2"}, {"m1"}}},
+		{"page size divides the history", MessageQuery{ChatJID: chat, Limit: 2}, [][]string{{"m4", "m3"}, {"m2", "m1"}}},
+		{"oldest first", MessageQuery{ChatJID: chat, Limit: 3, Ascending: true}, [][]string{{"m1", "m2", "m3"}, {"m4"}}},
+		{"one page", MessageQuery{ChatJID: chat, Limit: 4}, [][]string{{"m4", "m3", "m2", "m1"}}},
+		{"time window", MessageQuery{ChatJID: chat, Limit: 1, Since: at.Add(time.Minute), Until: at.Add(time.Minute)}, [][]string{{"m3"}, {"m2"}}},
+		{"every chat", MessageQuery{Limit: 4, Until: at}, [][]string{{"x1", "m1"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := tt.query
+			for i, want := range tt.wantPages {
+				messages, hasMore, err := getMessagePage(store, query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var ids []string
+				for _, msg := range messages {
+					ids = append(ids, msg.ID)
+				}
+				if strings.Join(ids, ",") != strings.Join(want, ",") {
+					t.Errorf("page %d = %q, want %q", i, ids, want)
+				}
+				if wantMore := i < len(tt.wantPages)-1; hasMore != wantMore {
+					t.Errorf("page %d has_more = %v, want %v", i, hasMore, wantMore)
+				}
+				if len(messages) == 0 {
+					return
+				}
+
+				// Continue from the cursor of the last message, as clients do
+				cursor := cursorForMessage(messages[len(messages)-1])
+				if query.Ascending {
+					query.After = &cursor
+				} else {
+					query.Before = &cursor
+				}
+			}
+		})
+	}
+}
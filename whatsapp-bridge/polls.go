@@ -0,0 +1,531 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/proto/waCommon"
+	"go.mau.fi/whatsmeow/proto/waWeb"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// WhatsApp accepts between 2 and 12 options per poll
+const (
+	minPollOptions = 2
+	maxPollOptions = 12
+)
+
+// Poll is a poll message with its options and the current tally
+type Poll struct {
+	ID       string `json:"id"`
+	ChatJID  string `json:"chat_jid"`
+	Creator  string `json:"creator"`
+	Question string `json:"question"`
+	// Maximum number of options a voter may select, 0 for any number
+	SelectableCount int          `json:"selectable_count"`
+	CreatedAt       time.Time    `json:"created_at"`
+	IsFromMe        bool         `json:"is_from_me"`
+	Options         []PollOption `json:"options"`
+	// Number of people with at least one option selected
+	VoterCount int `json:"voter_count"`
+}
+
+// PollOption is one answer of a poll with the people who selected it
+type PollOption struct {
+	Name   string   `json:"name"`
+	Votes  int      `json:"votes"`
+	Voters []string `json:"voters"`
+}
+
+// PollVote is the current selection of one voter. Votes refer to options by
+// their hash, and a new vote replaces the previous one. Option hashes are not
+// stored, since they would reveal the option names; they are computed from
+// the decrypted names when a poll is read.
+type PollVote struct {
+	Voter string
+	// Hex SHA-256 hashes of the selected option names; empty when the voter
+	// removed their vote
+	Selected []string
+	Time     time.Time
+}
+
+// Hash a poll option name the way WhatsApp refers to it in votes
+func pollOptionHash(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
+
+// Store a poll and its options
+func (store *SQLMessageStore) StorePoll(poll Poll) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`INSERT INTO polls (message_id, chat_jid, creator, question, selectable_count, created_at, is_from_me) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (chat_jid, message_id) DO UPDATE SET
+			creator = excluded.creator, question = excluded.question, selectable_count = excluded.selectable_count,
+			created_at = excluded.created_at, is_from_me = excluded.is_from_me`,
+		poll.ID, poll.ChatJID, poll.Creator, store.keys.encryptString(poll.Question), poll.SelectableCount, poll.CreatedAt, poll.IsFromMe,
+	)
+	if err != nil {
+		return err
+	}
+
+	for i, option := range poll.Options {
+		_, err := tx.Exec(
+			`INSERT INTO poll_options (poll_id, chat_jid, option_index, name) VALUES (?, ?, ?, ?)
+			ON CONFLICT (chat_jid, poll_id, option_index) DO UPDATE SET name = excluded.name`,
+			poll.ID, poll.ChatJID, i, store.keys.encryptString(option.Name),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Store a vote on a poll, replacing the voter's previous vote
+func (store *SQLMessageStore) StorePollVote(pollID, chatJID string, vote PollVote) error {
+	selected, err := json.Marshal(vote.Selected)
+	if err != nil {
+		return err
+	}
+
+	// Votes can arrive out of order, so an older one never replaces a newer one
+	_, err = store.db.Exec(
+		`INSERT INTO poll_votes (poll_id, chat_jid, voter, selected, timestamp) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (chat_jid, poll_id, voter) DO UPDATE SET
+			selected = excluded.selected, timestamp = excluded.timestamp
+		WHERE poll_votes.timestamp IS NULL OR excluded.timestamp >= poll_votes.timestamp`,
+		pollID, chatJID, vote.Voter, store.keys.encryptString(string(selected)), vote.Time,
+	)
+	return err
+}
+
+// Get a poll with its tally. chatJID may be empty to find the poll in any chat.
+func (store *SQLMessageStore) GetPoll(id, chatJID string) (*Poll, error) {
+	query := "SELECT message_id, chat_jid, creator, question, selectable_count, created_at, is_from_me FROM polls WHERE message_id = ?"
+	args := []interface{}{id}
+	if chatJID != "" {
+		query += " AND chat_jid = ?"
+		args = append(args, chatJID)
+	}
+
+	var poll Poll
+	var createdAt sql.NullTime
+	err := store.db.QueryRow(query+" LIMIT 1", args...).Scan(
+		&poll.ID, &poll.ChatJID, &poll.Creator, &poll.Question, &poll.SelectableCount, &createdAt, &poll.IsFromMe,
+	)
+	if err != nil {
+		return nil, err
+	}
+	poll.CreatedAt = createdAt.Time
+	if poll.Question, err = store.keys.decryptString(poll.Question); err != nil {
+		return nil, fmt.Errorf("poll %s: %v", poll.ID, err)
+	}
+
+	rows, err := store.db.Query(
+		"SELECT name FROM poll_options WHERE chat_jid = ? AND poll_id = ? ORDER BY option_index",
+		poll.ChatJID, poll.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	optionIndex := make(map[string]int)
+	for rows.Next() {
+		var option PollOption
+		if err := rows.Scan(&option.Name); err != nil {
+			return nil, err
+		}
+		if option.Name, err = store.keys.decryptString(option.Name); err != nil {
+			return nil, fmt.Errorf("poll %s: %v", poll.ID, err)
+		}
+		option.Voters = []string{}
+		optionIndex[pollOptionHash(option.Name)] = len(poll.Options)
+		poll.Options = append(poll.Options, option)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	voteRows, err := store.db.Query(
+		"SELECT voter, selected FROM poll_votes WHERE chat_jid = ? AND poll_id = ? ORDER BY timestamp, voter",
+		poll.ChatJID, poll.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer voteRows.Close()
+
+	for voteRows.Next() {
+		var voter, selectedJSON string
+		if err := voteRows.Scan(&voter, &selectedJSON); err != nil {
+			return nil, err
+		}
+		if selectedJSON, err = store.keys.decryptString(selectedJSON); err != nil {
+			return nil, fmt.Errorf("poll %s: %v", poll.ID, err)
+		}
+		var selected []string
+		if err := json.Unmarshal([]byte(selectedJSON), &selected); err != nil {
+			return nil, fmt.Errorf("invalid vote selection: %v", err)
+		}
+
+		counted := false
+		for _, hash := range selected {
+			i, ok := optionIndex[hash]
+			if !ok {
+				continue
+			}
+			poll.Options[i].Votes++
+			poll.Options[i].Voters = append(poll.Options[i].Voters, voter)
+			counted = true
+		}
+		if counted {
+			poll.VoterCount++
+		}
+	}
+	if err := voteRows.Err(); err != nil {
+		return nil, err
+	}
+
+	if poll.Options == nil {
+		poll.Options = []PollOption{}
+	}
+	return &poll, nil
+}
+
+// Get the poll creation content of a message, whichever version it uses
+func getPollCreation(msg *waProto.Message) *waProto.PollCreationMessage {
+	if poll := msg.GetPollCreationMessage(); poll != nil {
+		return poll
+	} else if poll := msg.GetPollCreationMessageV2(); poll != nil {
+		return poll
+	}
+	return msg.GetPollCreationMessageV3()
+}
+
+// Format a poll as message content: the question followed by one line per option
+func formatPollContent(poll *waProto.PollCreationMessage) string {
+	var b strings.Builder
+	b.WriteString("[Poll] ")
+	b.WriteString(poll.GetName())
+	for _, option := range poll.GetOptions() {
+		b.WriteString("\n- ")
+		b.WriteString(option.GetOptionName())
+	}
+	return b.String()
+}
+
+// Convert a poll creation message into a Poll
+func pollFromMessage(id, chatJID, creator string, createdAt time.Time, isFromMe bool, msg *waProto.PollCreationMessage) Poll {
+	poll := Poll{
+		ID:              id,
+		ChatJID:         chatJID,
+		Creator:         creator,
+		Question:        msg.GetName(),
+		SelectableCount: int(msg.GetSelectableOptionsCount()),
+		CreatedAt:       createdAt,
+		IsFromMe:        isFromMe,
+	}
+	for _, option := range msg.GetOptions() {
+		poll.Options = append(poll.Options, PollOption{Name: option.GetOptionName()})
+	}
+	return poll
+}
+
+// Store the poll carried by a message, if it is one
+func recordPoll(messageStore MessageStore, msg *events.Message, logger waLog.Logger) {
+	creation := getPollCreation(msg.Message)
+	if creation == nil {
+		return
+	}
+	poll := pollFromMessage(msg.Info.ID, msg.Info.Chat.String(), msg.Info.Sender.User, msg.Info.Timestamp, msg.Info.IsFromMe, creation)
+	if err := messageStore.StorePoll(poll); err != nil {
+		logger.Warnf("Failed to store poll %s: %v", poll.ID, err)
+	}
+}
+
+// Decrypt and store an incoming poll vote, then notify the webhook
+func handlePollVote(client *whatsmeow.Client, messageStore MessageStore, msg *events.Message, logger waLog.Logger) {
+	pollID := msg.Message.GetPollUpdateMessage().GetPollCreationMessageKey().GetID()
+	if pollID == "" {
+		logger.Warnf("Ignoring poll vote without a poll")
+		return
+	}
+
+	decrypted, err := client.DecryptPollVote(context.Background(), msg)
+	if err != nil {
+		logger.Warnf("Failed to decrypt vote on poll %s: %v", pollID, err)
+		return
+	}
+
+	chatJID := msg.Info.Chat.String()
+	vote := PollVote{
+		Voter:    msg.Info.Sender.User,
+		Selected: []string{},
+		Time:     msg.Info.Timestamp,
+	}
+	for _, hash := range decrypted.GetSelectedOptions() {
+		vote.Selected = append(vote.Selected, hex.EncodeToString(hash))
+	}
+
+	if err := messageStore.StorePollVote(pollID, chatJID, vote); err != nil {
+		logger.Warnf("Failed to store poll vote: %v", err)
+		return
+	}
+	logger.Infof("%s voted on poll %s (%d options selected)", vote.Voter, pollID, len(vote.Selected))
+
+	if isEligibleForWebhook(msg, chatJID, logger) {
+		sendPollVoteWebhook(messageStore, msg.Info.ID, pollID, chatJID, vote, logger)
+	}
+}
+
+// Store a poll received in a history sync, with the votes that come attached to it
+func storeHistorySyncPoll(client *whatsmeow.Client, messageStore MessageStore, chatJID string, chat types.JID,
+	messageID, sender string, timestamp time.Time, msg *waWeb.WebMessageInfo, logger waLog.Logger) {
+	creation := getPollCreation(msg.GetMessage())
+	if creation == nil {
+		return
+	}
+
+	poll := pollFromMessage(messageID, chatJID, sender, timestamp, msg.GetKey().GetFromMe(), creation)
+	if err := messageStore.StorePoll(poll); err != nil {
+		logger.Warnf("Failed to store history poll: %v", err)
+		return
+	}
+
+	for _, update := range msg.GetPollUpdates() {
+		vote := PollVote{
+			Voter:    historyKeySender(client, chat, update.GetPollUpdateMessageKey()),
+			Selected: []string{},
+			Time:     time.UnixMilli(update.GetSenderTimestampMS()),
+		}
+		if vote.Voter == "" {
+			continue
+		}
+		for _, hash := range update.GetVote().GetSelectedOptions() {
+			vote.Selected = append(vote.Selected, hex.EncodeToString(hash))
+		}
+		if err := messageStore.StorePollVote(messageID, chatJID, vote); err != nil {
+			logger.Warnf("Failed to store history poll vote: %v", err)
+		}
+	}
+}
+
+// Work out who sent a message from its key in a history sync
+func historyKeySender(client *whatsmeow.Client, chat types.JID, key *waCommon.MessageKey) string {
+	switch {
+	case key.GetFromMe():
+		return client.Store.ID.User
+	case key.GetParticipant() != "":
+		if participant, err := types.ParseJID(key.GetParticipant()); err == nil {
+			return participant.User
+		}
+		return ""
+	default:
+		return chat.User
+	}
+}
+
+// Send a poll_vote webhook notification with the voter's selection by name
+// and the current tally. Votes on polls that were never stored only carry
+// option hashes.
+func sendPollVoteWebhook(messageStore MessageStore, voteID, pollID, chatJID string, vote PollVote, logger waLog.Logger) {
+	webhookPayload := map[string]interface{}{
+		"event":     "poll_vote",
+		"id":        voteID,
+		"poll_id":   pollID,
+		"chat_jid":  chatJID,
+		"voter":     vote.Voter,
+		"selected":  []string{},
+		"removed":   len(vote.Selected) == 0,
+		"timestamp": vote.Time,
+	}
+
+	poll, err := messageStore.GetPoll(pollID, chatJID)
+	if err != nil {
+		webhookPayload["selected_hashes"] = vote.Selected
+	} else {
+		names := make(map[string]string)
+		for _, option := range poll.Options {
+			names[pollOptionHash(option.Name)] = option.Name
+		}
+		selected := []string{}
+		for _, hash := range vote.Selected {
+			if name, ok := names[hash]; ok {
+				selected = append(selected, name)
+			}
+		}
+		webhookPayload["selected"] = selected
+		webhookPayload["poll"] = poll
+	}
+
+	postWebhook(webhookPayload, logger)
+}
+
+// SendPollRequest represents the request body for the send poll API
+type SendPollRequest struct {
+	Recipient string   `json:"recipient"`
+	Question  string   `json:"question"`
+	Options   []string `json:"options"`
+	// Maximum number of options a voter may select; 0 (the default) allows any number
+	SelectableCount int `json:"selectable_count,omitempty"`
+}
+
+// Check a poll request against WhatsApp's limits
+func validatePollRequest(req SendPollRequest) error {
+	if req.Recipient == "" {
+		return fmt.Errorf("recipient is required")
+	}
+	if strings.TrimSpace(req.Question) == "" {
+		return fmt.Errorf("question is required")
+	}
+	if len(req.Options) < minPollOptions || len(req.Options) > maxPollOptions {
+		return fmt.Errorf("a poll needs between %d and %d options", minPollOptions, maxPollOptions)
+	}
+	// Votes refer to options by the hash of their name, so names must be unique
+	seen := make(map[string]bool)
+	for _, option := range req.Options {
+		if strings.TrimSpace(option) == "" {
+			return fmt.Errorf("options must not be empty")
+		}
+		if seen[option] {
+			return fmt.Errorf("duplicate option: %s", option)
+		}
+		seen[option] = true
+	}
+	if req.SelectableCount < 0 || req.SelectableCount > len(req.Options) {
+		return fmt.Errorf("selectable_count must be between 0 and the number of options")
+	}
+	return nil
+}
+
+// Handler for sending a poll
+func handleSendPoll(client *whatsmeow.Client, logger waLog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only allow POST requests
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if client is connected to WhatsApp
+		if !client.IsConnected() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "WhatsApp client is not connected",
+			})
+			return
+		}
+
+		var req SendPollRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Invalid request format: %v", err),
+			})
+			return
+		}
+		if err := validatePollRequest(req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		recipientJID, err := parseRecipientJID(req.Recipient)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Invalid recipient: %v", err),
+			})
+			return
+		}
+
+		// The poll is built with a fresh message secret, which whatsmeow keeps
+		// to decrypt the votes
+		msg := client.BuildPollCreation(req.Question, req.Options, req.SelectableCount)
+		resp, err := client.SendMessage(context.Background(), recipientJID, msg)
+		if err != nil {
+			logger.Warnf("Failed to send poll: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Error sending poll: %v", err),
+			})
+			return
+		}
+		logger.Infof("Poll sent to %s with ID %s", recipientJID, resp.ID)
+
+		dispatchOutgoingMessage(client, recipientJID, resp.ID, msg)
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"message":  fmt.Sprintf("Poll sent to %s", req.Recipient),
+			"id":       resp.ID,
+			"chat_jid": recipientJID.String(),
+		})
+	}
+}
+
+// Handler for getting a poll with its live tally: /api/polls/{id}
+func handlePoll(messageStore MessageStore, logger waLog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only allow GET requests
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		id := r.PathValue("id")
+		poll, err := messageStore.GetPoll(id, r.URL.Query().Get("chat_jid"))
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "Poll not found",
+			})
+			return
+		}
+		if err != nil {
+			logger.Errorf("Failed to get poll %s: %v", id, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to get poll: %v", err),
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"poll":    poll,
+		})
+	}
+}
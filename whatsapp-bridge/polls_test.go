@@ -0,0 +1,77 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPollTally(t *testing.T) {
+	group := "123456789@g.us"
+	at := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	vote := func(voter string, minutes int, options ...string) PollVote {
+		selected := []string{}
+		for _, option := range options {
+			selected = append(selected, pollOptionHash(option))
+		}
+		return PollVote{Voter: voter, Selected: selected, Time: at.Add(time.Duration(minutes) * time.Minute)}
+	}
+
+	tests := []struct {
+		name   string
+		votes  []PollVote
+		want   map[string][]string
+		voters int
+	}{
+		{"no votes", nil, map[string][]string{}, 0},
+		{"one vote each", []PollVote{vote("111", 1, "Pizza"), vote("222", 2, "Sushi")},
+			map[string][]string{"Pizza": {"111"}, "Sushi": {"222"}}, 2},
+		{"several options", []PollVote{vote("111", 1, "Pizza", "Tacos"), vote("222", 2, "Tacos")},
+			map[string][]string{"Pizza": {"111"}, "Tacos": {"111", "222"}}, 2},
+		{"a new vote replaces the old one", []PollVote{vote("111", 1, "Pizza"), vote("111", 2, "Sushi")},
+			map[string][]string{"Sushi": {"111"}}, 1},
+		{"an older vote arriving late is ignored", []PollVote{vote("111", 2, "Sushi"), vote("111", 1, "Pizza")},
+			map[string][]string{"Sushi": {"111"}}, 1},
+		{"a removed vote is not counted", []PollVote{vote("111", 1, "Pizza"), vote("111", 2), vote("222", 3, "Pizza")},
+			map[string][]string{"Pizza": {"222"}}, 1},
+		{"unknown options are ignored", []PollVote{vote("111", 1, "Burgers")}, map[string][]string{}, 0},
+	}
+
+	for _, encrypted := range []bool{false, true} {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				store := newTestStore(t)
+				if encrypted {
+					store.keys = newTestKeyring(t, 1)
+				}
+				err := store.StorePoll(Poll{ID: "p1", ChatJID: group, Creator: "111", Question: "Lunch?", CreatedAt: at,
+					Options: []PollOption{{Name: "Pizza"}, {Name: "Sushi"}, {Name: "Tacos"}}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, v := range tt.votes {
+					if err := store.StorePollVote("p1", group, v); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				poll, err := store.GetPoll("p1", "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if poll.Question != "Lunch?" || len(poll.Options) != 3 {
+					t.Fatalf("encrypted=%v: poll = %+v", encrypted, poll)
+				}
+				for _, option := range poll.Options {
+					want := tt.want[option.Name]
+					if option.Votes != len(want) || !slices.Equal(option.Voters, want) {
+						t.Errorf("encrypted=%v: %s has %d votes from %q, want %q", encrypted, option.Name, option.Votes, option.Voters, want)
+					}
+				}
+				if poll.VoterCount != tt.voters {
+					t.Errorf("encrypted=%v: voter count = %d, want %d", encrypted, poll.VoterCount, tt.voters)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waWeb"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// Reaction is an emoji reaction to a message. Each sender has at most one
+// reaction per message; reacting again replaces it.
+type Reaction struct {
+	Sender   string
+	Emoji    string
+	Time     time.Time
+	IsFromMe bool
+}
+
+// Store a reaction to a message. An empty emoji means the sender removed
+// their reaction.
+func (store *SQLMessageStore) StoreReaction(messageID, chatJID string, reaction Reaction) error {
+	// Reactions can arrive out of order, so an older one never replaces or
+	// removes a newer one
+	if reaction.Emoji == "" {
+		_, err := store.db.Exec(
+			"DELETE FROM reactions WHERE chat_jid = ? AND message_id = ? AND sender = ? AND (timestamp IS NULL OR timestamp <= ?)",
+			chatJID, messageID, reaction.Sender, reaction.Time,
+		)
+		return err
+	}
+
+	_, err := store.db.Exec(
+		`INSERT INTO reactions (message_id, chat_jid, sender, emoji, timestamp, is_from_me) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (chat_jid, message_id, sender) DO UPDATE SET
+			emoji = excluded.emoji, timestamp = excluded.timestamp, is_from_me = excluded.is_from_me
+		WHERE reactions.timestamp IS NULL OR excluded.timestamp >= reactions.timestamp`,
+		messageID, chatJID, reaction.Sender, store.keys.encryptString(reaction.Emoji), reaction.Time, reaction.IsFromMe,
+	)
+	return err
+}
+
+// Get the reactions to a set of messages in a chat, keyed by message ID, oldest first
+func (store *SQLMessageStore) GetReactions(chatJID string, messageIDs []string) (map[string][]Reaction, error) {
+	reactions := make(map[string][]Reaction)
+	if len(messageIDs) == 0 {
+		return reactions, nil
+	}
+
+	args := []interface{}{chatJID}
+	for _, id := range messageIDs {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(messageIDs)), ", ")
+
+	rows, err := store.db.Query(
+		"SELECT message_id, sender, emoji, timestamp, is_from_me FROM reactions WHERE chat_jid = ? AND message_id IN ("+placeholders+") ORDER BY timestamp, sender",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID string
+		var reaction Reaction
+		if err := rows.Scan(&messageID, &reaction.Sender, &reaction.Emoji, &reaction.Time, &reaction.IsFromMe); err != nil {
+			return nil, err
+		}
+		if reaction.Emoji, err = store.keys.decryptString(reaction.Emoji); err != nil {
+			return nil, fmt.Errorf("reaction to %s: %v", messageID, err)
+		}
+		reactions[messageID] = append(reactions[messageID], reaction)
+	}
+	return reactions, rows.Err()
+}
+
+// Attach their reactions to a page of messages
+func attachReactions(messageStore MessageStore, messages []Message) error {
+	ids := make(map[string][]string)
+	for _, msg := range messages {
+		ids[msg.ChatJID] = append(ids[msg.ChatJID], msg.ID)
+	}
+	for chatJID, chatIDs := range ids {
+		reactions, err := messageStore.GetReactions(chatJID, chatIDs)
+		if err != nil {
+			return err
+		}
+		for i := range messages {
+			if messages[i].ChatJID == chatJID {
+				messages[i].Reactions = reactions[messages[i].ID]
+			}
+		}
+	}
+	return nil
+}
+
+// Store an incoming reaction message and notify the webhook
+func handleReactionMessage(messageStore MessageStore, msg *events.Message, logger waLog.Logger) {
+	reactionMessage := msg.Message.GetReactionMessage()
+	targetID := reactionMessage.GetKey().GetID()
+	if targetID == "" {
+		logger.Warnf("Ignoring reaction without a target message")
+		return
+	}
+
+	chatJID := msg.Info.Chat.String()
+	reaction := Reaction{
+		Sender:   msg.Info.Sender.User,
+		Emoji:    reactionMessage.GetText(),
+		Time:     msg.Info.Timestamp,
+		IsFromMe: msg.Info.IsFromMe,
+	}
+
+	if err := messageStore.StoreReaction(targetID, chatJID, reaction); err != nil {
+		logger.Warnf("Failed to store reaction: %v", err)
+		return
+	}
+	if reaction.Emoji == "" {
+		logger.Infof("%s removed their reaction to %s", reaction.Sender, targetID)
+	} else {
+		logger.Infof("%s reacted %s to %s", reaction.Sender, reaction.Emoji, targetID)
+	}
+
+	if isEligibleForWebhook(msg, chatJID, logger) {
+		sendReactionWebhook(messageStore, msg.Info.ID, targetID, chatJID, reaction, logger)
+	}
+}
+
+// Store the reactions that come attached to a message in a history sync
+func storeHistorySyncReactions(client *whatsmeow.Client, messageStore MessageStore, chatJID string, chat types.JID,
+	messageID string, reactions []*waWeb.Reaction, logger waLog.Logger) {
+	for _, r := range reactions {
+		if r.GetText() == "" {
+			continue
+		}
+
+		reaction := Reaction{
+			Sender:   historyKeySender(client, chat, r.GetKey()),
+			Emoji:    r.GetText(),
+			Time:     time.UnixMilli(r.GetSenderTimestampMS()),
+			IsFromMe: r.GetKey().GetFromMe(),
+		}
+		if reaction.Sender == "" {
+			continue
+		}
+
+		if err := messageStore.StoreReaction(messageID, chatJID, reaction); err != nil {
+			logger.Warnf("Failed to store history reaction: %v", err)
+		}
+	}
+}
+
+// Send a reaction webhook notification. The reacted-to message is included
+// when it is in the store.
+func sendReactionWebhook(messageStore MessageStore, reactionID, targetID, chatJID string, reaction Reaction, logger waLog.Logger) {
+	webhookPayload := map[string]interface{}{
+		"event":      "reaction",
+		"id":         reactionID,
+		"message_id": targetID,
+		"chat_jid":   chatJID,
+		"sender":     reaction.Sender,
+		"emoji":      reaction.Emoji,
+		"removed":    reaction.Emoji == "",
+		"timestamp":  reaction.Time,
+		"is_from_me": reaction.IsFromMe,
+	}
+
+	if target, err := messageStore.GetMessage(targetID, chatJID); err == nil {
+		webhookPayload["target_message"] = map[string]interface{}{
+			"sender":     target.Sender,
+			"content":    target.Content,
+			"timestamp":  target.Time,
+			"is_from_me": target.IsFromMe,
+			"media_type": target.MediaType,
+			"filename":   target.Filename,
+		}
+	}
+
+	postWebhook(webhookPayload, logger)
+}
+
+// ReactRequest is the request body for reacting to a message
+type ReactRequest struct {
+	ChatJID   string `json:"chat_jid"`
+	MessageID string `json:"message_id"`
+	// Sender of the message reacted to. Only needed when the message is not
+	// in the store.
+	Sender string `json:"sender,omitempty"`
+	// Emoji to react with; empty removes our reaction
+	Emoji string `json:"emoji"`
+}
+
+// Resolve the sender of the message a reaction targets, from the request or
+// else from the stored message
+func reactionTargetSender(client *whatsmeow.Client, messageStore MessageStore, chat types.JID, req ReactRequest) (types.JID, error) {
+	if req.Sender != "" {
+		return parseRecipientJID(req.Sender)
+	}
+
+	target, err := messageStore.GetMessage(req.MessageID, chat.String())
+	if err == sql.ErrNoRows {
+		return types.JID{}, fmt.Errorf("message %s is not stored, so sender is required", req.MessageID)
+	}
+	if err != nil {
+		return types.JID{}, fmt.Errorf("failed to get message: %v", err)
+	}
+	return storedSenderJID(client, messageStore, chat, target), nil
+}
+
+// Handler for reacting to a message, or removing our reaction to it
+func handleReact(client *whatsmeow.Client, messageStore MessageStore, logger waLog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only allow POST requests
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if client is connected to WhatsApp
+		if !client.IsConnected() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "WhatsApp client is not connected",
+			})
+			return
+		}
+
+		var req ReactRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Invalid request format: %v", err),
+			})
+			return
+		}
+		if req.ChatJID == "" || req.MessageID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "chat_jid and message_id are required",
+			})
+			return
+		}
+
+		chat, err := parseRecipientJID(req.ChatJID)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Invalid chat_jid: %v", err),
+			})
+			return
+		}
+		sender, err := reactionTargetSender(client, messageStore, chat, req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		msg := client.BuildReaction(chat, sender, req.MessageID, req.Emoji)
+		resp, err := client.SendMessage(context.Background(), chat, msg)
+		if err != nil {
+			logger.Warnf("Failed to send reaction: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Error sending reaction: %v", err),
+			})
+			return
+		}
+
+		// Our own reactions are not echoed back to us, so record it here
+		reaction := Reaction{
+			Sender:   client.Store.ID.User,
+			Emoji:    req.Emoji,
+			Time:     resp.Timestamp,
+			IsFromMe: true,
+		}
+		if err := messageStore.StoreReaction(req.MessageID, chat.String(), reaction); err != nil {
+			logger.Warnf("Failed to store reaction: %v", err)
+		}
+		if req.Emoji == "" {
+			logger.Infof("Removed our reaction to %s in %s", req.MessageID, chat)
+		} else {
+			logger.Infof("Reacted %s to %s in %s", req.Emoji, req.MessageID, chat)
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":    true,
+			"id":         resp.ID,
+			"message_id": req.MessageID,
+			"chat_jid":   chat.String(),
+			"emoji":      req.Emoji,
+			"removed":    req.Emoji == "",
+		})
+	}
+}
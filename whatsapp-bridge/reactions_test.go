@@ -0,0 +1,101 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestStoreReaction(t *testing.T) {
+	chat := "4915112345678@s.whatsapp.net"
+	at := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	react := func(sender, emoji string, minutes int) Reaction {
+		return Reaction{Sender: sender, Emoji: emoji, Time: at.Add(time.Duration(minutes) * time.Minute)}
+	}
+
+	tests := []struct {
+		name      string
+		reactions []Reaction
+		// Sender and emoji of each stored reaction, oldest first
+		want [][2]string
+	}{
+		{"one reaction", []Reaction{react("111", "👍", 1)}, [][2]string{{"111", "👍"}}},
+		{"a newer reaction replaces the sender's last", []Reaction{react("111", "👍", 1), react("111", "❤️", 2)}, [][2]string{{"111", "❤️"}}},
+		{"an older reaction arriving late is ignored", []Reaction{react("111", "❤️", 2), react("111", "👍", 1)}, [][2]string{{"111", "❤️"}}},
+		{"an empty emoji removes the reaction", []Reaction{react("111", "👍", 1), react("111", "", 2)}, nil},
+		{"an older removal is ignored", []Reaction{react("111", "👍", 2), react("111", "", 1)}, [][2]string{{"111", "👍"}}},
+		{"senders are kept apart, oldest first", []Reaction{react("222", "😂", 3), react("111", "👍", 1), react("333", "🙏", 2)},
+			[][2]string{{"111", "👍"}, {"333", "🙏"}, {"222", "😂"}}},
+	}
+
+	for _, encrypted := range []bool{false, true} {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				store := newTestStore(t)
+				if encrypted {
+					store.keys = newTestKeyring(t, 1)
+				}
+				storeTestMessage(t, store, chat, "m1", "111", "hello", at, "", "")
+				for _, reaction := range tt.reactions {
+					if err := store.StoreReaction("m1", chat, reaction); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				reactions, err := store.GetReactions(chat, []string{"m1"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got [][2]string
+				for _, reaction := range reactions["m1"] {
+					got = append(got, [2]string{reaction.Sender, reaction.Emoji})
+				}
+				if !slices.Equal(got, tt.want) {
+					t.Errorf("encrypted=%v: reactions = %q, want %q", encrypted, got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestReactionTargetSender(t *testing.T) {
+	store := newTestStore(t)
+	client := &whatsmeow.Client{}
+	direct := types.NewJID("4915100000001", types.DefaultUserServer)
+	group := types.NewJID("123456789", types.GroupServer)
+	at := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	storeTestMessage(t, store, direct.String(), "direct", "4915100000001", "hello", at, "", "")
+	storeTestMessage(t, store, group.String(), "group", "4915100000002", "hi all", at, "", "")
+
+	tests := []struct {
+		name    string
+		chat    types.JID
+		req     ReactRequest
+		want    string
+		wantErr string
+	}{
+		{"sender from the request", group, ReactRequest{MessageID: "unknown", Sender: "4915100000003"}, "4915100000003@s.whatsapp.net", ""},
+		{"sender of a stored direct message", direct, ReactRequest{MessageID: "direct"}, "4915100000001@s.whatsapp.net", ""},
+		{"sender of a stored group message", group, ReactRequest{MessageID: "group"}, "4915100000002@s.whatsapp.net", ""},
+		{"message not stored", group, ReactRequest{MessageID: "unknown"}, "", "sender is required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, err := reactionTargetSender(client, store, tt.chat, tt.req)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("reactionTargetSender = %v, %v, want an error about %q", sender, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || sender.String() != tt.want {
+				t.Errorf("reactionTargetSender = %v, %v, want %s", sender, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// Delivery statuses of a message, in the order they are reached
+const (
+	statusSent      = "sent"
+	statusDelivered = "delivered"
+	statusRead      = "read"
+	statusPlayed    = "played"
+)
+
+// Rank of each status; a participant that reached a status has also
+// reached every status ranked below it
+var statusRank = map[string]int{
+	statusSent:      1,
+	statusDelivered: 2,
+	statusRead:      3,
+	statusPlayed:    4,
+}
+
+// StatusChange is one entry in the status history of a message
+type StatusChange struct {
+	Participant string    `json:"participant"`
+	Status      string    `json:"status"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// ParticipantStatus is how far a message got with one recipient
+type ParticipantStatus struct {
+	Participant string     `json:"participant"`
+	Status      string     `json:"status"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	ReadAt      *time.Time `json:"read_at,omitempty"`
+	PlayedAt    *time.Time `json:"played_at,omitempty"`
+}
+
+// MessageStatus summarises the receipts received for a message
+type MessageStatus struct {
+	MessageID string     `json:"message_id"`
+	ChatJID   string     `json:"chat_jid"`
+	Status    string     `json:"status"`
+	SentAt    *time.Time `json:"sent_at,omitempty"`
+	// Number of recipients, when known (group size without us, or 1)
+	Recipients   int                 `json:"recipients,omitempty"`
+	Participants []ParticipantStatus `json:"participants"`
+	History      []StatusChange      `json:"history"`
+}
+
+// Record that a message reached a status for a participant. Each status is
+// kept once per participant, at the time it was first reached, so the
+// returned bool is false for repeated receipts.
+func (store *SQLMessageStore) RecordMessageStatus(messageID, chatJID string, change StatusChange) (bool, error) {
+	result, err := store.db.Exec(
+		`INSERT INTO message_status (message_id, chat_jid, participant, status, timestamp) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (chat_jid, message_id, participant, status) DO NOTHING`,
+		messageID, chatJID, change.Participant, change.Status, change.Timestamp,
+	)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// Get the status history of a message, oldest first
+func (store *SQLMessageStore) GetMessageStatusHistory(messageID, chatJID string) ([]StatusChange, error) {
+	rows, err := store.db.Query(
+		"SELECT participant, status, timestamp FROM message_status WHERE chat_jid = ? AND message_id = ? ORDER BY timestamp, participant",
+		chatJID, messageID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []StatusChange
+	for rows.Next() {
+		var change StatusChange
+		if err := rows.Scan(&change.Participant, &change.Status, &change.Timestamp); err != nil {
+			return nil, err
+		}
+		history = append(history, change)
+	}
+	return history, rows.Err()
+}
+
+// Build the status summary of a message from its history
+func buildMessageStatus(messageStore MessageStore, messageID, chatJID string, history []StatusChange) MessageStatus {
+	status := MessageStatus{
+		MessageID:    messageID,
+		ChatJID:      chatJID,
+		Participants: []ParticipantStatus{},
+		History:      history,
+	}
+
+	byParticipant := make(map[string]*ParticipantStatus)
+	var order []string
+	for _, change := range history {
+		at := change.Timestamp
+		if change.Status == statusSent {
+			if status.SentAt == nil {
+				status.SentAt = &at
+			}
+			continue
+		}
+
+		p, ok := byParticipant[change.Participant]
+		if !ok {
+			p = &ParticipantStatus{Participant: change.Participant}
+			byParticipant[change.Participant] = p
+			order = append(order, change.Participant)
+		}
+		switch change.Status {
+		case statusDelivered:
+			p.DeliveredAt = &at
+		case statusRead:
+			p.ReadAt = &at
+		case statusPlayed:
+			p.PlayedAt = &at
+		}
+		if statusRank[change.Status] > statusRank[p.Status] {
+			p.Status = change.Status
+		}
+	}
+	for _, participant := range order {
+		status.Participants = append(status.Participants, *byParticipant[participant])
+	}
+
+	// In a group the message only counts as delivered or read once every
+	// other member got that far, as in the WhatsApp apps
+	if strings.HasSuffix(chatJID, "@g.us") {
+		if group, err := messageStore.GetGroup(chatJID); err == nil && group.ParticipantCount > 1 {
+			status.Recipients = group.ParticipantCount - 1
+		}
+	} else {
+		status.Recipients = 1
+	}
+
+	if status.SentAt != nil {
+		status.Status = statusSent
+	}
+	if status.Recipients > 1 {
+		for _, candidate := range []string{statusDelivered, statusRead, statusPlayed} {
+			reached := 0
+			for _, p := range status.Participants {
+				if statusRank[p.Status] >= statusRank[candidate] {
+					reached++
+				}
+			}
+			if reached < status.Recipients {
+				break
+			}
+			status.Status = candidate
+		}
+		return status
+	}
+	for _, p := range status.Participants {
+		if statusRank[p.Status] > statusRank[status.Status] {
+			status.Status = p.Status
+		}
+	}
+	return status
+}
+
+// Map a receipt type to the message status it signals. Receipts that are
+// not about the recipient's progress (our own devices, retries, ...) map
+// to "".
+func receiptStatus(receiptType types.ReceiptType) string {
+	switch receiptType {
+	case types.ReceiptTypeDelivered:
+		return statusDelivered
+	case types.ReceiptTypeRead:
+		return statusRead
+	case types.ReceiptTypePlayed:
+		return statusPlayed
+	default:
+		return ""
+	}
+}
+
+// Record that one of our messages was sent
+func recordSentStatus(messageStore MessageStore, msg *events.Message, logger waLog.Logger) {
+	change := StatusChange{
+		Participant: msg.Info.Sender.User,
+		Status:      statusSent,
+		Timestamp:   msg.Info.Timestamp,
+	}
+	if _, err := messageStore.RecordMessageStatus(msg.Info.ID, msg.Info.Chat.String(), change); err != nil {
+		logger.Warnf("Failed to record sent status of %s: %v", msg.Info.ID, err)
+	}
+}
+
+// Map a LID to the phone number JID it belongs to, when known, so receipts
+// are stored under the same chat and participant as the messages they are for
+func phoneNumberJID(client *whatsmeow.Client, jid types.JID) types.JID {
+	if jid.Server != types.HiddenUserServer {
+		return jid
+	}
+	if pn, err := client.Store.LIDs.GetPNForLID(context.Background(), jid.ToNonAD()); err == nil && !pn.IsEmpty() {
+		return pn.ToNonAD()
+	}
+	return jid
+}
+
+// Store the statuses carried by a receipt and notify the webhook of changes
+func handleReceipt(client *whatsmeow.Client, messageStore MessageStore, receipt *events.Receipt, logger waLog.Logger) {
+	// Receipts sent by our own devices say nothing about the recipients
+	if receipt.IsFromMe {
+		return
+	}
+	status := receiptStatus(receipt.Type)
+	if status == "" {
+		return
+	}
+
+	chatJID := phoneNumberJID(client, receipt.Chat).String()
+	change := StatusChange{
+		Participant: phoneNumberJID(client, receipt.Sender).User,
+		Status:      status,
+		Timestamp:   receipt.Timestamp,
+	}
+	for _, messageID := range receipt.MessageIDs {
+		changed, err := messageStore.RecordMessageStatus(messageID, chatJID, change)
+		if err != nil {
+			logger.Warnf("Failed to record %s status of %s: %v", status, messageID, err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		logger.Infof("Message %s %s by %s", messageID, status, change.Participant)
+
+		if isEligibleForStatusWebhook(receipt, chatJID, logger) {
+			sendStatusWebhook(messageStore, messageID, chatJID, change, logger)
+		}
+	}
+}
+
+// Status webhooks follow the same rules as message webhooks: direct chats only
+func isEligibleForStatusWebhook(receipt *events.Receipt, chatJID string, logger waLog.Logger) bool {
+	if receipt.IsGroup {
+		return false
+	}
+	if strings.HasSuffix(chatJID, "@lid") {
+		logger.Infof("Skipping status webhook for @lid JID: %s", chatJID)
+		return false
+	}
+	return true
+}
+
+// Send a status-change webhook notification. The message is included when
+// it is in the store.
+func sendStatusWebhook(messageStore MessageStore, messageID, chatJID string, change StatusChange, logger waLog.Logger) {
+	webhookPayload := map[string]interface{}{
+		"event":       "message_status",
+		"message_id":  messageID,
+		"chat_jid":    chatJID,
+		"participant": change.Participant,
+		"status":      change.Status,
+		"timestamp":   change.Timestamp,
+	}
+
+	if msg, err := messageStore.GetMessage(messageID, chatJID); err == nil {
+		webhookPayload["message"] = map[string]interface{}{
+			"content":    msg.Content,
+			"timestamp":  msg.Time,
+			"is_from_me": msg.IsFromMe,
+			"media_type": msg.MediaType,
+			"filename":   msg.Filename,
+		}
+	}
+
+	postWebhook(webhookPayload, logger)
+}
+
+// Handler for the delivery status of a message: /api/messages/{id}/status
+func handleMessageStatus(messageStore MessageStore, logger waLog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only allow GET requests
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		messageID := r.PathValue("id")
+		chatJID := r.URL.Query().Get("chat_jid")
+		if chatJID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "chat_jid is required",
+			})
+			return
+		}
+
+		history, err := messageStore.GetMessageStatusHistory(messageID, chatJID)
+		if err != nil {
+			logger.Errorf("Failed to get status of message %s: %v", messageID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to get message status: %v", err),
+			})
+			return
+		}
+
+		if len(history) == 0 {
+			if exists, _ := messageStore.MessageExists(messageID, chatJID); !exists {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "Message not found",
+				})
+				return
+			}
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"status":  buildMessageStatus(messageStore, messageID, chatJID, history),
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuildMessageStatus(t *testing.T) {
+	direct := "4915100000001@s.whatsapp.net"
+	group := "123456789@g.us"
+	unknownGroup := "987654321@g.us"
+	bob, carol := "4915100000002@s.whatsapp.net", "4915100000003@s.whatsapp.net"
+	at := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// Each change is a participant and status, one minute after the last
+	type change [2]string
+	tests := []struct {
+		name           string
+		chatJID        string
+		changes        []change
+		wantStatus     string
+		wantRecipients int
+	}{
+		{"nothing recorded", direct, nil, "", 1},
+		{"sent", direct, []change{{"", statusSent}}, statusSent, 1},
+		{"direct chat read", direct, []change{{"", statusSent}, {direct, statusDelivered}, {direct, statusRead}}, statusRead, 1},
+		{"group delivered to one member", group, []change{{"", statusSent}, {bob, statusDelivered}}, statusSent, 2},
+		{"group delivered to every member", group, []change{{"", statusSent}, {bob, statusDelivered}, {carol, statusDelivered}}, statusDelivered, 2},
+		{"group read by one member", group, []change{{"", statusSent}, {bob, statusRead}, {carol, statusDelivered}}, statusDelivered, 2},
+		{"group read by every member", group, []change{{"", statusSent}, {bob, statusRead}, {carol, statusRead}}, statusRead, 2},
+		{"group played by one, read by the other", group, []change{{"", statusSent}, {bob, statusPlayed}, {carol, statusRead}}, statusRead, 2},
+		{"group of unknown size", unknownGroup, []change{{"", statusSent}, {bob, statusRead}}, statusRead, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			err := store.StoreGroup(Group{JID: group, Subject: "Team", Participants: []GroupParticipant{
+				{JID: "4915100000001@s.whatsapp.net"}, {JID: bob}, {JID: carol},
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, c := range tt.changes {
+				added, err := store.RecordMessageStatus("m1", tt.chatJID, StatusChange{Participant: c[0], Status: c[1], Timestamp: at.Add(time.Duration(i) * time.Minute)})
+				if err != nil || !added {
+					t.Fatalf("RecordMessageStatus(%v) = %v, %v", c, added, err)
+				}
+				// A repeated receipt keeps the first time
+				if added, err := store.RecordMessageStatus("m1", tt.chatJID, StatusChange{Participant: c[0], Status: c[1], Timestamp: at.Add(time.Hour)}); err != nil || added {
+					t.Errorf("repeated RecordMessageStatus(%v) = %v, %v, want not added", c, added, err)
+				}
+			}
+
+			history, err := store.GetMessageStatusHistory("m1", tt.chatJID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			status := buildMessageStatus(store, "m1", tt.chatJID, history)
+			if status.Status != tt.wantStatus || status.Recipients != tt.wantRecipients {
+				t.Errorf("status = %q with %d recipients, want %q with %d", status.Status, status.Recipients, tt.wantStatus, tt.wantRecipients)
+			}
+			if len(tt.changes) > 0 && tt.changes[0][1] == statusSent && (status.SentAt == nil || !status.SentAt.Equal(at)) {
+				t.Errorf("sent at = %v, want %v", status.SentAt, at)
+			}
+		})
+	}
+}
@@ -0,0 +1,660 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// Directory holding downloaded media (one subdirectory per chat) and temp_media
+const mediaRootDir = "store"
+
+// RetentionPolicy describes what the retention janitor removes. A zero duration
+// or budget disables that rule.
+type RetentionPolicy struct {
+	// How often the janitor runs
+	Interval time.Duration
+	// Delete messages (and their media) older than this
+	MessageMaxAge time.Duration
+	// Per-chat overrides of MessageMaxAge; 0 keeps a chat forever
+	ChatMaxAge map[string]time.Duration
+	// Delete downloaded media files of messages older than this
+	MediaMaxAge time.Duration
+	// Per-media-type overrides of MediaMaxAge; 0 keeps that type forever
+	MediaTypeMaxAge map[string]time.Duration
+	// Delete the oldest media files once downloaded media exceeds this many bytes
+	MediaDiskBudget int64
+	// Delete leftover files in store/temp_media older than this
+	TempMediaMaxAge time.Duration
+	// Clear the content of deleted messages this long after deletion
+	DeletedContentMaxAge time.Duration
+}
+
+// RetentionRule selects stored messages older than Before, optionally limited
+// to one chat or media type. The exclusions let a catch-all rule skip chats and
+// media types that have rules of their own.
+type RetentionRule struct {
+	Before            time.Time
+	ChatJID           string
+	ExcludeChatJIDs   []string
+	MediaType         string
+	ExcludeMediaTypes []string
+}
+
+// MediaFile identifies the downloaded media file of a stored message
+type MediaFile struct {
+	MessageID string
+	ChatJID   string
+	Filename  string
+}
+
+// RetentionReport summarizes what a single janitor run removed
+type RetentionReport struct {
+	StartedAt             time.Time `json:"started_at"`
+	FinishedAt            time.Time `json:"finished_at"`
+	MessagesDeleted       int       `json:"messages_deleted"`
+	DeletedMessagesPurged int       `json:"deleted_messages_purged"`
+	MediaFilesDeleted     int       `json:"media_files_deleted"`
+	TempFilesDeleted      int       `json:"temp_files_deleted"`
+	BytesFreed            int64     `json:"bytes_freed"`
+	Vacuumed              bool      `json:"vacuumed"`
+	Errors                []string  `json:"errors,omitempty"`
+}
+
+// Build the WHERE clause selecting the messages covered by a rule
+func (rule RetentionRule) where() (string, []interface{}) {
+	conditions := []string{"timestamp < ?"}
+	args := []interface{}{rule.Before}
+
+	if rule.ChatJID != "" {
+		conditions = append(conditions, "chat_jid = ?")
+		args = append(args, rule.ChatJID)
+	}
+	if len(rule.ExcludeChatJIDs) > 0 {
+		conditions = append(conditions, "chat_jid NOT IN (?"+strings.Repeat(", ?", len(rule.ExcludeChatJIDs)-1)+")")
+		for _, jid := range rule.ExcludeChatJIDs {
+			args = append(args, jid)
+		}
+	}
+	if rule.MediaType != "" {
+		conditions = append(conditions, "media_type = ?")
+		args = append(args, rule.MediaType)
+	}
+	if len(rule.ExcludeMediaTypes) > 0 {
+		conditions = append(conditions, "media_type NOT IN (?"+strings.Repeat(", ?", len(rule.ExcludeMediaTypes)-1)+")")
+		for _, mediaType := range rule.ExcludeMediaTypes {
+			args = append(args, mediaType)
+		}
+	}
+
+	return strings.Join(conditions, " AND "), args
+}
+
+// Clear the content, edit history and media of messages deleted before cutoff.
+// The tombstone row itself (id, sender, timestamps, deleted_by) is kept.
+// Returns the number of messages purged.
+func (store *SQLMessageStore) PurgeDeletedMessageContent(cutoff time.Time) (int, error) {
+	rows, err := store.db.Query(
+		"SELECT id, chat_jid, COALESCE(filename, ''), COALESCE(media_type, '') FROM messages WHERE deleted_at IS NOT NULL AND deleted_at < ? AND content_purged_at IS NULL",
+		cutoff,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	type purgeTarget struct {
+		id, chatJID, filename, mediaType string
+	}
+	var targets []purgeTarget
+	for rows.Next() {
+		var t purgeTarget
+		if err := rows.Scan(&t.id, &t.chatJID, &t.filename, &t.mediaType); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		targets = append(targets, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(targets) == 0 {
+		return 0, nil
+	}
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	for _, t := range targets {
+		_, err := tx.Exec(
+			`UPDATE messages SET content = '', filename = '', url = NULL, media_key = NULL, file_sha256 = NULL,
+				file_enc_sha256 = NULL, file_length = NULL, mimetype = NULL, direct_path = NULL, quoted_message = '', structured_data = NULL,
+				content_purged_at = ?
+			WHERE id = ? AND chat_jid = ?`,
+			now, t.id, t.chatJID,
+		)
+		if err != nil {
+			return 0, err
+		}
+
+		if _, err := tx.Exec("DELETE FROM message_revisions WHERE message_id = ? AND chat_jid = ?", t.id, t.chatJID); err != nil {
+			return 0, err
+		}
+
+		if err := store.syncSearchIndex(tx, t.id, t.chatJID); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	// Remove downloaded media only once the rows are purged
+	for _, t := range targets {
+		if t.mediaType == "" || t.filename == "" {
+			continue
+		}
+		if err := releaseStoredMedia(store, MediaFile{MessageID: t.id, ChatJID: t.chatJID, Filename: t.filename}); err != nil {
+			return len(targets), err
+		}
+	}
+
+	return len(targets), nil
+}
+
+// Permanently delete the messages covered by a rule, along with their edit
+// history and search index entries. Returns the number of messages deleted and
+// the media files they referenced, which the caller should release.
+func (store *SQLMessageStore) PruneMessages(rule RetentionRule) (int, []MediaFile, error) {
+	where, args := rule.where()
+	rows, err := store.db.Query(
+		"SELECT id, chat_jid, COALESCE(media_type, ''), COALESCE(filename, '') FROM messages WHERE "+where,
+		args...,
+	)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	type pruneTarget struct {
+		id, chatJID, mediaType, filename string
+	}
+	var targets []pruneTarget
+	for rows.Next() {
+		var t pruneTarget
+		if err := rows.Scan(&t.id, &t.chatJID, &t.mediaType, &t.filename); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		targets = append(targets, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	if len(targets) == 0 {
+		return 0, nil, nil
+	}
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	var files []MediaFile
+	for _, t := range targets {
+		if err := store.removeSearchIndex(tx, t.id, t.chatJID); err != nil {
+			return 0, nil, err
+		}
+		if _, err := tx.Exec("DELETE FROM message_revisions WHERE message_id = ? AND chat_jid = ?", t.id, t.chatJID); err != nil {
+			return 0, nil, err
+		}
+		if _, err := tx.Exec("DELETE FROM reactions WHERE message_id = ? AND chat_jid = ?", t.id, t.chatJID); err != nil {
+			return 0, nil, err
+		}
+		if _, err := tx.Exec("DELETE FROM message_status WHERE message_id = ? AND chat_jid = ?", t.id, t.chatJID); err != nil {
+			return 0, nil, err
+		}
+		for _, table := range []string{"poll_votes", "poll_options"} {
+			if _, err := tx.Exec("DELETE FROM "+table+" WHERE poll_id = ? AND chat_jid = ?", t.id, t.chatJID); err != nil {
+				return 0, nil, err
+			}
+		}
+		if _, err := tx.Exec("DELETE FROM polls WHERE message_id = ? AND chat_jid = ?", t.id, t.chatJID); err != nil {
+			return 0, nil, err
+		}
+		if _, err := tx.Exec("DELETE FROM media_downloads WHERE message_id = ? AND chat_jid = ?", t.id, t.chatJID); err != nil {
+			return 0, nil, err
+		}
+		if _, err := tx.Exec("DELETE FROM messages WHERE id = ? AND chat_jid = ?", t.id, t.chatJID); err != nil {
+			return 0, nil, err
+		}
+
+		if t.mediaType != "" && t.filename != "" {
+			files = append(files, MediaFile{MessageID: t.id, ChatJID: t.chatJID, Filename: t.filename})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+
+	return len(targets), files, nil
+}
+
+// Get the media files of the messages covered by a rule. The messages themselves are kept.
+func (store *SQLMessageStore) GetMediaFiles(rule RetentionRule) ([]MediaFile, error) {
+	where, args := rule.where()
+	rows, err := store.db.Query(
+		"SELECT id, chat_jid, filename FROM messages WHERE "+where+" AND COALESCE(media_type, '') <> '' AND COALESCE(filename, '') <> ''",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []MediaFile
+	for rows.Next() {
+		var file MediaFile
+		if err := rows.Scan(&file.MessageID, &file.ChatJID, &file.Filename); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	return files, rows.Err()
+}
+
+// Reclaim the space left behind by deleted rows
+func (store *SQLMessageStore) Vacuum() error {
+	_, err := store.db.Exec("VACUUM")
+	return err
+}
+
+// Read a whole number of days from an environment variable.
+// Returns 0 when the variable is unset or invalid.
+func retentionDaysFromEnv(name string, logger waLog.Logger) time.Duration {
+	daysStr := os.Getenv(name)
+	if daysStr == "" {
+		return 0
+	}
+
+	days, err := strconv.Atoi(daysStr)
+	if err != nil || days < 0 {
+		logger.Warnf("Invalid %s: %s, ignoring", name, daysStr)
+		return 0
+	}
+
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// Read per-key day overrides such as "video=7,audio=30" from an environment variable
+func retentionOverridesFromEnv(name string, logger waLog.Logger) map[string]time.Duration {
+	overrides := make(map[string]time.Duration)
+	for _, entry := range strings.Split(os.Getenv(name), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		key, daysStr, found := strings.Cut(entry, "=")
+		days, err := strconv.Atoi(strings.TrimSpace(daysStr))
+		if !found || strings.TrimSpace(key) == "" || err != nil || days < 0 {
+			logger.Warnf("Invalid %s entry: %s, expected key=days", name, entry)
+			continue
+		}
+
+		overrides[strings.TrimSpace(key)] = time.Duration(days) * 24 * time.Hour
+	}
+	return overrides
+}
+
+// Load the retention policy from the environment
+func loadRetentionPolicy(logger waLog.Logger) RetentionPolicy {
+	policy := RetentionPolicy{
+		Interval:             time.Hour,
+		MessageMaxAge:        retentionDaysFromEnv("MESSAGE_RETENTION_DAYS", logger),
+		ChatMaxAge:           retentionOverridesFromEnv("CHAT_RETENTION_DAYS", logger),
+		MediaMaxAge:          retentionDaysFromEnv("MEDIA_RETENTION_DAYS", logger),
+		MediaTypeMaxAge:      retentionOverridesFromEnv("MEDIA_TYPE_RETENTION_DAYS", logger),
+		TempMediaMaxAge:      24 * time.Hour,
+		DeletedContentMaxAge: retentionDaysFromEnv("DELETED_MESSAGE_RETENTION_DAYS", logger),
+	}
+
+	if intervalStr := os.Getenv("RETENTION_INTERVAL_MINUTES"); intervalStr != "" {
+		if minutes, err := strconv.Atoi(intervalStr); err == nil && minutes > 0 {
+			policy.Interval = time.Duration(minutes) * time.Minute
+		} else {
+			logger.Warnf("Invalid RETENTION_INTERVAL_MINUTES: %s, using default of %v", intervalStr, policy.Interval)
+		}
+	}
+
+	if budgetStr := os.Getenv("MEDIA_DISK_BUDGET_MB"); budgetStr != "" {
+		if mb, err := strconv.ParseInt(budgetStr, 10, 64); err == nil && mb >= 0 {
+			policy.MediaDiskBudget = mb * 1024 * 1024
+		} else {
+			logger.Warnf("Invalid MEDIA_DISK_BUDGET_MB: %s, ignoring", budgetStr)
+		}
+	}
+
+	if hoursStr := os.Getenv("TEMP_MEDIA_MAX_AGE_HOURS"); hoursStr != "" {
+		if hours, err := strconv.Atoi(hoursStr); err == nil && hours >= 0 {
+			policy.TempMediaMaxAge = time.Duration(hours) * time.Hour
+		} else {
+			logger.Warnf("Invalid TEMP_MEDIA_MAX_AGE_HOURS: %s, using default of %v", hoursStr, policy.TempMediaMaxAge)
+		}
+	}
+
+	return policy
+}
+
+// retentionJanitor periodically applies a RetentionPolicy and keeps the report
+// of its last run
+type retentionJanitor struct {
+	store  MessageStore
+	policy RetentionPolicy
+
+	mu         sync.Mutex
+	lastReport *RetentionReport
+}
+
+// Remove a file, adding it to the report if it existed
+func (j *retentionJanitor) removeFile(path string, report *RetentionReport) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if err := os.Remove(path); err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to remove %s: %v", path, err))
+		return false
+	}
+	report.BytesFreed += info.Size()
+	return true
+}
+
+// Remove the downloaded media files of messages. Files still used by
+// other messages are kept.
+func (j *retentionJanitor) removeMediaFiles(files []MediaFile, report *RetentionReport) {
+	for _, file := range files {
+		path, err := j.store.ReleaseMediaFile(file)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to release media of %s: %v", file.MessageID, err))
+			continue
+		}
+		if path != "" && j.removeFile(path, report) {
+			report.MediaFilesDeleted++
+		}
+	}
+}
+
+// Delete messages past their chat's retention, or the global one
+func (j *retentionJanitor) pruneMessages(now time.Time, report *RetentionReport) {
+	var rules []RetentionRule
+	var overridden []string
+	for chatJID, maxAge := range j.policy.ChatMaxAge {
+		overridden = append(overridden, chatJID)
+		if maxAge > 0 {
+			rules = append(rules, RetentionRule{Before: now.Add(-maxAge), ChatJID: chatJID})
+		}
+	}
+	if j.policy.MessageMaxAge > 0 {
+		rules = append(rules, RetentionRule{Before: now.Add(-j.policy.MessageMaxAge), ExcludeChatJIDs: overridden})
+	}
+
+	for _, rule := range rules {
+		deleted, files, err := j.store.PruneMessages(rule)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to prune messages: %v", err))
+			continue
+		}
+		report.MessagesDeleted += deleted
+		j.removeMediaFiles(files, report)
+	}
+}
+
+// Delete media files past their media type's retention, or the global one
+func (j *retentionJanitor) pruneMedia(now time.Time, report *RetentionReport) {
+	var rules []RetentionRule
+	var overridden []string
+	for mediaType, maxAge := range j.policy.MediaTypeMaxAge {
+		overridden = append(overridden, mediaType)
+		if maxAge > 0 {
+			rules = append(rules, RetentionRule{Before: now.Add(-maxAge), MediaType: mediaType})
+		}
+	}
+	if j.policy.MediaMaxAge > 0 {
+		rules = append(rules, RetentionRule{Before: now.Add(-j.policy.MediaMaxAge), ExcludeMediaTypes: overridden})
+	}
+
+	for _, rule := range rules {
+		files, err := j.store.GetMediaFiles(rule)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to list media files: %v", err))
+			continue
+		}
+		j.removeMediaFiles(files, report)
+	}
+}
+
+// Delete the oldest downloaded media until the total fits the disk budget.
+// Blobs of the media store are released through the store, which drops them
+// for every message sharing them; blobs being read are left for a later run.
+// Files left in per-chat directories from before the media store are
+// removed directly.
+func (j *retentionJanitor) enforceMediaDiskBudget(report *RetentionReport) {
+	type mediaEntry struct {
+		// Blob hash, or "" for a file in a per-chat directory
+		hash    string
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	blobs, err := j.store.GetMediaBlobs()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to list media blobs: %v", err))
+		return
+	}
+	var entries []mediaEntry
+	var total int64
+	for _, blob := range blobs {
+		entries = append(entries, mediaEntry{hash: blob.Hash, size: blob.Size, modTime: blob.CreatedAt})
+		total += blob.Size
+	}
+
+	err = filepath.WalkDir(mediaRootDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			// Blobs are accounted for by the store
+			if path == mediaBlobDir || d.Name() == "temp_media" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Files directly in the store directory are databases, not media
+		if filepath.Dir(path) == mediaRootDir {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, mediaEntry{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to scan media: %v", err))
+		return
+	}
+
+	if total <= j.policy.MediaDiskBudget {
+		return
+	}
+
+	sort.SliceStable(entries, func(a, b int) bool {
+		return entries[a].modTime.Before(entries[b].modTime)
+	})
+	for _, entry := range entries {
+		if total <= j.policy.MediaDiskBudget {
+			break
+		}
+		if entry.hash == "" {
+			if j.removeFile(entry.path, report) {
+				report.MediaFilesDeleted++
+				total -= entry.size
+			}
+			continue
+		}
+
+		if mediaBlobInUse(entry.hash) {
+			continue
+		}
+		path, err := j.store.ReleaseMediaBlob(entry.hash)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to release media blob %s: %v", entry.hash, err))
+			continue
+		}
+		total -= entry.size
+		if path != "" && j.removeFile(path, report) {
+			report.MediaFilesDeleted++
+		}
+	}
+}
+
+// Delete files left behind in store/temp_media
+func (j *retentionJanitor) sweepTempMedia(now time.Time, report *RetentionReport) {
+	entries, err := os.ReadDir(filepath.Join(mediaRootDir, "temp_media"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to read temp media: %v", err))
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() || now.Sub(info.ModTime()) < j.policy.TempMediaMaxAge {
+			continue
+		}
+		if j.removeFile(filepath.Join(mediaRootDir, "temp_media", entry.Name()), report) {
+			report.TempFilesDeleted++
+		}
+	}
+}
+
+// Apply the retention policy once and record the report
+func (j *retentionJanitor) run() RetentionReport {
+	now := time.Now()
+	report := RetentionReport{StartedAt: now}
+
+	if j.policy.DeletedContentMaxAge > 0 {
+		purged, err := j.store.PurgeDeletedMessageContent(now.Add(-j.policy.DeletedContentMaxAge))
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to purge deleted messages: %v", err))
+		}
+		report.DeletedMessagesPurged = purged
+	}
+
+	j.pruneMessages(now, &report)
+	j.pruneMedia(now, &report)
+	if j.policy.MediaDiskBudget > 0 {
+		j.enforceMediaDiskBudget(&report)
+	}
+	if j.policy.TempMediaMaxAge > 0 {
+		j.sweepTempMedia(now, &report)
+	}
+
+	// Only vacuum when rows were actually removed or cleared, since it rewrites the database
+	if report.MessagesDeleted > 0 || report.DeletedMessagesPurged > 0 {
+		if err := j.store.Vacuum(); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to vacuum database: %v", err))
+		} else {
+			report.Vacuumed = true
+		}
+	}
+
+	report.FinishedAt = time.Now()
+
+	j.mu.Lock()
+	j.lastReport = &report
+	j.mu.Unlock()
+
+	return report
+}
+
+// Get the report of the last janitor run, or nil if it hasn't run yet
+func (j *retentionJanitor) LastReport() *RetentionReport {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.lastReport
+}
+
+// Start the retention janitor, which applies the retention policy on start and
+// then periodically in the background
+func startRetentionJanitor(messageStore MessageStore, logger waLog.Logger) *retentionJanitor {
+	janitor := &retentionJanitor{
+		store:  messageStore,
+		policy: loadRetentionPolicy(logger),
+	}
+
+	policy := janitor.policy
+	logger.Infof("Retention janitor running every %v (messages: %v, chat overrides: %d, media: %v, media type overrides: %d, media budget: %d MB, temp media: %v, deleted content: %v; 0 keeps forever)",
+		policy.Interval, policy.MessageMaxAge, len(policy.ChatMaxAge), policy.MediaMaxAge, len(policy.MediaTypeMaxAge),
+		policy.MediaDiskBudget/(1024*1024), policy.TempMediaMaxAge, policy.DeletedContentMaxAge)
+
+	go func() {
+		for {
+			report := janitor.run()
+			if report.MessagesDeleted > 0 || report.DeletedMessagesPurged > 0 || report.MediaFilesDeleted > 0 || report.TempFilesDeleted > 0 {
+				logger.Infof("Retention janitor deleted %d messages, purged %d deleted messages, removed %d media and %d temp files, freed %d bytes (vacuumed: %v)",
+					report.MessagesDeleted, report.DeletedMessagesPurged, report.MediaFilesDeleted, report.TempFilesDeleted, report.BytesFreed, report.Vacuumed)
+			}
+			for _, errMsg := range report.Errors {
+				logger.Warnf("Retention janitor: %s", errMsg)
+			}
+
+			time.Sleep(policy.Interval)
+		}
+	}()
+
+	return janitor
+}
+
+// Handler reporting the outcome of the last retention janitor run
+func handleRetentionReport(janitor *retentionJanitor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only allow GET requests
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":     true,
+			"last_report": janitor.LastReport(),
+		})
+	}
+}
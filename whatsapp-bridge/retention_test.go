@@ -0,0 +1,303 @@
+package main
+
+import (
+	"database/sql"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnforceMediaDiskBudget(t *testing.T) {
+	chat := "4915112345678@s.whatsapp.net"
+	tests := []struct {
+		name     string
+		budget   int64
+		reading  string
+		wantKept []string
+	}{
+		{"under budget", 1000, "", []string{"legacy", "a", "b", "c"}},
+		{"legacy file first", 350, "", []string{"a", "b", "c"}},
+		{"oldest first", 150, "", []string{"c"}},
+		{"blob being read is skipped", 150, "a", []string{"a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			store := newTestStore(t)
+
+			// A legacy file older than every blob, and three blobs of 100
+			// bytes; the oldest one is shared by two messages
+			legacy := mediaFilePath(chat, "old.jpg")
+			if err := os.MkdirAll(filepath.Dir(legacy), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(legacy, make([]byte, 100), 0644); err != nil {
+				t.Fatal(err)
+			}
+			old := time.Now().Add(-48 * time.Hour)
+			if err := os.Chtimes(legacy, old, old); err != nil {
+				t.Fatal(err)
+			}
+			hashes := make(map[string]string)
+			refs := map[string][]string{"a": {"m1", "m2"}, "b": {"m3"}, "c": {"m4"}}
+			for i, name := range []string{"a", "b", "c"} {
+				hash, _, err := writeMediaBlob([]byte(strings.Repeat(name, 100)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				hashes[name] = hash
+				for _, id := range refs[name] {
+					if err := store.StoreMediaRef(id, chat, hash, 100); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if _, err := store.db.Exec("UPDATE media_blobs SET created_at = ? WHERE sha256 = ?", old.Add(time.Duration(i+1)*time.Hour), hash); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if tt.reading != "" {
+				content, err := openStoredMedia(mediaBlobPath(hashes[tt.reading]))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer content.Close()
+			}
+
+			janitor := &retentionJanitor{store: store, policy: RetentionPolicy{MediaDiskBudget: tt.budget}}
+			var report RetentionReport
+			janitor.enforceMediaDiskBudget(&report)
+			if len(report.Errors) > 0 {
+				t.Fatalf("errors: %v", report.Errors)
+			}
+			if want := 4 - len(tt.wantKept); report.MediaFilesDeleted != want {
+				t.Errorf("deleted %d files, want %d", report.MediaFilesDeleted, want)
+			}
+
+			if _, err := os.Stat(legacy); (err == nil) != slices.Contains(tt.wantKept, "legacy") {
+				t.Errorf("legacy file exists = %v, want %v", err == nil, slices.Contains(tt.wantKept, "legacy"))
+			}
+			blobs, err := store.GetMediaBlobs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"a", "b", "c"} {
+				kept := slices.Contains(tt.wantKept, name)
+				hash := hashes[name]
+				if _, err := os.Stat(mediaBlobPath(hash)); (err == nil) != kept {
+					t.Errorf("blob %s exists = %v, want %v", name, err == nil, kept)
+				}
+				inStore := slices.ContainsFunc(blobs, func(b MediaBlob) bool { return b.Hash == hash })
+				if inStore != kept {
+					t.Errorf("blob %s in media_blobs = %v, want %v", name, inStore, kept)
+				}
+				// References go with their blob, so the messages download it again
+				for _, id := range refs[name] {
+					ref, err := store.GetMediaRef(id, chat)
+					if kept && ref != hash || !kept && err != sql.ErrNoRows {
+						t.Errorf("media ref of %s = %q (%v), want kept %v", id, ref, err, kept)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReleaseMediaBlob(t *testing.T) {
+	store := newTestStore(t)
+	chat := "4915112345678@s.whatsapp.net"
+	hash := strings.Repeat("ab", 32)
+	for _, id := range []string{"m1", "m2"} {
+		if err := store.StoreMediaRef(id, chat, hash, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path, err := store.ReleaseMediaBlob(hash)
+	if err != nil || path != mediaBlobPath(hash) {
+		t.Fatalf("ReleaseMediaBlob = %q, %v, want %q", path, err, mediaBlobPath(hash))
+	}
+	for _, id := range []string{"m1", "m2"} {
+		if _, err := store.GetMediaRef(id, chat); err != sql.ErrNoRows {
+			t.Errorf("media ref of %s after release: %v, want none", id, err)
+		}
+	}
+
+	// Releasing again finds nothing to delete
+	if path, err := store.ReleaseMediaBlob(hash); err != nil || path != "" {
+		t.Errorf("second ReleaseMediaBlob = %q, %v, want nothing", path, err)
+	}
+}
+
+func TestMessageTombstones(t *testing.T) {
+	chat := "4915112345678@s.whatsapp.net"
+	at := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	deletedAt := at.Add(time.Hour)
+
+	for _, name := range []string{"plaintext", "encrypted"} {
+		t.Run(name, func(t *testing.T) {
+			store := newTestStore(t)
+			if name == "encrypted" {
+				store.keys = newTestKeyring(t, 1)
+			}
+			storeTestMessage(t, store, chat, "kept", "111", "still here", at, "", "")
+			storeTestMessage(t, store, chat, "old", "111", "deleted long ago", at, "", "")
+			storeTestMessage(t, store, chat, "recent", "111", "deleted lately", at, "", "")
+			if err := store.UpdateEditedMessage("old", chat, "edited before deletion", at.Add(time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+			for id, when := range map[string]time.Time{"old": deletedAt, "recent": deletedAt.Add(48 * time.Hour)} {
+				if err := store.MarkMessageAsDeleted(id, chat, "111", when); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// A repeated revoke keeps the first deletion time
+			if err := store.MarkMessageAsDeleted("old", chat, "222", deletedAt.Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+
+			listed := func(includeDeleted bool) map[string]Message {
+				messages, err := store.GetMessages(MessageQuery{ChatJID: chat, Limit: 10, IncludeDeleted: includeDeleted})
+				if err != nil {
+					t.Fatal(err)
+				}
+				byID := make(map[string]Message)
+				for _, msg := range messages {
+					byID[msg.ID] = msg
+				}
+				return byID
+			}
+
+			if got := listed(false); len(got) != 1 || got["kept"].ID == "" {
+				t.Errorf("messages without tombstones = %v, want only kept", slices.Collect(maps.Keys(got)))
+			}
+			tombstone := listed(true)["old"]
+			if tombstone.DeletedAt == nil || !tombstone.DeletedAt.Equal(deletedAt) || tombstone.DeletedBy != "111" {
+				t.Errorf("tombstone = deleted at %v by %q, want %v by 111", tombstone.DeletedAt, tombstone.DeletedBy, deletedAt)
+			}
+			if tombstone.Content != "edited before deletion" {
+				t.Errorf("tombstone content = %q, want it kept until purged", tombstone.Content)
+			}
+
+			// Purging clears the content of tombstones deleted before the cutoff
+			purged, err := store.PurgeDeletedMessageContent(deletedAt.Add(24 * time.Hour))
+			if err != nil || purged != 1 {
+				t.Fatalf("PurgeDeletedMessageContent = %d, %v, want 1", purged, err)
+			}
+			messages := listed(true)
+			if got := messages["old"]; got.Content != "" || got.DeletedAt == nil {
+				t.Errorf("purged tombstone = %+v, want an empty tombstone", got)
+			}
+			if messages["recent"].Content != "deleted lately" || messages["kept"].Content != "still here" {
+				t.Errorf("messages outside the cutoff lost their content: %+v", messages)
+			}
+			if revisions, err := store.GetMessageRevisions("old", chat); err != nil || len(revisions) != 0 {
+				t.Errorf("revisions of a purged tombstone = %+v, %v, want none", revisions, err)
+			}
+
+			// Tombstones are only purged once
+			if purged, err := store.PurgeDeletedMessageContent(deletedAt.Add(24 * time.Hour)); err != nil || purged != 0 {
+				t.Errorf("second purge = %d, %v, want 0", purged, err)
+			}
+		})
+	}
+}
+
+func TestPruneMessages(t *testing.T) {
+	alice := "4915100000001@s.whatsapp.net"
+	group := "123456789@g.us"
+	at := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	cutoff := at.Add(24 * time.Hour)
+
+	// Each message, its chat, media type and whether it is older than the cutoff
+	messages := []struct {
+		id, chat, mediaType string
+		old                 bool
+	}{
+		{"alice-text", alice, "", true},
+		{"alice-video", alice, "video", true},
+		{"alice-new", alice, "", false},
+		{"group-text", group, "", true},
+		{"group-image", group, "image", true},
+	}
+
+	tests := []struct {
+		name      string
+		rule      RetentionRule
+		wantGone  []string
+		wantFiles []string
+	}{
+		{"everything old", RetentionRule{Before: cutoff}, []string{"alice-text", "alice-video", "group-image", "group-text"}, []string{"alice-video", "group-image"}},
+		{"one chat", RetentionRule{Before: cutoff, ChatJID: group}, []string{"group-image", "group-text"}, []string{"group-image"}},
+		{"other chats", RetentionRule{Before: cutoff, ExcludeChatJIDs: []string{group}}, []string{"alice-text", "alice-video"}, []string{"alice-video"}},
+		{"one media type", RetentionRule{Before: cutoff, MediaType: "video"}, []string{"alice-video"}, []string{"alice-video"}},
+		{"other media types", RetentionRule{Before: cutoff, ExcludeMediaTypes: []string{"video"}}, []string{"alice-text", "group-image", "group-text"}, []string{"group-image"}},
+		{"nothing old enough", RetentionRule{Before: at}, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			for _, m := range messages {
+				when := at
+				if !m.old {
+					when = cutoff.Add(time.Hour)
+				}
+				filename := ""
+				if m.mediaType != "" {
+					filename = m.id + ".bin"
+				}
+				storeTestMessage(t, store, m.chat, m.id, "111", "text", when, m.mediaType, filename)
+				if err := store.StoreReaction(m.id, m.chat, Reaction{Sender: "222", Emoji: "👍", Time: when}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			files, err := store.GetMediaFiles(tt.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fileIDs []string
+			for _, file := range files {
+				fileIDs = append(fileIDs, file.MessageID)
+			}
+			slices.Sort(fileIDs)
+			if !slices.Equal(fileIDs, tt.wantFiles) {
+				t.Errorf("GetMediaFiles = %q, want %q", fileIDs, tt.wantFiles)
+			}
+
+			count, files, err := store.PruneMessages(tt.rule)
+			if err != nil || count != len(tt.wantGone) {
+				t.Fatalf("PruneMessages = %d, %v, want %d", count, err, len(tt.wantGone))
+			}
+			fileIDs = nil
+			for _, file := range files {
+				fileIDs = append(fileIDs, file.MessageID)
+			}
+			slices.Sort(fileIDs)
+			if !slices.Equal(fileIDs, tt.wantFiles) {
+				t.Errorf("PruneMessages media files = %q, want %q", fileIDs, tt.wantFiles)
+			}
+
+			for _, m := range messages {
+				gone := slices.Contains(tt.wantGone, m.id)
+				if _, err := store.GetMessage(m.id, m.chat); (err == sql.ErrNoRows) != gone {
+					t.Errorf("message %s: %v, want deleted %v", m.id, err, gone)
+				}
+				// Reactions go with their message
+				reactions, err := store.GetReactions(m.chat, []string{m.id})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if (len(reactions[m.id]) == 0) != gone {
+					t.Errorf("reactions of %s = %v, want deleted %v", m.id, reactions[m.id], gone)
+				}
+			}
+		})
+	}
+}
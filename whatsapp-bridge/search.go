@@ -0,0 +1,464 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// Returned by SearchMessages when encryption at rest is enabled, since
+// encrypted content cannot be indexed
+var errSearchUnavailable = errors.New("full-text search is not available while encryption at rest is enabled")
+
+// Returned by SearchMessages when SQLite was built without FTS5
+var errFTS5Unavailable = errors.New("full-text search is not available: build the bridge with -tags sqlite_fts5")
+
+// sqlExecer is satisfied by both *sql.DB and *sql.Tx
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// SearchFilter holds the query and optional filters for a full-text message search
+type SearchFilter struct {
+	Query     string
+	ChatJID   string
+	Sender    string
+	From      time.Time
+	To        time.Time
+	MediaType string
+	IsFromMe  *bool
+	// Deleted messages are only searched when IncludeDeleted is set
+	IncludeDeleted bool
+	Limit          int
+	Offset         int
+}
+
+// SearchResult represents a single ranked match from a full-text message search
+type SearchResult struct {
+	ID            string     `json:"id"`
+	ChatJID       string     `json:"chat_jid"`
+	ChatName      string     `json:"chat_name"`
+	Sender        string     `json:"sender"`
+	Content       string     `json:"content"`
+	Timestamp     time.Time  `json:"timestamp"`
+	IsFromMe      bool       `json:"is_from_me"`
+	MediaType     string     `json:"media_type"`
+	Filename      string     `json:"filename"`
+	QuotedMessage string     `json:"quoted_message"`
+	DeletedAt     *time.Time `json:"deleted_at,omitempty"`
+	Snippet       string     `json:"snippet"`
+	Rank          float64    `json:"rank"`
+}
+
+// The text searched for each message in PostgreSQL. Must match the expression
+// indexed by migration 2.
+const postgresSearchDocument = "to_tsvector('simple', COALESCE(m.content, '') || ' ' || COALESCE(m.filename, '') || ' ' || COALESCE(m.quoted_message, ''))"
+
+// The SQLite full-text index, keyed by message_search_docs.docid
+const sqliteSearchIndexSchema = `
+	CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+		content,
+		filename,
+		quoted_message,
+		tokenize = 'unicode61 remove_diacritics 2'
+	)`
+
+// Check whether SQLite was built with FTS5, which go-sqlite3 only includes
+// with the sqlite_fts5 build tag
+func sqliteHasFTS5(db *dialectDB) bool {
+	var enabled bool
+	err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&enabled)
+	return err == nil && enabled
+}
+
+// Create the SQLite full-text index if needed and index the messages missing
+// from it: every message when the database was migrated without FTS5, and
+// those stored or edited while the bridge ran without it. Their stale entries
+// in messages_fts, whose docids are gone, are dropped first.
+func (store *SQLMessageStore) ensureSearchIndex() error {
+	if !store.fts {
+		return nil
+	}
+	if _, err := store.db.Exec(sqliteSearchIndexSchema); err != nil {
+		return fmt.Errorf("failed to create search index: %v", err)
+	}
+	if store.keys != nil {
+		return nil
+	}
+
+	var missing bool
+	err := store.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM messages m WHERE NOT EXISTS (
+		SELECT 1 FROM message_search_docs d WHERE d.message_id = m.id AND d.chat_jid = m.chat_jid))`).Scan(&missing)
+	if err != nil {
+		return fmt.Errorf("failed to check search index: %v", err)
+	}
+	if !missing {
+		return nil
+	}
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		DELETE FROM messages_fts WHERE rowid NOT IN (SELECT docid FROM message_search_docs);
+
+		INSERT INTO message_search_docs (message_id, chat_jid)
+		SELECT id, chat_jid FROM messages m WHERE NOT EXISTS (
+			SELECT 1 FROM message_search_docs d WHERE d.message_id = m.id AND d.chat_jid = m.chat_jid);
+
+		INSERT INTO messages_fts (rowid, content, filename, quoted_message)
+		SELECT d.docid, m.content, m.filename, m.quoted_message
+		FROM messages m
+		JOIN message_search_docs d ON d.message_id = m.id AND d.chat_jid = m.chat_jid
+		WHERE d.docid NOT IN (SELECT rowid FROM messages_fts);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to update search index: %v", err)
+	}
+	return tx.Commit()
+}
+
+// Empty the SQLite full-text index, which fails if the index exists but this
+// build cannot open it
+func clearSearchIndex(db *dialectDB) error {
+	if !sqliteHasFTS5(db) {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE name = 'messages_fts')").Scan(&exists); err != nil {
+			return fmt.Errorf("failed to check search index: %v", err)
+		}
+		if exists {
+			return fmt.Errorf("failed to clear search index: %v", errFTS5Unavailable)
+		}
+	} else if _, err := db.Exec("DELETE FROM messages_fts"); err != nil {
+		return fmt.Errorf("failed to clear search index: %v", err)
+	}
+
+	if _, err := db.Exec("DELETE FROM message_search_docs"); err != nil {
+		return fmt.Errorf("failed to clear search index: %v", err)
+	}
+	return nil
+}
+
+// Refresh the search index entry for a message from its current row.
+// Must be called after every write that changes content, filename or quoted_message.
+// PostgreSQL indexes the messages table directly and needs no syncing.
+// With encryption at rest the index would hold a plaintext copy, so messages
+// are dropped from it instead. Without FTS5 they are dropped too, and
+// ensureSearchIndex indexes them once the index is available.
+func (store *SQLMessageStore) syncSearchIndex(db sqlExecer, id, chatJID string) error {
+	if store.db.dialect == postgresDialect {
+		return nil
+	}
+	if store.keys != nil || !store.fts {
+		return store.removeSearchIndex(db, id, chatJID)
+	}
+
+	_, err := db.Exec(
+		"INSERT OR IGNORE INTO message_search_docs (message_id, chat_jid) VALUES (?, ?)",
+		id, chatJID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to register message for search: %v", err)
+	}
+
+	_, err = db.Exec(
+		`INSERT OR REPLACE INTO messages_fts (rowid, content, filename, quoted_message)
+		SELECT d.docid, m.content, m.filename, m.quoted_message
+		FROM messages m
+		JOIN message_search_docs d ON d.message_id = m.id AND d.chat_jid = m.chat_jid
+		WHERE m.id = ? AND m.chat_jid = ?`,
+		id, chatJID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update search index: %v", err)
+	}
+
+	return nil
+}
+
+// Drop the search index entry of a message that is being deleted
+func (store *SQLMessageStore) removeSearchIndex(db sqlExecer, id, chatJID string) error {
+	if store.db.dialect == postgresDialect {
+		return nil
+	}
+
+	// Without FTS5 the entry is left behind, keyed by a docid that no longer
+	// exists, for ensureSearchIndex to drop
+	if store.fts {
+		_, err := db.Exec(
+			"DELETE FROM messages_fts WHERE rowid IN (SELECT docid FROM message_search_docs WHERE message_id = ? AND chat_jid = ?)",
+			id, chatJID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to remove message from search index: %v", err)
+		}
+	}
+
+	_, err := db.Exec("DELETE FROM message_search_docs WHERE message_id = ? AND chat_jid = ?", id, chatJID)
+	if err != nil {
+		return fmt.Errorf("failed to remove message from search index: %v", err)
+	}
+
+	return nil
+}
+
+// Convert free text into an FTS5 query where every word must match.
+// Each word is quoted so user input can never be parsed as FTS5 syntax.
+func buildFTSQuery(query string) string {
+	var terms []string
+	for _, word := range strings.Fields(query) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// Search stored messages, best matches first
+func (store *SQLMessageStore) SearchMessages(filter SearchFilter) ([]SearchResult, error) {
+	if store.keys != nil {
+		return nil, errSearchUnavailable
+	}
+	if store.db.dialect == sqliteDialect && !store.fts {
+		return nil, errFTS5Unavailable
+	}
+
+	ftsQuery := buildFTSQuery(filter.Query)
+	if ftsQuery == "" {
+		return nil, fmt.Errorf("search query is empty")
+	}
+
+	// The match argument always comes first: it is bound in the FROM clause for
+	// PostgreSQL and as the first condition for SQLite
+	var source, snippet, score string
+	var conditions []string
+	var args []interface{}
+	if store.db.dialect == postgresDialect {
+		source = "messages m CROSS JOIN plainto_tsquery('simple', ?) query"
+		conditions = append(conditions, postgresSearchDocument+" @@ query")
+		args = append(args, filter.Query)
+		snippet = "ts_headline('simple', COALESCE(m.content, '') || ' ' || COALESCE(m.filename, '') || ' ' || COALESCE(m.quoted_message, ''), query, " +
+			"'StartSel=<mark>, StopSel=</mark>, MaxFragments=1, FragmentDelimiter=..., MaxWords=16, MinWords=4')"
+		// Negated so that, as with bm25, lower scores are better matches
+		score = "-ts_rank(" + postgresSearchDocument + ", query)"
+	} else {
+		source = `messages_fts
+		JOIN message_search_docs d ON d.docid = messages_fts.rowid
+		JOIN messages m ON m.id = d.message_id AND m.chat_jid = d.chat_jid`
+		conditions = append(conditions, "messages_fts MATCH ?")
+		args = append(args, ftsQuery)
+		snippet = "snippet(messages_fts, -1, '<mark>', '</mark>', '...', 16)"
+		score = "bm25(messages_fts)"
+	}
+
+	if filter.ChatJID != "" {
+		conditions = append(conditions, "m.chat_jid = ?")
+		args = append(args, filter.ChatJID)
+	}
+	if filter.Sender != "" {
+		conditions = append(conditions, "m.sender = ?")
+		args = append(args, filter.Sender)
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "m.timestamp >= ?")
+		args = append(args, filter.From)
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "m.timestamp <= ?")
+		args = append(args, filter.To)
+	}
+	if filter.MediaType == "text" {
+		// Plain text messages have no media type
+		conditions = append(conditions, "COALESCE(m.media_type, '') = ''")
+	} else if filter.MediaType != "" {
+		conditions = append(conditions, "m.media_type = ?")
+		args = append(args, filter.MediaType)
+	}
+	if filter.IsFromMe != nil {
+		conditions = append(conditions, "m.is_from_me = ?")
+		args = append(args, *filter.IsFromMe)
+	}
+	if !filter.IncludeDeleted {
+		conditions = append(conditions, "m.deleted_at IS NULL")
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 20
+	}
+	args = append(args, limit, filter.Offset)
+
+	rows, err := store.db.Query(
+		`SELECT m.id, m.chat_jid, COALESCE(c.name, ''), m.sender, COALESCE(m.content, ''), m.timestamp,
+			m.is_from_me, COALESCE(m.media_type, ''), COALESCE(m.filename, ''), COALESCE(m.quoted_message, ''), m.deleted_at,
+			`+snippet+`, `+score+` AS score
+		FROM `+source+`
+		LEFT JOIN chats c ON c.jid = m.chat_jid
+		WHERE `+strings.Join(conditions, " AND ")+`
+		ORDER BY score, m.timestamp DESC
+		LIMIT ? OFFSET ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		var result SearchResult
+		var deletedAt sql.NullTime
+		err := rows.Scan(&result.ID, &result.ChatJID, &result.ChatName, &result.Sender, &result.Content, &result.Timestamp,
+			&result.IsFromMe, &result.MediaType, &result.Filename, &result.QuotedMessage, &deletedAt, &result.Snippet, &result.Rank)
+		if err != nil {
+			return nil, err
+		}
+		if deletedAt.Valid {
+			result.DeletedAt = &deletedAt.Time
+		}
+		if result.ChatName, err = store.keys.decryptString(result.ChatName); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
+
+// Parse a date filter given either as RFC3339 or as a plain YYYY-MM-DD date.
+// Plain dates used as an upper bound cover the whole day.
+func parseSearchTime(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q: use RFC3339 or YYYY-MM-DD", value)
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+// Handler for full-text search over stored messages
+func handleSearch(messageStore MessageStore, logger waLog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only allow GET requests
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		w.Header().Set("Content-Type", "application/json")
+
+		// Small helper for the many validation failures below
+		badRequest := func(errMsg, message string) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   errMsg,
+				"message": message,
+			})
+		}
+
+		filter := SearchFilter{
+			Query:     strings.TrimSpace(query.Get("q")),
+			ChatJID:   query.Get("chat_jid"),
+			Sender:    query.Get("sender"),
+			MediaType: query.Get("media_type"),
+		}
+
+		if filter.Query == "" {
+			badRequest("Missing required parameter: q", "The q parameter is required to search messages")
+			return
+		}
+
+		var err error
+		if from := query.Get("from"); from != "" {
+			if filter.From, err = parseSearchTime(from, false); err != nil {
+				badRequest("Invalid from parameter", err.Error())
+				return
+			}
+		}
+		if to := query.Get("to"); to != "" {
+			if filter.To, err = parseSearchTime(to, true); err != nil {
+				badRequest("Invalid to parameter", err.Error())
+				return
+			}
+		}
+
+		if isFromMe := query.Get("is_from_me"); isFromMe != "" {
+			value, err := strconv.ParseBool(isFromMe)
+			if err != nil {
+				badRequest("Invalid is_from_me parameter", "The is_from_me parameter must be true or false")
+				return
+			}
+			filter.IsFromMe = &value
+		}
+
+		if includeDeleted := query.Get("include_deleted"); includeDeleted != "" {
+			filter.IncludeDeleted = includeDeleted == "true" || includeDeleted == "1" || includeDeleted == "yes"
+		}
+
+		// Parse limit and offset parameters with default values
+		filter.Limit = 20
+		if limitStr := query.Get("limit"); limitStr != "" {
+			l, err := strconv.Atoi(limitStr)
+			if err != nil || l <= 0 {
+				badRequest("Invalid limit parameter: must be a positive number", "The limit parameter must be a valid positive integer")
+				return
+			}
+			filter.Limit = l
+		}
+		if offsetStr := query.Get("offset"); offsetStr != "" {
+			o, err := strconv.Atoi(offsetStr)
+			if err != nil || o < 0 {
+				badRequest("Invalid offset parameter: must be zero or a positive number", "The offset parameter must be a valid non-negative integer")
+				return
+			}
+			filter.Offset = o
+		}
+
+		results, err := messageStore.SearchMessages(filter)
+		if err == errSearchUnavailable || err == errFTS5Unavailable {
+			w.WriteHeader(http.StatusNotImplemented)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "Search unavailable",
+				"message": err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			logger.Warnf("Error searching messages: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "Database error",
+				"message": fmt.Sprintf("Failed to search messages: %v", err),
+			})
+			return
+		}
+
+		if results == nil {
+			results = []SearchResult{}
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"results": results,
+			"count":   len(results),
+		})
+	}
+}
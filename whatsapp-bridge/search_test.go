@@ -0,0 +1,179 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBuildFTSQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"empty", "", ""},
+		{"only whitespace", " \t\n ", ""},
+		{"single word", "hello", `"hello"`},
+		{"every word must match", "hello  world", `"hello" "world"`},
+		{"quotes are escaped", `say "hi"`, `"say" """hi"""`},
+		{"operators stay literal", "cats OR dogs", `"cats" "OR" "dogs"`},
+		{"syntax characters stay literal", "foo* -bar col:baz (x)", `"foo*" "-bar" "col:baz" "(x)"`},
+		{"unicode", "café 你好", `"café" "你好"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buildFTSQuery(tt.query); got != tt.want {
+				t.Errorf("buildFTSQuery(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+// Search a store, returning the IDs of the matching messages
+func searchIDs(t *testing.T, store *SQLMessageStore, query string) []string {
+	t.Helper()
+	results, err := store.SearchMessages(SearchFilter{Query: query, Limit: 10})
+	if err != nil {
+		t.Fatalf("SearchMessages(%q): %v", query, err)
+	}
+	var ids []string
+	for _, result := range results {
+		ids = append(ids, result.ID)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestSearchWithoutFTS5(t *testing.T) {
+	store := newTestStore(t)
+	store.fts = false
+	at := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	storeTestMessage(t, store, "a@s.whatsapp.net", "m1", "111", "hello world", at, "", "")
+
+	if _, err := store.SearchMessages(SearchFilter{Query: "hello", Limit: 10}); err != errFTS5Unavailable {
+		t.Errorf("SearchMessages without FTS5: %v, want %v", err, errFTS5Unavailable)
+	}
+}
+
+func TestEnsureSearchIndex(t *testing.T) {
+	store := newTestStore(t)
+	if !store.fts {
+		t.Skip("built without the sqlite_fts5 tag")
+	}
+	at := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	storeTestMessage(t, store, "a@s.whatsapp.net", "m1", "111", "hello world", at, "", "")
+	storeTestMessage(t, store, "a@s.whatsapp.net", "m2", "111", "goodbye world", at.Add(time.Minute), "", "")
+
+	// Run without FTS5 for a while: a new message and an edit miss the index
+	store.fts = false
+	storeTestMessage(t, store, "a@s.whatsapp.net", "m3", "111", "hello again", at.Add(2*time.Minute), "", "")
+	if err := store.UpdateEditedMessage("m2", "a@s.whatsapp.net", "farewell", at.Add(3*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	store.fts = true
+	if got := searchIDs(t, store, "hello"); !slices.Equal(got, []string{"m1"}) {
+		t.Errorf("before reindexing, hello matches %q, want [m1]", got)
+	}
+	if err := store.ensureSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"hello", []string{"m1", "m3"}},
+		{"farewell", []string{"m2"}},
+		{"goodbye", nil},
+	}
+	for _, tt := range tests {
+		if got := searchIDs(t, store, tt.query); !slices.Equal(got, tt.want) {
+			t.Errorf("after reindexing, %q matches %q, want %q", tt.query, got, tt.want)
+		}
+	}
+
+	// The stale entry of the edited message is gone
+	var entries int
+	if err := store.db.QueryRow("SELECT COUNT(*) FROM messages_fts").Scan(&entries); err != nil || entries != 3 {
+		t.Errorf("messages_fts has %d entries (%v), want 3", entries, err)
+	}
+}
+
+func TestSearchMessagesFilters(t *testing.T) {
+	store := newTestStore(t)
+	if !store.fts {
+		t.Skip("built without the sqlite_fts5 tag")
+	}
+	alice := "4915100000001@s.whatsapp.net"
+	group := "123456789@g.us"
+	at := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	storeTestMessage(t, store, alice, "text", "4915100000001", "lunch at noon", at, "", "")
+	storeTestMessage(t, store, alice, "photo", "4915100000001", "lunch photo", at.Add(time.Hour), "image", "lunch.jpg")
+	storeTestMessage(t, store, group, "group", "4915100000002", "lunch in the group", at.Add(2*time.Hour), "", "")
+	storeTestMessage(t, store, group, "deleted", "4915100000002", "lunch cancelled", at.Add(3*time.Hour), "", "")
+	if err := store.StoreMessage("mine", alice, "me", "lunch sounds good", at.Add(4*time.Hour), true, "", "", "", nil, nil, nil, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MarkMessageAsDeleted("deleted", group, "4915100000002", at.Add(5*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	storeTestMessage(t, store, alice, "other", "4915100000001", "dinner later", at.Add(6*time.Hour), "", "")
+
+	fromMe, notFromMe := true, false
+	tests := []struct {
+		name   string
+		filter SearchFilter
+		want   []string
+	}{
+		{"query only", SearchFilter{Query: "lunch"}, []string{"group", "mine", "photo", "text"}},
+		{"chat", SearchFilter{Query: "lunch", ChatJID: group}, []string{"group"}},
+		{"sender", SearchFilter{Query: "lunch", Sender: "4915100000001"}, []string{"photo", "text"}},
+		{"from", SearchFilter{Query: "lunch", From: at.Add(2 * time.Hour)}, []string{"group", "mine"}},
+		{"to", SearchFilter{Query: "lunch", To: at.Add(time.Hour)}, []string{"photo", "text"}},
+		{"media type", SearchFilter{Query: "lunch", MediaType: "image"}, []string{"photo"}},
+		{"text only", SearchFilter{Query: "lunch", MediaType: "text"}, []string{"group", "mine", "text"}},
+		{"from me", SearchFilter{Query: "lunch", IsFromMe: &fromMe}, []string{"mine"}},
+		{"not from me", SearchFilter{Query: "lunch", IsFromMe: &notFromMe}, []string{"group", "photo", "text"}},
+		{"deleted included", SearchFilter{Query: "cancelled", IncludeDeleted: true}, []string{"deleted"}},
+		{"deleted left out", SearchFilter{Query: "cancelled"}, nil},
+		{"filename", SearchFilter{Query: "jpg"}, []string{"photo"}},
+		{"every word must match", SearchFilter{Query: "lunch group"}, []string{"group"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.filter.Limit = 10
+			results, err := store.SearchMessages(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, result := range results {
+				ids = append(ids, result.ID)
+			}
+			slices.Sort(ids)
+			if !slices.Equal(ids, tt.want) {
+				t.Errorf("SearchMessages(%+v) = %q, want %q", tt.filter, ids, tt.want)
+			}
+		})
+	}
+
+	// Results are paged
+	first, err := store.SearchMessages(SearchFilter{Query: "lunch", Limit: 3})
+	if err != nil || len(first) != 3 {
+		t.Fatalf("first page = %d results, %v, want 3", len(first), err)
+	}
+	rest, err := store.SearchMessages(SearchFilter{Query: "lunch", Limit: 3, Offset: 3})
+	if err != nil || len(rest) != 1 {
+		t.Fatalf("second page = %d results, %v, want 1", len(rest), err)
+	}
+	for _, result := range first {
+		if result.ID == rest[0].ID {
+			t.Errorf("%s is on both pages", result.ID)
+		}
+	}
+}
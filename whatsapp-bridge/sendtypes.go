@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	waLog "go.mau.fi/whatsmeow/util/log"
+	"google.golang.org/protobuf/proto"
+)
+
+// SendLocationRequest is the request body for sending a location, or one
+// update of a live location
+type SendLocationRequest struct {
+	Recipient      string   `json:"recipient"`
+	Latitude       *float64 `json:"latitude"`
+	Longitude      *float64 `json:"longitude"`
+	Name           string   `json:"name,omitempty"`
+	Address        string   `json:"address,omitempty"`
+	URL            string   `json:"url,omitempty"`
+	Comment        string   `json:"comment,omitempty"`
+	AccuracyMeters uint32   `json:"accuracy_meters,omitempty"`
+	// Live locations only
+	Live           bool    `json:"live,omitempty"`
+	SpeedMPS       float32 `json:"speed_mps,omitempty"`
+	Heading        uint32  `json:"heading,omitempty"`
+	SequenceNumber int64   `json:"sequence_number,omitempty"`
+	// Message to reply to, as in SendMessageRequest
+	ReplyTo *ReplyTarget `json:"reply_to,omitempty"`
+}
+
+// SendContactRequest is the request body for sending contact cards. The
+// cards have the same fields as the contacts of a received contact message.
+type SendContactRequest struct {
+	Recipient string        `json:"recipient"`
+	Contacts  []ContactCard `json:"contacts"`
+	// Message to reply to, as in SendMessageRequest
+	ReplyTo *ReplyTarget `json:"reply_to,omitempty"`
+}
+
+// Check a location request
+func validateLocationRequest(req SendLocationRequest) error {
+	if req.Recipient == "" {
+		return fmt.Errorf("recipient is required")
+	}
+	if req.Latitude == nil || req.Longitude == nil {
+		return fmt.Errorf("latitude and longitude are required")
+	}
+	if *req.Latitude < -90 || *req.Latitude > 90 || *req.Longitude < -180 || *req.Longitude > 180 {
+		return fmt.Errorf("latitude must be between -90 and 90, and longitude between -180 and 180")
+	}
+	if req.Live {
+		// A live location is shown without a place name
+		if req.Name != "" || req.Address != "" || req.URL != "" {
+			return fmt.Errorf("name, address and url cannot be sent with a live location")
+		}
+		if req.SpeedMPS < 0 {
+			return fmt.Errorf("speed_mps cannot be negative")
+		}
+		if req.Heading > 359 {
+			return fmt.Errorf("heading must be between 0 and 359")
+		}
+		if req.SequenceNumber < 0 {
+			return fmt.Errorf("sequence_number cannot be negative")
+		}
+	} else if req.SpeedMPS != 0 || req.Heading != 0 || req.SequenceNumber != 0 {
+		return fmt.Errorf("speed_mps, heading and sequence_number need live to be set")
+	}
+	return nil
+}
+
+// Build the message for a location request: a live location message when
+// live is set, otherwise a plain location
+func buildLocationMessage(req SendLocationRequest) *waProto.Message {
+	var accuracy *uint32
+	if req.AccuracyMeters > 0 {
+		accuracy = proto.Uint32(req.AccuracyMeters)
+	}
+
+	if req.Live {
+		live := &waProto.LiveLocationMessage{
+			DegreesLatitude:  req.Latitude,
+			DegreesLongitude: req.Longitude,
+			AccuracyInMeters: accuracy,
+			Caption:          optionalString(req.Comment),
+			SequenceNumber:   proto.Int64(req.SequenceNumber),
+		}
+		if req.SpeedMPS > 0 {
+			live.SpeedInMps = proto.Float32(req.SpeedMPS)
+		}
+		if req.Heading > 0 {
+			live.DegreesClockwiseFromMagneticNorth = proto.Uint32(req.Heading)
+		}
+		return &waProto.Message{LiveLocationMessage: live}
+	}
+
+	return &waProto.Message{LocationMessage: &waProto.LocationMessage{
+		DegreesLatitude:  req.Latitude,
+		DegreesLongitude: req.Longitude,
+		Name:             optionalString(req.Name),
+		Address:          optionalString(req.Address),
+		URL:              optionalString(req.URL),
+		Comment:          optionalString(req.Comment),
+		AccuracyInMeters: accuracy,
+	}}
+}
+
+// Check a contact request
+func validateContactRequest(req SendContactRequest) error {
+	if req.Recipient == "" {
+		return fmt.Errorf("recipient is required")
+	}
+	if len(req.Contacts) == 0 {
+		return fmt.Errorf("at least one contact is required")
+	}
+	for i, card := range req.Contacts {
+		if strings.TrimSpace(card.DisplayName+card.FullName+card.FirstName+card.LastName) == "" {
+			return fmt.Errorf("contact %d has no name", i+1)
+		}
+		if len(card.Phones) == 0 {
+			return fmt.Errorf("contact %d has no phone number", i+1)
+		}
+		for _, phone := range card.Phones {
+			if strings.TrimSpace(phone.Number) == "" {
+				return fmt.Errorf("contact %d has an empty phone number", i+1)
+			}
+		}
+	}
+	return nil
+}
+
+// Get an optional proto string field, left unset when empty
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return proto.String(value)
+}
+
+// Build the message sharing a list of contact cards: a single contact
+// message for one card, a contacts array for several
+func buildContactMessage(cards []ContactCard) *waProto.Message {
+	contacts := make([]*waProto.ContactMessage, len(cards))
+	for i, card := range cards {
+		vcard := formatVCard(card)
+		contacts[i] = &waProto.ContactMessage{
+			DisplayName: proto.String(parseVCard(vcard).DisplayName),
+			Vcard:       proto.String(vcard),
+		}
+	}
+
+	if len(contacts) == 1 {
+		return &waProto.Message{ContactMessage: contacts[0]}
+	}
+	return &waProto.Message{ContactsArrayMessage: &waProto.ContactsArrayMessage{
+		DisplayName: proto.String(fmt.Sprintf("%d contacts", len(contacts))),
+		Contacts:    contacts,
+	}}
+}
+
+// Send a structured message built by a handler and answer the request. The
+// message is stored through the same handlers as incoming messages, with its
+// structured data.
+func sendStructuredMessage(w http.ResponseWriter, client *whatsmeow.Client, messageStore MessageStore,
+	recipient string, replyTo *ReplyTarget, msg *waProto.Message, kind string, logger waLog.Logger) {
+	recipientJID, err := parseRecipientJID(recipient)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   fmt.Sprintf("Invalid recipient: %v", err),
+		})
+		return
+	}
+
+	contextInfo, status, err := sendContextForRequest(client, messageStore, recipient, "", replyTo, nil, false)
+	if err != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	if contextInfo != nil {
+		setContextInfo(msg, contextInfo)
+	}
+
+	resp, err := client.SendMessage(context.Background(), recipientJID, msg)
+	if err != nil {
+		logger.Warnf("Failed to send %s: %v", kind, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   fmt.Sprintf("Error sending %s: %v", kind, err),
+		})
+		return
+	}
+	logger.Infof("Sent %s to %s with ID %s", kind, recipientJID, resp.ID)
+
+	dispatchOutgoingMessage(client, recipientJID, resp.ID, msg)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"message":  fmt.Sprintf("%s sent to %s", strings.ToUpper(kind[:1])+kind[1:], recipient),
+		"id":       resp.ID,
+		"chat_jid": recipientJID.String(),
+	})
+}
+
+// Handler for sending a location
+func handleSendLocation(client *whatsmeow.Client, messageStore MessageStore, logger waLog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only allow POST requests
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if client is connected to WhatsApp
+		if !client.IsConnected() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "WhatsApp client is not connected",
+			})
+			return
+		}
+
+		var req SendLocationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Invalid request format: %v", err),
+			})
+			return
+		}
+		if err := validateLocationRequest(req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		kind := "location"
+		if req.Live {
+			kind = "live location"
+		}
+		sendStructuredMessage(w, client, messageStore, req.Recipient, req.ReplyTo, buildLocationMessage(req), kind, logger)
+	}
+}
+
+// Handler for sending one or more contact cards
+func handleSendContact(client *whatsmeow.Client, messageStore MessageStore, logger waLog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only allow POST requests
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if client is connected to WhatsApp
+		if !client.IsConnected() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "WhatsApp client is not connected",
+			})
+			return
+		}
+
+		var req SendContactRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Invalid request format: %v", err),
+			})
+			return
+		}
+		if err := validateContactRequest(req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		sendStructuredMessage(w, client, messageStore, req.Recipient, req.ReplyTo, buildContactMessage(req.Contacts), "contact", logger)
+	}
+}
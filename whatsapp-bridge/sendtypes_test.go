@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateLocationRequest(t *testing.T) {
+	coordinate := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name    string
+		req     SendLocationRequest
+		wantErr string
+	}{
+		{"valid", SendLocationRequest{Recipient: "4915112345678", Latitude: coordinate(52.52), Longitude: coordinate(13.405)}, ""},
+		{"bounds", SendLocationRequest{Recipient: "4915112345678", Latitude: coordinate(-90), Longitude: coordinate(180)}, ""},
+		{"zero coordinates", SendLocationRequest{Recipient: "4915112345678", Latitude: coordinate(0), Longitude: coordinate(0)}, ""},
+		{"no recipient", SendLocationRequest{Latitude: coordinate(52.52), Longitude: coordinate(13.405)}, "recipient"},
+		{"no latitude", SendLocationRequest{Recipient: "4915112345678", Longitude: coordinate(13.405)}, "required"},
+		{"no longitude", SendLocationRequest{Recipient: "4915112345678", Latitude: coordinate(52.52)}, "required"},
+		{"latitude out of range", SendLocationRequest{Recipient: "4915112345678", Latitude: coordinate(90.5), Longitude: coordinate(0)}, "between"},
+		{"longitude out of range", SendLocationRequest{Recipient: "4915112345678", Latitude: coordinate(0), Longitude: coordinate(-180.5)}, "between"},
+		{"live", SendLocationRequest{Recipient: "4915112345678", Latitude: coordinate(52.52), Longitude: coordinate(13.405),
+			Live: true, SpeedMPS: 1.5, Heading: 359, SequenceNumber: 3}, ""},
+		{"live with a place name", SendLocationRequest{Recipient: "4915112345678", Latitude: coordinate(52.52), Longitude: coordinate(13.405),
+			Live: true, Name: "Home"}, "cannot be sent with a live location"},
+		{"heading out of range", SendLocationRequest{Recipient: "4915112345678", Latitude: coordinate(52.52), Longitude: coordinate(13.405),
+			Live: true, Heading: 360}, "heading"},
+		{"negative speed", SendLocationRequest{Recipient: "4915112345678", Latitude: coordinate(52.52), Longitude: coordinate(13.405),
+			Live: true, SpeedMPS: -1}, "speed_mps"},
+		{"sequence number without live", SendLocationRequest{Recipient: "4915112345678", Latitude: coordinate(52.52), Longitude: coordinate(13.405),
+			SequenceNumber: 2}, "need live"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateLocationRequest(tt.req)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validateLocationRequest: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateLocationRequest = %v, want an error about %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateContactRequest(t *testing.T) {
+	alice := ContactCard{DisplayName: "Alice", Phones: []ContactPhone{{Number: "+49 151 12345678"}}}
+	tests := []struct {
+		name    string
+		req     SendContactRequest
+		wantErr string
+	}{
+		{"valid", SendContactRequest{Recipient: "4915112345678", Contacts: []ContactCard{alice}}, ""},
+		{"first name only", SendContactRequest{Recipient: "4915112345678",
+			Contacts: []ContactCard{{FirstName: "Bob", Phones: []ContactPhone{{Number: "030 1234"}}}}}, ""},
+		{"no recipient", SendContactRequest{Contacts: []ContactCard{alice}}, "recipient"},
+		{"no contacts", SendContactRequest{Recipient: "4915112345678"}, "at least one contact"},
+		{"no name", SendContactRequest{Recipient: "4915112345678",
+			Contacts: []ContactCard{{Organization: "Acme", Phones: []ContactPhone{{Number: "030 1234"}}}}}, "contact 1 has no name"},
+		{"blank name", SendContactRequest{Recipient: "4915112345678",
+			Contacts: []ContactCard{{DisplayName: "  ", Phones: []ContactPhone{{Number: "030 1234"}}}}}, "contact 1 has no name"},
+		{"no phones", SendContactRequest{Recipient: "4915112345678",
+			Contacts: []ContactCard{alice, {DisplayName: "Bob"}}}, "contact 2 has no phone number"},
+		{"blank phone", SendContactRequest{Recipient: "4915112345678",
+			Contacts: []ContactCard{alice, {DisplayName: "Bob", Phones: []ContactPhone{{Number: " "}}}}}, "contact 2 has an empty phone number"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateContactRequest(tt.req)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validateContactRequest: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateContactRequest = %v, want an error about %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuildLocationMessage(t *testing.T) {
+	coordinate := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name     string
+		req      SendLocationRequest
+		wantType string
+		want     LocationData
+	}{
+		{"location", SendLocationRequest{Latitude: coordinate(52.52), Longitude: coordinate(13.405), Name: "Pickup point", AccuracyMeters: 20},
+			messageTypeLocation, LocationData{Latitude: 52.52, Longitude: 13.405, Name: "Pickup point", AccuracyMeters: 20}},
+		{"live location", SendLocationRequest{Latitude: coordinate(52.52), Longitude: coordinate(13.405), Comment: "On my way",
+			AccuracyMeters: 5, Live: true, SpeedMPS: 1.5, Heading: 90, SequenceNumber: 7},
+			messageTypeLiveLocation, LocationData{Latitude: 52.52, Longitude: 13.405, Comment: "On my way",
+				AccuracyMeters: 5, SpeedMPS: 1.5, Heading: 90, SequenceNumber: 7}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Sent locations are stored like received ones
+			messageType, data := extractMessageData(buildLocationMessage(tt.req))
+			if messageType != tt.wantType {
+				t.Errorf("type = %q, want %q", messageType, tt.wantType)
+			}
+			if data == nil || data.Location == nil || *data.Location != tt.want {
+				t.Errorf("location = %+v, want %+v", data, tt.want)
+			}
+		})
+	}
+}
@@ -5,7 +5,7 @@
 
 APP_NAME="whatsapp-bridge"
 APP_DIR=$(dirname "$0")
-GO_MAIN="main.go"
+GO_MAIN="."
 
 cd "$APP_DIR" || exit 1
 
@@ -15,7 +15,7 @@ cd "$APP_DIR" || exit 1
 if pm2 list | grep -q "$APP_NAME"; then
   pm2 restart "$APP_NAME"
 else
-  pm2 start --name "$APP_NAME" --interpreter=none -- go run "$GO_MAIN"
+  pm2 start --name "$APP_NAME" --interpreter=none -- go run -tags sqlite_fts5 "$GO_MAIN"
 fi
 
 # Save the PM2 process list for resurrecting on reboot
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// MessageStore is the storage backend for chats and message history.
+// Every caller goes through this interface rather than running SQL directly,
+// so the backend can be swapped with MESSAGE_DB_DSN.
+type MessageStore interface {
+	Close() error
+
+	StoreChat(jid, name string, lastMessageTime time.Time) error
+	GetChats() (map[string]time.Time, error)
+	ChatExists(jid string) (bool, error)
+	GetStoredChatName(jid string) (string, error)
+	ListChats(filter ChatFilter) ([]Chat, error)
+	GetChat(jid string) (*Chat, error)
+
+	StoreMessage(id, chatJID, sender, content string, timestamp time.Time, isFromMe bool,
+		mediaType, filename, url string, mediaKey, fileSHA256, fileEncSHA256 []byte, fileLength uint64, quotedMessage string) error
+	StoreMediaInfo(id, chatJID, url string, mediaKey, fileSHA256, fileEncSHA256 []byte, fileLength uint64) error
+	StoreMessageData(id, chatJID, messageType string, data *MessageData) error
+	StoreReplyTarget(id, chatJID, replyToID, replyToSender string) error
+	StoreMediaSource(id, chatJID, mimetype, directPath string) error
+	UpdateEditedMessage(originalID, chatJID, content string, timestamp time.Time) error
+	MarkMessageAsDeleted(originalID, chatJID, deletedBy string, timestamp time.Time) error
+
+	GetMessages(query MessageQuery) ([]Message, error)
+	GetMessage(id, chatJID string) (*Message, error)
+	FindMessageChat(id string) (string, error)
+	MessageExists(id, chatJID string) (bool, error)
+	GetMessageRevisions(id, chatJID string) ([]MessageRevision, error)
+	GetThread(id, chatJID string) (*Thread, error)
+	GetMediaInfo(id, chatJID string) (string, string, string, []byte, []byte, []byte, uint64, error)
+	GetMediaSource(id, chatJID string) (string, string, error)
+	FindMessageIDByFilename(chatJID string, filename string) (string, error)
+	SearchMessages(filter SearchFilter) ([]SearchResult, error)
+
+	StoreContact(contact Contact) error
+	GetContact(id string) (*Contact, error)
+	SearchContacts(query string, limit, offset int) ([]Contact, error)
+
+	StoreGroup(group Group) error
+	DeleteGroup(jid string) error
+	GetGroup(jid string) (*Group, error)
+	GetGroups() ([]Group, error)
+
+	StoreReaction(messageID, chatJID string, reaction Reaction) error
+	GetReactions(chatJID string, messageIDs []string) (map[string][]Reaction, error)
+
+	RecordMessageStatus(messageID, chatJID string, change StatusChange) (bool, error)
+	GetMessageStatusHistory(messageID, chatJID string) ([]StatusChange, error)
+
+	StorePoll(poll Poll) error
+	StorePollVote(pollID, chatJID string, vote PollVote) error
+	GetPoll(id, chatJID string) (*Poll, error)
+
+	GetMediaRef(messageID, chatJID string) (string, error)
+	StoreMediaRef(messageID, chatJID, hash string, size int64) error
+	ReleaseMediaFile(file MediaFile) (string, error)
+	GetMediaBlobs() ([]MediaBlob, error)
+	ReleaseMediaBlob(hash string) (string, error)
+	GetUnreferencedMediaFiles() ([]MediaFile, error)
+
+	StoreMediaDownload(download MediaDownload) error
+	QueueMediaDownload(download MediaDownload) (bool, error)
+	GetMediaDownload(messageID, chatJID string) (*MediaDownload, error)
+	GetMediaDownloads(state string, limit int) ([]MediaDownload, error)
+	GetDueMediaDownloads(now time.Time, limit int) ([]MediaDownload, error)
+	RequeueMediaDownloads() error
+
+	PurgeDeletedMessageContent(cutoff time.Time) (int, error)
+	PruneMessages(rule RetentionRule) (int, []MediaFile, error)
+	GetMediaFiles(rule RetentionRule) ([]MediaFile, error)
+	Vacuum() error
+}
+
+// sqlDialect identifies the SQL database behind a SQLMessageStore.
+// The value doubles as the database/sql driver name.
+type sqlDialect string
+
+const (
+	sqliteDialect   sqlDialect = "sqlite3"
+	postgresDialect sqlDialect = "postgres"
+)
+
+// Default message database when MESSAGE_DB_DSN is not set
+const defaultMessageDBDSN = "file:store/messages.db?_foreign_keys=on"
+
+// Rewrite ? placeholders into the dialect's native form ($1, $2, ... for PostgreSQL).
+// Queries are written once with ? and rebound just before they run.
+func (d sqlDialect) rebind(query string) string {
+	if d != postgresDialect || !strings.Contains(query, "?") {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	inString := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			inString = !inString
+		case r == '?' && !inString:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Build a LIKE pattern matching values that contain s, for use with ESCAPE '\'
+func likePattern(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+	return "%" + s + "%"
+}
+
+// dialectDB wraps *sql.DB so queries written with ? placeholders run on every dialect
+type dialectDB struct {
+	*sql.DB
+	dialect sqlDialect
+}
+
+func (db *dialectDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(db.dialect.rebind(query), args...)
+}
+
+func (db *dialectDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.Query(db.dialect.rebind(query), args...)
+}
+
+func (db *dialectDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRow(db.dialect.rebind(query), args...)
+}
+
+func (db *dialectDB) Begin() (*dialectTx, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &dialectTx{Tx: tx, dialect: db.dialect}, nil
+}
+
+// dialectTx is the transaction counterpart of dialectDB
+type dialectTx struct {
+	*sql.Tx
+	dialect sqlDialect
+}
+
+func (tx *dialectTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(tx.dialect.rebind(query), args...)
+}
+
+func (tx *dialectTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.dialect.rebind(query), args...)
+}
+
+func (tx *dialectTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRow(tx.dialect.rebind(query), args...)
+}
+
+// Work out which dialect a DSN refers to. postgres:// and postgresql:// URLs
+// select PostgreSQL; anything else is treated as a SQLite DSN.
+func dialectForDSN(dsn string) sqlDialect {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return postgresDialect
+	}
+	return sqliteDialect
+}
+
+// Open the database used for message history, as selected by MESSAGE_DB_DSN
+func openMessageDB() (*dialectDB, error) {
+	dsn := os.Getenv("MESSAGE_DB_DSN")
+	if dsn == "" {
+		// Create directory for database if it doesn't exist
+		if err := os.MkdirAll("store", 0755); err != nil {
+			return nil, fmt.Errorf("failed to create store directory: %v", err)
+		}
+		dsn = defaultMessageDBDSN
+	}
+
+	dialect := dialectForDSN(dsn)
+	db, err := sql.Open(string(dialect), dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open message database: %v", err)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to message database: %v", err)
+	}
+
+	return &dialectDB{DB: db, dialect: dialect}, nil
+}
+
+// Initialize the message store selected by MESSAGE_DB_DSN
+func NewMessageStore() (MessageStore, error) {
+	db, err := openMessageDB()
+	if err != nil {
+		return nil, err
+	}
+
+	// Bring the schema up to date before anything touches it
+	if _, err := runMigrations(db, false); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate message database: %v", err)
+	}
+
+	masterKey, err := loadMasterKey("ENCRYPTION_KEY", "ENCRYPTION_KEY_FILE")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	keys, err := loadDataKeyring(db, masterKey)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Media files on disk share the data keys of the message store
+	mediaKeys = keys
+
+	store := &SQLMessageStore{db: db, keys: keys, fts: db.dialect == sqliteDialect && sqliteHasFTS5(db)}
+	if err := store.ensureSearchIndex(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// Run message database migrations without starting the bridge.
+// With dryRun set, pending migrations are returned but not applied.
+func MigrateMessageStore(dryRun bool) ([]Migration, error) {
+	db, err := openMessageDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	return runMigrations(db, dryRun)
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	waLog "go.mau.fi/whatsmeow/util/log"
+	"google.golang.org/protobuf/proto"
+)
+
+// Upper bound on the messages returned for one thread, and on how far a
+// reply chain is followed up to its root
+const (
+	maxThreadMessages = 1000
+	maxThreadDepth    = 200
+)
+
+// Thread is a message together with the reply chain it belongs to
+type Thread struct {
+	// ID of the oldest stored message the chain leads back to
+	RootID string `json:"root_id"`
+	// Set when the root itself replies to a message that is not stored
+	MissingParentID string `json:"missing_parent_id,omitempty"`
+	// The root and every stored reply below it, oldest first
+	Messages []Message `json:"messages"`
+	// Whether the thread had more than maxThreadMessages messages
+	Truncated bool `json:"truncated"`
+}
+
+// Get the context info of a message, whatever its type. Every message type
+// that can be sent as a reply carries its own ContextInfo.
+func getContextInfo(msg *waProto.Message) *waProto.ContextInfo {
+	if msg == nil {
+		return nil
+	}
+	msg, _ = unwrapViewOnce(msg)
+
+	if ext := msg.GetExtendedTextMessage(); ext != nil {
+		return ext.GetContextInfo()
+	} else if img := msg.GetImageMessage(); img != nil {
+		return img.GetContextInfo()
+	} else if vid := msg.GetVideoMessage(); vid != nil {
+		return vid.GetContextInfo()
+	} else if aud := msg.GetAudioMessage(); aud != nil {
+		return aud.GetContextInfo()
+	} else if doc := msg.GetDocumentMessage(); doc != nil {
+		return doc.GetContextInfo()
+	} else if sticker := msg.GetStickerMessage(); sticker != nil {
+		return sticker.GetContextInfo()
+	} else if loc := msg.GetLocationMessage(); loc != nil {
+		return loc.GetContextInfo()
+	} else if live := msg.GetLiveLocationMessage(); live != nil {
+		return live.GetContextInfo()
+	} else if contact := msg.GetContactMessage(); contact != nil {
+		return contact.GetContextInfo()
+	} else if contacts := msg.GetContactsArrayMessage(); contacts != nil {
+		return contacts.GetContextInfo()
+	} else if poll := getPollCreation(msg); poll != nil {
+		return poll.GetContextInfo()
+	} else if event := msg.GetEventMessage(); event != nil {
+		return event.GetContextInfo()
+	} else if buttons := msg.GetButtonsResponseMessage(); buttons != nil {
+		return buttons.GetContextInfo()
+	} else if list := msg.GetListResponseMessage(); list != nil {
+		return list.GetContextInfo()
+	} else if template := msg.GetTemplateButtonReplyMessage(); template != nil {
+		return template.GetContextInfo()
+	} else if interactive := msg.GetInteractiveResponseMessage(); interactive != nil {
+		return interactive.GetContextInfo()
+	}
+	return nil
+}
+
+// Extract the message a reply points at: its ID and the user who sent it
+func extractReplyTarget(msg *waProto.Message) (replyToID, replyToSender string) {
+	ctx := getContextInfo(msg)
+	if ctx.GetStanzaID() == "" {
+		return "", ""
+	}
+	replyToID = ctx.GetStanzaID()
+	if participant, err := types.ParseJID(ctx.GetParticipant()); err == nil {
+		replyToSender = participant.User
+	}
+	return replyToID, replyToSender
+}
+
+// ReplyTarget identifies the message an outgoing message replies to
+type ReplyTarget struct {
+	MessageID string `json:"message_id"`
+	// Chat of the message replied to, when it is not the chat the reply is
+	// sent to (a private reply to a group message)
+	ChatJID string `json:"chat_jid,omitempty"`
+}
+
+// Get the JID of the sender of a stored message, which a reply to it must
+// name. Only the user part of senders is stored, so in groups the server is
+// recovered from the contacts.
+func storedSenderJID(client *whatsmeow.Client, messageStore MessageStore, chat types.JID, msg *Message) types.JID {
+	if msg.IsFromMe {
+		return client.Store.ID.ToNonAD()
+	}
+	if chat.Server != types.GroupServer {
+		return chat
+	}
+
+	lid := types.NewJID(msg.Sender, types.HiddenUserServer)
+	if contact, err := messageStore.GetContact(lid.String()); err == nil && (contact.JID == lid.String() || contact.LID == lid.String()) {
+		return lid
+	}
+	return types.NewJID(msg.Sender, types.DefaultUserServer)
+}
+
+// Rebuild a stored message as the quoted copy carried by a reply to it.
+// Media is quoted with its stored media info, mimetype and direct path, so it
+// can still be opened from the quote.
+func quotedMessageFromStored(messageStore MessageStore, msg *Message, chatJID string) *waProto.Message {
+	if data := msg.Data; data != nil {
+		if loc := data.Location; loc != nil {
+			return &waProto.Message{LocationMessage: &waProto.LocationMessage{
+				DegreesLatitude:  proto.Float64(loc.Latitude),
+				DegreesLongitude: proto.Float64(loc.Longitude),
+				Name:             optionalString(loc.Name),
+				Address:          optionalString(loc.Address),
+			}}
+		}
+		if len(data.Contacts) == 1 {
+			return &waProto.Message{ContactMessage: &waProto.ContactMessage{
+				DisplayName: proto.String(data.Contacts[0].DisplayName),
+			}}
+		}
+	}
+
+	if msg.MediaType != "" {
+		_, _, url, mediaKey, fileSHA256, fileEncSHA256, fileLength, err := messageStore.GetMediaInfo(msg.ID, chatJID)
+		var mimetype, directPath string
+		if err == nil {
+			mimetype, directPath, err = messageStore.GetMediaSource(msg.ID, chatJID)
+		}
+		if err == nil {
+			switch msg.MediaType {
+			case "image":
+				return &waProto.Message{ImageMessage: &waProto.ImageMessage{
+					Caption: proto.String(msg.Content), URL: proto.String(url), MediaKey: mediaKey,
+					Mimetype: optionalString(mimetype), DirectPath: optionalString(directPath),
+					FileSHA256: fileSHA256, FileEncSHA256: fileEncSHA256, FileLength: proto.Uint64(fileLength),
+				}}
+			case "video":
+				return &waProto.Message{VideoMessage: &waProto.VideoMessage{
+					Caption: proto.String(msg.Content), URL: proto.String(url), MediaKey: mediaKey,
+					Mimetype: optionalString(mimetype), DirectPath: optionalString(directPath),
+					FileSHA256: fileSHA256, FileEncSHA256: fileEncSHA256, FileLength: proto.Uint64(fileLength),
+				}}
+			case "audio":
+				return &waProto.Message{AudioMessage: &waProto.AudioMessage{
+					URL: proto.String(url), MediaKey: mediaKey,
+					Mimetype: optionalString(mimetype), DirectPath: optionalString(directPath),
+					FileSHA256: fileSHA256, FileEncSHA256: fileEncSHA256, FileLength: proto.Uint64(fileLength),
+				}}
+			case "document":
+				return &waProto.Message{DocumentMessage: &waProto.DocumentMessage{
+					Caption: proto.String(msg.Content), FileName: proto.String(msg.Filename), URL: proto.String(url), MediaKey: mediaKey,
+					Mimetype: optionalString(mimetype), DirectPath: optionalString(directPath),
+					FileSHA256: fileSHA256, FileEncSHA256: fileEncSHA256, FileLength: proto.Uint64(fileLength),
+				}}
+			case "sticker":
+				return &waProto.Message{StickerMessage: &waProto.StickerMessage{
+					URL: proto.String(url), MediaKey: mediaKey,
+					Mimetype: optionalString(mimetype), DirectPath: optionalString(directPath),
+					FileSHA256: fileSHA256, FileEncSHA256: fileEncSHA256, FileLength: proto.Uint64(fileLength),
+				}}
+			}
+		}
+	}
+
+	return &waProto.Message{Conversation: proto.String(msg.Content)}
+}
+
+var errReplyTargetNotFound = errors.New("message to reply to not found")
+
+// Build the context info that makes an outgoing message a quoted reply to a
+// stored message. Deleted messages can no longer be quoted and count as
+// not found.
+func buildReplyContext(client *whatsmeow.Client, messageStore MessageStore, chat, parentChat types.JID, parentID string) (*waProto.ContextInfo, error) {
+	parent, err := messageStore.GetMessage(parentID, parentChat.String())
+	if err == sql.ErrNoRows || (err == nil && parent.DeletedAt != nil) {
+		return nil, errReplyTargetNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get message to reply to: %v", err)
+	}
+
+	contextInfo := &waProto.ContextInfo{
+		StanzaID:      proto.String(parent.ID),
+		Participant:   proto.String(storedSenderJID(client, messageStore, parentChat, parent).String()),
+		QuotedMessage: quotedMessageFromStored(messageStore, parent, parentChat.String()),
+	}
+	// Replies to a message from another chat name that chat
+	if parentChat != chat {
+		contextInfo.RemoteJID = proto.String(parentChat.String())
+	}
+	return contextInfo, nil
+}
+
+// Build the reply context for a send request, with the HTTP status to
+// answer with when the reply target is invalid or unknown
+func replyContextForRequest(client *whatsmeow.Client, messageStore MessageStore, recipient string, replyTo *ReplyTarget) (*waProto.ContextInfo, int, error) {
+	if replyTo == nil {
+		return nil, http.StatusOK, nil
+	}
+	if replyTo.MessageID == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("reply_to.message_id is required")
+	}
+	chat, err := parseRecipientJID(recipient)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("Error parsing JID: %v", err)
+	}
+	parentChat := chat
+	if replyTo.ChatJID != "" {
+		if parentChat, err = types.ParseJID(replyTo.ChatJID); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid reply_to.chat_jid: %v", err)
+		}
+	}
+
+	contextInfo, err := buildReplyContext(client, messageStore, chat, parentChat, replyTo.MessageID)
+	if err == errReplyTargetNotFound {
+		return nil, http.StatusNotFound, fmt.Errorf("message %s to reply to not found in %s", replyTo.MessageID, parentChat)
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return contextInfo, http.StatusOK, nil
+}
+
+// Attach context info to an outgoing message. Plain text is turned into
+// extended text, since a plain conversation message has no context info.
+func setContextInfo(msg *waProto.Message, contextInfo *waProto.ContextInfo) {
+	switch {
+	case msg.Conversation != nil:
+		msg.ExtendedTextMessage = &waProto.ExtendedTextMessage{Text: msg.Conversation}
+		msg.Conversation = nil
+		msg.ExtendedTextMessage.ContextInfo = contextInfo
+	case msg.ExtendedTextMessage != nil:
+		msg.ExtendedTextMessage.ContextInfo = contextInfo
+	case msg.ImageMessage != nil:
+		msg.ImageMessage.ContextInfo = contextInfo
+	case msg.VideoMessage != nil:
+		msg.VideoMessage.ContextInfo = contextInfo
+	case msg.AudioMessage != nil:
+		msg.AudioMessage.ContextInfo = contextInfo
+	case msg.DocumentMessage != nil:
+		msg.DocumentMessage.ContextInfo = contextInfo
+	case msg.StickerMessage != nil:
+		msg.StickerMessage.ContextInfo = contextInfo
+	case msg.LocationMessage != nil:
+		msg.LocationMessage.ContextInfo = contextInfo
+	case msg.LiveLocationMessage != nil:
+		msg.LiveLocationMessage.ContextInfo = contextInfo
+	case msg.ContactMessage != nil:
+		msg.ContactMessage.ContextInfo = contextInfo
+	case msg.ContactsArrayMessage != nil:
+		msg.ContactsArrayMessage.ContextInfo = contextInfo
+	}
+}
+
+// Store which message a stored message replies to
+func (store *SQLMessageStore) StoreReplyTarget(id, chatJID, replyToID, replyToSender string) error {
+	_, err := store.db.Exec(
+		"UPDATE messages SET reply_to_id = ?, reply_to_sender = ? WHERE id = ? AND chat_jid = ?",
+		replyToID, nullIfEmpty(replyToSender), id, chatJID,
+	)
+	return err
+}
+
+// Get the reply chain a message belongs to: its root, found by following the
+// replies upwards, and every stored reply below that root
+func (store *SQLMessageStore) GetThread(id, chatJID string) (*Thread, error) {
+	thread := &Thread{RootID: id}
+
+	// Walk up to the oldest stored ancestor
+	seen := map[string]bool{id: true}
+	for depth := 0; depth < maxThreadDepth; depth++ {
+		var parentID sql.NullString
+		err := store.db.QueryRow(
+			"SELECT reply_to_id FROM messages WHERE id = ? AND chat_jid = ?", thread.RootID, chatJID,
+		).Scan(&parentID)
+		if err != nil {
+			return nil, err
+		}
+		if parentID.String == "" || seen[parentID.String] {
+			break
+		}
+
+		exists, err := store.MessageExists(parentID.String, chatJID)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			thread.MissingParentID = parentID.String
+			break
+		}
+		seen[parentID.String] = true
+		thread.RootID = parentID.String
+	}
+
+	// Collect the root and its replies, one generation at a time
+	root, err := store.GetMessage(thread.RootID, chatJID)
+	if err != nil {
+		return nil, err
+	}
+	thread.Messages = []Message{*root}
+	inThread := map[string]bool{root.ID: true}
+	generation := []string{root.ID}
+	for len(generation) > 0 && !thread.Truncated {
+		args := []interface{}{chatJID}
+		for _, parentID := range generation {
+			args = append(args, parentID)
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(generation)), ", ")
+
+		rows, err := store.db.Query(
+			"SELECT "+messageColumns+" FROM messages WHERE chat_jid = ? AND reply_to_id IN ("+placeholders+") ORDER BY timestamp, id",
+			args...,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		generation = nil
+		for rows.Next() {
+			msg, err := scanMessage(rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if inThread[msg.ID] {
+				continue
+			}
+			if len(thread.Messages) >= maxThreadMessages {
+				thread.Truncated = true
+				break
+			}
+			if err := store.decryptMessage(&msg); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			inThread[msg.ID] = true
+			thread.Messages = append(thread.Messages, msg)
+			generation = append(generation, msg.ID)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(thread.Messages, func(i, j int) bool {
+		return thread.Messages[i].Time.Before(thread.Messages[j].Time)
+	})
+	return thread, nil
+}
+
+// Handler for the reply thread of a message: /api/messages/{id}/thread
+func handleMessageThread(messageStore MessageStore, logger waLog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only allow GET requests
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		messageID := r.PathValue("id")
+		chatJID := r.URL.Query().Get("chat_jid")
+		if chatJID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "chat_jid is required",
+			})
+			return
+		}
+
+		thread, err := messageStore.GetThread(messageID, chatJID)
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "Message not found",
+			})
+			return
+		}
+		if err != nil {
+			logger.Errorf("Failed to get thread of message %s: %v", messageID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to get thread: %v", err),
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"thread":  thread,
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+func TestGetThread(t *testing.T) {
+	store := newTestStore(t)
+	chat := "4915112345678@s.whatsapp.net"
+	at := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// Each message and the message it replies to, in the order they were sent
+	messages := []struct{ id, replyTo string }{
+		{"root", ""},
+		{"reply", "root"},
+		{"nested", "reply"},
+		{"second-reply", "root"},
+		{"unrelated", ""},
+		{"orphan", "not-stored"},
+		{"orphan-reply", "orphan"},
+		{"loop-a", "loop-b"},
+		{"loop-b", "loop-a"},
+	}
+	for i, m := range messages {
+		storeTestMessage(t, store, chat, m.id, "111", "text", at.Add(time.Duration(i)*time.Minute), "", "")
+		if m.replyTo != "" {
+			if err := store.StoreReplyTarget(m.id, chat, m.replyTo, "111"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name        string
+		id          string
+		wantRoot    string
+		wantMissing string
+		want        []string
+	}{
+		{"from the root", "root", "root", "", []string{"root", "reply", "nested", "second-reply"}},
+		{"from a nested reply", "nested", "root", "", []string{"root", "reply", "nested", "second-reply"}},
+		{"no replies", "unrelated", "unrelated", "", []string{"unrelated"}},
+		{"parent not stored", "orphan-reply", "orphan", "not-stored", []string{"orphan", "orphan-reply"}},
+		{"reply loop", "loop-a", "loop-b", "", []string{"loop-a", "loop-b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			thread, err := store.GetThread(tt.id, chat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, msg := range thread.Messages {
+				ids = append(ids, msg.ID)
+			}
+			if thread.RootID != tt.wantRoot || thread.MissingParentID != tt.wantMissing || !slices.Equal(ids, tt.want) {
+				t.Errorf("GetThread(%s) = root %q, missing %q, %q, want root %q, missing %q, %q",
+					tt.id, thread.RootID, thread.MissingParentID, ids, tt.wantRoot, tt.wantMissing, tt.want)
+			}
+			if thread.Truncated {
+				t.Errorf("GetThread(%s) is truncated", tt.id)
+			}
+		})
+	}
+}
+
+func TestReplyContextForRequest(t *testing.T) {
+	store := newTestStore(t)
+	client := &whatsmeow.Client{}
+	direct := "4915100000001@s.whatsapp.net"
+	group := "123456789@g.us"
+	at := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	storeTestMessage(t, store, direct, "direct", "4915100000001", "hello", at, "", "")
+	storeTestMessage(t, store, group, "by-phone", "4915100000002", "from a phone number", at, "", "")
+	storeTestMessage(t, store, group, "by-lid", "98765432101234", "from a LID", at, "", "")
+	storeTestMessage(t, store, direct, "deleted", "4915100000001", "gone", at, "", "")
+	if err := store.MarkMessageAsDeleted("deleted", direct, "4915100000001", at.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.StoreContact(Contact{JID: "98765432101234@lid", LID: "98765432101234@lid", PushName: "Carol"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		recipient       string
+		replyTo         *ReplyTarget
+		wantStatus      int
+		wantParticipant string
+		wantRemoteJID   string
+		wantQuoted      string
+	}{
+		{"no reply", direct, nil, http.StatusOK, "", "", ""},
+		{"no message ID", direct, &ReplyTarget{}, http.StatusBadRequest, "", "", ""},
+		{"unknown message", direct, &ReplyTarget{MessageID: "missing"}, http.StatusNotFound, "", "", ""},
+		{"deleted message", direct, &ReplyTarget{MessageID: "deleted"}, http.StatusNotFound, "", "", ""},
+		{"invalid chat", direct, &ReplyTarget{MessageID: "direct", ChatJID: "not:a@jid@"}, http.StatusBadRequest, "", "", ""},
+		{"direct chat", "4915100000001", &ReplyTarget{MessageID: "direct"}, http.StatusOK, direct, "", "hello"},
+		{"group member by phone number", group, &ReplyTarget{MessageID: "by-phone"}, http.StatusOK, "4915100000002@s.whatsapp.net", "", "from a phone number"},
+		{"group member by LID", group, &ReplyTarget{MessageID: "by-lid"}, http.StatusOK, "98765432101234@lid", "", "from a LID"},
+		{"private reply to a group message", "4915100000002", &ReplyTarget{MessageID: "by-phone", ChatJID: group}, http.StatusOK,
+			"4915100000002@s.whatsapp.net", group, "from a phone number"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contextInfo, status, err := replyContextForRequest(client, store, tt.recipient, tt.replyTo)
+			if status != tt.wantStatus || (err != nil) != (tt.wantStatus != http.StatusOK) {
+				t.Fatalf("replyContextForRequest = status %d, %v, want %d", status, err, tt.wantStatus)
+			}
+			if tt.replyTo == nil || err != nil {
+				if contextInfo != nil {
+					t.Errorf("context info = %v, want none", contextInfo)
+				}
+				return
+			}
+			if contextInfo.GetStanzaID() != tt.replyTo.MessageID || contextInfo.GetParticipant() != tt.wantParticipant ||
+				contextInfo.GetRemoteJID() != tt.wantRemoteJID || contextInfo.GetQuotedMessage().GetConversation() != tt.wantQuoted {
+				t.Errorf("context info = %v, want reply to %s from %s in %q quoting %q",
+					contextInfo, tt.replyTo.MessageID, tt.wantParticipant, tt.wantRemoteJID, tt.wantQuoted)
+			}
+		})
+	}
+}
@@ -1,13 +1,12 @@
-import sqlite3
 from datetime import datetime
 from dataclasses import dataclass
 from typing import Optional, List, Tuple
+from urllib.parse import quote
 import os.path
 import requests
 import json
 import audio
 
-MESSAGES_DB_PATH = os.path.join(os.path.dirname(os.path.abspath(__file__)), '..', 'whatsapp-bridge', 'store', 'messages.db')
 WHATSAPP_API_BASE_URL = "http://localhost:8080/api"
 
 @dataclass
@@ -47,63 +46,104 @@ class MessageContext:
     before: List[Message]
     after: List[Message]
 
-def get_sender_name(sender_jid: str) -> str:
+def api_get(path: str, params: Optional[dict] = None) -> Optional[dict]:
+    """GET a bridge API endpoint and return the decoded JSON, or None on errors.
+
+    The bridge decrypts stored messages, so history is always read through it
+    rather than from its database.
+    """
     try:
-        conn = sqlite3.connect(MESSAGES_DB_PATH)
-        cursor = conn.cursor()
-        
-        # First try matching by exact JID
-        cursor.execute("""
-            SELECT name
-            FROM chats
-            WHERE jid = ?
-            LIMIT 1
-        """, (sender_jid,))
-        
-        result = cursor.fetchone()
-        
-        # If no result, try looking for the number within JIDs
-        if not result:
-            # Extract the phone number part if it's a JID
-            if '@' in sender_jid:
-                phone_part = sender_jid.split('@')[0]
-            else:
-                phone_part = sender_jid
-                
-            cursor.execute("""
-                SELECT name
-                FROM chats
-                WHERE jid LIKE ?
-                LIMIT 1
-            """, (f"%{phone_part}%",))
-            
-            result = cursor.fetchone()
-        
-        if result and result[0]:
-            return result[0]
-        else:
-            return sender_jid
-        
-    except sqlite3.Error as e:
-        print(f"Database error while getting sender name: {e}")
-        return sender_jid
-    finally:
-        if 'conn' in locals():
-            conn.close()
+        response = requests.get(f"{WHATSAPP_API_BASE_URL}{path}", params=params)
+
+        if response.status_code != 200:
+            if response.status_code != 404:
+                print(f"Error: HTTP {response.status_code} - {response.text}")
+            return None
+
+        return response.json()
+
+    except requests.RequestException as e:
+        print(f"Request error: {str(e)}")
+        return None
+    except json.JSONDecodeError:
+        print(f"Error parsing response: {response.text}")
+        return None
+
+def parse_api_time(value: Optional[str]) -> Optional[datetime]:
+    """Parse a timestamp from the bridge; Go's zero time means none."""
+    if not value or value.startswith("0001-01-01"):
+        return None
+    return datetime.fromisoformat(value)
+
+def format_api_time(value: str, name: str) -> str:
+    """Turn an ISO-8601 date into the RFC3339 form the bridge expects."""
+    try:
+        parsed = datetime.fromisoformat(value)
+    except ValueError:
+        raise ValueError(f"Invalid date format for '{name}': {value}. Please use ISO-8601 format.")
+    if parsed.tzinfo is None:
+        parsed = parsed.astimezone()
+    return parsed.isoformat()
+
+def message_from_api(data: dict, chat_name: Optional[str] = None) -> Message:
+    return Message(
+        timestamp=parse_api_time(data["Time"]),
+        sender=data["Sender"],
+        content=data["Content"],
+        is_from_me=data["IsFromMe"],
+        chat_jid=data["ChatJID"],
+        id=data["ID"],
+        chat_name=chat_name,
+        media_type=data.get("MediaType") or None
+    )
+
+def chat_from_api(data: dict) -> Chat:
+    last = data.get("LastMessage")
+    return Chat(
+        jid=data["JID"],
+        name=data.get("Name") or None,
+        last_message_time=parse_api_time(data.get("LastMessageTime")),
+        last_message=last["Content"] if last else None,
+        last_sender=last["Sender"] if last else None,
+        last_is_from_me=last["IsFromMe"] if last else None
+    )
+
+def get_chat_names(chat_jids: List[str]) -> dict:
+    """Look up the names of the given chats."""
+    names = {}
+    for chat_jid in set(chat_jids):
+        chat = get_chat(chat_jid, include_last_message=False)
+        names[chat_jid] = chat.name if chat else None
+    return names
+
+def get_sender_name(sender_jid: str) -> str:
+    # First try matching by exact JID
+    result = api_get(f"/chats/{quote(sender_jid, safe='')}", {"include_last_message": "false"})
+    name = result["chat"].get("Name") if result else None
+
+    # If no result, try looking for the number within JIDs
+    if not name:
+        # Extract the phone number part if it's a JID
+        phone_part = sender_jid.split('@')[0]
+        result = api_get("/chats", {"query": phone_part, "limit": 1, "include_last_message": "false"})
+        chats = result.get("chats", []) if result else []
+        name = chats[0].get("Name") if chats else None
+
+    return name or sender_jid
 
 def format_message(message: Message, show_chat_info: bool = True) -> None:
     """Print a single message with consistent formatting."""
     output = ""
-    
+
     if show_chat_info and message.chat_name:
         output += f"[{message.timestamp:%Y-%m-%d %H:%M:%S}] Chat: {message.chat_name} "
     else:
         output += f"[{message.timestamp:%Y-%m-%d %H:%M:%S}] "
-        
+
     content_prefix = ""
     if hasattr(message, 'media_type') and message.media_type:
         content_prefix = f"[{message.media_type} - Message ID: {message.id} - Chat JID: {message.chat_jid}] "
-    
+
     try:
         sender_name = get_sender_name(message.sender) if not message.is_from_me else "Me"
         output += f"From: {sender_name}: {content_prefix}{message.content}\n"
@@ -116,7 +156,7 @@ def format_messages_list(messages: List[Message], show_chat_info: bool = True) -
     if not messages:
         output += "No messages to display."
         return output
-    
+
     for message in messages:
         output += format_message(message, show_chat_info)
     return output
@@ -134,93 +174,50 @@ def list_messages(
     context_after: int = 1
 ) -> List[Message]:
     """Get messages matching the specified criteria with optional context."""
-    try:
-        conn = sqlite3.connect(MESSAGES_DB_PATH)
-        cursor = conn.cursor()
-        
-        # Build base query
-        query_parts = ["SELECT messages.timestamp, messages.sender, chats.name, messages.content, messages.is_from_me, chats.jid, messages.id, messages.media_type FROM messages"]
-        query_parts.append("JOIN chats ON messages.chat_jid = chats.jid")
-        where_clauses = []
-        params = []
-        
-        # Add filters
-        if after:
-            try:
-                after = datetime.fromisoformat(after)
-            except ValueError:
-                raise ValueError(f"Invalid date format for 'after': {after}. Please use ISO-8601 format.")
-            
-            where_clauses.append("messages.timestamp > ?")
-            params.append(after)
+    # Deleted messages are kept as tombstones by the bridge and left out here
+    params = {"limit": limit}
 
-        if before:
-            try:
-                before = datetime.fromisoformat(before)
-            except ValueError:
-                raise ValueError(f"Invalid date format for 'before': {before}. Please use ISO-8601 format.")
-            
-            where_clauses.append("messages.timestamp < ?")
-            params.append(before)
+    # Add filters
+    if after:
+        params["since"] = format_api_time(after, "after")
+    if before:
+        params["until"] = format_api_time(before, "before")
+    if sender_phone_number:
+        params["sender"] = sender_phone_number
+    if chat_jid:
+        params["chat_jid"] = chat_jid
+    if query:
+        params["q"] = query
 
-        if sender_phone_number:
-            where_clauses.append("messages.sender = ?")
-            params.append(sender_phone_number)
-            
-        if chat_jid:
-            where_clauses.append("messages.chat_jid = ?")
-            params.append(chat_jid)
-            
-        if query:
-            where_clauses.append("LOWER(messages.content) LIKE LOWER(?)")
-            params.append(f"%{query}%")
-            
-        if where_clauses:
-            query_parts.append("WHERE " + " AND ".join(where_clauses))
-            
-        # Add pagination
-        offset = page * limit
-        query_parts.append("ORDER BY messages.timestamp DESC")
-        query_parts.append("LIMIT ? OFFSET ?")
-        params.extend([limit, offset])
-        
-        cursor.execute(" ".join(query_parts), tuple(params))
-        messages = cursor.fetchall()
-        
-        result = []
-        for msg in messages:
-            message = Message(
-                timestamp=datetime.fromisoformat(msg[0]),
-                sender=msg[1],
-                chat_name=msg[2],
-                content=msg[3],
-                is_from_me=msg[4],
-                chat_jid=msg[5],
-                id=msg[6],
-                media_type=msg[7]
-            )
-            result.append(message)
-            
-        if include_context and result:
-            # Add context for each message
-            messages_with_context = []
-            for msg in result:
-                context = get_message_context(msg.id, context_before, context_after)
-                messages_with_context.extend(context.before)
-                messages_with_context.append(context.message)
-                messages_with_context.extend(context.after)
-            
-            return format_messages_list(messages_with_context, show_chat_info=True)
-            
-        # Format and display messages without context
-        return format_messages_list(result, show_chat_info=True)    
-        
-    except sqlite3.Error as e:
-        print(f"Database error: {e}")
-        return []
-    finally:
-        if 'conn' in locals():
-            conn.close()
+    # The bridge pages with cursors, so walk forward to the requested page
+    data = []
+    for current in range(page + 1):
+        result = api_get("/messages", params)
+        if result is None:
+            return []
+        data = result.get("messages", [])
+        if current < page:
+            if not result.get("has_more"):
+                data = []
+                break
+            params["before"] = result["next_cursor"]
+
+    names = get_chat_names([msg["ChatJID"] for msg in data])
+    result = [message_from_api(msg, names.get(msg["ChatJID"])) for msg in data]
+
+    if include_context and result:
+        # Add context for each message
+        messages_with_context = []
+        for msg in result:
+            context = get_message_context(msg.id, context_before, context_after)
+            messages_with_context.extend(context.before)
+            messages_with_context.append(context.message)
+            messages_with_context.extend(context.after)
+
+        return format_messages_list(messages_with_context, show_chat_info=True)
+
+    # Format and display messages without context
+    return format_messages_list(result, show_chat_info=True)
 
 
 def get_message_context(
@@ -229,91 +226,17 @@ def get_message_context(
     after: int = 5
 ) -> MessageContext:
     """Get context around a specific message."""
-    try:
-        conn = sqlite3.connect(MESSAGES_DB_PATH)
-        cursor = conn.cursor()
-        
-        # Get the target message first
-        cursor.execute("""
-            SELECT messages.timestamp, messages.sender, chats.name, messages.content, messages.is_from_me, chats.jid, messages.id, messages.chat_jid, messages.media_type
-            FROM messages
-            JOIN chats ON messages.chat_jid = chats.jid
-            WHERE messages.id = ?
-        """, (message_id,))
-        msg_data = cursor.fetchone()
-        
-        if not msg_data:
-            raise ValueError(f"Message with ID {message_id} not found")
-            
-        target_message = Message(
-            timestamp=datetime.fromisoformat(msg_data[0]),
-            sender=msg_data[1],
-            chat_name=msg_data[2],
-            content=msg_data[3],
-            is_from_me=msg_data[4],
-            chat_jid=msg_data[5],
-            id=msg_data[6],
-            media_type=msg_data[8]
-        )
-        
-        # Get messages before
-        cursor.execute("""
-            SELECT messages.timestamp, messages.sender, chats.name, messages.content, messages.is_from_me, chats.jid, messages.id, messages.media_type
-            FROM messages
-            JOIN chats ON messages.chat_jid = chats.jid
-            WHERE messages.chat_jid = ? AND messages.timestamp < ?
-            ORDER BY messages.timestamp DESC
-            LIMIT ?
-        """, (msg_data[7], msg_data[0], before))
-        
-        before_messages = []
-        for msg in cursor.fetchall():
-            before_messages.append(Message(
-                timestamp=datetime.fromisoformat(msg[0]),
-                sender=msg[1],
-                chat_name=msg[2],
-                content=msg[3],
-                is_from_me=msg[4],
-                chat_jid=msg[5],
-                id=msg[6],
-                media_type=msg[7]
-            ))
-        
-        # Get messages after
-        cursor.execute("""
-            SELECT messages.timestamp, messages.sender, chats.name, messages.content, messages.is_from_me, chats.jid, messages.id, messages.media_type
-            FROM messages
-            JOIN chats ON messages.chat_jid = chats.jid
-            WHERE messages.chat_jid = ? AND messages.timestamp > ?
-            ORDER BY messages.timestamp ASC
-            LIMIT ?
-        """, (msg_data[7], msg_data[0], after))
-        
-        after_messages = []
-        for msg in cursor.fetchall():
-            after_messages.append(Message(
-                timestamp=datetime.fromisoformat(msg[0]),
-                sender=msg[1],
-                chat_name=msg[2],
-                content=msg[3],
-                is_from_me=msg[4],
-                chat_jid=msg[5],
-                id=msg[6],
-                media_type=msg[7]
-            ))
-        
-        return MessageContext(
-            message=target_message,
-            before=before_messages,
-            after=after_messages
-        )
-        
-    except sqlite3.Error as e:
-        print(f"Database error: {e}")
-        raise
-    finally:
-        if 'conn' in locals():
-            conn.close()
+    result = api_get(f"/messages/{quote(message_id, safe='')}/context", {"before": before, "after": after})
+    if not result:
+        raise ValueError(f"Message with ID {message_id} not found")
+
+    chat_jid = result["message"]["ChatJID"]
+    chat_name = get_chat_names([chat_jid])[chat_jid]
+    return MessageContext(
+        message=message_from_api(result["message"], chat_name),
+        before=[message_from_api(msg, chat_name) for msg in result["before"]],
+        after=[message_from_api(msg, chat_name) for msg in result["after"]]
+    )
 
 
 def list_chats(
@@ -324,303 +247,104 @@ def list_chats(
     sort_by: str = "last_active"
 ) -> List[Chat]:
     """Get chats matching the specified criteria."""
-    try:
-        conn = sqlite3.connect(MESSAGES_DB_PATH)
-        cursor = conn.cursor()
-        
-        # Build base query
-        query_parts = ["""
-            SELECT 
-                chats.jid,
-                chats.name,
-                chats.last_message_time,
-                messages.content as last_message,
-                messages.sender as last_sender,
-                messages.is_from_me as last_is_from_me
-            FROM chats
-        """]
-        
-        if include_last_message:
-            query_parts.append("""
-                LEFT JOIN messages ON chats.jid = messages.chat_jid 
-                AND chats.last_message_time = messages.timestamp
-            """)
-            
-        where_clauses = []
-        params = []
-        
-        if query:
-            where_clauses.append("(LOWER(chats.name) LIKE LOWER(?) OR chats.jid LIKE ?)")
-            params.extend([f"%{query}%", f"%{query}%"])
-            
-        if where_clauses:
-            query_parts.append("WHERE " + " AND ".join(where_clauses))
-            
-        # Add sorting
-        order_by = "chats.last_message_time DESC" if sort_by == "last_active" else "chats.name"
-        query_parts.append(f"ORDER BY {order_by}")
-        
-        # Add pagination
-        offset = (page ) * limit
-        query_parts.append("LIMIT ? OFFSET ?")
-        params.extend([limit, offset])
-        
-        cursor.execute(" ".join(query_parts), tuple(params))
-        chats = cursor.fetchall()
-        
-        result = []
-        for chat_data in chats:
-            chat = Chat(
-                jid=chat_data[0],
-                name=chat_data[1],
-                last_message_time=datetime.fromisoformat(chat_data[2]) if chat_data[2] else None,
-                last_message=chat_data[3],
-                last_sender=chat_data[4],
-                last_is_from_me=chat_data[5]
-            )
-            result.append(chat)
-            
-        return result
-        
-    except sqlite3.Error as e:
-        print(f"Database error: {e}")
+    params = {
+        "limit": limit,
+        "offset": page * limit,
+        "include_last_message": "true" if include_last_message else "false",
+        "sort_by": "last_active" if sort_by == "last_active" else "name",
+    }
+    if query:
+        params["query"] = query
+
+    result = api_get("/chats", params)
+    if result is None:
         return []
-    finally:
-        if 'conn' in locals():
-            conn.close()
+    return [chat_from_api(chat) for chat in result.get("chats", [])]
 
 
 def search_contacts(query: str) -> List[Contact]:
     """Search contacts by name or phone number."""
     try:
-        conn = sqlite3.connect(MESSAGES_DB_PATH)
-        cursor = conn.cursor()
-        
-        # Split query into characters to support partial matching
-        search_pattern = '%' +query + '%'
-        
-        cursor.execute("""
-            SELECT DISTINCT 
-                jid,
-                name
-            FROM chats
-            WHERE 
-                (LOWER(name) LIKE LOWER(?) OR LOWER(jid) LIKE LOWER(?))
-                AND jid NOT LIKE '%@g.us'
-            ORDER BY name, jid
-            LIMIT 50
-        """, (search_pattern, search_pattern))
-        
-        contacts = cursor.fetchall()
-        
+        url = f"{WHATSAPP_API_BASE_URL}/contacts"
+        response = requests.get(url, params={"query": query, "limit": 50})
+
+        if response.status_code != 200:
+            print(f"Error: HTTP {response.status_code} - {response.text}")
+            return []
+
         result = []
-        for contact_data in contacts:
+        for contact_data in response.json().get("contacts", []):
+            name = (contact_data.get("full_name") or contact_data.get("first_name")
+                    or contact_data.get("business_name") or contact_data.get("push_name"))
             contact = Contact(
-                phone_number=contact_data[0].split('@')[0],
-                name=contact_data[1],
-                jid=contact_data[0]
+                phone_number=contact_data.get("phone_number") or contact_data["jid"].split('@')[0],
+                name=name,
+                jid=contact_data["jid"]
             )
             result.append(contact)
-            
+
         return result
-        
-    except sqlite3.Error as e:
-        print(f"Database error: {e}")
+
+    except requests.RequestException as e:
+        print(f"Request error: {str(e)}")
+        return []
+    except json.JSONDecodeError:
+        print(f"Error parsing response: {response.text}")
         return []
-    finally:
-        if 'conn' in locals():
-            conn.close()
 
 
 def get_contact_chats(jid: str, limit: int = 20, page: int = 0) -> List[Chat]:
     """Get all chats involving the contact.
-    
+
     Args:
         jid: The contact's JID to search for
         limit: Maximum number of chats to return (default 20)
         page: Page number for pagination (default 0)
     """
-    try:
-        conn = sqlite3.connect(MESSAGES_DB_PATH)
-        cursor = conn.cursor()
-        
-        cursor.execute("""
-            SELECT DISTINCT
-                c.jid,
-                c.name,
-                c.last_message_time,
-                m.content as last_message,
-                m.sender as last_sender,
-                m.is_from_me as last_is_from_me
-            FROM chats c
-            JOIN messages m ON c.jid = m.chat_jid
-            WHERE m.sender = ? OR c.jid = ?
-            ORDER BY c.last_message_time DESC
-            LIMIT ? OFFSET ?
-        """, (jid, jid, limit, page * limit))
-        
-        chats = cursor.fetchall()
-        
-        result = []
-        for chat_data in chats:
-            chat = Chat(
-                jid=chat_data[0],
-                name=chat_data[1],
-                last_message_time=datetime.fromisoformat(chat_data[2]) if chat_data[2] else None,
-                last_message=chat_data[3],
-                last_sender=chat_data[4],
-                last_is_from_me=chat_data[5]
-            )
-            result.append(chat)
-            
-        return result
-        
-    except sqlite3.Error as e:
-        print(f"Database error: {e}")
+    result = api_get("/chats", {"participant": jid, "limit": limit, "offset": page * limit})
+    if result is None:
         return []
-    finally:
-        if 'conn' in locals():
-            conn.close()
+    return [chat_from_api(chat) for chat in result.get("chats", [])]
 
 
 def get_last_interaction(jid: str) -> str:
     """Get most recent message involving the contact."""
-    try:
-        conn = sqlite3.connect(MESSAGES_DB_PATH)
-        cursor = conn.cursor()
-        
-        cursor.execute("""
-            SELECT 
-                m.timestamp,
-                m.sender,
-                c.name,
-                m.content,
-                m.is_from_me,
-                c.jid,
-                m.id,
-                m.media_type
-            FROM messages m
-            JOIN chats c ON m.chat_jid = c.jid
-            WHERE m.sender = ? OR c.jid = ?
-            ORDER BY m.timestamp DESC
-            LIMIT 1
-        """, (jid, jid))
-        
-        msg_data = cursor.fetchone()
-        
-        if not msg_data:
-            return None
-            
-        message = Message(
-            timestamp=datetime.fromisoformat(msg_data[0]),
-            sender=msg_data[1],
-            chat_name=msg_data[2],
-            content=msg_data[3],
-            is_from_me=msg_data[4],
-            chat_jid=msg_data[5],
-            id=msg_data[6],
-            media_type=msg_data[7]
-        )
-        
-        return format_message(message)
-        
-    except sqlite3.Error as e:
-        print(f"Database error: {e}")
+    # The newest message either sent by the contact or in their chat
+    candidates = []
+    for params in ({"sender": jid}, {"chat_jid": jid}):
+        result = api_get("/messages", {**params, "limit": 1})
+        if result and result.get("messages"):
+            candidates.append(result["messages"][0])
+
+    if not candidates:
         return None
-    finally:
-        if 'conn' in locals():
-            conn.close()
+
+    latest = max(candidates, key=lambda msg: parse_api_time(msg["Time"]))
+    names = get_chat_names([latest["ChatJID"]])
+    return format_message(message_from_api(latest, names[latest["ChatJID"]]))
 
 
 def get_chat(chat_jid: str, include_last_message: bool = True) -> Optional[Chat]:
     """Get chat metadata by JID."""
-    try:
-        conn = sqlite3.connect(MESSAGES_DB_PATH)
-        cursor = conn.cursor()
-        
-        query = """
-            SELECT 
-                c.jid,
-                c.name,
-                c.last_message_time,
-                m.content as last_message,
-                m.sender as last_sender,
-                m.is_from_me as last_is_from_me
-            FROM chats c
-        """
-        
-        if include_last_message:
-            query += """
-                LEFT JOIN messages m ON c.jid = m.chat_jid 
-                AND c.last_message_time = m.timestamp
-            """
-            
-        query += " WHERE c.jid = ?"
-        
-        cursor.execute(query, (chat_jid,))
-        chat_data = cursor.fetchone()
-        
-        if not chat_data:
-            return None
-            
-        return Chat(
-            jid=chat_data[0],
-            name=chat_data[1],
-            last_message_time=datetime.fromisoformat(chat_data[2]) if chat_data[2] else None,
-            last_message=chat_data[3],
-            last_sender=chat_data[4],
-            last_is_from_me=chat_data[5]
-        )
-        
-    except sqlite3.Error as e:
-        print(f"Database error: {e}")
+    result = api_get(
+        f"/chats/{quote(chat_jid, safe='')}",
+        {"include_last_message": "true" if include_last_message else "false"}
+    )
+    if not result:
         return None
-    finally:
-        if 'conn' in locals():
-            conn.close()
+    return chat_from_api(result["chat"])
 
 
 def get_direct_chat_by_contact(sender_phone_number: str) -> Optional[Chat]:
     """Get chat metadata by sender phone number."""
-    try:
-        conn = sqlite3.connect(MESSAGES_DB_PATH)
-        cursor = conn.cursor()
-        
-        cursor.execute("""
-            SELECT 
-                c.jid,
-                c.name,
-                c.last_message_time,
-                m.content as last_message,
-                m.sender as last_sender,
-                m.is_from_me as last_is_from_me
-            FROM chats c
-            LEFT JOIN messages m ON c.jid = m.chat_jid 
-                AND c.last_message_time = m.timestamp
-            WHERE c.jid LIKE ? AND c.jid NOT LIKE '%@g.us'
-            LIMIT 1
-        """, (f"%{sender_phone_number}%",))
-        
-        chat_data = cursor.fetchone()
-        
-        if not chat_data:
-            return None
-            
-        return Chat(
-            jid=chat_data[0],
-            name=chat_data[1],
-            last_message_time=datetime.fromisoformat(chat_data[2]) if chat_data[2] else None,
-            last_message=chat_data[3],
-            last_sender=chat_data[4],
-            last_is_from_me=chat_data[5]
-        )
-        
-    except sqlite3.Error as e:
-        print(f"Database error: {e}")
+    result = api_get("/chats", {"query": sender_phone_number, "limit": 50})
+    if result is None:
         return None
-    finally:
-        if 'conn' in locals():
-            conn.close()
+
+    for chat in result.get("chats", []):
+        if not chat["JID"].endswith("@g.us"):
+            return chat_from_api(chat)
+    return None
 
 def send_message(recipient: str, message: str) -> Tuple[bool, str]:
     try: